@@ -0,0 +1,152 @@
+// Package cgm aggregates the glucose samples of continuous glucose monitors (CGMs).  CGMs report a sample every few
+// minutes, which is far too granular to store as one FHIR Observation each, so the samples are stored locally and
+// summarized daily, with the summaries written to the FHIR server as Observations.
+package cgm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/devices"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+)
+
+// GlucoseMolarMass is the molar mass of glucose (g/mol), for converting samples reported in mmol/L
+const GlucoseMolarMass = 180.16
+
+// The range of glucose values (mg/dL) that CGMs report; values outside it are sensor errors
+const (
+	MinGlucose = 20
+	MaxGlucose = 600
+)
+
+// maxClockSkew is how far in the future a sample's timestamp may be, to allow for devices with fast clocks
+const maxClockSkew = 5 * time.Minute
+
+// Sample is a glucose value reported by a CGM.  Value is in the given unit (mg/dL, mmol/L, or a common spelling of
+// either); samples are stored in mg/dL.
+type Sample struct {
+	DeviceID  string    `bson:"device" json:"deviceId"`
+	PatientID string    `bson:"patient" json:"patientId"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Value     float64   `bson:"value" json:"value"`
+	Unit      string    `bson:"-" json:"unit,omitempty"`
+}
+
+// Normalize validates the sample, converting its value to mg/dL
+func (s *Sample) Normalize(now time.Time) error {
+	switch {
+	case s.DeviceID == "":
+		return errors.New("Sample has no deviceId")
+	case s.PatientID == "":
+		return errors.New("Sample has no patientId")
+	case s.Timestamp.IsZero():
+		return errors.New("Sample has no timestamp")
+	case s.Timestamp.After(now.Add(maxClockSkew)):
+		return fmt.Errorf("Sample timestamp %s is in the future", s.Timestamp.Format(time.RFC3339))
+	}
+	unit := "mg/dL"
+	if s.Unit != "" {
+		var err error
+		if unit, err = ucum.QuantityUnit(&fhir.Quantity{Unit: s.Unit}); err != nil {
+			return err
+		}
+	}
+	value, err := ucum.ConvertSubstance(s.Value, unit, "mg/dL", GlucoseMolarMass)
+	if err != nil {
+		return fmt.Errorf("Invalid unit for glucose: %s", err.Error())
+	}
+	if value < MinGlucose || value > MaxGlucose {
+		return fmt.Errorf("Implausible glucose of %g %s: must be from %d to %d mg/dL", s.Value, s.Unit, MinGlucose, MaxGlucose)
+	}
+	s.Value, s.Unit, s.Timestamp = value, "", s.Timestamp.UTC()
+	return nil
+}
+
+// SampleError is the error for a sample that couldn't be received.  Index is the sample's position in the received
+// samples.
+type SampleError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// ReceiveResult is the outcome of receiving samples: the number stored, the number that were already stored, and the
+// errors for the samples that were rejected
+type ReceiveResult struct {
+	Received   int           `json:"received"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   []SampleError `json:"rejected"`
+}
+
+// Receiver validates CGM samples and adds them to the sample store.  If the receiver has a Resolver, each sample is
+// attributed to the patient its device was assigned to at the sample's timestamp.
+type Receiver struct {
+	Store    SampleStore
+	Resolver devices.PatientResolver
+	now      func() time.Time
+}
+
+// NewReceiver returns a receiver adding samples to the store
+func NewReceiver(store SampleStore) *Receiver {
+	return &Receiver{Store: store, now: time.Now}
+}
+
+// Receive validates the samples, resolving their patients, and adds the valid samples to the store.  Samples already
+// in the store (i.e., from the same device, with the same timestamp) aren't duplicated.  It's an error if the samples
+// couldn't be stored.
+func (r *Receiver) Receive(samples []Sample) (ReceiveResult, error) {
+	result := ReceiveResult{Rejected: []SampleError{}}
+	var valid []Sample
+	for i := range samples {
+		s := samples[i]
+		if err := r.resolve(&s); err == nil {
+			err = s.Normalize(r.now())
+			if err == nil {
+				valid = append(valid, s)
+				continue
+			}
+			result.Rejected = append(result.Rejected, SampleError{Index: i, Error: err.Error()})
+		} else if _, ok := err.(rejection); ok {
+			result.Rejected = append(result.Rejected, SampleError{Index: i, Error: err.Error()})
+		} else {
+			return result, err
+		}
+	}
+	if len(valid) == 0 {
+		return result, nil
+	}
+	added, err := r.Store.Add(valid)
+	if err != nil {
+		return result, err
+	}
+	result.Received, result.Duplicates = added, len(valid)-added
+	return result, nil
+}
+
+// rejection is an error resolving a sample's patient that rejects the sample, as opposed to a failure of the resolver
+type rejection string
+
+func (r rejection) Error() string {
+	return string(r)
+}
+
+// resolve resolves the sample's patient with the resolver (if any), returning a rejection if the device wasn't
+// assigned to the sample's patient at the time
+func (r *Receiver) resolve(s *Sample) error {
+	if r.Resolver == nil || s.DeviceID == "" || s.Timestamp.IsZero() {
+		return nil
+	}
+	patientID, err := r.Resolver.Resolve(s.DeviceID, s.Timestamp)
+	switch {
+	case err != nil:
+		return err
+	case patientID == "":
+		return rejection(fmt.Sprintf("Device %s wasn't assigned to a patient at %s", s.DeviceID, s.Timestamp.UTC().Format(time.RFC3339)))
+	case s.PatientID != "" && s.PatientID != patientID:
+		return rejection(fmt.Sprintf("Device %s was assigned to Patient/%s at %s, not Patient/%s", s.DeviceID, patientID, s.Timestamp.UTC().Format(time.RFC3339), s.PatientID))
+	}
+	s.PatientID = patientID
+	return nil
+}
@@ -0,0 +1,141 @@
+package cgm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSampleSuite(t *testing.T) {
+	suite.Run(t, new(SampleSuite))
+}
+
+type SampleSuite struct {
+	suite.Suite
+	Now      time.Time
+	Receiver *Receiver
+}
+
+func (suite *SampleSuite) SetupTest() {
+	suite.Now = time.Date(2016, time.March, 7, 12, 0, 0, 0, time.UTC)
+	suite.Receiver = NewReceiver(NewMemorySampleStore())
+	suite.Receiver.now = func() time.Time { return suite.Now }
+}
+
+func (suite *SampleSuite) TestNormalize() {
+	assert := suite.Assert()
+
+	local := time.FixedZone("EST", -5*60*60)
+	s := Sample{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now.In(local), Value: 112}
+	assert.NoError(s.Normalize(suite.Now))
+	assert.Equal(112.0, s.Value)
+	assert.Equal(time.UTC, s.Timestamp.Location())
+
+	s = Sample{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 5.5, Unit: "mmol/L"}
+	assert.NoError(s.Normalize(suite.Now))
+	assert.InDelta(99.1, s.Value, 0.1)
+	assert.Empty(s.Unit)
+
+	s = Sample{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 140, Unit: "mg/dl"}
+	assert.NoError(s.Normalize(suite.Now))
+	assert.Equal(140.0, s.Value)
+}
+
+func (suite *SampleSuite) TestNormalizeInvalid() {
+	assert := suite.Assert()
+
+	samples := map[string]Sample{
+		"no device":    {PatientID: "1", Timestamp: suite.Now, Value: 100},
+		"no patient":   {DeviceID: "cgm-1", Timestamp: suite.Now, Value: 100},
+		"no timestamp": {DeviceID: "cgm-1", PatientID: "1", Value: 100},
+		"future":       {DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now.Add(time.Hour), Value: 100},
+		"wrong unit":   {DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 100, Unit: "kg"},
+		"too low":      {DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 5},
+		"too high":     {DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 45, Unit: "mmol/L"},
+	}
+	for name, s := range samples {
+		assert.Error(s.Normalize(suite.Now), name)
+	}
+
+	// A little clock skew is allowed
+	s := Sample{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now.Add(time.Minute), Value: 100}
+	assert.NoError(s.Normalize(suite.Now))
+}
+
+func (suite *SampleSuite) TestReceive() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	samples := []Sample{
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now.Add(-10 * time.Minute), Value: 100},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now.Add(-5 * time.Minute), Value: 2},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 6, Unit: "mmol/L"},
+	}
+	result, err := suite.Receiver.Receive(samples)
+	require.NoError(err)
+	assert.Equal(2, result.Received)
+	assert.Equal(0, result.Duplicates)
+	require.Len(result.Rejected, 1)
+	assert.Equal(1, result.Rejected[0].Index)
+
+	// Receiving the samples again doesn't duplicate them
+	result, err = suite.Receiver.Receive(samples)
+	require.NoError(err)
+	assert.Equal(0, result.Received)
+	assert.Equal(2, result.Duplicates)
+
+	stored, err := suite.Receiver.Store.Range(suite.Now.Add(-time.Hour), suite.Now.Add(time.Hour))
+	require.NoError(err)
+	require.Len(stored, 2)
+	assert.Equal(100.0, stored[0].Value)
+	assert.InDelta(108.1, stored[1].Value, 0.1)
+}
+
+func (suite *SampleSuite) TestReceiveResolvesPatients() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Receiver.Resolver = resolverFunc(func(deviceID string, at time.Time) (string, error) {
+		switch {
+		case deviceID == "broken-1":
+			return "", errors.New("The registry is down")
+		case deviceID == "cgm-1" && at.Before(suite.Now):
+			return "1", nil
+		case deviceID == "cgm-1":
+			return "2", nil
+		}
+		return "", nil
+	})
+	samples := []Sample{
+		{DeviceID: "cgm-1", Timestamp: suite.Now.Add(-5 * time.Minute), Value: 100},
+		{DeviceID: "cgm-1", Timestamp: suite.Now, Value: 110},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Now, Value: 120},
+		{DeviceID: "cgm-2", PatientID: "1", Timestamp: suite.Now, Value: 130},
+	}
+	result, err := suite.Receiver.Receive(samples)
+	require.NoError(err)
+	assert.Equal(2, result.Received)
+	require.Len(result.Rejected, 2)
+	assert.Equal(2, result.Rejected[0].Index)
+	assert.Contains(result.Rejected[0].Error, "Patient/2")
+	assert.Equal(3, result.Rejected[1].Index)
+	assert.Contains(result.Rejected[1].Error, "wasn't assigned")
+
+	stored, err := suite.Receiver.Store.Range(suite.Now.Add(-time.Hour), suite.Now.Add(time.Hour))
+	require.NoError(err)
+	require.Len(stored, 2)
+	assert.Equal("1", stored[0].PatientID)
+	assert.Equal("2", stored[1].PatientID)
+
+	// A failure of the resolver fails the whole request
+	_, err = suite.Receiver.Receive([]Sample{{DeviceID: "broken-1", Timestamp: suite.Now, Value: 100}})
+	assert.Error(err)
+}
+
+type resolverFunc func(deviceID string, at time.Time) (string, error)
+
+func (f resolverFunc) Resolve(deviceID string, at time.Time) (string, error) {
+	return f(deviceID, at)
+}
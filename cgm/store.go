@@ -0,0 +1,194 @@
+package cgm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SampleStore provides storage for CGM samples.  Samples are identified by their device and timestamp.
+type SampleStore interface {
+	// EnsureIndexes creates any indexes needed to efficiently query the store
+	EnsureIndexes() error
+	// Add adds the samples that aren't already stored, returning the number added
+	Add(samples []Sample) (int, error)
+	// Range returns the samples from the start time until (but not including) the end time, sorted by patient and
+	// timestamp
+	Range(start, end time.Time) ([]Sample, error)
+	// Prune removes the samples from before the given time, returning the number removed
+	Prune(before time.Time) (int, error)
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// OpenSampleStore returns the SampleStore indicated by the backend: "mongo", using the given database, or "memory"
+func OpenSampleStore(backend, mongoURL, database string) (SampleStore, error) {
+	switch backend {
+	case "mongo":
+		session, err := mgo.Dial(mongoURL)
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to the database at %s: %s", mongoURL, err.Error())
+		}
+		s := NewMongoSampleStore(session.DB(database).C("cgmSamples"))
+		s.session = session
+		return s, nil
+	case "memory":
+		return NewMemorySampleStore(), nil
+	}
+	return nil, fmt.Errorf("Unknown CGM sample store backend: %s", backend)
+}
+
+// MongoSampleStore is a SampleStore backed by a MongoDB collection
+type MongoSampleStore struct {
+	C       *mgo.Collection
+	session *mgo.Session
+}
+
+// NewMongoSampleStore returns a SampleStore backed by the given collection.  Closing the store does not close the
+// collection's session.
+func NewMongoSampleStore(c *mgo.Collection) *MongoSampleStore {
+	return &MongoSampleStore{C: c}
+}
+
+// EnsureIndexes creates the unique index on the samples' device and timestamp, and the index for querying samples by
+// time
+func (s *MongoSampleStore) EnsureIndexes() error {
+	indexes := []mgo.Index{
+		{Key: []string{"device", "timestamp"}, Unique: true},
+		{Key: []string{"timestamp", "patient"}},
+	}
+	for _, index := range indexes {
+		if err := s.C.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds the samples that aren't already stored, returning the number added
+func (s *MongoSampleStore) Add(samples []Sample) (int, error) {
+	added := 0
+	for i := range samples {
+		sample := &samples[i]
+		info, err := s.C.Upsert(bson.M{"device": sample.DeviceID, "timestamp": sample.Timestamp}, bson.M{"$setOnInsert": sample})
+		if err != nil {
+			return added, err
+		}
+		if info.UpsertedId != nil {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// Range returns the samples from the start time until the end time, sorted by patient and timestamp
+func (s *MongoSampleStore) Range(start, end time.Time) ([]Sample, error) {
+	var samples []Sample
+	query := bson.M{"timestamp": bson.M{"$gte": start, "$lt": end}}
+	if err := s.C.Find(query).Sort("patient", "timestamp").All(&samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// Prune removes the samples from before the given time, returning the number removed
+func (s *MongoSampleStore) Prune(before time.Time) (int, error) {
+	info, err := s.C.RemoveAll(bson.M{"timestamp": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// Close closes the store's session, if it opened one
+func (s *MongoSampleStore) Close() error {
+	if s.session != nil {
+		s.session.Close()
+	}
+	return nil
+}
+
+// MemorySampleStore is a SampleStore that keeps samples in memory.  It is suitable for demos and tests, but all
+// samples are lost when the process exits.
+type MemorySampleStore struct {
+	mutex   sync.RWMutex
+	samples map[sampleKey]Sample
+}
+
+type sampleKey struct {
+	device    string
+	timestamp int64
+}
+
+// NewMemorySampleStore returns a new, empty, in-memory SampleStore
+func NewMemorySampleStore() *MemorySampleStore {
+	return &MemorySampleStore{samples: make(map[sampleKey]Sample)}
+}
+
+// EnsureIndexes does nothing for the in-memory store
+func (s *MemorySampleStore) EnsureIndexes() error {
+	return nil
+}
+
+// Add adds the samples that aren't already stored, returning the number added
+func (s *MemorySampleStore) Add(samples []Sample) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	added := 0
+	for _, sample := range samples {
+		key := sampleKey{sample.DeviceID, sample.Timestamp.UnixNano()}
+		if _, ok := s.samples[key]; !ok {
+			s.samples[key] = sample
+			added++
+		}
+	}
+	return added, nil
+}
+
+// Range returns the samples from the start time until the end time, sorted by patient and timestamp
+func (s *MemorySampleStore) Range(start, end time.Time) ([]Sample, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var samples []Sample
+	for _, sample := range s.samples {
+		if !sample.Timestamp.Before(start) && sample.Timestamp.Before(end) {
+			samples = append(samples, sample)
+		}
+	}
+	sort.Sort(byPatientAndTimestamp(samples))
+	return samples, nil
+}
+
+// Prune removes the samples from before the given time, returning the number removed
+func (s *MemorySampleStore) Prune(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := 0
+	for key, sample := range s.samples {
+		if sample.Timestamp.Before(before) {
+			delete(s.samples, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Close does nothing for the in-memory store
+func (s *MemorySampleStore) Close() error {
+	return nil
+}
+
+type byPatientAndTimestamp []Sample
+
+func (s byPatientAndTimestamp) Len() int      { return len(s) }
+func (s byPatientAndTimestamp) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPatientAndTimestamp) Less(i, j int) bool {
+	if s[i].PatientID != s[j].PatientID {
+		return s[i].PatientID < s[j].PatientID
+	}
+	return s[i].Timestamp.Before(s[j].Timestamp)
+}
@@ -0,0 +1,134 @@
+package cgm
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+// In order for 'go test' to run these suites, we need to create
+// normal test functions and pass our suites to suite.Run
+func TestMemorySampleStoreSuite(t *testing.T) {
+	suite.Run(t, &SampleStoreSuite{NewStore: func() SampleStore {
+		return NewMemorySampleStore()
+	}})
+}
+
+func TestMongoSampleStoreSuite(t *testing.T) {
+	// Skip rather than panic without MongoDB, so the rest of the package's tests still run
+	if _, err := exec.LookPath("mongod"); err != nil {
+		t.Skip("mongod isn't installed")
+	}
+	s := new(MongoSampleStoreSuite)
+	s.NewStore = func() SampleStore {
+		s.Session = s.DBServer.Session()
+		return NewMongoSampleStore(s.Session.DB("riskservice-test").C("cgmSamples"))
+	}
+	suite.Run(t, s)
+}
+
+// SampleStoreSuite tests the behavior common to all SampleStore implementations
+type SampleStoreSuite struct {
+	suite.Suite
+	NewStore func() SampleStore
+	Store    SampleStore
+}
+
+func (suite *SampleStoreSuite) SetupTest() {
+	suite.Store = suite.NewStore()
+	suite.Require().NoError(suite.Store.EnsureIndexes())
+}
+
+func (suite *SampleStoreSuite) TearDownTest() {
+	suite.Store.Close()
+}
+
+func (suite *SampleStoreSuite) TestAddAndRange() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2016, time.March, 7, 0, 0, 0, 0, time.UTC)
+	added, err := suite.Store.Add([]Sample{
+		{DeviceID: "cgm-2", PatientID: "2", Timestamp: start, Value: 150},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start.Add(SampleInterval), Value: 110},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start, Value: 100},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start.Add(-SampleInterval), Value: 90},
+	})
+	require.NoError(err)
+	assert.Equal(4, added)
+
+	// Samples from the same device at the same time aren't added again
+	added, err = suite.Store.Add([]Sample{
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start, Value: 105},
+		{DeviceID: "cgm-2", PatientID: "2", Timestamp: start.Add(SampleInterval), Value: 160},
+	})
+	require.NoError(err)
+	assert.Equal(1, added)
+
+	samples, err := suite.Store.Range(start, start.Add(time.Hour))
+	require.NoError(err)
+	require.Len(samples, 4)
+	assert.Equal("1", samples[0].PatientID)
+	assert.True(start.Equal(samples[0].Timestamp))
+	assert.Equal(100.0, samples[0].Value)
+	assert.Equal(110.0, samples[1].Value)
+	assert.Equal("2", samples[2].PatientID)
+	assert.Equal(150.0, samples[2].Value)
+	assert.Equal(160.0, samples[3].Value)
+
+	samples, err = suite.Store.Range(start.Add(time.Hour), start.Add(2*time.Hour))
+	assert.NoError(err)
+	assert.Empty(samples)
+}
+
+func (suite *SampleStoreSuite) TestPrune() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2016, time.March, 7, 0, 0, 0, 0, time.UTC)
+	_, err := suite.Store.Add([]Sample{
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start.AddDate(0, 0, -2), Value: 90},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start.AddDate(0, 0, -1), Value: 100},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: start, Value: 110},
+	})
+	require.NoError(err)
+
+	removed, err := suite.Store.Prune(start)
+	require.NoError(err)
+	assert.Equal(2, removed)
+	samples, err := suite.Store.Range(start.AddDate(0, 0, -7), start.AddDate(0, 0, 1))
+	require.NoError(err)
+	require.Len(samples, 1)
+	assert.Equal(110.0, samples[0].Value)
+}
+
+// MongoSampleStoreSuite runs the common SampleStore tests against a temporary MongoDB server
+type MongoSampleStoreSuite struct {
+	SampleStoreSuite
+	DBServer *dbtest.DBServer
+	Session  *mgo.Session
+}
+
+func (suite *MongoSampleStoreSuite) SetupSuite() {
+	suite.DBServer = &dbtest.DBServer{}
+	path, err := ioutil.TempDir("", "mongotestdb")
+	if err != nil {
+		panic(err)
+	}
+	suite.DBServer.SetPath(path)
+}
+
+func (suite *MongoSampleStoreSuite) TearDownTest() {
+	suite.SampleStoreSuite.TearDownTest()
+	suite.Session.Close()
+	suite.DBServer.Wipe()
+}
+
+func (suite *MongoSampleStoreSuite) TearDownSuite() {
+	suite.DBServer.Stop()
+}
@@ -0,0 +1,124 @@
+package cgm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// Summarizer summarizes each patient's CGM samples over a day, writing the summaries to the FHIR server as
+// Observations.  If IncludeTrace is set, each summary includes the day's samples as SampledData.
+type Summarizer struct {
+	Store        SampleStore
+	FHIREndpoint string
+	IncludeTrace bool
+}
+
+// NewSummarizer returns a summarizer of the samples in the store
+func NewSummarizer(store SampleStore, fhirEndpoint string, includeTrace bool) *Summarizer {
+	return &Summarizer{Store: store, FHIREndpoint: strings.TrimSuffix(fhirEndpoint, "/"), IncludeTrace: includeTrace}
+}
+
+// SummaryResult is the outcome of summarizing a patient's samples over a day
+type SummaryResult struct {
+	PatientID   string
+	Date        string
+	Count       int
+	Observation string
+	Error       error
+}
+
+// MarshalJSON handles the marshalling of the errors since Go doesn't
+func (r *SummaryResult) MarshalJSON() ([]byte, error) {
+	var errString string
+	if r.Error != nil {
+		errString = r.Error.Error()
+	}
+	return json.Marshal(&struct {
+		PatientID   string `json:"patientId"`
+		Date        string `json:"date"`
+		Count       int    `json:"samples"`
+		Observation string `json:"observation,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}{
+		PatientID:   r.PatientID,
+		Date:        r.Date,
+		Count:       r.Count,
+		Observation: r.Observation,
+		Error:       errString,
+	})
+}
+
+// LogSummaryResultSummary prints out a log of the summary results (# of patients summarized and # of errors)
+func LogSummaryResultSummary(results []SummaryResult) {
+	errors := 0
+	for _, result := range results {
+		if result.Error != nil {
+			errors++
+		}
+	}
+	log.Printf("Summarized CGM samples for %d patients.  %d errors.", len(results)-errors, errors)
+}
+
+// Day returns the start and end of the clinical day containing the time
+func Day(t time.Time) (time.Time, time.Time) {
+	t = t.In(models.ClinicalLocation)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, models.ClinicalLocation)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// SummarizeDay summarizes each patient's samples over the clinical day containing the time, writing each summary to
+// the FHIR server.  It's an error if the samples couldn't be read; errors writing a patient's summary are reported in
+// the patient's result.
+func (s *Summarizer) SummarizeDay(day time.Time) ([]SummaryResult, error) {
+	start, end := Day(day)
+	samples, err := s.Store.Range(start, end)
+	if err != nil {
+		return nil, err
+	}
+	var results []SummaryResult
+	for len(samples) > 0 {
+		n := 1
+		for n < len(samples) && samples[n].PatientID == samples[0].PatientID {
+			n++
+		}
+		summary := Summarize(samples[0].PatientID, start, end, samples[:n])
+		samples = samples[n:]
+
+		result := SummaryResult{PatientID: summary.PatientID, Date: start.Format("2006-01-02"), Count: summary.Count}
+		result.Observation, result.Error = s.write(summary)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// write writes the summary's observation with a conditional update on its identifier, so a day that's summarized
+// again has its summary updated, returning the observation's location
+func (s *Summarizer) write(summary *Summary) (string, error) {
+	data, err := json.Marshal(summary.ToObservation(s.IncludeTrace))
+	if err != nil {
+		return "", err
+	}
+	query := url.QueryEscape(SummaryIdentifierSystem + "|" + summary.Key())
+	req, err := http.NewRequest("PUT", s.FHIREndpoint+"/Observation?identifier="+query, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Received HTTP %d %s from FHIR server when writing the CGM summary for patient %s.", res.StatusCode, res.Status, summary.PatientID)
+	}
+	return res.Header.Get("Location"), nil
+}
@@ -0,0 +1,119 @@
+package cgm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSummarizerSuite(t *testing.T) {
+	suite.Run(t, new(SummarizerSuite))
+}
+
+type SummarizerSuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Written    map[string]*fhir.Observation
+	Summarizer *Summarizer
+	Day        time.Time
+}
+
+func (suite *SummarizerSuite) SetupTest() {
+	suite.Written = make(map[string]*fhir.Observation)
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identifier := r.URL.Query().Get("identifier")
+		if r.Method != "PUT" || r.URL.Path != "/Observation" || identifier == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if identifier == SummaryIdentifierSystem+"|3|2016-03-07" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		o := &fhir.Observation{}
+		json.NewDecoder(r.Body).Decode(o)
+		status := http.StatusCreated
+		if _, ok := suite.Written[identifier]; ok {
+			status = http.StatusOK
+		}
+		suite.Written[identifier] = o
+		w.Header().Set("Location", "Observation/"+o.Identifier[0].Value)
+		w.WriteHeader(status)
+	}))
+	suite.Summarizer = NewSummarizer(NewMemorySampleStore(), suite.FHIRServer.URL+"/", true)
+	suite.Day = time.Date(2016, time.March, 7, 0, 0, 0, 0, models.ClinicalLocation)
+}
+
+func (suite *SummarizerSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func (suite *SummarizerSuite) TestSummarizeDay() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	samples := []Sample{
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Day.Add(time.Hour), Value: 100},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Day.Add(time.Hour + SampleInterval), Value: 120},
+		{DeviceID: "cgm-2", PatientID: "2", Timestamp: suite.Day.Add(12 * time.Hour), Value: 200},
+		// The samples from the day before and after aren't included
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Day.Add(-time.Minute), Value: 300},
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Day.AddDate(0, 0, 1), Value: 300},
+	}
+	_, err := suite.Summarizer.Store.Add(samples)
+	require.NoError(err)
+
+	results, err := suite.Summarizer.SummarizeDay(suite.Day.Add(18 * time.Hour))
+	require.NoError(err)
+	require.Len(results, 2)
+	assert.Equal(SummaryResult{PatientID: "1", Date: "2016-03-07", Count: 2, Observation: "Observation/1|2016-03-07"}, results[0])
+	assert.Equal(SummaryResult{PatientID: "2", Date: "2016-03-07", Count: 1, Observation: "Observation/2|2016-03-07"}, results[1])
+
+	require.Len(suite.Written, 2)
+	o := suite.Written[SummaryIdentifierSystem+"|1|2016-03-07"]
+	require.NotNil(o)
+	assert.Equal("Patient/1", o.Subject.Reference)
+	assert.Equal("2 CGM samples", o.Comments)
+	require.NotNil(o.ValueSampledData)
+
+	// Summarizing the day again updates the summaries
+	results, err = suite.Summarizer.SummarizeDay(suite.Day)
+	require.NoError(err)
+	assert.Len(results, 2)
+	assert.Len(suite.Written, 2)
+}
+
+func (suite *SummarizerSuite) TestSummarizeDayErrors() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	samples := []Sample{
+		{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Day.Add(time.Hour), Value: 100},
+		{DeviceID: "cgm-3", PatientID: "3", Timestamp: suite.Day.Add(time.Hour), Value: 100},
+	}
+	_, err := suite.Summarizer.Store.Add(samples)
+	require.NoError(err)
+
+	results, err := suite.Summarizer.SummarizeDay(suite.Day)
+	require.NoError(err)
+	require.Len(results, 2)
+	assert.NoError(results[0].Error)
+	assert.Error(results[1].Error)
+	assert.Empty(results[1].Observation)
+
+	data, err := json.Marshal(&results[1])
+	require.NoError(err)
+	assert.Contains(string(data), `"error":"Received HTTP 500`)
+}
+
+func (suite *SummarizerSuite) TestSummarizeEmptyDay() {
+	results, err := suite.Summarizer.SummarizeDay(suite.Day)
+	suite.Require().NoError(err)
+	suite.Assert().Empty(results)
+}
@@ -0,0 +1,188 @@
+package cgm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+)
+
+// SummaryIdentifierSystem is the system of the identifiers given to the daily summary observations.  The identifier
+// is unique to the patient and day, so summarizing a day again updates its summary.
+const SummaryIdentifierSystem = "http://interventionengine.org/fhir/cgm-summaries"
+
+// CodeSystem is the system of the codes of the daily summary observations and their components
+const CodeSystem = "http://interventionengine.org/fhir/cgm"
+
+// SampleInterval is the interval at which CGMs report samples.  A day's wear is the percent of its intervals with a
+// sample, and its trace has a value (or "E", if there's no sample) for each interval.
+const SampleInterval = 5 * time.Minute
+
+// The glycemic ranges (mg/dL) of the international consensus on time in range
+const (
+	VeryLowThreshold  = 54
+	LowThreshold      = 70
+	HighThreshold     = 180
+	VeryHighThreshold = 250
+)
+
+// Summary is the summary of a patient's CGM samples over a day.  The times in and out of range are percents of the
+// samples: BelowRange includes VeryLow, and AboveRange includes VeryHigh.
+type Summary struct {
+	PatientID  string
+	Start      time.Time
+	End        time.Time
+	Count      int
+	Wear       float64
+	Mean       float64
+	SD         float64
+	CV         float64
+	GMI        float64
+	VeryLow    float64
+	BelowRange float64
+	InRange    float64
+	AboveRange float64
+	VeryHigh   float64
+	samples    []Sample
+}
+
+// Summarize summarizes the patient's samples (sorted by timestamp) from the start until the end of a day, returning
+// nil if there are none
+func Summarize(patientID string, start, end time.Time, samples []Sample) *Summary {
+	if len(samples) == 0 {
+		return nil
+	}
+	s := &Summary{PatientID: patientID, Start: start, End: end, Count: len(samples), samples: samples}
+	var sum, veryLow, belowRange, aboveRange, veryHigh float64
+	intervals := make(map[int]bool)
+	for _, sample := range samples {
+		sum += sample.Value
+		switch v := sample.Value; {
+		case v < VeryLowThreshold:
+			veryLow++
+			belowRange++
+		case v < LowThreshold:
+			belowRange++
+		case v > VeryHighThreshold:
+			veryHigh++
+			aboveRange++
+		case v > HighThreshold:
+			aboveRange++
+		}
+		intervals[s.interval(sample.Timestamp)] = true
+	}
+	n := float64(len(samples))
+	s.Mean = sum / n
+	if len(samples) > 1 {
+		var squares float64
+		for _, sample := range samples {
+			squares += (sample.Value - s.Mean) * (sample.Value - s.Mean)
+		}
+		s.SD = math.Sqrt(squares / (n - 1))
+	}
+	s.CV = 100 * s.SD / s.Mean
+	// The glucose management indicator estimates the HbA1c (%) from the mean glucose (mg/dL)
+	s.GMI = 3.31 + 0.02392*s.Mean
+	s.VeryLow, s.BelowRange = 100*veryLow/n, 100*belowRange/n
+	s.AboveRange, s.VeryHigh = 100*aboveRange/n, 100*veryHigh/n
+	s.InRange = 100 - s.BelowRange - s.AboveRange
+	s.Wear = 100 * float64(len(intervals)) / float64(s.intervals())
+	return s
+}
+
+// intervals returns the number of sample intervals in the day (which isn't always 288, on days when daylight saving
+// time starts or ends)
+func (s *Summary) intervals() int {
+	return int(s.End.Sub(s.Start) / SampleInterval)
+}
+
+// interval returns the index of the sample interval the time falls in
+func (s *Summary) interval(t time.Time) int {
+	return int(t.Sub(s.Start) / SampleInterval)
+}
+
+// Trace returns the day's samples as SampledData, with a value for each sample interval
+func (s *Summary) Trace() *fhir.SampledData {
+	values := make([]string, s.intervals())
+	for i := range values {
+		values[i] = "E"
+	}
+	for _, sample := range s.samples {
+		if i := s.interval(sample.Timestamp); i >= 0 && i < len(values) {
+			values[i] = strconv.FormatFloat(round(sample.Value, 0), 'f', -1, 64)
+		}
+	}
+	zero, period, dimensions := 0.0, float64(SampleInterval/time.Millisecond), uint32(1)
+	return &fhir.SampledData{
+		Origin:     &fhir.Quantity{Value: &zero, Unit: "mg/dL", System: ucum.System, Code: "mg/dL"},
+		Period:     &period,
+		Dimensions: &dimensions,
+		Data:       strings.Join(values, " "),
+	}
+}
+
+// summaryComponent is a component of the daily summary observation
+type summaryComponent struct {
+	code    string
+	display string
+	unit    string
+	value   func(s *Summary) float64
+}
+
+var summaryComponents = []summaryComponent{
+	{"mean-glucose", "Mean glucose", "mg/dL", func(s *Summary) float64 { return s.Mean }},
+	{"glucose-standard-deviation", "Standard deviation of glucose", "mg/dL", func(s *Summary) float64 { return s.SD }},
+	{"glucose-coefficient-of-variation", "Coefficient of variation of glucose", "%", func(s *Summary) float64 { return s.CV }},
+	{"glucose-management-indicator", "Glucose management indicator", "%", func(s *Summary) float64 { return s.GMI }},
+	{"time-very-low", "Time below 54 mg/dL", "%", func(s *Summary) float64 { return s.VeryLow }},
+	{"time-below-range", "Time below 70 mg/dL", "%", func(s *Summary) float64 { return s.BelowRange }},
+	{"time-in-range", "Time from 70 to 180 mg/dL", "%", func(s *Summary) float64 { return s.InRange }},
+	{"time-above-range", "Time above 180 mg/dL", "%", func(s *Summary) float64 { return s.AboveRange }},
+	{"time-very-high", "Time above 250 mg/dL", "%", func(s *Summary) float64 { return s.VeryHigh }},
+	{"sensor-wear", "Time with CGM samples", "%", func(s *Summary) float64 { return s.Wear }},
+}
+
+// Key returns the summary's identifier value: its patient and day
+func (s *Summary) Key() string {
+	return s.PatientID + "|" + s.Start.Format("2006-01-02")
+}
+
+// ToObservation returns the summary as an Observation whose components are the summary's metrics, and whose value is
+// the day's trace if includeTrace is set
+func (s *Summary) ToObservation(includeTrace bool) *fhir.Observation {
+	code := fhir.Coding{System: CodeSystem, Code: "daily-summary", Display: "CGM daily glucose summary"}
+	o := &fhir.Observation{
+		Identifier: []fhir.Identifier{{System: SummaryIdentifierSystem, Value: s.Key()}},
+		Status:     "final",
+		Category: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{{System: "http://hl7.org/fhir/observation-category", Code: "laboratory"}},
+		},
+		Code:    &fhir.CodeableConcept{Coding: []fhir.Coding{code}, Text: code.Display},
+		Subject: &fhir.Reference{Reference: "Patient/" + s.PatientID},
+		EffectivePeriod: &fhir.Period{
+			Start: &fhir.FHIRDateTime{Time: s.Start.In(models.ClinicalLocation), Precision: fhir.Timestamp},
+			End:   &fhir.FHIRDateTime{Time: s.End.In(models.ClinicalLocation), Precision: fhir.Timestamp},
+		},
+		Comments: strconv.Itoa(s.Count) + " CGM samples",
+	}
+	for _, c := range summaryComponents {
+		value := round(c.value(s), 1)
+		o.Component = append(o.Component, fhir.ObservationComponentComponent{
+			Code:          &fhir.CodeableConcept{Coding: []fhir.Coding{{System: CodeSystem, Code: c.code, Display: c.display}}, Text: c.display},
+			ValueQuantity: &fhir.Quantity{Value: &value, Unit: c.unit, System: ucum.System, Code: c.unit},
+		})
+	}
+	if includeTrace {
+		o.ValueSampledData = s.Trace()
+	}
+	return o
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Floor(value*scale+0.5) / scale
+}
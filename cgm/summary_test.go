@@ -0,0 +1,107 @@
+package cgm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSummarySuite(t *testing.T) {
+	suite.Run(t, new(SummarySuite))
+}
+
+type SummarySuite struct {
+	suite.Suite
+	Start time.Time
+	End   time.Time
+}
+
+func (suite *SummarySuite) SetupTest() {
+	suite.Start = time.Date(2016, time.March, 7, 0, 0, 0, 0, time.UTC)
+	suite.End = suite.Start.AddDate(0, 0, 1)
+}
+
+// samples returns samples with the values, one per sample interval from the start of the day
+func (suite *SummarySuite) samples(values ...float64) []Sample {
+	samples := make([]Sample, len(values))
+	for i, value := range values {
+		samples[i] = Sample{DeviceID: "cgm-1", PatientID: "1", Timestamp: suite.Start.Add(time.Duration(i) * SampleInterval), Value: value}
+	}
+	return samples
+}
+
+func (suite *SummarySuite) TestSummarize() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	assert.Nil(Summarize("1", suite.Start, suite.End, nil))
+
+	s := Summarize("1", suite.Start, suite.End, suite.samples(50, 60, 100, 120, 140, 160, 170, 200, 260, 140))
+	require.NotNil(s)
+	assert.Equal("1", s.PatientID)
+	assert.Equal(10, s.Count)
+	assert.InDelta(140, s.Mean, 0.001)
+	assert.InDelta(63.07, s.SD, 0.01)
+	assert.InDelta(45.05, s.CV, 0.01)
+	assert.InDelta(6.66, s.GMI, 0.01)
+	assert.InDelta(10, s.VeryLow, 0.001)
+	assert.InDelta(20, s.BelowRange, 0.001)
+	assert.InDelta(60, s.InRange, 0.001)
+	assert.InDelta(20, s.AboveRange, 0.001)
+	assert.InDelta(10, s.VeryHigh, 0.001)
+	assert.InDelta(100*10.0/288, s.Wear, 0.001)
+	assert.Equal("1|2016-03-07", s.Key())
+
+	// The thresholds themselves are in range
+	s = Summarize("1", suite.Start, suite.End, suite.samples(70, 180))
+	assert.InDelta(100, s.InRange, 0.001)
+}
+
+func (suite *SummarySuite) TestTrace() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	samples := suite.samples(100.4, 120, 140)
+	// Drop the second sample, leaving a gap in the trace
+	samples = append(samples[:1], samples[2])
+	trace := Summarize("1", suite.Start, suite.End, samples).Trace()
+	require.NotNil(trace.Period)
+	assert.Equal(300000.0, *trace.Period)
+	assert.Equal(uint32(1), *trace.Dimensions)
+	assert.Equal("mg/dL", trace.Origin.Code)
+	values := strings.Split(trace.Data, " ")
+	require.Len(values, 288)
+	assert.Equal([]string{"100", "E", "140", "E"}, values[:4])
+}
+
+func (suite *SummarySuite) TestToObservation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	s := Summarize("1", suite.Start, suite.End, suite.samples(50, 60, 100, 120, 140, 160, 170, 200, 260, 140))
+	o := s.ToObservation(false)
+	require.Len(o.Identifier, 1)
+	assert.Equal(SummaryIdentifierSystem, o.Identifier[0].System)
+	assert.Equal("1|2016-03-07", o.Identifier[0].Value)
+	assert.Equal("final", o.Status)
+	assert.Equal("daily-summary", o.Code.Coding[0].Code)
+	assert.Equal("Patient/1", o.Subject.Reference)
+	assert.True(suite.Start.Equal(o.EffectivePeriod.Start.Time))
+	assert.True(suite.End.Equal(o.EffectivePeriod.End.Time))
+	assert.Nil(o.ValueSampledData)
+
+	values := make(map[string]float64)
+	for _, c := range o.Component {
+		values[c.Code.Coding[0].Code] = *c.ValueQuantity.Value
+	}
+	assert.Len(values, len(summaryComponents))
+	assert.Equal(140.0, values["mean-glucose"])
+	assert.Equal(6.7, values["glucose-management-indicator"])
+	assert.Equal(45.0, values["glucose-coefficient-of-variation"])
+	assert.Equal(60.0, values["time-in-range"])
+	assert.Equal(3.5, values["sensor-wear"])
+
+	assert.NotNil(s.ToObservation(true).ValueSampledData)
+}
@@ -8,66 +8,138 @@ import (
 	"net/url"
 	"strings"
 
-	"gopkg.in/mgo.v2"
-
 	"sync"
 
 	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/multifactorriskservice/models"
-	"github.com/intervention-engine/riskservice/service"
+	"github.com/intervention-engine/multifactorriskservice/store"
 )
 
 var m sync.Mutex
 
 // RefreshRiskAssessments pulls the risk assessment data from REDCap and posts it to the FHIR server, replacing older
-// risk assessments and storing pie representations.
-func RefreshRiskAssessments(fhirEndpoint string, redcapEndpoint string, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) ([]Result, error) {
+// risk assessments and storing pie representations.  The model configuration determines how the risk assessments are
+// identified and scored.
+func RefreshRiskAssessments(fhirEndpoint string, redcapEndpoint string, redcapToken string, pieStore store.PieStore, basisPieURL string, model ModelConfig) ([]Result, error) {
 	m.Lock()
 	defer m.Unlock()
 	studies, err := GetREDCapData(redcapEndpoint, redcapToken)
 	if err != nil {
 		return nil, err
 	}
-	return PostRiskAssessments(fhirEndpoint, studies, pieCollection, basisPieURL), nil
+	return PostRiskAssessments(fhirEndpoint, studies, pieStore, basisPieURL, model), nil
+}
+
+// ImportRiskAssessments posts the risk assessments in the records (e.g., from a REDCap export file) to the FHIR
+// server, replacing older risk assessments and storing pie representations, just as RefreshRiskAssessments does for
+// the records pulled from REDCap.
+func ImportRiskAssessments(fhirEndpoint string, records []models.Record, pieStore store.PieStore, basisPieURL string, model ModelConfig) ([]Result, error) {
+	m.Lock()
+	defer m.Unlock()
+	studies := make(models.StudyMap)
+	if err := studies.AddRecords(records); err != nil {
+		return nil, err
+	}
+	return PostRiskAssessments(fhirEndpoint, studies, pieStore, basisPieURL, model), nil
 }
 
 // GetREDCapData queries REDCap at the specified endpoint with the specifed token, returning a StudyMap containing
 // the resulting data.
 func GetREDCapData(endpoint string, token string) (models.StudyMap, error) {
+	return GetREDCapStudies(endpoint, token, nil)
+}
+
+// GetREDCapStudies queries REDCap at the specified endpoint with the specified token for the studies with the given
+// IDs (or all studies, if no IDs are given), returning a StudyMap containing the resulting data.
+func GetREDCapStudies(endpoint string, token string, studyIDs []string) (models.StudyMap, error) {
 	form := url.Values{}
+	for i, id := range studyIDs {
+		form.Set(fmt.Sprintf("records[%d]", i), id)
+	}
 	form.Set("token", token)
 	form.Set("content", "record")
 	form.Set("format", "json")
 	form.Set("returnFormat", "json")
 	form.Set("type", "flat")
-	form.Set("fields", "study_id, redcap_event_name, rf_date, rf_cmc_risk_cat, rf_func_risk_cat, rf_sb_risk_cat, rf_util_risk_cat, rf_risk_predicted")
+	form.Set("fields", strings.Join(models.RecordFields, ", "))
 
+	var records []models.Record
+	if err := postREDCap(endpoint, form, &records); err != nil {
+		return nil, err
+	}
+
+	m := make(models.StudyMap)
+	if err := m.AddRecords(records); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GetREDCapMetadata queries REDCap at the specified endpoint with the specified token, returning the project's data
+// dictionary
+func GetREDCapMetadata(endpoint string, token string) ([]models.MetadataField, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("content", "metadata")
+	form.Set("format", "json")
+	form.Set("returnFormat", "json")
+
+	var fields []models.MetadataField
+	if err := postREDCap(endpoint, form, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// postREDCap posts the form to the REDCap API at the specified endpoint, decoding the JSON response into v
+func postREDCap(endpoint string, form url.Values, v interface{}) error {
 	if !strings.HasSuffix(endpoint, "/") {
 		endpoint += "/"
 	}
 	res, err := http.DefaultClient.PostForm(endpoint, form)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// REDCap reports errors as a JSON object with an error message
+		var redcapErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&redcapErr)
+		return fmt.Errorf("Received HTTP %d %s from REDCap: %s", res.StatusCode, http.StatusText(res.StatusCode), redcapErr.Error)
+	}
 
-	var records []models.Record
 	decoder := json.NewDecoder(res.Body)
-	if err := decoder.Decode(&records); err != nil {
-		return nil, err
-	}
+	return decoder.Decode(v)
+}
 
-	m := make(models.StudyMap)
-	if err := m.AddRecords(records); err != nil {
-		return nil, err
+// CheckFHIRServer checks that the FHIR server at the specified endpoint can be queried for patients
+func CheckFHIRServer(fhirEndpoint string) error {
+	r, err := http.NewRequest("GET", fhirEndpoint+"/Patient?_count=1", nil)
+	if err != nil {
+		return err
 	}
-
-	return m, nil
+	r.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received HTTP %d %s from FHIR server when querying for patients.", res.StatusCode, res.Status)
+	}
+	var bundle fhir.Bundle
+	if err := json.NewDecoder(res.Body).Decode(&bundle); err != nil {
+		return fmt.Errorf("Couldn't decode the FHIR server's response to a patient query.  Error: %s", err.Error())
+	}
+	return nil
 }
 
 // PostRiskAssessments posts the risk assessments from the studies to the FHIR server and also stores the risk pies
-// to the local Mongo database
-func PostRiskAssessments(fhirEndpoint string, studies models.StudyMap, pieCollection *mgo.Collection, basisPieURL string) []Result {
+// in the pie store.  Overall scores are computed using the model's aggregation strategy.
+func PostRiskAssessments(fhirEndpoint string, studies models.StudyMap, pieStore store.PieStore, basisPieURL string, model ModelConfig) []Result {
 	results := make([]Result, 0, len(studies))
 	for _, study := range studies {
 		result := Result{
@@ -113,8 +185,8 @@ func PostRiskAssessments(fhirEndpoint string, studies models.StudyMap, pieCollec
 		result.FHIRPatientID = patientID
 
 		// Get the risk assessments from the records, post to FHIR server, and update pies in Mongo
-		calcResults := study.ToRiskServiceCalculationResults(fhirEndpoint + "/Patient/" + patientID)
-		err = service.UpdateRiskAssessmentsAndPies(fhirEndpoint, patientID, calcResults, pieCollection, basisPieURL, REDCapRiskServiceConfig)
+		calcResults := study.ToResults(fhirEndpoint+"/Patient/"+patientID, model.Aggregation)
+		err = UpdateRiskAssessmentsAndPies(fhirEndpoint, patientID, calcResults, pieStore, basisPieURL, model)
 		if err != nil {
 			result.Error = err
 		} else {
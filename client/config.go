@@ -2,6 +2,7 @@ package client
 
 import (
 	"github.com/intervention-engine/fhir/models"
+	mfmodels "github.com/intervention-engine/multifactorriskservice/models"
 	"github.com/intervention-engine/riskservice/plugin"
 )
 
@@ -20,3 +21,43 @@ var REDCapRiskServiceConfig = plugin.RiskServicePluginConfig{
 	},
 	RequiredResourceTypes: []string{},
 }
+
+// AggregationExtensionURL is the URL of the RiskAssessment extension recording the aggregation strategy used to
+// compute the overall score
+const AggregationExtensionURL = "http://interventionengine.org/fhir/extension/riskassessment/aggregation-strategy"
+
+// TrajectoryExtensionURL is the base URL of the RiskAssessment extensions recording trajectory metrics on the most
+// recent risk assessment.  Each metric is recorded as <base>/<overall or slice>/<metric>.
+const TrajectoryExtensionURL = "http://interventionengine.org/fhir/extension/riskassessment/trajectory"
+
+// ModelConfig represents the configuration of a risk model: the plugin configuration identifying its risk
+// assessments, the strategy used to aggregate its pie slices into an overall score, and the options used to compute
+// risk trajectories.
+type ModelConfig struct {
+	plugin.RiskServicePluginConfig
+	Aggregation mfmodels.AggregationStrategy
+	Trajectory  mfmodels.TrajectoryOptions
+}
+
+// NewREDCapModelConfig returns the multi-factor REDCap model configuration using the given aggregation strategy.  If
+// the strategy is nil, the MaxValueAggregation is used.  The overall high risk threshold for trajectories is scaled to
+// match the range of scores produced by the strategy.
+func NewREDCapModelConfig(strategy mfmodels.AggregationStrategy) ModelConfig {
+	if strategy == nil {
+		strategy = mfmodels.MaxValueAggregation{}
+	}
+	trajectory := mfmodels.DefaultTrajectoryOptions
+	switch strategy.(type) {
+	case mfmodels.WeightedSumAggregation:
+		trajectory.OverallHighRiskThreshold = 75
+	case mfmodels.ThresholdCountAggregation:
+		trajectory.OverallHighRiskThreshold = 1
+	case mfmodels.LogisticAggregation:
+		trajectory.OverallHighRiskThreshold = 50
+	}
+	return ModelConfig{
+		RiskServicePluginConfig: REDCapRiskServiceConfig,
+		Aggregation:             strategy,
+		Trajectory:              trajectory,
+	}
+}
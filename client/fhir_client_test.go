@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -102,7 +103,7 @@ func (suite *FHIRClientSuite) TestPostRiskAssessments() {
 
 	// Post the studies as risk assessments
 	piesCollection := suite.Database.C("pies")
-	results := PostRiskAssessments(suite.Server.URL, suite.Studies, piesCollection, suite.Server.URL+"/pies")
+	results := PostRiskAssessments(suite.Server.URL, suite.Studies, store.NewMongoPieStore(piesCollection), suite.Server.URL+"/pies", NewREDCapModelConfig(nil))
 	assert.Len(results, 2)
 
 	// Check the results
@@ -154,7 +155,7 @@ func (suite *FHIRClientSuite) TestPostRiskAssessmentsWithUnfoundStudyID() {
 
 	// Post the studies as risk assessments
 	piesCollection := suite.Database.C("pies")
-	results := PostRiskAssessments(suite.Server.URL, suite.Studies, piesCollection, suite.Server.URL+"/pies")
+	results := PostRiskAssessments(suite.Server.URL, suite.Studies, store.NewMongoPieStore(piesCollection), suite.Server.URL+"/pies", NewREDCapModelConfig(nil))
 	assert.Len(results, 2)
 
 	// Check the results
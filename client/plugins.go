@@ -0,0 +1,454 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/intervention-engine/riskservice/service"
+)
+
+// ErrPatientNotFound is returned when calculating the risk assessments of a patient that isn't on the FHIR server
+var ErrPatientNotFound = errors.New("Patient not found")
+
+// supportedResourceTypes are the resource types that may be required by hosted plugins, mapped to the search
+// parameter referencing the patient.  These are the resource types that can be converted to events.
+var supportedResourceTypes = map[string]string{
+	"Condition":           "patient",
+	"MedicationOrder":     "patient",
+	"MedicationStatement": "patient",
+	"Observation":         "patient",
+}
+
+// DetailedPlugin is a RiskServicePlugin that also reports the details of its results that the calculation results
+// themselves can't represent, such as the precision of their dates.  The registry calculates risk assessments with
+// CalculateDetails instead of Calculate when a hosted plugin is a DetailedPlugin.
+type DetailedPlugin interface {
+	plugin.RiskServicePlugin
+	CalculateDetails(es *plugin.EventStream, fhirEndpointURL string) ([]models.Result, error)
+}
+
+// HostedPlugin is a risk service plugin hosted by the service, along with the model configuration used to aggregate,
+// post and store its risk assessments
+type HostedPlugin struct {
+	Name   string
+	Plugin plugin.RiskServicePlugin
+	Model  ModelConfig
+}
+
+// PluginRegistry holds the risk service plugins hosted by the service.  The plugins calculate risk assessments from
+// each patient's FHIR data, which are posted to the FHIR server and stored as pies just like the risk assessments
+// refreshed from REDCap.
+type PluginRegistry struct {
+	plugins []HostedPlugin
+}
+
+// NewPluginRegistry returns an empty PluginRegistry
+func NewPluginRegistry() *PluginRegistry {
+	return &PluginRegistry{}
+}
+
+// NewModelConfig returns the model configuration for a plugin, using the given aggregation strategy (defaulting to
+// MaxValueAggregation if nil) and the default trajectory options
+func NewModelConfig(config plugin.RiskServicePluginConfig, strategy models.AggregationStrategy) ModelConfig {
+	if strategy == nil {
+		strategy = models.MaxValueAggregation{}
+	}
+	return ModelConfig{
+		RiskServicePluginConfig: config,
+		Aggregation:             strategy,
+		Trajectory:              models.DefaultTrajectoryOptions,
+	}
+}
+
+// Register adds the plugin to the registry under the given name, using MaxValueAggregation if the model has no
+// aggregation strategy.  An error is returned if the name is already taken,
+// the model has no method coding, or the plugin requires a resource type that can't be converted to events.
+func (r *PluginRegistry) Register(name string, p plugin.RiskServicePlugin, model ModelConfig) error {
+	for _, hosted := range r.plugins {
+		if hosted.Name == name {
+			return fmt.Errorf("A plugin named %s is already registered", name)
+		}
+	}
+	if len(model.Method.Coding) == 0 {
+		return fmt.Errorf("Plugin %s must provide a method with a coding", name)
+	}
+	if model.Aggregation == nil {
+		model.Aggregation = models.MaxValueAggregation{}
+	}
+	for _, resourceType := range p.Config().RequiredResourceTypes {
+		if _, ok := supportedResourceTypes[resourceType]; !ok {
+			return fmt.Errorf("Plugin %s requires unsupported resource type %s", name, resourceType)
+		}
+	}
+	r.plugins = append(r.plugins, HostedPlugin{Name: name, Plugin: p, Model: model})
+	return nil
+}
+
+// Has checks if a plugin is registered under the given name
+func (r *PluginRegistry) Has(name string) bool {
+	for _, hosted := range r.plugins {
+		if hosted.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Plugins returns the registered plugins, in the order they were registered
+func (r *PluginRegistry) Plugins() []HostedPlugin {
+	return r.plugins
+}
+
+// PluginResult represents the result (successful or not) of calculating a patient's risk assessments with a plugin.
+// NotApplicable indicates that the plugin doesn't apply to the patient, so no risk assessments were calculated.
+type PluginResult struct {
+	Plugin              string
+	FHIRPatientID       string
+	RiskAssessmentCount int
+	NotApplicable       bool
+	Error               error
+}
+
+// MarshalJSON handles the marshalling of the errors since Go doesn't
+func (r *PluginResult) MarshalJSON() ([]byte, error) {
+	var errString string
+	if r.Error != nil {
+		errString = r.Error.Error()
+	}
+	return json.Marshal(&struct {
+		Plugin              string `json:"plugin"`
+		FHIRPatientID       string `json:"fhirPatientID"`
+		RiskAssessmentCount int    `json:"riskAssessmentCount"`
+		NotApplicable       bool   `json:"notApplicable,omitempty"`
+		Error               string `json:"error,omitempty"`
+	}{
+		Plugin:              r.Plugin,
+		FHIRPatientID:       r.FHIRPatientID,
+		RiskAssessmentCount: r.RiskAssessmentCount,
+		NotApplicable:       r.NotApplicable,
+		Error:               errString,
+	})
+}
+
+// LogPluginResultSummary prints out a log of the plugin result summary (# patients, # errors, # assessments)
+func LogPluginResultSummary(results []PluginResult) {
+	patients := make(map[string]bool)
+	var numErrors, numAssessments int
+	for _, result := range results {
+		patients[result.FHIRPatientID] = true
+		if result.Error != nil {
+			numErrors++
+		}
+		numAssessments += result.RiskAssessmentCount
+	}
+	log.Printf("Calculated risk assessments for %d patients: %d errors, %d risk assessments.",
+		len(patients), numErrors, numAssessments)
+}
+
+// CalculateRiskAssessments calculates the patient's risk assessments with each registered plugin from the patient's
+// FHIR data, replacing the patient's older risk assessments for the plugin on the FHIR server and storing their pies.
+// ErrPatientNotFound is returned if the patient isn't on the FHIR server.
+func (r *PluginRegistry) CalculateRiskAssessments(fhirEndpoint string, patientID string, pieStore store.PieStore, basisPieURL string) ([]PluginResult, error) {
+	m.Lock()
+	defer m.Unlock()
+	streams, err := r.getEventStreams(fhirEndpoint, url.Values{"_id": []string{patientID}})
+	if err != nil {
+		return nil, err
+	}
+	es, ok := streams[patientID]
+	if !ok {
+		return nil, ErrPatientNotFound
+	}
+	return r.calculate(fhirEndpoint, patientID, es, pieStore, basisPieURL), nil
+}
+
+// CalculateAllRiskAssessments calculates the risk assessments of every patient on the FHIR server with each
+// registered plugin, as CalculateRiskAssessments does for a single patient.  The patients are calculated one page of
+// the FHIR server's patients at a time, so only that page's resources are held in memory, and refreshes from REDCap
+// may run between pages.  If a page can't be calculated, the results of the previous pages are returned with the
+// error.
+func (r *PluginRegistry) CalculateAllRiskAssessments(fhirEndpoint string, pieStore store.PieStore, basisPieURL string) ([]PluginResult, error) {
+	var results []PluginResult
+	var pageErr error
+	err := ForEachBundle(strings.TrimSuffix(fhirEndpoint, "/")+"/Patient", func(bundle *fhir.Bundle) {
+		if pageErr != nil {
+			return
+		}
+		var patientIDs []string
+		for _, entry := range bundle.Entry {
+			if patient, ok := entry.Resource.(*fhir.Patient); ok && patient.Id != "" {
+				patientIDs = append(patientIDs, patient.Id)
+			}
+		}
+		var pageResults []PluginResult
+		pageResults, pageErr = r.calculatePatients(fhirEndpoint, patientIDs, pieStore, basisPieURL)
+		results = append(results, pageResults...)
+	})
+	if err == nil {
+		err = pageErr
+	}
+	return results, err
+}
+
+// calculatePatients calculates the risk assessments of the patients with each registered plugin, querying the FHIR
+// server for all of their resources at once.  Patients that are no longer on the FHIR server are skipped.
+func (r *PluginRegistry) calculatePatients(fhirEndpoint string, patientIDs []string, pieStore store.PieStore, basisPieURL string) ([]PluginResult, error) {
+	if len(patientIDs) == 0 {
+		return nil, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	streams, err := r.getEventStreams(fhirEndpoint, url.Values{"_id": []string{strings.Join(patientIDs, ",")}})
+	if err != nil {
+		return nil, err
+	}
+	var results []PluginResult
+	for _, patientID := range patientIDs {
+		if es, ok := streams[patientID]; ok {
+			results = append(results, r.calculate(fhirEndpoint, patientID, es, pieStore, basisPieURL)...)
+		}
+	}
+	return results, nil
+}
+
+// calculate calculates the patient's risk assessments with each plugin, posting and storing the results
+func (r *PluginRegistry) calculate(fhirEndpoint, patientID string, es *plugin.EventStream, pieStore store.PieStore, basisPieURL string) []PluginResult {
+	results := make([]PluginResult, 0, len(r.plugins))
+	for _, hosted := range r.plugins {
+		result := PluginResult{Plugin: hosted.Name, FHIRPatientID: patientID}
+
+		// Copy the event stream since plugins may modify it, and we add significant birthdays based on their config
+		esClone := es.Clone()
+		addSignificantBirthdayEvents(esClone, hosted.Plugin.Config().SignificantBirthdays)
+		var calcResults []models.Result
+		var err error
+		if detailed, ok := hosted.Plugin.(DetailedPlugin); ok {
+			calcResults, err = detailed.CalculateDetails(esClone, fhirEndpoint)
+		} else {
+			var plain []plugin.RiskServiceCalculationResult
+			plain, err = hosted.Plugin.Calculate(esClone, fhirEndpoint)
+			calcResults = models.NewResults(plain)
+		}
+		if _, ok := err.(plugin.NotApplicableError); ok {
+			result.NotApplicable = true
+		} else if err != nil {
+			result.Error = fmt.Errorf("Plugin %s failed to calculate risk assessments for patient %s.  Error: %s", hosted.Name, patientID, err.Error())
+		} else {
+			calcResults = consolidateResults(calcResults)
+			for i := range calcResults {
+				hosted.Model.Aggregation.Aggregate(&calcResults[i].RiskServiceCalculationResult)
+			}
+			if err := UpdateRiskAssessmentsAndPies(fhirEndpoint, patientID, calcResults, pieStore, basisPieURL, hosted.Model); err != nil {
+				result.Error = err
+			} else {
+				result.RiskAssessmentCount = len(calcResults)
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// getEventStreams queries the FHIR server for the patients matching the parameters, along with the resources required
+// by the plugins, returning each patient's event stream by patient ID
+func (r *PluginRegistry) getEventStreams(fhirEndpoint string, params url.Values) (map[string]*plugin.EventStream, error) {
+	included := make(map[string]bool)
+	for _, hosted := range r.plugins {
+		for _, resourceType := range hosted.Plugin.Config().RequiredResourceTypes {
+			if !included[resourceType] {
+				params.Add("_revinclude", resourceType+":"+supportedResourceTypes[resourceType])
+				included[resourceType] = true
+			}
+		}
+	}
+
+	// Group the entries of each patient into a bundle, so it can be converted to an event stream
+	bundles := make(map[string]*fhir.Bundle)
+	err := ForEachBundle(strings.TrimSuffix(fhirEndpoint, "/")+"/Patient?"+params.Encode(), func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			var patientID string
+			switch t := entry.Resource.(type) {
+			case *fhir.Patient:
+				patientID = t.Id
+			case *fhir.Condition:
+				patientID = referencedID(t.Patient)
+			case *fhir.MedicationStatement:
+				patientID = referencedID(t.Patient)
+			case *fhir.MedicationOrder:
+				patientID = referencedID(t.Patient)
+			case *fhir.Observation:
+				patientID = referencedID(t.Subject)
+			}
+			if patientID == "" {
+				continue
+			}
+			if bundles[patientID] == nil {
+				bundles[patientID] = &fhir.Bundle{}
+			}
+			bundles[patientID].Entry = append(bundles[patientID].Entry, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make(map[string]*plugin.EventStream)
+	for patientID, bundle := range bundles {
+		// The risk service can't convert MedicationOrders, so they're added to the event stream separately
+		orders := removeMedicationOrders(bundle)
+		es, err := service.BundleToEventStream(bundle)
+		if err != nil {
+			return nil, err
+		}
+		// Skip resources referencing patients that weren't found (e.g., deleted patients)
+		if es.Patient == nil {
+			continue
+		}
+		addMedicationOrderEvents(es, orders)
+		// Normalize the observations' units before any plugin uses them, leaving out observations in incompatible units
+		for _, err := range ucum.DefaultNormalizer.NormalizeEventStream(es) {
+			log.Printf("Ignoring observation for patient %s.  Error: %s", patientID, err.Error())
+		}
+		streams[patientID] = es
+	}
+	return streams, nil
+}
+
+// REDCapPlugin is a RiskServicePlugin that imports a patient's multi-factor risk assessments from REDCap, so that
+// they can be calculated on demand along with the other hosted plugins.  Just as when risk assessments are refreshed
+// from REDCap, the patient's study is the one whose ID matches one of the patient's identifiers.
+type REDCapPlugin struct {
+	Endpoint string
+	Token    string
+	Model    ModelConfig
+}
+
+// NewREDCapPlugin returns a REDCapPlugin for the REDCap API at the given endpoint, using the model configuration
+func NewREDCapPlugin(endpoint, token string, model ModelConfig) *REDCapPlugin {
+	return &REDCapPlugin{Endpoint: endpoint, Token: token, Model: model}
+}
+
+// Config returns the configuration of the multi-factor model
+func (p *REDCapPlugin) Config() plugin.RiskServicePluginConfig {
+	return p.Model.RiskServicePluginConfig
+}
+
+// Calculate converts the records of the patient's REDCap study to results, returning a NotApplicableError if none of
+// the patient's identifiers match a study ID
+func (p *REDCapPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	results, err := p.CalculateDetails(es, fhirEndpointURL)
+	return models.CalculationResults(results), err
+}
+
+// CalculateDetails converts the records of the patient's REDCap study to results as Calculate does, along with the
+// precision of each record's risk factor date
+func (p *REDCapPlugin) CalculateDetails(es *plugin.EventStream, fhirEndpointURL string) ([]models.Result, error) {
+	var ids []string
+	for _, identifier := range es.Patient.Identifier {
+		if identifier.Value != "" {
+			ids = append(ids, identifier.Value)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, plugin.NewNotApplicableError("The patient has no identifiers matching a REDCap study")
+	}
+	studies, err := GetREDCapStudies(p.Endpoint, p.Token, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(studies) == 0 {
+		return nil, plugin.NewNotApplicableError("The patient has no identifiers matching a REDCap study")
+	} else if len(studies) > 1 {
+		return nil, fmt.Errorf("Found too many REDCap studies (%d) matching the patient's identifiers", len(studies))
+	}
+	for _, study := range studies {
+		return study.ToResults(strings.TrimSuffix(fhirEndpointURL, "/")+"/Patient/"+es.Patient.Id, p.Model.Aggregation), nil
+	}
+	return nil, nil
+}
+
+// removeMedicationOrders removes the MedicationOrders from the bundle, returning them
+func removeMedicationOrders(bundle *fhir.Bundle) []*fhir.MedicationOrder {
+	var orders []*fhir.MedicationOrder
+	entries := bundle.Entry[:0]
+	for _, entry := range bundle.Entry {
+		if order, ok := entry.Resource.(*fhir.MedicationOrder); ok {
+			orders = append(orders, order)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	bundle.Entry = entries
+	return orders
+}
+
+// addMedicationOrderEvents adds a "MedicationOrder" event for each order when it was written, and an end event when
+// it ended (if it has), just as MedicationStatements are converted to events.  Orders that are drafts or were entered
+// in error are skipped, as they are by interactions.FromOrder, and so are orders without a date written, which can't
+// be placed in the event stream.
+func addMedicationOrderEvents(es *plugin.EventStream, orders []*fhir.MedicationOrder) {
+	if len(orders) == 0 {
+		return
+	}
+	for _, o := range orders {
+		if o.Status == "entered-in-error" || o.Status == "draft" || o.DateWritten == nil {
+			continue
+		}
+		es.Events = append(es.Events, plugin.Event{Date: o.DateWritten.Time, Type: "MedicationOrder", End: false, Value: o})
+		if o.DateEnded != nil {
+			es.Events = append(es.Events, plugin.Event{Date: o.DateEnded.Time, Type: "MedicationOrder", End: true, Value: o})
+		}
+	}
+	plugin.SortEventsByDate(es.Events)
+}
+
+// referencedID returns the ID of the resource referenced by a relative or absolute reference
+func referencedID(ref *fhir.Reference) string {
+	if ref == nil {
+		return ""
+	}
+	if ref.ReferencedID != "" {
+		return ref.ReferencedID
+	}
+	parts := strings.Split(ref.Reference, "/")
+	return parts[len(parts)-1]
+}
+
+// addSignificantBirthdayEvents adds an "Age" event for each of the significant birthdays the patient has reached
+func addSignificantBirthdayEvents(es *plugin.EventStream, birthdays []int) {
+	if len(birthdays) == 0 || es.Patient == nil || es.Patient.BirthDate == nil {
+		return
+	}
+	for _, age := range birthdays {
+		bd := es.Patient.BirthDate.Time.AddDate(age, 0, 0)
+		if bd.Before(time.Now()) {
+			es.Events = append(es.Events, plugin.Event{Date: bd, Type: "Age", End: false, Value: age})
+		}
+	}
+	plugin.SortEventsByDate(es.Events)
+}
+
+// consolidateResults sorts the results by date and then consolidates the ones that have the same timestamp into one,
+// choosing whichever was last in the original order
+func consolidateResults(results []models.Result) []models.Result {
+	models.SortResultsByAsOfDate(results)
+	consolidated := make([]models.Result, 0, len(results))
+	for _, result := range results {
+		if n := len(consolidated); n > 0 && consolidated[n-1].AsOf.Equal(result.AsOf) {
+			consolidated[n-1] = result
+		} else {
+			consolidated = append(consolidated, result)
+		}
+	}
+	return consolidated
+}
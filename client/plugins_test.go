@@ -0,0 +1,283 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPluginRegistrySuite(t *testing.T) {
+	suite.Run(t, new(PluginRegistrySuite))
+}
+
+type PluginRegistrySuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Queries    []string
+	Posted     []fhir.Bundle
+	Lock       sync.Mutex
+	PieStore   store.PieStore
+	Registry   *PluginRegistry
+}
+
+// countingPlugin calculates one result per observation, failing for patients with the failing ID
+type countingPlugin struct {
+	config    plugin.RiskServicePluginConfig
+	failingID string
+}
+
+func (p *countingPlugin) Config() plugin.RiskServicePluginConfig {
+	return p.config
+}
+
+func (p *countingPlugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	if es.Patient.Id == p.failingID {
+		return nil, errors.New("boom")
+	}
+	var results []plugin.RiskServiceCalculationResult
+	for _, event := range es.Events {
+		if event.Type != "Observation" {
+			continue
+		}
+		pie := plugin.NewPie(fhirEndpointURL + "/Patient/" + es.Patient.Id)
+		pie.Slices = []plugin.Slice{{Name: "Observations", Weight: 100, Value: len(results) + 1, MaxValue: 10}}
+		results = append(results, plugin.RiskServiceCalculationResult{AsOf: event.Date, Pie: pie})
+	}
+	if len(results) == 0 {
+		return nil, plugin.NewNotApplicableError("No observations")
+	}
+	return results, nil
+}
+
+func testPluginConfig(code string) plugin.RiskServicePluginConfig {
+	return plugin.RiskServicePluginConfig{
+		Name:                  code,
+		Method:                fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://test", Code: code}}},
+		RequiredResourceTypes: []string{"Observation"},
+	}
+}
+
+func observationEntry(patientID string, d time.Time) fhir.BundleEntryComponent {
+	return fhir.BundleEntryComponent{Resource: &fhir.Observation{
+		Status:            "final",
+		Subject:           &fhir.Reference{Reference: "Patient/" + patientID},
+		EffectiveDateTime: &fhir.FHIRDateTime{Time: d, Precision: fhir.Timestamp},
+	}}
+}
+
+func (suite *PluginRegistrySuite) SetupTest() {
+	suite.Queries, suite.Posted = nil, nil
+	patient1, patient2 := &fhir.Patient{}, &fhir.Patient{}
+	patient1.Id, patient2.Id = "1", "2"
+	d := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Lock.Lock()
+		defer suite.Lock.Unlock()
+		if r.Method == "POST" {
+			var bundle fhir.Bundle
+			json.NewDecoder(r.Body).Decode(&bundle)
+			suite.Posted = append(suite.Posted, bundle)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		suite.Queries = append(suite.Queries, r.URL.RawQuery)
+		bundle := fhir.Bundle{Type: "searchset"}
+		query := r.URL.Query()
+		switch {
+		case query.Get("_id") == "" && query.Get("page") == "":
+			// Page through the patients one at a time
+			bundle.Entry = []fhir.BundleEntryComponent{{Resource: patient1}}
+			bundle.Link = []fhir.BundleLinkComponent{{Relation: "next", Url: "http://" + r.Host + "/Patient?page=2"}}
+		case query.Get("_id") == "":
+			bundle.Entry = []fhir.BundleEntryComponent{{Resource: patient2}}
+		case query.Get("_id") == "1":
+			bundle.Entry = []fhir.BundleEntryComponent{{Resource: patient1}, observationEntry("1", d), observationEntry("1", d.AddDate(0, 1, 0))}
+		case query.Get("_id") == "2":
+			bundle.Entry = []fhir.BundleEntryComponent{{Resource: patient2}}
+		}
+		json.NewEncoder(w).Encode(&bundle)
+	}))
+	suite.PieStore = store.NewMemoryPieStore()
+	suite.Registry = NewPluginRegistry()
+	suite.Require().NoError(suite.Registry.Register("counting", &countingPlugin{config: testPluginConfig("Counting")}, NewModelConfig(testPluginConfig("Counting"), nil)))
+}
+
+func (suite *PluginRegistrySuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func (suite *PluginRegistrySuite) TestRegister() {
+	assert := suite.Assert()
+
+	assert.EqualError(suite.Registry.Register("counting", &countingPlugin{}, NewModelConfig(testPluginConfig("Other"), nil)), "A plugin named counting is already registered")
+	assert.EqualError(suite.Registry.Register("nocode", &countingPlugin{}, ModelConfig{}), "Plugin nocode must provide a method with a coding")
+	config := testPluginConfig("Encounters")
+	config.RequiredResourceTypes = []string{"Encounter"}
+	assert.EqualError(suite.Registry.Register("encounters", &countingPlugin{config: config}, NewModelConfig(config, nil)), "Plugin encounters requires unsupported resource type Encounter")
+	assert.Len(suite.Registry.Plugins(), 1)
+	assert.True(suite.Registry.Has("counting"))
+	assert.False(suite.Registry.Has("encounters"))
+}
+
+func (suite *PluginRegistrySuite) TestCalculateRiskAssessments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	results, err := suite.Registry.CalculateRiskAssessments(suite.FHIRServer.URL, "1", suite.PieStore, "http://risk/pies")
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal(PluginResult{Plugin: "counting", FHIRPatientID: "1", RiskAssessmentCount: 2}, results[0])
+	require.Len(suite.Queries, 1)
+	assert.Equal("_id=1&_revinclude=Observation%3Apatient", suite.Queries[0])
+
+	require.Len(suite.Posted, 1)
+	require.Len(suite.Posted[0].Entry, 3)
+	assert.Equal("RiskAssessment?method=http%3A%2F%2Ftest%7CCounting&patient=1", suite.Posted[0].Entry[0].Request.Url)
+	ra := suite.Posted[0].Entry[2].Resource.(*fhir.RiskAssessment)
+	// The scores are aggregated by the model's strategy
+	assert.Equal(float64(2), *ra.Prediction[0].ProbabilityDecimal)
+
+	pies, err := suite.PieStore.Find(suite.FHIRServer.URL+"/Patient/1", fhir.Coding{System: "http://test", Code: "Counting"})
+	require.NoError(err)
+	assert.Len(pies, 2)
+
+	_, err = suite.Registry.CalculateRiskAssessments(suite.FHIRServer.URL, "3", suite.PieStore, "http://risk/pies")
+	assert.Equal(ErrPatientNotFound, err)
+}
+
+func (suite *PluginRegistrySuite) TestMedicationOrderEvents() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	patient := &fhir.Patient{}
+	patient.Id = "1"
+	d := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	order := func(id, status string, written, ended time.Time) fhir.BundleEntryComponent {
+		o := &fhir.MedicationOrder{Status: status, Patient: &fhir.Reference{Reference: "Patient/1"}}
+		o.Id = id
+		if !written.IsZero() {
+			o.DateWritten = &fhir.FHIRDateTime{Time: written, Precision: fhir.Timestamp}
+		}
+		if !ended.IsZero() {
+			o.DateEnded = &fhir.FHIRDateTime{Time: ended, Precision: fhir.Timestamp}
+		}
+		return fhir.BundleEntryComponent{Resource: o}
+	}
+	var query string
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		json.NewEncoder(w).Encode(&fhir.Bundle{Type: "searchset", Entry: []fhir.BundleEntryComponent{
+			{Resource: patient},
+			order("1", "completed", d.AddDate(0, 1, 0), d.AddDate(0, 3, 0)),
+			observationEntry("1", d.AddDate(0, 2, 0)),
+			order("2", "active", d, time.Time{}),
+			order("3", "entered-in-error", d, time.Time{}),
+			order("4", "active", time.Time{}, time.Time{}),
+			order("5", "draft", d, time.Time{}),
+			// Orders without a status are kept, just as interactions.FromOrder keeps them
+			order("6", "", d.AddDate(0, 4, 0), time.Time{}),
+		}})
+	}))
+	defer fhirServer.Close()
+
+	config := testPluginConfig("Orders")
+	config.RequiredResourceTypes = []string{"Observation", "MedicationOrder"}
+	registry := NewPluginRegistry()
+	require.NoError(registry.Register("orders", &countingPlugin{config: config}, NewModelConfig(config, nil)))
+	streams, err := registry.getEventStreams(fhirServer.URL, url.Values{"_id": []string{"1"}})
+	require.NoError(err)
+	assert.Equal("_id=1&_revinclude=Observation%3Apatient&_revinclude=MedicationOrder%3Apatient", query)
+
+	// The orders are converted to events in order of their dates, alongside the other resources
+	es := streams["1"]
+	require.NotNil(es)
+	require.Len(es.Events, 5)
+	assert.Equal("MedicationOrder", es.Events[0].Type)
+	assert.Equal("2", es.Events[0].Value.(*fhir.MedicationOrder).Id)
+	assert.Equal("MedicationOrder", es.Events[1].Type)
+	assert.Equal("1", es.Events[1].Value.(*fhir.MedicationOrder).Id)
+	assert.False(es.Events[1].End)
+	assert.Equal("Observation", es.Events[2].Type)
+	assert.Equal("MedicationOrder", es.Events[3].Type)
+	assert.True(es.Events[3].End)
+	assert.True(es.Events[3].Date.Equal(d.AddDate(0, 3, 0)))
+	assert.Equal("6", es.Events[4].Value.(*fhir.MedicationOrder).Id)
+}
+
+func (suite *PluginRegistrySuite) TestCalculateAllRiskAssessments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	require.NoError(suite.Registry.Register("failing", &countingPlugin{config: testPluginConfig("Failing"), failingID: "1"}, NewModelConfig(testPluginConfig("Failing"), models.WeightedSumAggregation{})))
+	results, err := suite.Registry.CalculateAllRiskAssessments(suite.FHIRServer.URL, suite.PieStore, "http://risk/pies")
+	require.NoError(err)
+	require.Len(results, 4)
+
+	byPatientAndPlugin := make(map[string]PluginResult)
+	for _, result := range results {
+		byPatientAndPlugin[result.FHIRPatientID+"/"+result.Plugin] = result
+	}
+	assert.Equal(2, byPatientAndPlugin["1/counting"].RiskAssessmentCount)
+	assert.EqualError(byPatientAndPlugin["1/failing"].Error, "Plugin failing failed to calculate risk assessments for patient 1.  Error: boom")
+	assert.True(byPatientAndPlugin["2/counting"].NotApplicable)
+	assert.True(byPatientAndPlugin["2/failing"].NotApplicable)
+	// Only the successful calculation was posted
+	assert.Len(suite.Posted, 1)
+	// Each page of patients was queried with its resources separately
+	require.Len(suite.Queries, 4)
+	assert.Equal("", suite.Queries[0])
+	assert.Equal("1", mustParseQuery(suite.Queries[1]).Get("_id"))
+	assert.Equal([]string{"Observation:patient"}, mustParseQuery(suite.Queries[1])["_revinclude"])
+	assert.Equal("page=2", suite.Queries[2])
+	assert.Equal("2", mustParseQuery(suite.Queries[3]).Get("_id"))
+}
+
+func mustParseQuery(query string) url.Values {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		panic(err)
+	}
+	return values
+}
+
+func (suite *PluginRegistrySuite) TestREDCapPlugin() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var requestedIDs []string
+	redcapServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requestedIDs = append(requestedIDs, r.PostForm.Get("records[0]"), r.PostForm.Get("records[1]"))
+		records := []models.Record{}
+		if r.PostForm.Get("records[1]") == "MRN1" {
+			records = append(records, models.Record{StudyID: "MRN1", RiskFactorDate: "2016-01-01", ClinicalRisk: "2", FunctionalRisk: "3", PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "3"})
+		}
+		json.NewEncoder(w).Encode(records)
+	}))
+	defer redcapServer.Close()
+
+	p := NewREDCapPlugin(redcapServer.URL, "token", NewREDCapModelConfig(nil))
+	patient := &fhir.Patient{Identifier: []fhir.Identifier{{Value: "SSN1"}, {Value: "MRN1"}}}
+	patient.Id = "1"
+	results, err := p.Calculate(plugin.NewEventStream(patient), "http://fhir")
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal("http://fhir/Patient/1", results[0].Pie.Patient)
+	assert.Equal(3, *results[0].Score)
+	assert.Equal([]string{"SSN1", "MRN1"}, requestedIDs)
+
+	patient.Identifier = []fhir.Identifier{{Value: "SSN2"}}
+	_, err = p.Calculate(plugin.NewEventStream(patient), "http://fhir")
+	assert.IsType(plugin.NotApplicableError{}, err)
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// IssueType identifies a kind of discrepancy between the REDCap studies and the FHIR patients
+type IssueType string
+
+// The kinds of discrepancies reported by Reconcile
+const (
+	// UnmatchedStudy indicates that no FHIR patient has an identifier matching the study ID
+	UnmatchedStudy IssueType = "unmatched-study"
+	// AmbiguousStudy indicates that more than one FHIR patient has an identifier matching the study ID
+	AmbiguousStudy IssueType = "ambiguous-study"
+	// PatientWithoutStudy indicates that none of the FHIR patient's identifiers match a study ID
+	PatientWithoutStudy IssueType = "patient-without-study"
+	// StaleRiskAssessments indicates that the patient's risk assessments on the FHIR server are missing or older than
+	// the study's complete records in REDCap
+	StaleRiskAssessments IssueType = "stale-risk-assessments"
+	// IncompleteStudy indicates that none of the study's records have complete risk factors
+	IncompleteStudy IssueType = "incomplete-study"
+)
+
+// Issue represents a discrepancy found when reconciling the REDCap studies with the FHIR patients.  Dates are reported
+// at day precision, since that is the precision of the REDCap risk factor dates.
+type Issue struct {
+	Type               IssueType `json:"type"`
+	StudyID            string    `json:"studyID,omitempty"`
+	FHIRPatientIDs     []string  `json:"fhirPatientIDs,omitempty"`
+	REDCapDate         string    `json:"redcapDate,omitempty"`
+	RiskAssessmentDate string    `json:"riskAssessmentDate,omitempty"`
+	Detail             string    `json:"detail"`
+}
+
+// Report is the result of reconciling the REDCap studies with the FHIR patients
+type Report struct {
+	Generated time.Time         `json:"generated"`
+	Studies   int               `json:"studies"`
+	Patients  int               `json:"patients"`
+	Counts    map[IssueType]int `json:"counts"`
+	Issues    []Issue           `json:"issues"`
+}
+
+// ReconcileWithREDCap pulls the studies from REDCap and reconciles them with the patients on the FHIR server
+func ReconcileWithREDCap(fhirEndpoint string, redcapEndpoint string, redcapToken string, model ModelConfig) (*Report, error) {
+	studies, err := GetREDCapData(redcapEndpoint, redcapToken)
+	if err != nil {
+		return nil, err
+	}
+	return Reconcile(fhirEndpoint, studies, model)
+}
+
+// Reconcile compares the studies with the patients and the model's risk assessments on the FHIR server, reporting
+// studies that don't match exactly one patient (by identifier, as PostRiskAssessments does), patients that don't match
+// a study, studies without any complete records, and patients whose risk assessments are missing or older than their
+// study's complete records.  Issues are sorted by type and then by study ID or patient ID.
+func Reconcile(fhirEndpoint string, studies models.StudyMap, model ModelConfig) (*Report, error) {
+	patientsByIdentifier := make(map[string][]string)
+	var patientIDs []string
+	err := ForEachBundle(fhirEndpoint+"/Patient", func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			if patient, ok := entry.Resource.(*fhir.Patient); ok {
+				patientIDs = append(patientIDs, patient.Id)
+				seen := make(map[string]bool)
+				for _, identifier := range patient.Identifier {
+					if identifier.Value != "" && !seen[identifier.Value] {
+						seen[identifier.Value] = true
+						patientsByIdentifier[identifier.Value] = append(patientsByIdentifier[identifier.Value], patient.Id)
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	assessments, err := getRiskAssessmentSummaries(fhirEndpoint, model)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Generated: time.Now(),
+		Studies:   len(studies),
+		Patients:  len(patientIDs),
+		Counts:    make(map[IssueType]int),
+	}
+	addIssue := func(issue Issue) {
+		report.Issues = append(report.Issues, issue)
+		report.Counts[issue.Type]++
+	}
+
+	matchedPatients := make(map[string]bool)
+	for studyID, study := range studies {
+		matches := patientsByIdentifier[studyID]
+		for _, id := range matches {
+			matchedPatients[id] = true
+		}
+		results := study.ToRiskServiceCalculationResults("", nil)
+		if len(results) == 0 {
+			addIssue(Issue{
+				Type:           IncompleteStudy,
+				StudyID:        studyID,
+				FHIRPatientIDs: matches,
+				Detail:         fmt.Sprintf("None of the study's %d records have complete risk factors", len(study.Records)),
+			})
+		}
+		switch {
+		case len(matches) == 0:
+			addIssue(Issue{
+				Type:    UnmatchedStudy,
+				StudyID: studyID,
+				Detail:  fmt.Sprintf("Couldn't find patient with Study ID %s", studyID),
+			})
+		case len(matches) > 1:
+			addIssue(Issue{
+				Type:           AmbiguousStudy,
+				StudyID:        studyID,
+				FHIRPatientIDs: matches,
+				Detail:         fmt.Sprintf("Found too many patients (%d) with Study ID %s", len(matches), studyID),
+			})
+		case len(results) > 0:
+			redcapDate := dateString(models.ToFHIRDateTime(results[len(results)-1].AsOf, fhir.Timestamp))
+			summary := assessments[matches[0]]
+			var detail string
+			if summary.Count == 0 {
+				detail = fmt.Sprintf("Patient has no risk assessments, but REDCap has %d complete records", len(results))
+			} else if summary.Latest < redcapDate {
+				detail = fmt.Sprintf("Patient's latest risk assessment is from %s, but REDCap has a complete record from %s", summary.Latest, redcapDate)
+			} else if summary.Count < len(results) {
+				detail = fmt.Sprintf("Patient has %d risk assessments, but REDCap has %d complete records", summary.Count, len(results))
+			}
+			if detail != "" {
+				addIssue(Issue{
+					Type:               StaleRiskAssessments,
+					StudyID:            studyID,
+					FHIRPatientIDs:     matches,
+					REDCapDate:         redcapDate,
+					RiskAssessmentDate: summary.Latest,
+					Detail:             detail,
+				})
+			}
+		}
+	}
+
+	for _, id := range patientIDs {
+		if !matchedPatients[id] {
+			addIssue(Issue{
+				Type:           PatientWithoutStudy,
+				FHIRPatientIDs: []string{id},
+				Detail:         fmt.Sprintf("None of patient %s's identifiers match a Study ID", id),
+			})
+		}
+	}
+
+	sort.Stable(byIssueTypeAndID(report.Issues))
+	return report, nil
+}
+
+// riskAssessmentSummary summarizes a patient's risk assessments: the number of them, and the date of the latest one
+type riskAssessmentSummary struct {
+	Count  int
+	Latest string
+}
+
+// getRiskAssessmentSummaries queries the FHIR server for the model's risk assessments, summarizing them by patient ID
+func getRiskAssessmentSummaries(fhirEndpoint string, model ModelConfig) (map[string]riskAssessmentSummary, error) {
+	params := url.Values{}
+	params.Set("method", fmt.Sprintf("%s|%s", model.Method.Coding[0].System, model.Method.Coding[0].Code))
+	summaries := make(map[string]riskAssessmentSummary)
+	err := ForEachBundle(fhirEndpoint+"/RiskAssessment?"+params.Encode(), func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			if ra, ok := entry.Resource.(*fhir.RiskAssessment); ok && ra.Subject != nil {
+				summary := summaries[ra.Subject.ReferencedID]
+				summary.Count++
+				if date := dateString(ra.Date); date > summary.Latest {
+					summary.Latest = date
+				}
+				summaries[ra.Subject.ReferencedID] = summary
+			}
+		}
+	})
+	return summaries, err
+}
+
+// ForEachBundle queries the FHIR server, calling the function with each page of the resulting bundle
+func ForEachBundle(query string, fn func(*fhir.Bundle)) error {
+	// Perform a loop to go through the pages of a bundle response
+	for query != "" {
+		r, err := http.NewRequest("GET", query, nil)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("Received HTTP %d %s from FHIR server when querying %s.", res.StatusCode, res.Status, query)
+		}
+		var bundle fhir.Bundle
+		err = json.NewDecoder(res.Body).Decode(&bundle)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		fn(&bundle)
+
+		query = ""
+		for _, link := range bundle.Link {
+			if link.Relation == "next" && link.Url != "" {
+				query = link.Url
+			}
+		}
+	}
+	return nil
+}
+
+// dateString returns the date (in YYYY-MM-DD format) of the FHIR date/time, interpreting timestamps in the clinical
+// timezone
+func dateString(dt *fhir.FHIRDateTime) string {
+	if dt == nil {
+		return ""
+	}
+	if dt.Precision == fhir.Timestamp {
+		return dt.Time.In(models.ClinicalLocation).Format("2006-01-02")
+	}
+	return dt.Time.Format("2006-01-02")
+}
+
+// csvHeader is the header row of the CSV reconciliation report
+var csvHeader = []string{"type", "studyID", "fhirPatientIDs", "redcapDate", "riskAssessmentDate", "detail"}
+
+// WriteCSV writes the report's issues as CSV, one row per issue.  Multiple patient IDs are separated by spaces.
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, issue := range r.Issues {
+		row := []string{string(issue.Type), issue.StudyID, strings.Join(issue.FHIRPatientIDs, " "), issue.REDCapDate, issue.RiskAssessmentDate, issue.Detail}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// issueTypeOrder is the order in which issue types are reported
+var issueTypeOrder = map[IssueType]int{
+	UnmatchedStudy:       0,
+	AmbiguousStudy:       1,
+	PatientWithoutStudy:  2,
+	StaleRiskAssessments: 3,
+	IncompleteStudy:      4,
+}
+
+type byIssueTypeAndID []Issue
+
+func (p byIssueTypeAndID) Len() int {
+	return len(p)
+}
+func (p byIssueTypeAndID) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+func (p byIssueTypeAndID) Less(i, j int) bool {
+	if p[i].Type != p[j].Type {
+		return issueTypeOrder[p[i].Type] < issueTypeOrder[p[j].Type]
+	}
+	if p[i].StudyID != p[j].StudyID {
+		return p[i].StudyID < p[j].StudyID
+	}
+	return strings.Join(p[i].FHIRPatientIDs, " ") < strings.Join(p[j].FHIRPatientIDs, " ")
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReconcileSuite(t *testing.T) {
+	suite.Run(t, new(ReconcileSuite))
+}
+
+type ReconcileSuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Studies    models.StudyMap
+}
+
+func reconcilePatient(id string, identifiers ...string) fhir.BundleEntryComponent {
+	patient := &fhir.Patient{}
+	patient.Id = id
+	for _, value := range identifiers {
+		patient.Identifier = append(patient.Identifier, fhir.Identifier{Value: value})
+	}
+	return fhir.BundleEntryComponent{Resource: patient}
+}
+
+func reconcileRiskAssessment(patientID string, date time.Time) fhir.BundleEntryComponent {
+	return fhir.BundleEntryComponent{Resource: &fhir.RiskAssessment{
+		Subject: &fhir.Reference{Reference: "Patient/" + patientID, ReferencedID: patientID, Type: "Patient"},
+		Date:    models.ToFHIRDateTime(date, fhir.Date),
+	}}
+}
+
+func (suite *ReconcileSuite) SetupTest() {
+	models.ClinicalLocation = time.UTC
+	day := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02", s)
+		return t
+	}
+
+	// The patients are split across two pages to check that paging is followed
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var bundle fhir.Bundle
+		switch {
+		case r.URL.Path == "/Patient" && r.URL.Query().Get("page") == "":
+			bundle.Entry = []fhir.BundleEntryComponent{
+				reconcilePatient("p1", "1"),
+				reconcilePatient("p2", "a", "a"),
+				reconcilePatient("p3", "dup"),
+			}
+			bundle.Link = []fhir.BundleLinkComponent{{Relation: "next", Url: server.URL + "/Patient?page=2"}}
+		case r.URL.Path == "/Patient":
+			bundle.Entry = []fhir.BundleEntryComponent{
+				reconcilePatient("p4", "dup"),
+				reconcilePatient("p5", "x"),
+				reconcilePatient("p6", "inc"),
+			}
+		case r.URL.Path == "/RiskAssessment":
+			suite.Assert().Equal("http://interventionengine.org/risk-assessments|MultiFactor", r.URL.Query().Get("method"))
+			bundle.Entry = []fhir.BundleEntryComponent{
+				reconcileRiskAssessment("p1", day("2015-12-07")),
+				reconcileRiskAssessment("p2", day("2016-02-21")),
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&bundle)
+	}))
+	suite.FHIRServer = server
+
+	suite.Studies = make(models.StudyMap)
+	records := []models.Record{
+		{StudyID: "1", RiskFactorDate: "2015-12-07", ClinicalRisk: "3", FunctionalRisk: "2", PsychosocialRisk: "1", UtilizationRisk: "3", PerceivedRisk: "3"},
+		{StudyID: "1", RiskFactorDate: "2016-04-01", ClinicalRisk: "3", FunctionalRisk: "2", PsychosocialRisk: "1", UtilizationRisk: "4", PerceivedRisk: "4"},
+		{StudyID: "a", RiskFactorDate: "2016-02-21", ClinicalRisk: "1", FunctionalRisk: "1", PsychosocialRisk: "2", UtilizationRisk: "1", PerceivedRisk: "2"},
+		{StudyID: "dup", RiskFactorDate: "2016-02-21", ClinicalRisk: "1", FunctionalRisk: "1", PsychosocialRisk: "2", UtilizationRisk: "1", PerceivedRisk: "2"},
+		{StudyID: "missing", RiskFactorDate: "2016-02-21", ClinicalRisk: "1", FunctionalRisk: "1", PsychosocialRisk: "2", UtilizationRisk: "1", PerceivedRisk: "2"},
+		{StudyID: "inc", RiskFactorDate: "2016-02-21", ClinicalRisk: "1"},
+	}
+	suite.Require().NoError(suite.Studies.AddRecords(records))
+}
+
+func (suite *ReconcileSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+	models.ClinicalLocation = time.Local
+}
+
+func (suite *ReconcileSuite) TestReconcile() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	report, err := Reconcile(suite.FHIRServer.URL, suite.Studies, NewREDCapModelConfig(nil))
+	require.NoError(err)
+	assert.Equal(5, report.Studies)
+	assert.Equal(6, report.Patients)
+	assert.Equal(map[IssueType]int{
+		UnmatchedStudy:       1,
+		AmbiguousStudy:       1,
+		PatientWithoutStudy:  1,
+		StaleRiskAssessments: 1,
+		IncompleteStudy:      1,
+	}, report.Counts)
+
+	require.Len(report.Issues, 5)
+	assert.Equal(Issue{Type: UnmatchedStudy, StudyID: "missing", Detail: "Couldn't find patient with Study ID missing"}, report.Issues[0])
+	assert.Equal(AmbiguousStudy, report.Issues[1].Type)
+	assert.Equal("dup", report.Issues[1].StudyID)
+	assert.Equal([]string{"p3", "p4"}, report.Issues[1].FHIRPatientIDs)
+	assert.Equal(PatientWithoutStudy, report.Issues[2].Type)
+	assert.Equal([]string{"p5"}, report.Issues[2].FHIRPatientIDs)
+	assert.Equal(Issue{
+		Type:               StaleRiskAssessments,
+		StudyID:            "1",
+		FHIRPatientIDs:     []string{"p1"},
+		REDCapDate:         "2016-04-01",
+		RiskAssessmentDate: "2015-12-07",
+		Detail:             "Patient's latest risk assessment is from 2015-12-07, but REDCap has a complete record from 2016-04-01",
+	}, report.Issues[3])
+	assert.Equal(IncompleteStudy, report.Issues[4].Type)
+	assert.Equal("inc", report.Issues[4].StudyID)
+	assert.Equal([]string{"p6"}, report.Issues[4].FHIRPatientIDs)
+}
+
+func (suite *ReconcileSuite) TestReportWriteCSV() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	report, err := Reconcile(suite.FHIRServer.URL, suite.Studies, NewREDCapModelConfig(nil))
+	require.NoError(err)
+	var buf bytes.Buffer
+	require.NoError(report.WriteCSV(&buf))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(err)
+	require.Len(rows, 6)
+	assert.Equal([]string{"type", "studyID", "fhirPatientIDs", "redcapDate", "riskAssessmentDate", "detail"}, rows[0])
+	assert.Equal([]string{"ambiguous-study", "dup", "p3 p4", "", "", "Found too many patients (2) with Study ID dup"}, rows[2])
+}
+
+func (suite *ReconcileSuite) TestReconcileFHIRError() {
+	_, err := Reconcile(suite.FHIRServer.URL+"/unknown", suite.Studies, NewREDCapModelConfig(nil))
+	suite.Assert().Error(err)
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// UpdateRiskAssessmentsAndPies removes existing risk assessments from the FHIR server and replaces them with new ones,
+// recording the model's aggregation strategy on each new risk assessment, and the precision of its result's date and its
+// result's basis.  It also replaces the patient's pies in the pie store.
+func UpdateRiskAssessmentsAndPies(fhirEndpoint string, patientID string, results []models.Result, pieStore store.PieStore, basisPieURL string, model ModelConfig) error {
+	// Build up the bundle with risk assessments to delete and add
+	raBundle := buildRiskAssessmentBundle(patientID, results, basisPieURL, model)
+
+	// Submit the risk assessment bundle
+	data, err := json.Marshal(raBundle)
+	if err != nil {
+		return err
+	}
+	response, err := http.Post(fhirEndpoint, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Risk assessments did not post properly.  Received response code: %d", response.StatusCode)
+	}
+
+	// Replace the old pies with the new pies, storing their method (to identify by patient and method) and as-of date
+	pies := make([]models.StoredPie, len(results))
+	for i := range results {
+		pies[i] = *models.NewStoredPie(&results[i].RiskServiceCalculationResult, model.Method)
+	}
+	return pieStore.Replace(fhirEndpoint+"/Patient/"+patientID, model.Method.Coding[0], pies)
+}
+
+// GetRiskServiceCalculationResults reconstructs the patient's risk assessment results for the model from the stored
+// pies, returning them sorted by their as-of date.
+func GetRiskServiceCalculationResults(fhirEndpoint string, patientID string, pieStore store.PieStore, model ModelConfig) ([]plugin.RiskServiceCalculationResult, error) {
+	pies, err := pieStore.Find(fhirEndpoint+"/Patient/"+patientID, model.Method.Coding[0])
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]plugin.RiskServiceCalculationResult, len(pies))
+	for i := range pies {
+		results[i] = pies[i].ToRiskServiceCalculationResult(model.Aggregation)
+	}
+	plugin.SortResultsByAsOfDate(results)
+	return results, nil
+}
+
+func buildRiskAssessmentBundle(patientID string, results []models.Result, basisPieURL string, model ModelConfig) *fhir.Bundle {
+	raBundle := &fhir.Bundle{}
+	raBundle.Type = "transaction"
+	raBundle.Entry = make([]fhir.BundleEntryComponent, len(results)+1)
+	raBundle.Entry[0].Request = &fhir.BundleEntryRequestComponent{
+		Method: "DELETE",
+		Url:    getRiskAssessmentDeleteURL(model.Method, patientID),
+	}
+	for i := range results {
+		raBundle.Entry[i+1].Request = &fhir.BundleEntryRequestComponent{
+			Method: "POST",
+			Url:    "RiskAssessment",
+		}
+		ra := results[i].ToRiskAssessment(patientID, basisPieURL, model.RiskServicePluginConfig)
+		ra.Date = models.ToFHIRDateTime(results[i].AsOf, results[i].AsOfPrecision())
+		ra.Basis = append(ra.Basis, results[i].Basis...)
+		if model.Aggregation != nil {
+			ra.Extension = append(ra.Extension, fhir.Extension{
+				Url:         AggregationExtensionURL,
+				ValueString: model.Aggregation.Name(),
+			})
+		}
+		if (i + 1) == len(results) {
+			ra.Meta = &fhir.Meta{
+				Tag: []fhir.Coding{{System: "http://interventionengine.org/tags/", Code: "MOST_RECENT"}},
+			}
+			trajectory := models.ComputeTrajectory(models.CalculationResults(results), model.Trajectory)
+			ra.Extension = append(ra.Extension, trajectoryExtensions(trajectory)...)
+		}
+		raBundle.Entry[i+1].Resource = ra
+	}
+	return raBundle
+}
+
+// trajectoryExtensions converts the trajectory to a flat list of extensions, with one extension per metric for the
+// overall trend and for each slice trend
+func trajectoryExtensions(trajectory *models.Trajectory) []fhir.Extension {
+	if trajectory == nil {
+		return nil
+	}
+	extensions := trendExtensions("overall", trajectory.Overall)
+	for _, trend := range trajectory.Slices {
+		extensions = append(extensions, trendExtensions(slug(trend.Name), trend)...)
+	}
+	return extensions
+}
+
+func trendExtensions(name string, trend models.Trend) []fhir.Extension {
+	base := TrajectoryExtensionURL + "/" + name + "/"
+	daysAtHighRisk := trend.DaysAtHighRisk
+	escalations := int32(trend.Escalations)
+	extensions := []fhir.Extension{
+		{Url: base + "days-at-high-risk", ValueDecimal: &daysAtHighRisk},
+		{Url: base + "escalations", ValueInteger: &escalations},
+	}
+	if trend.ChangeSincePrevious != nil {
+		change := *trend.ChangeSincePrevious
+		extensions = append(extensions, fhir.Extension{Url: base + "change-since-previous", ValueDecimal: &change})
+	}
+	if trend.SlopePerMonth != nil {
+		slope := *trend.SlopePerMonth
+		extensions = append(extensions, fhir.Extension{Url: base + "slope-per-month", ValueDecimal: &slope})
+	}
+	return extensions
+}
+
+// slug converts a slice name to a lowercase, hyphenated form suitable for use in a URL (e.g., "Clinical Risk"
+// becomes "clinical-risk")
+func slug(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, "-")
+}
+
+// getRiskAssessmentDeleteURL constructs the URL to use for identifying all risk assessments for a given patient
+// using a given method.  This is used to delete the old set of assessments before adding the new set.
+func getRiskAssessmentDeleteURL(concept fhir.CodeableConcept, patientID string) string {
+	params := url.Values{}
+	params.Set("method", fmt.Sprintf("%s|%s", concept.Coding[0].System, concept.Coding[0].Code))
+	params.Set("patient", patientID)
+	return fmt.Sprintf("RiskAssessment?%s", params.Encode())
+}
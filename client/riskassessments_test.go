@@ -0,0 +1,147 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRiskAssessmentsSuite(t *testing.T) {
+	suite.Run(t, new(RiskAssessmentsSuite))
+}
+
+type RiskAssessmentsSuite struct {
+	suite.Suite
+	Results []models.Result
+}
+
+func (suite *RiskAssessmentsSuite) SetupTest() {
+	require := suite.Require()
+
+	records := []models.Record{
+		{StudyID: "1", RiskFactorDate: "2015-12-07", ClinicalRisk: "3", FunctionalRisk: "2", PsychosocialRisk: "1", UtilizationRisk: "3", PerceivedRisk: "3"},
+		{StudyID: "1", RiskFactorDate: "2016-04-01", ClinicalRisk: "3", FunctionalRisk: "2", PsychosocialRisk: "1", UtilizationRisk: "4", PerceivedRisk: "4"},
+	}
+	study := new(models.Study)
+	for i := range records {
+		require.NoError(study.AddRecord(records[i]))
+	}
+	suite.Results = study.ToResults("http://fhir/Patient/1", models.WeightedSumAggregation{})
+	require.Len(suite.Results, 2)
+}
+
+func (suite *RiskAssessmentsSuite) TestBuildRiskAssessmentBundle() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	model := NewREDCapModelConfig(models.WeightedSumAggregation{})
+	bundle := buildRiskAssessmentBundle("1", suite.Results, "http://risk/pies", model)
+	require.Len(bundle.Entry, 3)
+	assert.Equal("transaction", bundle.Type)
+	assert.Equal("DELETE", bundle.Entry[0].Request.Method)
+	assert.Equal("RiskAssessment?method=http%3A%2F%2Finterventionengine.org%2Frisk-assessments%7CMultiFactor&patient=1", bundle.Entry[0].Request.Url)
+
+	for i, entry := range bundle.Entry[1:] {
+		assert.Equal("POST", entry.Request.Method)
+		ra, ok := entry.Resource.(*fhir.RiskAssessment)
+		require.True(ok)
+		assert.Equal("Patient/1", ra.Subject.Reference)
+		assert.Equal(float64(*suite.Results[i].Score), *ra.Prediction[0].ProbabilityDecimal)
+		require.NotEmpty(ra.Extension)
+		assert.Equal(AggregationExtensionURL, ra.Extension[0].Url)
+		assert.Equal("weighted-sum", ra.Extension[0].ValueString)
+	}
+
+	first := bundle.Entry[1].Resource.(*fhir.RiskAssessment)
+	assert.True(first.Date.Time.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, time.Local)))
+	assert.Equal(fhir.Precision(fhir.Date), first.Date.Precision)
+	assert.Nil(first.Meta)
+	assert.Len(first.Extension, 1)
+	last := bundle.Entry[2].Resource.(*fhir.RiskAssessment)
+	require.NotNil(last.Meta)
+	assert.Equal("MOST_RECENT", last.Meta.Tag[0].Code)
+}
+
+func (suite *RiskAssessmentsSuite) TestBuildRiskAssessmentBundleWithTrajectory() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	model := NewREDCapModelConfig(models.WeightedSumAggregation{})
+	bundle := buildRiskAssessmentBundle("1", suite.Results, "http://risk/pies", model)
+	require.Len(bundle.Entry, 3)
+	last := bundle.Entry[2].Resource.(*fhir.RiskAssessment)
+
+	extensions := make(map[string]fhir.Extension)
+	for _, ext := range last.Extension {
+		extensions[ext.Url] = ext
+	}
+	// Weighted sum goes from 56 to 63
+	change, ok := extensions[TrajectoryExtensionURL+"/overall/change-since-previous"]
+	require.True(ok)
+	assert.Equal(float64(7), *change.ValueDecimal)
+	// ... which is below the weighted sum's high risk threshold, so it isn't an escalation
+	escalations, ok := extensions[TrajectoryExtensionURL+"/overall/escalations"]
+	require.True(ok)
+	assert.Equal(int32(0), *escalations.ValueInteger)
+	_, ok = extensions[TrajectoryExtensionURL+"/overall/slope-per-month"]
+	assert.True(ok)
+	_, ok = extensions[TrajectoryExtensionURL+"/overall/days-at-high-risk"]
+	assert.True(ok)
+
+	// Utilization risk went from 3 to 4, so it was at high risk for the full period
+	days, ok := extensions[TrajectoryExtensionURL+"/utilization-risk/days-at-high-risk"]
+	require.True(ok)
+	assert.InDelta(116, *days.ValueDecimal, 1)
+	change, ok = extensions[TrajectoryExtensionURL+"/psychosocial-and-mental-health-risk/change-since-previous"]
+	require.True(ok)
+	assert.Equal(float64(0), *change.ValueDecimal)
+}
+
+func (suite *RiskAssessmentsSuite) TestSlug() {
+	assert := suite.Assert()
+	assert.Equal("clinical-risk", slug("Clinical Risk"))
+	assert.Equal("functional-and-environmental-risk", slug("Functional and Environmental Risk"))
+	assert.Equal("bmi", slug(" BMI! "))
+}
+
+func (suite *RiskAssessmentsSuite) TestBuildRiskAssessmentBundleWithMidnightDateTime() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// A REDCap datetime at midnight is still a timestamp
+	study := new(models.Study)
+	require.NoError(study.AddRecord(models.Record{StudyID: "1", RiskFactorDate: "2016-04-01 00:00", ClinicalRisk: "3", FunctionalRisk: "2", PsychosocialRisk: "1", UtilizationRisk: "4", PerceivedRisk: "4"}))
+	bundle := buildRiskAssessmentBundle("1", study.ToResults("http://fhir/Patient/1", nil), "http://risk/pies", NewREDCapModelConfig(nil))
+	require.Len(bundle.Entry, 2)
+	ra := bundle.Entry[1].Resource.(*fhir.RiskAssessment)
+	assert.Equal(fhir.Precision(fhir.Timestamp), ra.Date.Precision)
+
+	// Without details, dates are timestamps
+	results := models.NewResults(models.CalculationResults(suite.Results))
+	bundle = buildRiskAssessmentBundle("1", results, "http://risk/pies", NewREDCapModelConfig(nil))
+	ra = bundle.Entry[1].Resource.(*fhir.RiskAssessment)
+	assert.Equal(fhir.Precision(fhir.Timestamp), ra.Date.Precision)
+}
+
+func (suite *RiskAssessmentsSuite) TestBuildRiskAssessmentBundleWithBasis() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Results[1].Basis = []fhir.Reference{{Reference: "Observation/1"}}
+	bundle := buildRiskAssessmentBundle("1", suite.Results, "http://risk/pies", NewREDCapModelConfig(nil))
+	require.Len(bundle.Entry, 3)
+
+	// The result's basis follows the pie
+	first := bundle.Entry[1].Resource.(*fhir.RiskAssessment)
+	require.Len(first.Basis, 1)
+	assert.Equal("http://risk/pies/"+suite.Results[0].Pie.Id.Hex(), first.Basis[0].Reference)
+	last := bundle.Entry[2].Resource.(*fhir.RiskAssessment)
+	require.Len(last.Basis, 2)
+	assert.Equal("http://risk/pies/"+suite.Results[1].Pie.Id.Hex(), last.Basis[0].Reference)
+	assert.Equal("Observation/1", last.Basis[1].Reference)
+}
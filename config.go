@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// runConfig runs the config subcommand named by the first argument.  The only subcommand is validate.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: multifactorriskservice config validate [flags]")
+		return 2
+	}
+	return runConfigValidate(args[1:])
+}
+
+// runConfigValidate checks the serve command's configuration from its flags, the environment and the configuration
+// file, without connecting to any servers.  The settings are printed along with where each came from, with secrets
+// redacted.
+func runConfigValidate(args []string) int {
+	s := newServeSettings("Checks the serve command's configuration from the flags, environment and configuration file, without connecting to REDCap or the FHIR server.")
+	fs := s.loader.FlagSet
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: multifactorriskservice config validate [flags]\n\nChecks the serve command's configuration without connecting to REDCap or the FHIR server.  Accepts the flags of the serve command.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := s.loader.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, "Configuration is invalid.")
+		return 1
+	}
+
+	if file := s.loader.ConfigFile(); file != "" {
+		fmt.Printf("Configuration file: %s\n\n", file)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, setting := range s.loader.Settings() {
+		value := fmt.Sprintf("%q", setting.Value)
+		if setting.Secret && setting.Value != "" {
+			value = "(redacted)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Name, value, setting.Source)
+	}
+	w.Flush()
+	fmt.Println("\nConfiguration is valid.")
+	return 0
+}
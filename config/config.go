@@ -0,0 +1,348 @@
+// Package config loads the configuration shared by the multifactorriskservice commands.  Each value may be passed in
+// as a command-line flag, falling back to an environment variable, falling back to a configuration file, falling back
+// to a default.  Secrets may also be read from files, so that they don't show up in the process list.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConfigEnvVar is the environment variable indicating the configuration file, if the -config flag isn't passed
+const ConfigEnvVar = "RISKSERVICE_CONFIG"
+
+// Loader loads configuration values from a command's flags, the environment and a configuration file
+type Loader struct {
+	FlagSet  *flag.FlagSet
+	command  string
+	values   []*value
+	file     *string
+	flagged  map[string]string
+	getenv   func(string) string
+	readFile func(string) ([]byte, error)
+}
+
+type value struct {
+	name       string
+	envVar     string
+	defaultVal string
+	required   bool
+	secretFile *string
+	check      func(string) error
+	val        *string
+	source     string
+}
+
+// Setting describes the value of a configuration setting and where it came from
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+	Secret bool
+}
+
+// NewLoader returns a Loader for the named command.  Errors in parsing the flags are reported to the output along
+// with the command's usage.  The command's section of the configuration file overrides the file's top-level values.
+func NewLoader(command string, output io.Writer) *Loader {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(output)
+	l := &Loader{FlagSet: fs, command: command, getenv: os.Getenv, readFile: ioutil.ReadFile}
+	l.file = fs.String("config", "", fmt.Sprintf("Configuration file (env: %s)", ConfigEnvVar))
+	return l
+}
+
+// String defines a configuration value with the given flag name, environment variable, default value and usage.  The
+// returned string is populated when Parse is called.
+func (l *Loader) String(name, envVar, defaultVal, usage string) *string {
+	if defaultVal != "" {
+		usage = fmt.Sprintf("%s (env: %s, default: %q)", usage, envVar, defaultVal)
+	} else {
+		usage = fmt.Sprintf("%s (env: %s)", usage, envVar)
+	}
+	v := &value{name: name, envVar: envVar, defaultVal: defaultVal, val: l.FlagSet.String(name, "", usage)}
+	l.values = append(l.values, v)
+	return v.val
+}
+
+// Required defines a configuration value that has no default, and so must be passed in as a flag, environment
+// variable or configuration file value
+func (l *Loader) Required(name, envVar, usage string) *string {
+	usage = fmt.Sprintf("%s (required, env: %s)", usage, envVar)
+	v := &value{name: name, envVar: envVar, required: true, val: l.FlagSet.String(name, "", usage)}
+	l.values = append(l.values, v)
+	return v.val
+}
+
+// Secret marks the named configuration value as a secret.  In addition to the usual sources, a secret may be read
+// from the file indicated by the -<name>-file flag, the <envVar>_FILE environment variable, or the <name>-file key of
+// the configuration file.  Secrets are redacted from the Settings.
+func (l *Loader) Secret(name string) {
+	v := l.lookup(name)
+	usage := fmt.Sprintf("File containing the -%s value, which keeps it out of the process list (env: %s_FILE)", name, v.envVar)
+	v.secretFile = l.FlagSet.String(name+"-file", "", usage)
+}
+
+// Check sets the function used to validate the named configuration value when it is parsed or reloaded
+func (l *Loader) Check(name string, check func(string) error) {
+	l.lookup(name).check = check
+}
+
+// Bool defines a boolean flag.  Boolean flags are not read from the environment or the configuration file.
+func (l *Loader) Bool(name, usage string) *bool {
+	return l.FlagSet.Bool(name, false, usage)
+}
+
+func (l *Loader) lookup(name string) *value {
+	for _, v := range l.values {
+		if v.name == name {
+			return v
+		}
+	}
+	panic("config: no configuration value named " + name)
+}
+
+// Parse parses the arguments, filling in each value that wasn't passed in as a flag from its environment variable,
+// the configuration file, or its default value.  An error is returned if the arguments or configuration file can't be
+// parsed, a required value is missing, or a value fails its check.
+func (l *Loader) Parse(args []string) error {
+	*l.file = ""
+	for _, v := range l.values {
+		*v.val = ""
+		if v.secretFile != nil {
+			*v.secretFile = ""
+		}
+	}
+	if err := l.FlagSet.Parse(args); err != nil {
+		return err
+	}
+	l.flagged = make(map[string]string)
+	for _, v := range l.values {
+		l.flagged[v.name] = *v.val
+	}
+	settings, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	for _, v := range l.values {
+		*v.val, v.source = settings[v.name].Value, settings[v.name].Source
+	}
+	return nil
+}
+
+// Reload re-reads the environment and configuration file (flags can't change), updating the reloadable values that
+// have changed.  It returns the names of the reloadable values that were updated and of the other values that have
+// changed but were left as-is, since they can only be changed by restarting.  If the configuration is invalid,
+// nothing is updated.  Reload must not be called while other goroutines read the reloadable values.
+func (l *Loader) Reload(reloadable ...string) (updated, ignored []string, err error) {
+	settings, err := l.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range l.values {
+		s := settings[v.name]
+		switch {
+		case s.Value == *v.val:
+			v.source = s.Source
+		case contains(reloadable, v.name):
+			*v.val, v.source = s.Value, s.Source
+			updated = append(updated, v.name)
+		default:
+			ignored = append(ignored, v.name)
+		}
+	}
+	return updated, ignored, nil
+}
+
+// Settings returns the parsed configuration values, in the order they were defined
+func (l *Loader) Settings() []Setting {
+	settings := make([]Setting, len(l.values))
+	for i, v := range l.values {
+		settings[i] = Setting{Name: v.name, Value: *v.val, Source: v.source, Secret: v.secretFile != nil}
+	}
+	return settings
+}
+
+// ConfigFile returns the path of the configuration file, or "" if there isn't one
+func (l *Loader) ConfigFile() string {
+	if *l.file != "" {
+		return *l.file
+	}
+	return l.getenv(ConfigEnvVar)
+}
+
+// resolve determines the setting for each value from its sources, checking it
+func (l *Loader) resolve() (map[string]Setting, error) {
+	file, err := l.loadFile()
+	if err != nil {
+		return nil, err
+	}
+	var missing, problems []string
+	settings := make(map[string]Setting)
+	for _, v := range l.values {
+		s, err := l.resolveValue(v, file)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if s.Value == "" && v.required {
+			missing = append(missing, fmt.Sprintf("-%s (or %s)", v.name, v.envVar))
+			continue
+		}
+		if v.check != nil {
+			if err := v.check(s.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid -%s from %s: %s", v.name, s.Source, err.Error()))
+				continue
+			}
+		}
+		settings[v.name] = s
+	}
+	if file != nil {
+		problems = append(problems, l.unknownKeys(file)...)
+	}
+	if len(missing) > 0 {
+		problems = append([]string{"Missing required configuration: " + strings.Join(missing, ", ")}, problems...)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return settings, nil
+}
+
+// resolveValue determines the setting for the value from the first source that has it: the flag, the environment,
+// the configuration file, or the default
+func (l *Loader) resolveValue(v *value, file *File) (Setting, error) {
+	s := Setting{Name: v.name, Secret: v.secretFile != nil}
+	secret := func(path, source string) (Setting, error) {
+		data, err := l.readFile(path)
+		if err != nil {
+			return s, fmt.Errorf("Can't read -%s from %s: %s", v.name, source, err.Error())
+		}
+		s.Value, s.Source = strings.TrimSpace(string(data)), source+" ("+path+")"
+		if s.Value == "" {
+			return s, fmt.Errorf("Can't read -%s from %s: the file is empty", v.name, source)
+		}
+		return s, nil
+	}
+
+	if val := l.flagged[v.name]; val != "" {
+		s.Value, s.Source = val, "flag -"+v.name
+		return s, nil
+	}
+	if v.secretFile != nil && *v.secretFile != "" {
+		return secret(*v.secretFile, "flag -"+v.name+"-file")
+	}
+	if val := l.getenv(v.envVar); val != "" {
+		s.Value, s.Source = val, "env "+v.envVar
+		return s, nil
+	}
+	if v.secretFile != nil {
+		if path := l.getenv(v.envVar + "_FILE"); path != "" {
+			return secret(path, "env "+v.envVar+"_FILE")
+		}
+	}
+	if file != nil {
+		if val, ok := file.Lookup(l.command, v.name); ok {
+			s.Value, s.Source = val, "config "+file.Path
+			return s, nil
+		}
+		if v.secretFile != nil {
+			if path, ok := file.Lookup(l.command, v.name+"-file"); ok {
+				// Relative paths are relative to the configuration file, not the working directory
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(file.Path), path)
+				}
+				return secret(path, "config "+file.Path)
+			}
+		}
+	}
+	s.Value, s.Source = v.defaultVal, "default"
+	return s, nil
+}
+
+// loadFile reads and parses the configuration file, returning nil if there isn't one
+func (l *Loader) loadFile() (*File, error) {
+	path := l.ConfigFile()
+	if path == "" {
+		return nil, nil
+	}
+	data, err := l.readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read configuration file: %s", err.Error())
+	}
+	return ParseFile(path, data)
+}
+
+// unknownKeys reports the keys in the command's section of the configuration file that aren't configuration values
+// of the command.  Top-level keys aren't reported, since they may be meant for other commands.
+func (l *Loader) unknownKeys(file *File) []string {
+	var problems []string
+	for key := range file.Sections[l.command] {
+		known := false
+		for _, v := range l.values {
+			if key == v.name || (v.secretFile != nil && key == v.name+"-file") {
+				known = true
+				break
+			}
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown setting %q for the %s command", file.Path, file.Line(l.command, key), key, l.command))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalURL returns the address as a URL with the given scheme, if it is only a port (e.g., ":3001"), assuming the
+// host is localhost.  Other addresses are returned as-is.
+func LocalURL(scheme, addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return scheme + "://localhost" + addr
+	}
+	return addr
+}
+
+// Endpoint returns the address the HTTP service listening on the given address can be reached at, discovering the
+// host's IP address if the address is only a port
+func Endpoint(httpa string) string {
+	if strings.HasPrefix(httpa, ":") {
+		return DiscoverSelf() + httpa
+	}
+	return httpa
+}
+
+// DiscoverSelf returns the host's first non-loopback IPv4 address, falling back to localhost
+func DiscoverSelf() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("Unable to determine IP address.  Defaulting to localhost.")
+		return "localhost"
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+
+	log.Println("Unable to determine IP address.  Defaulting to localhost.")
+	return "localhost"
+}
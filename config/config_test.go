@@ -0,0 +1,236 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestLoaderSuite(t *testing.T) {
+	suite.Run(t, new(LoaderSuite))
+}
+
+type LoaderSuite struct {
+	suite.Suite
+	Output *bytes.Buffer
+	Loader *Loader
+	Env    map[string]string
+	Files  map[string]string
+}
+
+func (suite *LoaderSuite) SetupTest() {
+	suite.Output = new(bytes.Buffer)
+	suite.Loader = NewLoader("test", suite.Output)
+	suite.Env = make(map[string]string)
+	suite.Loader.getenv = func(name string) string {
+		return suite.Env[name]
+	}
+	suite.Files = make(map[string]string)
+	suite.Loader.readFile = func(path string) ([]byte, error) {
+		data, ok := suite.Files[path]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", path)
+		}
+		return []byte(data), nil
+	}
+}
+
+func (suite *LoaderSuite) TestPrefersFlagThenEnvThenDefault() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	flagged := suite.Loader.String("flagged", "FLAGGED", "default", "Flagged value")
+	env := suite.Loader.String("env", "ENV", "default", "Env value")
+	defaulted := suite.Loader.String("defaulted", "DEFAULTED", "default", "Defaulted value")
+	empty := suite.Loader.String("empty", "EMPTY", "", "Empty value")
+	suite.Env["FLAGGED"] = "from env"
+	suite.Env["ENV"] = "from env"
+
+	require.NoError(suite.Loader.Parse([]string{"-flagged", "from flag", "arg"}))
+	assert.Equal("from flag", *flagged)
+	assert.Equal("from env", *env)
+	assert.Equal("default", *defaulted)
+	assert.Equal("", *empty)
+	assert.Equal([]string{"arg"}, suite.Loader.FlagSet.Args())
+}
+
+func (suite *LoaderSuite) TestRequired() {
+	assert := suite.Assert()
+
+	token := suite.Loader.Required("token", "TOKEN", "API token")
+	err := suite.Loader.Parse(nil)
+	assert.EqualError(err, "Missing required configuration: -token (or TOKEN)")
+
+	suite.Env["TOKEN"] = "123"
+	assert.NoError(suite.Loader.Parse(nil))
+	assert.Equal("123", *token)
+}
+
+func (suite *LoaderSuite) TestUsage() {
+	assert := suite.Assert()
+
+	suite.Loader.String("http", "HTTP_HOST_AND_PORT", ":9000", "HTTP service address to listen on")
+	suite.Loader.Required("token", "TOKEN", "API token")
+	suite.Loader.FlagSet.PrintDefaults()
+	assert.Contains(suite.Output.String(), `HTTP service address to listen on (env: HTTP_HOST_AND_PORT, default: ":9000")`)
+	assert.Contains(suite.Output.String(), "API token (required, env: TOKEN)")
+
+	assert.Error(suite.Loader.Parse([]string{"-unknown"}))
+}
+
+func (suite *LoaderSuite) TestConfigFile() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	flagged := suite.Loader.String("flagged", "FLAGGED", "default", "Flagged value")
+	env := suite.Loader.String("env", "ENV", "default", "Env value")
+	file := suite.Loader.String("file", "FILE", "default", "File value")
+	section := suite.Loader.String("section", "SECTION", "default", "Section value")
+	defaulted := suite.Loader.String("defaulted", "DEFAULTED", "default", "Defaulted value")
+	suite.Env["ENV"] = "from env"
+	suite.Env[ConfigEnvVar] = "/etc/riskservice.toml"
+	suite.Files["/etc/riskservice.toml"] = `
+flagged = "from file"
+env = "from file"
+file = "from file"
+section = "from file"
+other = "for another command"
+
+[test]
+section = "from section"
+`
+
+	require.NoError(suite.Loader.Parse([]string{"-flagged", "from flag"}))
+	assert.Equal("from flag", *flagged)
+	assert.Equal("from env", *env)
+	assert.Equal("from file", *file)
+	assert.Equal("from section", *section)
+	assert.Equal("default", *defaulted)
+	assert.Equal([]Setting{
+		{Name: "flagged", Value: "from flag", Source: "flag -flagged"},
+		{Name: "env", Value: "from env", Source: "env ENV"},
+		{Name: "file", Value: "from file", Source: "config /etc/riskservice.toml"},
+		{Name: "section", Value: "from section", Source: "config /etc/riskservice.toml"},
+		{Name: "defaulted", Value: "default", Source: "default"},
+	}, suite.Loader.Settings())
+}
+
+func (suite *LoaderSuite) TestConfigFileErrors() {
+	assert := suite.Assert()
+
+	suite.Loader.String("value", "VALUE", "", "Value")
+	assert.EqualError(suite.Loader.Parse([]string{"-config", "missing.toml"}), "Can't read configuration file: open missing.toml: no such file or directory")
+
+	suite.Files["riskservice.toml"] = "[test]\nvalue = \"ok\"\nvalu = \"typo\"\n"
+	assert.EqualError(suite.Loader.Parse([]string{"-config", "riskservice.toml"}), `riskservice.toml:3: unknown setting "valu" for the test command`)
+}
+
+func (suite *LoaderSuite) TestSecret() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	token := suite.Loader.Required("token", "TOKEN", "API token")
+	suite.Loader.Secret("token")
+	suite.Files["/run/secrets/token"] = "from flag file\n"
+	suite.Files["/run/secrets/env-token"] = "from env file"
+	suite.Files["/etc/riskservice/token"] = "from config file"
+	suite.Files["/etc/riskservice/riskservice.toml"] = `token-file = "token"`
+
+	require.NoError(suite.Loader.Parse([]string{"-token-file", "/run/secrets/token"}))
+	assert.Equal("from flag file", *token)
+	assert.Equal([]Setting{{Name: "token", Value: "from flag file", Source: "flag -token-file (/run/secrets/token)", Secret: true}}, suite.Loader.Settings())
+
+	suite.Env["TOKEN_FILE"] = "/run/secrets/env-token"
+	require.NoError(suite.Loader.Parse(nil))
+	assert.Equal("from env file", *token)
+
+	delete(suite.Env, "TOKEN_FILE")
+	require.NoError(suite.Loader.Parse([]string{"-config", "/etc/riskservice/riskservice.toml"}))
+	assert.Equal("from config file", *token)
+
+	suite.Files["/etc/riskservice/token"] = "  \n"
+	assert.EqualError(suite.Loader.Parse([]string{"-config", "/etc/riskservice/riskservice.toml"}), "Can't read -token from config /etc/riskservice/riskservice.toml: the file is empty")
+}
+
+func (suite *LoaderSuite) TestCheck() {
+	assert := suite.Assert()
+
+	suite.Loader.String("level", "LEVEL", "info", "Level")
+	suite.Loader.Check("level", func(s string) error {
+		if s != "info" && s != "debug" {
+			return errors.New("must be info or debug")
+		}
+		return nil
+	})
+	suite.Loader.Required("token", "TOKEN", "API token")
+	assert.NoError(suite.Loader.Parse([]string{"-token", "123"}))
+
+	suite.Env["LEVEL"] = "loud"
+	assert.EqualError(suite.Loader.Parse(nil), "Missing required configuration: -token (or TOKEN)\nInvalid -level from env LEVEL: must be info or debug")
+}
+
+func (suite *LoaderSuite) TestReload() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	cron := suite.Loader.String("cron", "CRON", "@daily", "Cron spec")
+	mongo := suite.Loader.String("mongo", "MONGO", "mongodb://localhost", "Mongo URL")
+	suite.Loader.Check("cron", func(s string) error {
+		if s == "" {
+			return errors.New("must not be empty")
+		}
+		return nil
+	})
+	suite.Files["riskservice.toml"] = `cron = "@hourly"`
+	require.NoError(suite.Loader.Parse([]string{"-config", "riskservice.toml"}))
+	assert.Equal("@hourly", *cron)
+
+	updated, ignored, err := suite.Loader.Reload("cron")
+	require.NoError(err)
+	assert.Empty(updated)
+	assert.Empty(ignored)
+
+	suite.Files["riskservice.toml"] = "cron = \"@weekly\"\nmongo = \"mongodb://mongo\""
+	updated, ignored, err = suite.Loader.Reload("cron")
+	require.NoError(err)
+	assert.Equal([]string{"cron"}, updated)
+	assert.Equal([]string{"mongo"}, ignored)
+	assert.Equal("@weekly", *cron)
+	assert.Equal("mongodb://localhost", *mongo)
+
+	suite.Files["riskservice.toml"] = `cron = ""`
+	_, _, err = suite.Loader.Reload("cron")
+	assert.EqualError(err, "Invalid -cron from config riskservice.toml: must not be empty")
+	assert.Equal("@weekly", *cron)
+}
+
+func (suite *LoaderSuite) TestLogLevel() {
+	assert := suite.Assert()
+	require := suite.Require()
+	defer SetLogLevel(LogInfo)
+
+	level, err := ParseLogLevel("DEBUG")
+	require.NoError(err)
+	assert.Equal(LogDebug, level)
+	_, err = ParseLogLevel("verbose")
+	assert.EqualError(err, `Invalid log level "verbose": must be one of debug, info, error`)
+
+	assert.True(Logging(LogInfo))
+	assert.False(Logging(LogDebug))
+	SetLogLevel(LogError)
+	assert.False(Logging(LogInfo))
+	assert.True(Logging(LogError))
+}
+
+func (suite *LoaderSuite) TestLocalURL() {
+	assert := suite.Assert()
+
+	assert.Equal("http://localhost:3001", LocalURL("http", ":3001"))
+	assert.Equal("mongodb://localhost:27017", LocalURL("mongodb", ":27017"))
+	assert.Equal("http://fhir:3001", LocalURL("http", "http://fhir:3001"))
+}
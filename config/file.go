@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// File holds the values in a configuration file.  Configuration files use a subset of TOML: each line is blank, a
+// comment starting with "#", a "[command]" section header, or a "key = value" pair.  Values may be quoted strings
+// (basic or literal), or bare numbers and booleans, which are kept as written.  Keys before the first section header
+// apply to every command; keys in a command's section apply only to that command, overriding the top-level values.
+type File struct {
+	Path     string
+	Values   map[string]string
+	Sections map[string]map[string]string
+	lines    map[string]int
+}
+
+// ParseFile parses the contents of the configuration file at the given path (which is only used in error messages)
+func ParseFile(path string, data []byte) (*File, error) {
+	f := &File{
+		Path:     path,
+		Values:   make(map[string]string),
+		Sections: make(map[string]map[string]string),
+		lines:    make(map[string]int),
+	}
+	values, section := f.Values, ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, f.errorf(n, "invalid section header %s", line)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if !isKey(section) {
+				return nil, f.errorf(n, "invalid section name %q", section)
+			}
+			if _, ok := f.Sections[section]; ok {
+				return nil, f.errorf(n, "duplicate section [%s]", section)
+			}
+			values = make(map[string]string)
+			f.Sections[section] = values
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, f.errorf(n, "expected key = value, got %s", line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !isKey(key) {
+			return nil, f.errorf(n, "invalid key %q", key)
+		}
+		if _, ok := values[key]; ok {
+			return nil, f.errorf(n, "duplicate key %q", key)
+		}
+		val, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, f.errorf(n, "invalid value for %q: %s", key, err.Error())
+		}
+		values[key] = val
+		f.lines[section+"."+key] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read configuration file %s: %s", path, err.Error())
+	}
+	return f, nil
+}
+
+// Lookup returns the value of the key for the given command, preferring the command's section over the top-level
+// values
+func (f *File) Lookup(command, key string) (string, bool) {
+	if val, ok := f.Sections[command][key]; ok {
+		return val, true
+	}
+	val, ok := f.Values[key]
+	return val, ok
+}
+
+// Line returns the line number the key was defined on in the given section ("" for the top-level values), or 0 if it
+// wasn't defined
+func (f *File) Line(section, key string) int {
+	return f.lines[section+"."+key]
+}
+
+func (f *File) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", f.Path, line, fmt.Sprintf(format, args...))
+}
+
+// parseValue parses a quoted string, or a bare number or boolean, optionally followed by a comment
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "" || isComment(s):
+		return "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) || !isComment(s[end+1:]) {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strconv.Unquote(s[:end+1])
+	case s[0] == '\'':
+		end := strings.Index(s[1:], "'")
+		if end < 0 || !isComment(s[end+2:]) {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : end+1], nil
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s != "true" && s != "false" {
+		if _, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err != nil {
+			return "", fmt.Errorf("strings must be quoted")
+		}
+	}
+	return s, nil
+}
+
+// isComment indicates if the remainder of a line is blank or a comment
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// isKey indicates if the string is a valid bare key: letters, digits, dashes and underscores
+func isKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestFileSuite(t *testing.T) {
+	suite.Run(t, new(FileSuite))
+}
+
+type FileSuite struct {
+	suite.Suite
+}
+
+func (suite *FileSuite) TestParseFile() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	f, err := ParseFile("riskservice.toml", []byte(`
+# Shared by every command
+fhir = "http://fhir:3001"   # trailing comment
+redcap = 'http://redcapsrv:80/api/'
+pie-retention-days = 30
+dev = true
+escaped = "a \"quoted\" # value"
+
+[serve]
+cron = "0 0 22 * * *"
+
+[mock]
+http = ":9001"
+`))
+	require.NoError(err)
+	assert.Equal(map[string]string{
+		"fhir":               "http://fhir:3001",
+		"redcap":             "http://redcapsrv:80/api/",
+		"pie-retention-days": "30",
+		"dev":                "true",
+		"escaped":            `a "quoted" # value`,
+	}, f.Values)
+	assert.Equal(map[string]string{"cron": "0 0 22 * * *"}, f.Sections["serve"])
+	assert.Equal(10, f.Line("serve", "cron"))
+
+	val, ok := f.Lookup("mock", "http")
+	assert.True(ok)
+	assert.Equal(":9001", val)
+	val, ok = f.Lookup("mock", "fhir")
+	assert.True(ok)
+	assert.Equal("http://fhir:3001", val)
+	_, ok = f.Lookup("serve", "http")
+	assert.False(ok)
+}
+
+func (suite *FileSuite) TestParseFileErrors() {
+	assert := suite.Assert()
+
+	for data, msg := range map[string]string{
+		"fhir":                     `f.toml:1: expected key = value, got fhir`,
+		"fhir = http://fhir:3001":  `f.toml:1: invalid value for "fhir": strings must be quoted`,
+		"fhir = \"http://fhir":     `f.toml:1: invalid value for "fhir": unterminated string "http://fhir`,
+		"fhir =":                   `f.toml:1: invalid value for "fhir": missing value`,
+		"a b = 1":                  `f.toml:1: invalid key "a b"`,
+		"a = 1\na = 2":             `f.toml:2: duplicate key "a"`,
+		"[serve\na = 1":            `f.toml:1: invalid section header [serve`,
+		"[serve]\n[serve]":         `f.toml:2: duplicate section [serve]`,
+		"[serve.http]":             `f.toml:1: invalid section name "serve.http"`,
+		"fhir = 'a' 'b'":           `f.toml:1: invalid value for "fhir": unterminated string 'a' 'b'`,
+		"\n\n# comment\nport = x1": `f.toml:4: invalid value for "port": strings must be quoted`,
+	} {
+		_, err := ParseFile("f.toml", []byte(data))
+		assert.EqualError(err, msg, data)
+	}
+}
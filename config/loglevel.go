@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the minimum importance of the messages that are logged
+type LogLevel int32
+
+// The log levels, from most to least verbose.  Errors are always logged.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "error"}
+
+// currentLogLevel is accessed atomically, since the log level may be changed while the service is running
+var currentLogLevel = int32(LogInfo)
+
+// ParseLogLevel parses the name of a log level: debug, info or error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("Invalid log level %q: must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func (l LogLevel) String() string {
+	if l >= 0 && int(l) < len(logLevelNames) {
+		return logLevelNames[l]
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// SetLogLevel sets the minimum importance of the messages that are logged
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+// Logging indicates if messages at the given level are logged
+func Logging(level LogLevel) bool {
+	return level >= LogLevel(atomic.LoadInt32(&currentLogLevel))
+}
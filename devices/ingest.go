@@ -0,0 +1,266 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// DefaultBatchSize is the default maximum number of observations written in each transaction bundle
+const DefaultBatchSize = 100
+
+// The statuses of ingested readings
+const (
+	// Created readings were written to the FHIR server
+	Created = "created"
+	// Duplicate readings were sent earlier in the same request, or were already on the FHIR server
+	Duplicate = "duplicate"
+	// Rejected readings are invalid, or weren't taken by a registered device, and won't be accepted if sent again
+	Rejected = "rejected"
+	// Failed readings couldn't be written to the FHIR server, and may be sent again
+	Failed = "failed"
+)
+
+// Ingester validates and deduplicates device readings, writing them to the FHIR server as Observations.  If the
+// ingester has a Resolver, each reading is attributed to the patient its device was assigned to at the reading's
+// timestamp; otherwise, it's attributed to the reading's patient, who must be the patient referenced by the Device (if
+// any).
+type Ingester struct {
+	FHIREndpoint string
+	BatchSize    int
+	Resolver     PatientResolver
+	now          func() time.Time
+}
+
+// NewIngester returns an Ingester that writes readings to the FHIR server in batches of DefaultBatchSize
+func NewIngester(fhirEndpoint string) *Ingester {
+	return &Ingester{FHIREndpoint: strings.TrimSuffix(fhirEndpoint, "/"), BatchSize: DefaultBatchSize, now: time.Now}
+}
+
+// ReadingResult is the outcome of ingesting a reading.  Index is the reading's position in the ingested readings.
+type ReadingResult struct {
+	Index       int
+	Status      string
+	Observation string
+	Error       error
+}
+
+// MarshalJSON handles the marshalling of the errors since Go doesn't
+func (r *ReadingResult) MarshalJSON() ([]byte, error) {
+	var errString string
+	if r.Error != nil {
+		errString = r.Error.Error()
+	}
+	return json.Marshal(&struct {
+		Index       int    `json:"index"`
+		Status      string `json:"status"`
+		Observation string `json:"observation,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}{
+		Index:       r.Index,
+		Status:      r.Status,
+		Observation: r.Observation,
+		Error:       errString,
+	})
+}
+
+// LogReadingResultSummary prints out a log of the reading result summary (# of readings with each status)
+func LogReadingResultSummary(results []ReadingResult) {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	log.Printf("Ingested %d device readings: %d created, %d duplicates, %d rejected, %d failed.",
+		len(results), counts[Created], counts[Duplicate], counts[Rejected], counts[Failed])
+}
+
+// Ingest validates the readings and writes the valid, distinct readings to the FHIR server, in transaction bundles
+// of up to BatchSize observations.  Each observation references the registered Device whose identifier matches the
+// reading's device ID; readings from unregistered devices, or for patients who aren't on the FHIR server, are rejected.
+// Readings already on the FHIR server (i.e., with the same device, measurement and timestamp) aren't duplicated.  If
+// the ingester has a Resolver, readings without a patient are updated with their resolved patient.
+func (i *Ingester) Ingest(readings []Reading) []ReadingResult {
+	results := make([]ReadingResult, len(readings))
+	devices := make(map[string]*fhir.Device)
+	patients := make(map[string]bool)
+	seen := make(map[string]bool)
+	var pending []int
+	for n := range readings {
+		r := &readings[n]
+		results[n] = i.check(r, devices, patients)
+		results[n].Index = n
+		if results[n].Status != "" {
+			continue
+		}
+		if seen[r.Key()] {
+			results[n].Status = Duplicate
+			continue
+		}
+		seen[r.Key()] = true
+		pending = append(pending, n)
+	}
+
+	for len(pending) > 0 {
+		batch := pending
+		if i.BatchSize > 0 && len(batch) > i.BatchSize {
+			batch = pending[:i.BatchSize]
+		}
+		pending = pending[len(batch):]
+		i.write(readings, batch, devices, results)
+	}
+	return results
+}
+
+// check validates the reading and looks up its device and patient (caching them by ID), returning a result with a
+// status if the reading can't be written, or a result without a status if it can.  Readings without a patient are
+// given the patient resolved by the Resolver.
+func (i *Ingester) check(r *Reading, devices map[string]*fhir.Device, patients map[string]bool) ReadingResult {
+	if i.Resolver != nil && r.DeviceID != "" && !r.Timestamp.IsZero() {
+		patientID, err := i.Resolver.Resolve(r.DeviceID, r.Timestamp)
+		switch {
+		case err != nil:
+			return ReadingResult{Status: Failed, Error: err}
+		case patientID == "":
+			return ReadingResult{Status: Rejected, Error: fmt.Errorf("Device %s wasn't assigned to a patient at %s", r.DeviceID, formatTime(r.Timestamp))}
+		case r.PatientID == "":
+			r.PatientID = patientID
+		case r.PatientID != patientID:
+			return ReadingResult{Status: Rejected, Error: fmt.Errorf("Device %s was assigned to Patient/%s at %s, not Patient/%s", r.DeviceID, patientID, formatTime(r.Timestamp), r.PatientID)}
+		}
+	}
+	if err := r.Validate(i.now()); err != nil {
+		return ReadingResult{Status: Rejected, Error: err}
+	}
+	device, ok := devices[r.DeviceID]
+	if !ok {
+		var err error
+		if device, err = i.findDevice(r.DeviceID); err != nil {
+			return ReadingResult{Status: Failed, Error: err}
+		}
+		devices[r.DeviceID] = device
+	}
+	if device == nil {
+		return ReadingResult{Status: Rejected, Error: fmt.Errorf("Device %s isn't registered", r.DeviceID)}
+	}
+	// The registry's assignments supersede the Device's patient, which is only the patient it's currently assigned to
+	if i.Resolver == nil && device.Patient != nil && device.Patient.Reference != "" && !strings.HasSuffix(device.Patient.Reference, "Patient/"+r.PatientID) {
+		return ReadingResult{Status: Rejected, Error: fmt.Errorf("Device %s belongs to %s, not Patient/%s", r.DeviceID, device.Patient.Reference, r.PatientID)}
+	}
+	exists, ok := patients[r.PatientID]
+	if !ok {
+		var err error
+		if exists, err = patientExists(i.FHIREndpoint, r.PatientID); err != nil {
+			return ReadingResult{Status: Failed, Error: err}
+		}
+		patients[r.PatientID] = exists
+	}
+	if !exists {
+		return ReadingResult{Status: Rejected, Error: fmt.Errorf("Patient %s not found", r.PatientID)}
+	}
+	return ReadingResult{}
+}
+
+// findDevice returns the device with the identifier, or nil if there is none (or it was entered in error).  It's an
+// error if more than one device has the identifier.
+func (i *Ingester) findDevice(identifier string) (*fhir.Device, error) {
+	var found []*fhir.Device
+	err := client.ForEachBundle(i.FHIREndpoint+"/Device?identifier="+url.QueryEscape(identifier), func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			if device, ok := entry.Resource.(*fhir.Device); ok {
+				found = append(found, device)
+			}
+		}
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case len(found) > 1:
+		return nil, fmt.Errorf("Found %d devices with identifier %s", len(found), identifier)
+	case len(found) == 0 || found[0].Status == "entered-in-error":
+		return nil, nil
+	}
+	return found[0], nil
+}
+
+// write writes the batch of readings to the FHIR server in a transaction bundle, recording their results.  Each
+// observation is written with a conditional update on its identifier, so readings that were already written are
+// updated in place and reported as duplicates.
+func (i *Ingester) write(readings []Reading, batch []int, devices map[string]*fhir.Device, results []ReadingResult) {
+	bundle := &fhir.Bundle{Type: "transaction", Entry: make([]fhir.BundleEntryComponent, len(batch))}
+	for j, n := range batch {
+		r := &readings[n]
+		bundle.Entry[j] = fhir.BundleEntryComponent{
+			Resource: r.ToObservation("Device/" + devices[r.DeviceID].Id),
+			Request: &fhir.BundleEntryRequestComponent{
+				Method: "PUT",
+				Url:    "Observation?identifier=" + url.QueryEscape(ReadingIdentifierSystem+"|"+r.Key()),
+			},
+		}
+	}
+
+	response, err := i.postTransaction(bundle)
+	if err != nil {
+		for _, n := range batch {
+			results[n].Status, results[n].Error = Failed, err
+		}
+		return
+	}
+	// The server may reorder the entries of the response, so match them to the readings by identifier
+	responses := make(map[string]*fhir.BundleEntryResponseComponent)
+	if response != nil {
+		for _, entry := range response.Entry {
+			if o, ok := entry.Resource.(*fhir.Observation); ok && entry.Response != nil {
+				for _, id := range o.Identifier {
+					if id.System == ReadingIdentifierSystem {
+						responses[id.Value] = entry.Response
+					}
+				}
+			}
+		}
+	}
+	for _, n := range batch {
+		res, ok := responses[readings[n].Key()]
+		switch {
+		case !ok:
+			// The server didn't report the outcome of each entry, so the transaction's success means they were written
+			results[n].Status = Created
+		case strings.HasPrefix(res.Status, "201"):
+			results[n].Status, results[n].Observation = Created, res.Location
+		case strings.HasPrefix(res.Status, "200"):
+			results[n].Status, results[n].Observation = Duplicate, res.Location
+		default:
+			results[n].Status = Failed
+			results[n].Error = fmt.Errorf("FHIR server responded %s when writing the observation", res.Status)
+		}
+	}
+}
+
+// postTransaction posts the transaction bundle to the FHIR server, returning the transaction response bundle (or nil
+// if the server didn't return one)
+func (i *Ingester) postTransaction(bundle *fhir.Bundle) (*fhir.Bundle, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.Post(i.FHIREndpoint, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Observations did not post properly.  Received response code: %d", res.StatusCode)
+	}
+	var response fhir.Bundle
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, nil
+	}
+	return &response, nil
+}
@@ -0,0 +1,213 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIngesterSuite(t *testing.T) {
+	suite.Run(t, new(IngesterSuite))
+}
+
+type IngesterSuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Lock       sync.Mutex
+	Posted     []fhir.Bundle
+	Stored     map[string]bool
+	FailPosts  bool
+	Ingester   *Ingester
+}
+
+func (suite *IngesterSuite) SetupTest() {
+	suite.Posted, suite.Stored, suite.FailPosts = nil, make(map[string]bool), false
+	scale, cuff, retired := &fhir.Device{}, &fhir.Device{}, &fhir.Device{}
+	scale.Id, cuff.Id, retired.Id = "d1", "d2", "d3"
+	cuff.Patient = &fhir.Reference{Reference: "Patient/2"}
+	retired.Status = "entered-in-error"
+	devices := map[string]*fhir.Device{"scale-1": scale, "cuff-1": cuff, "retired-1": retired}
+
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Lock.Lock()
+		defer suite.Lock.Unlock()
+		switch {
+		case r.Method == "POST":
+			if suite.FailPosts {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			var bundle fhir.Bundle
+			json.NewDecoder(r.Body).Decode(&bundle)
+			suite.Posted = append(suite.Posted, bundle)
+			// Respond with the entries in reverse order, since servers may reorder them
+			response := fhir.Bundle{Type: "transaction-response"}
+			for i := len(bundle.Entry) - 1; i >= 0; i-- {
+				query, _ := url.ParseQuery(strings.SplitN(bundle.Entry[i].Request.Url, "?", 2)[1])
+				status := "201"
+				if suite.Stored[query.Get("identifier")] {
+					status = "200"
+				}
+				suite.Stored[query.Get("identifier")] = true
+				response.Entry = append(response.Entry, fhir.BundleEntryComponent{
+					Resource: bundle.Entry[i].Resource,
+					Response: &fhir.BundleEntryResponseComponent{Status: status, Location: "Observation/" + query.Get("identifier")},
+				})
+			}
+			json.NewEncoder(w).Encode(&response)
+		case r.URL.Path == "/Device":
+			bundle := fhir.Bundle{Type: "searchset"}
+			if device, ok := devices[r.URL.Query().Get("identifier")]; ok {
+				bundle.Entry = []fhir.BundleEntryComponent{{Resource: device}}
+			}
+			json.NewEncoder(w).Encode(&bundle)
+		case r.URL.Path == "/Patient/1" || r.URL.Path == "/Patient/2":
+			patient := &fhir.Patient{}
+			patient.Id = strings.TrimPrefix(r.URL.Path, "/Patient/")
+			json.NewEncoder(w).Encode(patient)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	suite.Ingester = NewIngester(suite.FHIRServer.URL + "/")
+	suite.Ingester.now = func() time.Time { return now }
+}
+
+func (suite *IngesterSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func (suite *IngesterSuite) TestIngest() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	readings := []Reading{
+		weightReading("scale-1", now.Add(-time.Hour), 132),
+		{DeviceID: "cuff-1", PatientID: "2", Timestamp: now, Measurement: "blood-pressure", Components: map[string]float64{"systolic": 120, "diastolic": 80}, Unit: "mm[Hg]"},
+		weightReading("scale-1", now.Add(-time.Hour), 132),
+		weightReading("scale-2", now, 132),
+		weightReading("retired-1", now, 132),
+		{DeviceID: "cuff-1", PatientID: "1", Timestamp: now, Measurement: "heart-rate", Value: value(72), Unit: "/min"},
+		{DeviceID: "scale-1", PatientID: "3", Timestamp: now, Measurement: "body-weight", Value: value(60), Unit: "kg"},
+		weightReading("scale-1", now, 1200),
+	}
+	results := suite.Ingester.Ingest(readings)
+	require.Len(results, len(readings))
+	for i, result := range results {
+		assert.Equal(i, result.Index)
+	}
+	assert.Equal(Created, results[0].Status)
+	assert.Equal("Observation/"+ReadingIdentifierSystem+"|scale-1|body-weight|2016-03-01T11:00:00Z", results[0].Observation)
+	assert.Equal(Created, results[1].Status)
+	assert.Equal(Duplicate, results[2].Status)
+	assert.Equal(Rejected, results[3].Status)
+	assert.EqualError(results[3].Error, "Device scale-2 isn't registered")
+	assert.Equal(Rejected, results[4].Status)
+	assert.EqualError(results[4].Error, "Device retired-1 isn't registered")
+	assert.Equal(Rejected, results[5].Status)
+	assert.EqualError(results[5].Error, "Device cuff-1 belongs to Patient/2, not Patient/1")
+	assert.Equal(Rejected, results[6].Status)
+	assert.EqualError(results[6].Error, "Patient 3 not found")
+	assert.Equal(Rejected, results[7].Status)
+	assert.EqualError(results[7].Error, "Implausible body-weight of 1200 lb: must be from 1 to 500 kg")
+
+	require.Len(suite.Posted, 1)
+	bundle := suite.Posted[0]
+	assert.Equal("transaction", bundle.Type)
+	require.Len(bundle.Entry, 2)
+	assert.Equal("PUT", bundle.Entry[0].Request.Method)
+	assert.Equal("Observation?identifier="+url.QueryEscape(ReadingIdentifierSystem+"|scale-1|body-weight|2016-03-01T11:00:00Z"), bundle.Entry[0].Request.Url)
+	o, ok := bundle.Entry[0].Resource.(*fhir.Observation)
+	require.True(ok)
+	assert.Equal("Device/d1", o.Device.Reference)
+	assert.Equal("Patient/1", o.Subject.Reference)
+	o, ok = bundle.Entry[1].Resource.(*fhir.Observation)
+	require.True(ok)
+	assert.Equal("Device/d2", o.Device.Reference)
+	assert.Len(o.Component, 2)
+
+	// Readings that were already written are duplicates
+	results = suite.Ingester.Ingest(readings[:1])
+	assert.Equal(Duplicate, results[0].Status)
+}
+
+func (suite *IngesterSuite) TestIngestBatches() {
+	assert := suite.Assert()
+
+	suite.Ingester.BatchSize = 2
+	var readings []Reading
+	for i := 0; i < 5; i++ {
+		readings = append(readings, weightReading("scale-1", now.Add(-time.Duration(i)*time.Hour), 130+float64(i)))
+	}
+	results := suite.Ingester.Ingest(readings)
+	for _, result := range results {
+		assert.Equal(Created, result.Status)
+	}
+	if assert.Len(suite.Posted, 3) {
+		assert.Len(suite.Posted[0].Entry, 2)
+		assert.Len(suite.Posted[1].Entry, 2)
+		assert.Len(suite.Posted[2].Entry, 1)
+	}
+}
+
+func (suite *IngesterSuite) TestIngestFailure() {
+	assert := suite.Assert()
+
+	suite.FailPosts = true
+	results := suite.Ingester.Ingest([]Reading{weightReading("scale-1", now, 132)})
+	assert.Equal(Failed, results[0].Status)
+	assert.EqualError(results[0].Error, "Observations did not post properly.  Received response code: 500")
+
+	data, err := json.Marshal(&results[0])
+	assert.NoError(err)
+	assert.JSONEq(`{"index": 0, "status": "failed", "error": "Observations did not post properly.  Received response code: 500"}`, string(data))
+
+	data, err = json.Marshal(&ReadingResult{Index: 1, Status: Rejected, Error: errors.New("Reading has no deviceId")})
+	assert.NoError(err)
+	assert.JSONEq(`{"index": 1, "status": "rejected", "error": "Reading has no deviceId"}`, string(data))
+}
+
+func (suite *IngesterSuite) TestIngestResolvesPatients() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The cuff's Device references Patient/2, but the registry's assignments supersede it
+	registry := NewRegistry(NewMemoryRegistryStore(), suite.FHIRServer.URL)
+	end := now.Add(-time.Hour)
+	require.NoError(registry.Store.SaveBinding(&Binding{ID: bson.NewObjectId(), DeviceID: "cuff-1", PatientID: "1", Start: now.AddDate(0, 0, -1), End: &end}))
+	require.NoError(registry.Store.SaveBinding(&Binding{ID: bson.NewObjectId(), DeviceID: "cuff-1", PatientID: "2", Start: end}))
+	suite.Ingester.Resolver = registry
+
+	readings := []Reading{
+		{DeviceID: "cuff-1", Timestamp: now.Add(-2 * time.Hour), Measurement: "heart-rate", Value: value(72), Unit: "/min"},
+		{DeviceID: "cuff-1", Timestamp: now, Measurement: "heart-rate", Value: value(74), Unit: "/min"},
+		{DeviceID: "cuff-1", PatientID: "1", Timestamp: now, Measurement: "heart-rate", Value: value(76), Unit: "/min"},
+		{DeviceID: "cuff-1", Timestamp: now.AddDate(0, 0, -2), Measurement: "heart-rate", Value: value(78), Unit: "/min"},
+	}
+	results := suite.Ingester.Ingest(readings)
+	assert.Equal(Created, results[0].Status)
+	assert.Equal("1", readings[0].PatientID)
+	assert.Equal(Created, results[1].Status)
+	assert.Equal("2", readings[1].PatientID)
+	assert.Equal(Rejected, results[2].Status)
+	assert.EqualError(results[2].Error, "Device cuff-1 was assigned to Patient/2 at 2016-03-01T12:00:00Z, not Patient/1")
+	assert.Equal(Rejected, results[3].Status)
+	assert.EqualError(results[3].Error, "Device cuff-1 wasn't assigned to a patient at 2016-02-28T12:00:00Z")
+
+	require.Len(suite.Posted, 1)
+	require.Len(suite.Posted[0].Entry, 2)
+	o := suite.Posted[0].Entry[0].Resource.(*fhir.Observation)
+	assert.Equal("Patient/1", o.Subject.Reference)
+	o = suite.Posted[0].Entry[1].Resource.(*fhir.Observation)
+	assert.Equal("Patient/2", o.Subject.Reference)
+}
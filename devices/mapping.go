@@ -0,0 +1,292 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+)
+
+// Mapping maps the JSON payloads of the MQTT messages published to a topic to readings.  Each field is a JSON path
+// into the payload (e.g., "$.device.serial" or "$.values[0]"), a level of the topic ("$topic[1]" is the second level),
+// or a constant (any other value).
+type Mapping struct {
+	Topic       string            `json:"topic"`
+	QoS         *byte             `json:"qos,omitempty"`
+	DeviceID    string            `json:"deviceId"`
+	PatientID   string            `json:"patientId,omitempty"`
+	Timestamp   string            `json:"timestamp"`
+	Measurement string            `json:"measurement"`
+	Value       string            `json:"value,omitempty"`
+	Components  map[string]string `json:"components,omitempty"`
+	Unit        string            `json:"unit"`
+}
+
+// ParseMappings parses a JSON array of mappings, checking that each has a valid topic filter and QoS and the fields
+// needed to build a reading.  Mappings without a QoS are subscribed at the given default QoS.  The patientId may be
+// left out if the device registry resolves the readings' patients.
+func ParseMappings(data []byte, defaultQoS byte) ([]Mapping, error) {
+	var mappings []Mapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("Invalid MQTT mappings: %s", err.Error())
+	}
+	if len(mappings) == 0 {
+		return nil, errors.New("Invalid MQTT mappings: there must be at least one mapping")
+	}
+	for i := range mappings {
+		m := &mappings[i]
+		if m.QoS == nil {
+			m.QoS = &defaultQoS
+		}
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid MQTT mapping for topic %q: %s", m.Topic, err.Error())
+		}
+	}
+	return mappings, nil
+}
+
+func (m *Mapping) validate() error {
+	if err := mqtt.ValidateFilter(m.Topic); err != nil {
+		return err
+	}
+	if *m.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	fields := map[string]string{"deviceId": m.DeviceID, "timestamp": m.Timestamp, "measurement": m.Measurement, "unit": m.Unit}
+	for _, name := range []string{"deviceId", "timestamp", "measurement", "unit"} {
+		if fields[name] == "" {
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	if (m.Value == "") == (len(m.Components) == 0) {
+		return errors.New("either value or components is required")
+	}
+	if !isPath(m.Measurement) {
+		if _, ok := Measurements[m.Measurement]; !ok {
+			return fmt.Errorf("unknown measurement %q", m.Measurement)
+		}
+	}
+	paths := []string{m.DeviceID, m.PatientID, m.Timestamp, m.Measurement, m.Value, m.Unit}
+	for _, path := range m.Components {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if isPath(path) {
+			if _, err := parsePath(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reading maps the payload of a message published to the topic to a reading
+func (m *Mapping) Reading(topic string, payload []byte) (Reading, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return Reading{}, fmt.Errorf("Payload isn't JSON: %s", err.Error())
+	} else if d.More() {
+		return Reading{}, errors.New("Payload isn't JSON: unexpected data after the top-level value")
+	}
+	e := extractor{topic: strings.Split(topic, "/"), doc: doc}
+	r := Reading{
+		DeviceID:    e.string(m.DeviceID),
+		Timestamp:   e.time(m.Timestamp),
+		Measurement: e.string(m.Measurement),
+		Unit:        e.string(m.Unit),
+	}
+	if m.PatientID != "" {
+		r.PatientID = e.string(m.PatientID)
+	}
+	if m.Value != "" {
+		value := e.number(m.Value)
+		r.Value = &value
+	}
+	if len(m.Components) > 0 {
+		r.Components = make(map[string]float64)
+		for name, path := range m.Components {
+			r.Components[name] = e.number(path)
+		}
+	}
+	return r, e.err
+}
+
+// isPath indicates if a mapping field is a path into the payload or topic, rather than a constant
+func isPath(field string) bool {
+	return strings.HasPrefix(field, "$.") || strings.HasPrefix(field, "$[") || strings.HasPrefix(field, "$topic[")
+}
+
+// step is a step of a path: an object member, or an array index if the name is empty
+type step struct {
+	name  string
+	index int
+}
+
+// parsePath parses a path: "$" (the payload) or "$topic" (the topic's levels), followed by any number of members
+// (".name" or "['name']") and array indexes ("[0]")
+func parsePath(path string) ([]step, error) {
+	var steps []step
+	rest := strings.TrimPrefix(path, "$")
+	if strings.HasPrefix(rest, "topic[") {
+		steps = append(steps, step{name: "$topic"})
+		rest = strings.TrimPrefix(rest, "topic")
+	}
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+			steps = append(steps, step{name: rest[1 : end+1]})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], rest[1:2]+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+			steps = append(steps, step{name: rest[2 : end+2]})
+			rest = rest[end+4:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+			steps = append(steps, step{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// extractor extracts the values of mapping fields from a message, recording the first error
+type extractor struct {
+	topic []string
+	doc   interface{}
+	err   error
+}
+
+func (e *extractor) value(field string) interface{} {
+	if e.err != nil {
+		return nil
+	}
+	if !isPath(field) {
+		return field
+	}
+	steps, err := parsePath(field)
+	if err != nil {
+		e.err = err
+		return nil
+	}
+	var v interface{} = e.doc
+	if len(steps) > 0 && steps[0].name == "$topic" {
+		topic := make([]interface{}, len(e.topic))
+		for i, level := range e.topic {
+			topic[i] = level
+		}
+		v, steps = topic, steps[1:]
+	}
+	for _, s := range steps {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[s.name]
+		case []interface{}:
+			if s.name != "" || s.index >= len(t) {
+				v = nil
+			} else {
+				v = t[s.index]
+			}
+		default:
+			v = nil
+		}
+		if v == nil {
+			e.err = fmt.Errorf("Message has no %s", field)
+			return nil
+		}
+	}
+	return v
+}
+
+func (e *extractor) string(field string) string {
+	switch v := e.value(field).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	}
+	e.fail(field, "a string")
+	return ""
+}
+
+func (e *extractor) number(field string) float64 {
+	var s string
+	switch v := e.value(field).(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case nil:
+		return 0
+	default:
+		e.fail(field, "a number")
+		return 0
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		e.fail(field, "a number")
+	}
+	return n
+}
+
+// time extracts a timestamp, which is either an RFC 3339 string or a Unix time in seconds (or milliseconds, if it's
+// too large to be in seconds)
+func (e *extractor) time(field string) time.Time {
+	switch v := e.value(field).(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			e.fail(field, "an RFC 3339 timestamp")
+		}
+		return t
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			e.fail(field, "a Unix time")
+			return time.Time{}
+		}
+		if n > 1e12 {
+			n /= 1000
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	case nil:
+		return time.Time{}
+	}
+	e.fail(field, "a timestamp")
+	return time.Time{}
+}
+
+func (e *extractor) fail(field, expected string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("Message %s isn't %s", field, expected)
+	}
+}
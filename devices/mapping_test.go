@@ -0,0 +1,129 @@
+package devices
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMappingSuite(t *testing.T) {
+	suite.Run(t, new(MappingSuite))
+}
+
+type MappingSuite struct {
+	suite.Suite
+}
+
+const testMappings = `[
+	{
+		"topic": "home/+/weight",
+		"deviceId": "$topic[1]",
+		"patientId": "$.patient",
+		"timestamp": "$.ts",
+		"measurement": "body-weight",
+		"value": "$.reading.lb",
+		"unit": "[lb_av]"
+	},
+	{
+		"topic": "home/+/bp",
+		"qos": 2,
+		"deviceId": "$['device-id']",
+		"patientId": "$.patient",
+		"timestamp": "$.time",
+		"measurement": "blood-pressure",
+		"components": {"systolic": "$.values[0]", "diastolic": "$.values[1]"},
+		"unit": "mm[Hg]"
+	}
+]`
+
+func (suite *MappingSuite) TestParseMappings() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	mappings, err := ParseMappings([]byte(testMappings), 1)
+	require.NoError(err)
+	require.Len(mappings, 2)
+	assert.Equal("home/+/weight", mappings[0].Topic)
+	assert.Equal(byte(1), *mappings[0].QoS)
+	assert.Equal(byte(2), *mappings[1].QoS)
+	assert.Equal("$.values[1]", mappings[1].Components["diastolic"])
+}
+
+func (suite *MappingSuite) TestParseInvalidMappings() {
+	assert := suite.Assert()
+
+	_, err := ParseMappings([]byte(`{}`), 1)
+	assert.Error(err)
+	_, err = ParseMappings([]byte(`[]`), 1)
+	assert.EqualError(err, "Invalid MQTT mappings: there must be at least one mapping")
+	_, err = ParseMappings([]byte(`[{"topic": "home/#/weight", "deviceId": "scale", "patientId": "1", "timestamp": "$.ts", "measurement": "body-weight", "value": "$.kg", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/#/weight": Invalid MQTT topic filter "home/#/weight": # must be the last level`)
+	_, err = ParseMappings([]byte(`[{"topic": "home/weight", "qos": 3, "deviceId": "scale", "patientId": "1", "timestamp": "$.ts", "measurement": "body-weight", "value": "$.kg", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/weight": QoS must be 0, 1 or 2`)
+	_, err = ParseMappings([]byte(`[{"topic": "home/weight", "patientId": "1", "timestamp": "$.ts", "measurement": "body-weight", "value": "$.kg", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/weight": deviceId is required`)
+	_, err = ParseMappings([]byte(`[{"topic": "home/weight", "deviceId": "scale", "timestamp": "$.ts", "measurement": "body-weight", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/weight": either value or components is required`)
+	_, err = ParseMappings([]byte(`[{"topic": "home/weight", "deviceId": "scale", "patientId": "1", "timestamp": "$.ts", "measurement": "body-fat", "value": "$.kg", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/weight": unknown measurement "body-fat"`)
+	_, err = ParseMappings([]byte(`[{"topic": "home/weight", "deviceId": "scale", "patientId": "1", "timestamp": "$.ts", "measurement": "body-weight", "value": "$.values[x]", "unit": "kg"}]`), 1)
+	assert.EqualError(err, `Invalid MQTT mapping for topic "home/weight": invalid path "$.values[x]"`)
+}
+
+func (suite *MappingSuite) TestReading() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	mappings, err := ParseMappings([]byte(testMappings), 1)
+	require.NoError(err)
+
+	r, err := mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": 1, "ts": "2016-03-01T07:00:00-05:00", "reading": {"lb": 132.5}}`))
+	require.NoError(err)
+	assert.Equal("scale-1", r.DeviceID)
+	assert.Equal("1", r.PatientID)
+	assert.True(now.Equal(r.Timestamp))
+	assert.Equal("body-weight", r.Measurement)
+	require.NotNil(r.Value)
+	assert.Equal(132.5, *r.Value)
+	assert.Equal("[lb_av]", r.Unit)
+
+	r, err = mappings[1].Reading("home/cuff-1/bp", []byte(`{"device-id": "cuff-1", "patient": "2", "time": 1456833600000, "values": [120, "80"]}`))
+	require.NoError(err)
+	assert.Equal("cuff-1", r.DeviceID)
+	assert.Equal(now, r.Timestamp)
+	assert.Equal(map[string]float64{"systolic": 120, "diastolic": 80}, r.Components)
+	assert.Nil(r.Value)
+
+	r, err = mappings[1].Reading("home/cuff-1/bp", []byte(`{"device-id": "cuff-1", "patient": "2", "time": 1456833600.5, "values": [120, 80]}`))
+	require.NoError(err)
+	assert.Equal(now.Add(500*time.Millisecond), r.Timestamp)
+
+	// Without a patientId, the patient is left to the device registry to resolve
+	mappings, err = ParseMappings([]byte(`[{"topic": "home/+/weight", "deviceId": "$topic[1]", "timestamp": "$.ts", "measurement": "body-weight", "value": "$.kg", "unit": "kg"}]`), 1)
+	require.NoError(err)
+	r, err = mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": "1", "ts": "2016-03-01T12:00:00Z", "kg": 60}`))
+	require.NoError(err)
+	assert.Equal("", r.PatientID)
+}
+
+func (suite *MappingSuite) TestReadingErrors() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	mappings, err := ParseMappings([]byte(testMappings), 1)
+	require.NoError(err)
+
+	_, err = mappings[0].Reading("home/scale-1/weight", []byte(`132.5 lb`))
+	assert.EqualError(err, "Payload isn't JSON: unexpected data after the top-level value")
+	_, err = mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": "1", "ts": "2016-03-01T12:00:00Z"}`))
+	assert.EqualError(err, "Message has no $.reading.lb")
+	_, err = mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": "1", "ts": "2016-03-01T12:00:00Z", "reading": {"lb": "heavy"}}`))
+	assert.EqualError(err, "Message $.reading.lb isn't a number")
+	_, err = mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": "1", "ts": "yesterday", "reading": {"lb": 132.5}}`))
+	assert.EqualError(err, "Message $.ts isn't an RFC 3339 timestamp")
+	_, err = mappings[0].Reading("home/scale-1/weight", []byte(`{"patient": {"id": "1"}, "ts": "2016-03-01T12:00:00Z", "reading": {"lb": 132.5}}`))
+	assert.EqualError(err, "Message $.patient isn't a string")
+	_, err = mappings[1].Reading("home/cuff-1/bp", []byte(`{"device-id": "cuff-1", "patient": "2", "time": 1456833600, "values": [120]}`))
+	assert.EqualError(err, "Message has no $.values[1]")
+}
@@ -0,0 +1,107 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ErrOutboxFull is returned when adding readings to an outbox that's at capacity
+var ErrOutboxFull = errors.New("Outbox is full")
+
+// Outbox buffers readings until they're ingested, so that readings received while the FHIR server is down aren't
+// lost.  If the outbox has a file, the buffered readings are saved to it whenever they change, so they also survive
+// restarts.
+type Outbox struct {
+	path      string
+	capacity  int
+	lock      sync.Mutex
+	flushLock sync.Mutex
+	readings  []Reading
+}
+
+// NewOutbox returns an outbox holding up to capacity readings, saved to the file at the given path (or only held in
+// memory if the path is empty).  The readings already saved to the file are loaded.
+func NewOutbox(path string, capacity int) (*Outbox, error) {
+	o := &Outbox{path: path, capacity: capacity}
+	if path == "" {
+		return o, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &o.readings); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Add adds the readings to the outbox, returning ErrOutboxFull if there isn't room for all of them, or an error if
+// they couldn't be saved.  Readings are only added if they're saved.
+func (o *Outbox) Add(readings ...Reading) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.readings)+len(readings) > o.capacity {
+		return ErrOutboxFull
+	}
+	n := len(o.readings)
+	o.readings = append(o.readings, readings...)
+	if err := o.save(); err != nil {
+		o.readings = o.readings[:n]
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of readings in the outbox
+func (o *Outbox) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.readings)
+}
+
+// Flush ingests the readings in the outbox, removing them from the outbox unless they failed (e.g., because the FHIR
+// server is down), in which case they're kept to be retried.  Readings can be added while the outbox is flushed.
+func (o *Outbox) Flush(ingester *Ingester) ([]ReadingResult, error) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+
+	o.lock.Lock()
+	readings := append([]Reading(nil), o.readings...)
+	o.lock.Unlock()
+	if len(readings) == 0 {
+		return nil, nil
+	}
+	results := ingester.Ingest(readings)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var remaining []Reading
+	for i, result := range results {
+		if result.Status == Failed {
+			remaining = append(remaining, readings[i])
+		}
+	}
+	o.readings = append(remaining, o.readings[len(readings):]...)
+	return results, o.save()
+}
+
+// save writes the readings to a temporary file and renames it, so the outbox's file is never partially written
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(o.readings)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(o.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(o.path+".tmp", o.path)
+}
@@ -0,0 +1,64 @@
+package devices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (suite *IngesterSuite) TestOutbox() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	dir, err := ioutil.TempDir("", "outbox")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	outbox, err := NewOutbox(path, 3)
+	require.NoError(err)
+	assert.Equal(0, outbox.Len())
+	require.NoError(outbox.Add(weightReading("scale-1", now, 132), weightReading("scale-2", now, 132)))
+	assert.Equal(ErrOutboxFull, outbox.Add(weightReading("scale-1", now.Add(-time.Hour), 132), weightReading("scale-1", now.Add(-2*time.Hour), 132)))
+	assert.Equal(2, outbox.Len())
+
+	// The readings survive restarts
+	outbox, err = NewOutbox(path, 3)
+	require.NoError(err)
+	assert.Equal(2, outbox.Len())
+
+	// Readings that failed are kept, while those that were created or rejected are removed
+	suite.FailPosts = true
+	results, err := outbox.Flush(suite.Ingester)
+	require.NoError(err)
+	require.Len(results, 2)
+	assert.Equal(Failed, results[0].Status)
+	assert.Equal(Rejected, results[1].Status)
+	assert.Equal(1, outbox.Len())
+
+	suite.FailPosts = false
+	results, err = outbox.Flush(suite.Ingester)
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal(Created, results[0].Status)
+	assert.Equal(0, outbox.Len())
+
+	results, err = outbox.Flush(suite.Ingester)
+	assert.NoError(err)
+	assert.Empty(results)
+
+	outbox, err = NewOutbox(path, 3)
+	require.NoError(err)
+	assert.Equal(0, outbox.Len())
+}
+
+func (suite *IngesterSuite) TestOutboxInMemory() {
+	assert := suite.Assert()
+
+	outbox, err := NewOutbox("", 1)
+	assert.NoError(err)
+	assert.NoError(outbox.Add(weightReading("scale-1", now, 132)))
+	assert.Equal(ErrOutboxFull, outbox.Add(weightReading("scale-1", now.Add(-time.Hour), 132)))
+	assert.Equal(1, outbox.Len())
+}
@@ -0,0 +1,204 @@
+// Package devices ingests readings from connected devices, such as scales, blood pressure cuffs and glucose meters,
+// and writes them to the FHIR server as Observations referencing the registered Device that took them.
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+)
+
+// ReadingIdentifierSystem is the system of the identifiers given to the observations written for device readings.
+// The identifier is unique to the device, measurement and time of the reading, so readings that are sent more than
+// once are only written once.
+const ReadingIdentifierSystem = "http://interventionengine.org/fhir/device-readings"
+
+const loincSystem = "http://loinc.org"
+
+// maxClockSkew is how far in the future a reading's timestamp may be, to allow for devices with fast clocks
+const maxClockSkew = 5 * time.Minute
+
+// Measurement is a kind of reading that devices send: the observation it's recorded as, and the range of plausible
+// values (in the measurement's unit)
+type Measurement struct {
+	Code     fhir.Coding
+	Category string
+	// Components are the named values of readings with more than one value (e.g., systolic and diastolic blood
+	// pressure), which are recorded as observation components
+	Components []Component
+	Unit       string
+	MolarMass  float64
+	Min        float64
+	Max        float64
+}
+
+// Component is one of the values of a measurement with more than one value
+type Component struct {
+	Name string
+	Code fhir.Coding
+}
+
+// Measurements are the kinds of readings that can be ingested, by name
+var Measurements = map[string]Measurement{
+	"body-weight": {
+		Code:     fhir.Coding{System: loincSystem, Code: "29463-7", Display: "Body weight"},
+		Category: "vital-signs",
+		Unit:     "kg",
+		Min:      1,
+		Max:      500,
+	},
+	"blood-pressure": {
+		Code:     fhir.Coding{System: loincSystem, Code: "85354-9", Display: "Blood pressure panel with all children optional"},
+		Category: "vital-signs",
+		Components: []Component{
+			{Name: "systolic", Code: fhir.Coding{System: loincSystem, Code: "8480-6", Display: "Systolic blood pressure"}},
+			{Name: "diastolic", Code: fhir.Coding{System: loincSystem, Code: "8462-4", Display: "Diastolic blood pressure"}},
+		},
+		Unit: "mm[Hg]",
+		Min:  20,
+		Max:  300,
+	},
+	"heart-rate": {
+		Code:     fhir.Coding{System: loincSystem, Code: "8867-4", Display: "Heart rate"},
+		Category: "vital-signs",
+		Unit:     "/min",
+		Min:      20,
+		Max:      300,
+	},
+	"blood-glucose": {
+		Code:      fhir.Coding{System: loincSystem, Code: "2339-0", Display: "Glucose [Mass/volume] in Blood"},
+		Category:  "laboratory",
+		Unit:      "mg/dL",
+		MolarMass: 180.16,
+		Min:       10,
+		Max:       1000,
+	},
+}
+
+// Reading is a measurement sent by a device.  Readings of measurements with components (e.g., blood pressure) have a
+// value for each component instead of a single value.
+type Reading struct {
+	DeviceID    string             `json:"deviceId"`
+	PatientID   string             `json:"patientId"`
+	Timestamp   time.Time          `json:"timestamp"`
+	Measurement string             `json:"measurement"`
+	Value       *float64           `json:"value,omitempty"`
+	Components  map[string]float64 `json:"components,omitempty"`
+	Unit        string             `json:"unit"`
+}
+
+// Key uniquely identifies the reading by its device, measurement and time
+func (r *Reading) Key() string {
+	return r.DeviceID + "|" + r.Measurement + "|" + r.Timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+// Validate checks that the reading has a device, patient, timestamp (no later than the given time) and known
+// measurement, and that its values are in a unit compatible with the measurement and within the plausible range
+func (r *Reading) Validate(now time.Time) error {
+	switch {
+	case r.DeviceID == "":
+		return errors.New("Reading has no deviceId")
+	case r.PatientID == "":
+		return errors.New("Reading has no patientId")
+	case r.Timestamp.IsZero():
+		return errors.New("Reading has no timestamp")
+	case r.Timestamp.After(now.Add(maxClockSkew)):
+		return fmt.Errorf("Reading timestamp %s is in the future", r.Timestamp.Format(time.RFC3339))
+	}
+	m, ok := Measurements[r.Measurement]
+	if !ok {
+		return fmt.Errorf("Unknown measurement %q: must be one of %s", r.Measurement, strings.Join(measurementNames(), ", "))
+	}
+	unit, err := r.unitCode()
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]float64)
+	if len(m.Components) == 0 {
+		if r.Value == nil || len(r.Components) > 0 {
+			return fmt.Errorf("A %s reading must have a value and no components", r.Measurement)
+		}
+		values[r.Measurement] = *r.Value
+	} else {
+		if r.Value != nil || len(r.Components) != len(m.Components) {
+			return fmt.Errorf("A %s reading must have components %s and no value", r.Measurement, strings.Join(componentNames(m), ", "))
+		}
+		for _, c := range m.Components {
+			value, ok := r.Components[c.Name]
+			if !ok {
+				return fmt.Errorf("A %s reading must have components %s and no value", r.Measurement, strings.Join(componentNames(m), ", "))
+			}
+			values[c.Name] = value
+		}
+	}
+	for name, value := range values {
+		converted, err := ucum.ConvertSubstance(value, unit, m.Unit, m.MolarMass)
+		if err != nil {
+			return fmt.Errorf("Invalid unit for %s: %s", r.Measurement, err.Error())
+		}
+		if converted < m.Min || converted > m.Max {
+			return fmt.Errorf("Implausible %s of %g %s: must be from %g to %g %s", name, value, r.Unit, m.Min, m.Max, m.Unit)
+		}
+	}
+	return nil
+}
+
+// ToObservation converts a valid reading to an Observation taken by the referenced device.  The reading's values are
+// recorded in the unit they were sent in, coded in UCUM.
+func (r *Reading) ToObservation(deviceReference string) *fhir.Observation {
+	m := Measurements[r.Measurement]
+	unit, _ := r.unitCode()
+	quantity := func(value float64) *fhir.Quantity {
+		return &fhir.Quantity{Value: &value, Unit: r.Unit, System: ucum.System, Code: unit}
+	}
+	o := &fhir.Observation{
+		Identifier: []fhir.Identifier{{System: ReadingIdentifierSystem, Value: r.Key()}},
+		Status:     "final",
+		Category: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{{System: "http://hl7.org/fhir/observation-category", Code: m.Category}},
+		},
+		Code:              &fhir.CodeableConcept{Coding: []fhir.Coding{m.Code}, Text: m.Code.Display},
+		Subject:           &fhir.Reference{Reference: "Patient/" + r.PatientID},
+		EffectiveDateTime: &fhir.FHIRDateTime{Time: r.Timestamp.In(models.ClinicalLocation), Precision: fhir.Timestamp},
+		Device:            &fhir.Reference{Reference: deviceReference},
+	}
+	if len(m.Components) == 0 {
+		o.ValueQuantity = quantity(*r.Value)
+	}
+	for _, c := range m.Components {
+		o.Component = append(o.Component, fhir.ObservationComponentComponent{
+			Code:          &fhir.CodeableConcept{Coding: []fhir.Coding{c.Code}, Text: c.Code.Display},
+			ValueQuantity: quantity(r.Components[c.Name]),
+		})
+	}
+	return o
+}
+
+// unitCode returns the UCUM code for the reading's unit, which may also be a common human-readable unit such as "lb"
+func (r *Reading) unitCode() (string, error) {
+	return ucum.QuantityUnit(&fhir.Quantity{Unit: r.Unit})
+}
+
+func measurementNames() []string {
+	names := make([]string, 0, len(Measurements))
+	for name := range Measurements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func componentNames(m Measurement) []string {
+	names := make([]string, len(m.Components))
+	for i, c := range m.Components {
+		names[i] = c.Name
+	}
+	return names
+}
@@ -0,0 +1,101 @@
+package devices
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestReadingSuite(t *testing.T) {
+	suite.Run(t, new(ReadingSuite))
+}
+
+type ReadingSuite struct {
+	suite.Suite
+}
+
+var now = time.Date(2016, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func weightReading(deviceID string, timestamp time.Time, lb float64) Reading {
+	return Reading{DeviceID: deviceID, PatientID: "1", Timestamp: timestamp, Measurement: "body-weight", Value: value(lb), Unit: "lb"}
+}
+
+func (suite *ReadingSuite) TestValidate() {
+	assert := suite.Assert()
+
+	r := weightReading("scale-1", now, 132)
+	assert.NoError(r.Validate(now))
+	r = Reading{DeviceID: "cuff-1", PatientID: "1", Timestamp: now, Measurement: "blood-pressure", Components: map[string]float64{"systolic": 120, "diastolic": 80}, Unit: "mm[Hg]"}
+	assert.NoError(r.Validate(now))
+	r = Reading{DeviceID: "meter-1", PatientID: "1", Timestamp: now, Measurement: "blood-glucose", Value: value(5.5), Unit: "mmol/L"}
+	assert.NoError(r.Validate(now))
+	// Timestamps a little in the future are allowed for devices with fast clocks
+	r = weightReading("scale-1", now.Add(time.Minute), 132)
+	assert.NoError(r.Validate(now))
+}
+
+func (suite *ReadingSuite) TestValidateErrors() {
+	assert := suite.Assert()
+
+	invalid := func(modify func(r *Reading), message string) {
+		r := weightReading("scale-1", now, 132)
+		modify(&r)
+		assert.EqualError(r.Validate(now), message)
+	}
+	invalid(func(r *Reading) { r.DeviceID = "" }, "Reading has no deviceId")
+	invalid(func(r *Reading) { r.PatientID = "" }, "Reading has no patientId")
+	invalid(func(r *Reading) { r.Timestamp = time.Time{} }, "Reading has no timestamp")
+	invalid(func(r *Reading) { r.Timestamp = now.Add(time.Hour) }, "Reading timestamp 2016-03-01T13:00:00Z is in the future")
+	invalid(func(r *Reading) { r.Measurement = "temperature" }, `Unknown measurement "temperature": must be one of blood-glucose, blood-pressure, body-weight, heart-rate`)
+	invalid(func(r *Reading) { r.Value = nil }, "A body-weight reading must have a value and no components")
+	invalid(func(r *Reading) { r.Unit = "cm" }, "Invalid unit for body-weight: Can't convert cm to kg: the units are incompatible")
+	invalid(func(r *Reading) { r.Unit = "stone" }, `Invalid unit for body-weight: Invalid UCUM unit "stone": unknown unit "stone"`)
+	invalid(func(r *Reading) { r.Value = value(1200) }, "Implausible body-weight of 1200 lb: must be from 1 to 500 kg")
+	invalid(func(r *Reading) {
+		r.Measurement = "blood-pressure"
+		r.Value, r.Unit = nil, "mm[Hg]"
+		r.Components = map[string]float64{"systolic": 120, "pulse": 80}
+	}, "A blood-pressure reading must have components systolic, diastolic and no value")
+	invalid(func(r *Reading) {
+		r.Measurement = "blood-pressure"
+		r.Value, r.Unit = nil, "mm[Hg]"
+		r.Components = map[string]float64{"systolic": 420, "diastolic": 80}
+	}, "Implausible systolic of 420 mm[Hg]: must be from 20 to 300 mm[Hg]")
+}
+
+func (suite *ReadingSuite) TestToObservation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	r := weightReading("scale-1", now, 132)
+	o := r.ToObservation("Device/d1")
+	require.Len(o.Identifier, 1)
+	assert.Equal(ReadingIdentifierSystem, o.Identifier[0].System)
+	assert.Equal("scale-1|body-weight|2016-03-01T12:00:00Z", o.Identifier[0].Value)
+	assert.Equal("final", o.Status)
+	assert.True(o.Code.MatchesCode("http://loinc.org", "29463-7"))
+	assert.Equal("Patient/1", o.Subject.Reference)
+	assert.Equal("Device/d1", o.Device.Reference)
+	assert.True(now.Equal(o.EffectiveDateTime.Time))
+	assert.Equal(fhir.Precision(fhir.Timestamp), o.EffectiveDateTime.Precision)
+	assert.Equal(&fhir.Quantity{Value: value(132), Unit: "lb", System: ucum.System, Code: "[lb_av]"}, o.ValueQuantity)
+
+	r = Reading{DeviceID: "cuff-1", PatientID: "1", Timestamp: now, Measurement: "blood-pressure", Components: map[string]float64{"systolic": 120, "diastolic": 80}, Unit: "mm[Hg]"}
+	o = r.ToObservation("Device/d2")
+	assert.Nil(o.ValueQuantity)
+	require.Len(o.Component, 2)
+	assert.True(o.Component[0].Code.MatchesCode("http://loinc.org", "8480-6"))
+	assert.Equal(120.0, *o.Component[0].ValueQuantity.Value)
+	assert.True(o.Component[1].Code.MatchesCode("http://loinc.org", "8462-4"))
+	assert.Equal(80.0, *o.Component[1].ValueQuantity.Value)
+	assert.Equal("mm[Hg]", o.Component[1].ValueQuantity.Code)
+}
@@ -0,0 +1,310 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeviceIdentifierSystem is the system of the identifiers of the Devices written for registered devices
+const DeviceIdentifierSystem = "http://interventionengine.org/fhir/devices"
+
+// AssignmentError is returned when a device can't be registered, assigned or unassigned as requested (e.g., because
+// the assignment would overlap another), as opposed to when the registry or FHIR server fails
+type AssignmentError struct {
+	Message string
+}
+
+func (e *AssignmentError) Error() string {
+	return e.Message
+}
+
+func assignmentErrorf(format string, a ...interface{}) error {
+	return &AssignmentError{Message: fmt.Sprintf(format, a...)}
+}
+
+// PatientResolver resolves the patient a device was assigned to at a time
+type PatientResolver interface {
+	// Resolve returns the ID of the patient the device was assigned to at the time, or "" if it wasn't assigned
+	Resolve(deviceID string, at time.Time) (string, error)
+}
+
+// Registry keeps track of the devices and the patients they're assigned to over time, writing a Device to the FHIR
+// server for each registered device (referencing the patient it's currently assigned to) and a DeviceUseStatement for
+// each assignment (whose period is when the device was assigned to the patient)
+type Registry struct {
+	Store        RegistryStore
+	FHIREndpoint string
+	lock         sync.Mutex
+}
+
+// NewRegistry returns a registry keeping the devices and their assignments in the store
+func NewRegistry(store RegistryStore, fhirEndpoint string) *Registry {
+	return &Registry{Store: store, FHIREndpoint: strings.TrimSuffix(fhirEndpoint, "/")}
+}
+
+// Register registers the device, or updates its details if it's already registered, returning the registered device
+func (r *Registry) Register(device RegisteredDevice) (*RegisteredDevice, error) {
+	if strings.TrimSpace(device.ID) == "" {
+		return nil, assignmentErrorf("Device has no id")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	existing, err := r.Store.GetDevice(device.ID)
+	if err != nil && err != ErrDeviceNotFound {
+		return nil, err
+	}
+	var current *Binding
+	if existing != nil {
+		device.FHIRID = existing.FHIRID
+		if current, err = r.current(device.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.writeDevice(&device, current); err != nil {
+		return nil, err
+	}
+	if err := r.Store.SaveDevice(&device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Device returns the registered device with the given ID and its bindings, or ErrDeviceNotFound if it isn't
+// registered
+func (r *Registry) Device(id string) (*RegisteredDevice, []Binding, error) {
+	device, err := r.Store.GetDevice(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	bindings, err := r.Store.Bindings(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return device, bindings, nil
+}
+
+// Assign assigns the device to the patient from the start time.  If the device is assigned to another patient, that
+// assignment ends at the start time.  Assignments can't be backdated to before the device's latest assignment began
+// (or ended).
+func (r *Registry) Assign(deviceID, patientID string, start time.Time) (*Binding, error) {
+	if patientID == "" {
+		return nil, assignmentErrorf("Assignment has no patientId")
+	}
+	if start.IsZero() {
+		return nil, assignmentErrorf("Assignment has no start")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	device, err := r.Store.GetDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := r.Store.Bindings(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	var latest *Binding
+	if len(bindings) > 0 {
+		latest = &bindings[len(bindings)-1]
+		switch {
+		case latest.End == nil && latest.PatientID == patientID:
+			return nil, assignmentErrorf("Device %s is already assigned to Patient/%s", deviceID, patientID)
+		case !start.After(latest.Start):
+			return nil, assignmentErrorf("Device %s was assigned to Patient/%s at %s, after %s", deviceID, latest.PatientID, formatTime(latest.Start), formatTime(start))
+		case latest.End != nil && start.Before(*latest.End):
+			return nil, assignmentErrorf("Device %s was assigned to Patient/%s until %s, after %s", deviceID, latest.PatientID, formatTime(*latest.End), formatTime(start))
+		}
+	}
+	exists, err := patientExists(r.FHIREndpoint, patientID)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, assignmentErrorf("Patient %s not found", patientID)
+	}
+
+	if latest != nil && latest.End == nil {
+		if err := r.end(device, latest, start); err != nil {
+			return nil, err
+		}
+	}
+	binding := &Binding{ID: bson.NewObjectId(), DeviceID: deviceID, PatientID: patientID, Start: start.UTC()}
+	if err := r.writeStatement(device, binding); err != nil {
+		return nil, err
+	}
+	if err := r.Store.SaveBinding(binding); err != nil {
+		return nil, err
+	}
+	if err := r.writeDevice(device, binding); err != nil {
+		return nil, err
+	}
+	return binding, r.Store.SaveDevice(device)
+}
+
+// Unassign ends the device's current assignment at the end time
+func (r *Registry) Unassign(deviceID string, end time.Time) (*Binding, error) {
+	if end.IsZero() {
+		return nil, assignmentErrorf("Unassignment has no end")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	device, err := r.Store.GetDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := r.current(deviceID)
+	if err != nil {
+		return nil, err
+	} else if current == nil {
+		return nil, assignmentErrorf("Device %s isn't assigned to a patient", deviceID)
+	} else if !end.After(current.Start) {
+		return nil, assignmentErrorf("Device %s was assigned to Patient/%s at %s, after %s", deviceID, current.PatientID, formatTime(current.Start), formatTime(end))
+	}
+	if err := r.end(device, current, end); err != nil {
+		return nil, err
+	}
+	if err := r.writeDevice(device, nil); err != nil {
+		return nil, err
+	}
+	return current, r.Store.SaveDevice(device)
+}
+
+// Resolve returns the ID of the patient the device was assigned to at the time, or "" if it wasn't assigned (or
+// isn't registered)
+func (r *Registry) Resolve(deviceID string, at time.Time) (string, error) {
+	bindings, err := r.Store.Bindings(deviceID)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range bindings {
+		if b.Covers(at) {
+			return b.PatientID, nil
+		}
+	}
+	return "", nil
+}
+
+// current returns the device's current (open) binding, or nil if it isn't assigned
+func (r *Registry) current(deviceID string) (*Binding, error) {
+	bindings, err := r.Store.Bindings(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(bindings); n > 0 && bindings[n-1].End == nil {
+		return &bindings[n-1], nil
+	}
+	return nil, nil
+}
+
+// end ends the binding at the time, updating its DeviceUseStatement
+func (r *Registry) end(device *RegisteredDevice, binding *Binding, end time.Time) error {
+	end = end.UTC()
+	binding.End = &end
+	if err := r.writeStatement(device, binding); err != nil {
+		return err
+	}
+	return r.Store.SaveBinding(binding)
+}
+
+// writeDevice writes the device's Device resource, referencing the patient it's currently assigned to (if any),
+// recording the resource's ID.  The Device is found by its identifier, so it's only written once even if it wasn't
+// recorded.
+func (r *Registry) writeDevice(device *RegisteredDevice, current *Binding) error {
+	d := &fhir.Device{
+		Identifier:   []fhir.Identifier{{System: DeviceIdentifierSystem, Value: device.ID}},
+		Status:       "available",
+		Manufacturer: device.Manufacturer,
+		Model:        device.Model,
+	}
+	if device.Type != "" {
+		d.Type = &fhir.CodeableConcept{Text: device.Type}
+	}
+	if current != nil {
+		d.Patient = &fhir.Reference{Reference: "Patient/" + current.PatientID}
+	}
+	id, err := r.put("Device?identifier="+url.QueryEscape(DeviceIdentifierSystem+"|"+device.ID), d)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		device.FHIRID = id
+	}
+	return nil
+}
+
+// writeStatement writes the binding's DeviceUseStatement, whose ID is the binding's ID
+func (r *Registry) writeStatement(device *RegisteredDevice, binding *Binding) error {
+	s := &fhir.DeviceUseStatement{
+		Identifier: []fhir.Identifier{{System: DeviceIdentifierSystem + "/bindings", Value: binding.ID.Hex()}},
+		Subject:    &fhir.Reference{Reference: "Patient/" + binding.PatientID},
+		Device:     &fhir.Reference{Reference: "Device/" + device.FHIRID},
+		WhenUsed:   &fhir.Period{Start: &fhir.FHIRDateTime{Time: binding.Start, Precision: fhir.Timestamp}},
+		RecordedOn: &fhir.FHIRDateTime{Time: time.Now().UTC(), Precision: fhir.Timestamp},
+	}
+	if binding.End != nil {
+		s.WhenUsed.End = &fhir.FHIRDateTime{Time: *binding.End, Precision: fhir.Timestamp}
+	}
+	if _, err := r.put("DeviceUseStatement/"+binding.ID.Hex(), s); err != nil {
+		return err
+	}
+	binding.Statement = binding.ID.Hex()
+	return nil
+}
+
+// put PUTs the resource to the path on the FHIR server, returning the ID in the Location of the response (if any)
+func (r *Registry) put(resourcePath string, resource interface{}) (string, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("PUT", r.FHIREndpoint+"/"+resourcePath, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Received HTTP %d %s from FHIR server when writing %s.", res.StatusCode, res.Status, strings.SplitN(resourcePath, "?", 2)[0])
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || location.Path == "" {
+		return "", nil
+	}
+	return path.Base(location.Path), nil
+}
+
+// patientExists indicates if the patient is on the FHIR server
+func patientExists(fhirEndpoint, patientID string) (bool, error) {
+	res, err := http.Get(fhirEndpoint + "/Patient/" + url.QueryEscape(patientID))
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusGone:
+		return false, nil
+	}
+	return false, fmt.Errorf("Received HTTP %d %s from FHIR server when looking up patient %s.", res.StatusCode, res.Status, patientID)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
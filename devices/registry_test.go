@@ -0,0 +1,210 @@
+package devices
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRegistrySuite(t *testing.T) {
+	suite.Run(t, new(RegistrySuite))
+}
+
+type RegistrySuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Lock       sync.Mutex
+	Devices    map[string]*fhir.Device
+	Statements map[string]*fhir.DeviceUseStatement
+	Registry   *Registry
+}
+
+func (suite *RegistrySuite) SetupTest() {
+	suite.Devices, suite.Statements = make(map[string]*fhir.Device), make(map[string]*fhir.DeviceUseStatement)
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Lock.Lock()
+		defer suite.Lock.Unlock()
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/Device":
+			var device fhir.Device
+			json.NewDecoder(r.Body).Decode(&device)
+			identifier := r.URL.Query().Get("identifier")
+			status := http.StatusOK
+			existing, ok := suite.Devices[identifier]
+			if ok {
+				device.Id = existing.Id
+			} else {
+				device.Id = "d" + string('0'+rune(len(suite.Devices)+1))
+				status = http.StatusCreated
+			}
+			suite.Devices[identifier] = &device
+			w.Header().Set("Location", "http://"+r.Host+"/Device/"+device.Id)
+			w.WriteHeader(status)
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/DeviceUseStatement/"):
+			var statement fhir.DeviceUseStatement
+			json.NewDecoder(r.Body).Decode(&statement)
+			suite.Statements[strings.TrimPrefix(r.URL.Path, "/DeviceUseStatement/")] = &statement
+			w.Header().Set("Location", "http://"+r.Host+r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/Patient/1" || r.URL.Path == "/Patient/2":
+			patient := &fhir.Patient{}
+			patient.Id = strings.TrimPrefix(r.URL.Path, "/Patient/")
+			json.NewEncoder(w).Encode(patient)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	suite.Registry = NewRegistry(NewMemoryRegistryStore(), suite.FHIRServer.URL+"/")
+}
+
+func (suite *RegistrySuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func (suite *RegistrySuite) device(id string) *fhir.Device {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	return suite.Devices[DeviceIdentifierSystem+"|"+id]
+}
+
+func (suite *RegistrySuite) statement(id string) *fhir.DeviceUseStatement {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	return suite.Statements[id]
+}
+
+func (suite *RegistrySuite) TestRegister() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	device, err := suite.Registry.Register(RegisteredDevice{ID: "scale-1", Type: "Weight scale", Manufacturer: "Acme"})
+	require.NoError(err)
+	assert.Equal("d1", device.FHIRID)
+	d := suite.device("scale-1")
+	require.NotNil(d)
+	assert.Equal("Weight scale", d.Type.Text)
+	assert.Equal("Acme", d.Manufacturer)
+	assert.Equal("available", d.Status)
+	assert.Nil(d.Patient)
+
+	// Registering the device again updates it
+	device, err = suite.Registry.Register(RegisteredDevice{ID: "scale-1", Type: "Weight scale", Model: "S100"})
+	require.NoError(err)
+	assert.Equal("d1", device.FHIRID)
+	assert.Equal("S100", suite.device("scale-1").Model)
+	stored, bindings, err := suite.Registry.Device("scale-1")
+	require.NoError(err)
+	assert.Equal("S100", stored.Model)
+	assert.Empty(bindings)
+
+	_, err = suite.Registry.Register(RegisteredDevice{ID: " "})
+	assert.EqualError(err, "Device has no id")
+	_, _, err = suite.Registry.Device("scale-2")
+	assert.Equal(ErrDeviceNotFound, err)
+}
+
+func (suite *RegistrySuite) TestAssignAndResolve() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	_, err := suite.Registry.Register(RegisteredDevice{ID: "scale-1"})
+	require.NoError(err)
+	monday := time.Date(2016, time.March, 7, 9, 0, 0, 0, time.UTC)
+	first, err := suite.Registry.Assign("scale-1", "1", monday)
+	require.NoError(err)
+	assert.Equal("1", first.PatientID)
+	assert.Nil(first.End)
+	assert.Equal("Patient/1", suite.device("scale-1").Patient.Reference)
+	s := suite.statement(first.Statement)
+	require.NotNil(s)
+	assert.Equal("Patient/1", s.Subject.Reference)
+	assert.Equal("Device/d1", s.Device.Reference)
+	assert.True(monday.Equal(s.WhenUsed.Start.Time))
+	assert.Nil(s.WhenUsed.End)
+
+	// Reassigning the device ends the current assignment
+	friday := monday.AddDate(0, 0, 4)
+	second, err := suite.Registry.Assign("scale-1", "2", friday)
+	require.NoError(err)
+	assert.Equal("Patient/2", suite.device("scale-1").Patient.Reference)
+	s = suite.statement(first.Statement)
+	require.NotNil(s.WhenUsed.End)
+	assert.True(friday.Equal(s.WhenUsed.End.Time))
+
+	for _, test := range []struct {
+		at      time.Time
+		patient string
+	}{
+		{monday.Add(-time.Second), ""},
+		{monday, "1"},
+		{friday.Add(-time.Second), "1"},
+		{friday, "2"},
+		{friday.AddDate(1, 0, 0), "2"},
+	} {
+		patientID, err := suite.Registry.Resolve("scale-1", test.at)
+		assert.NoError(err)
+		assert.Equal(test.patient, patientID, test.at.String())
+	}
+
+	// Unassigning the device ends its assignment
+	sunday := friday.AddDate(0, 0, 2)
+	ended, err := suite.Registry.Unassign("scale-1", sunday)
+	require.NoError(err)
+	assert.Equal(second.ID, ended.ID)
+	require.NotNil(ended.End)
+	assert.True(sunday.Equal(*ended.End))
+	assert.Nil(suite.device("scale-1").Patient)
+	assert.True(sunday.Equal(suite.statement(second.Statement).WhenUsed.End.Time))
+	patientID, err := suite.Registry.Resolve("scale-1", sunday)
+	assert.NoError(err)
+	assert.Equal("", patientID)
+
+	_, bindings, err := suite.Registry.Device("scale-1")
+	require.NoError(err)
+	require.Len(bindings, 2)
+	assert.Equal(first.ID, bindings[0].ID)
+	assert.Equal(second.ID, bindings[1].ID)
+}
+
+func (suite *RegistrySuite) TestInvalidAssignments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	monday := time.Date(2016, time.March, 7, 9, 0, 0, 0, time.UTC)
+	_, err := suite.Registry.Assign("scale-1", "1", monday)
+	assert.Equal(ErrDeviceNotFound, err)
+	_, err = suite.Registry.Register(RegisteredDevice{ID: "scale-1"})
+	require.NoError(err)
+
+	_, err = suite.Registry.Unassign("scale-1", monday)
+	assert.EqualError(err, "Device scale-1 isn't assigned to a patient")
+	_, err = suite.Registry.Assign("scale-1", "3", monday)
+	assert.EqualError(err, "Patient 3 not found")
+	_, err = suite.Registry.Assign("scale-1", "", monday)
+	assert.EqualError(err, "Assignment has no patientId")
+	_, ok := err.(*AssignmentError)
+	assert.True(ok)
+
+	_, err = suite.Registry.Assign("scale-1", "1", monday)
+	require.NoError(err)
+	_, err = suite.Registry.Assign("scale-1", "1", monday.Add(time.Hour))
+	assert.EqualError(err, "Device scale-1 is already assigned to Patient/1")
+	_, err = suite.Registry.Assign("scale-1", "2", monday.Add(-time.Hour))
+	assert.EqualError(err, "Device scale-1 was assigned to Patient/1 at 2016-03-07T09:00:00Z, after 2016-03-07T08:00:00Z")
+	_, err = suite.Registry.Unassign("scale-1", monday)
+	assert.EqualError(err, "Device scale-1 was assigned to Patient/1 at 2016-03-07T09:00:00Z, after 2016-03-07T09:00:00Z")
+
+	_, err = suite.Registry.Unassign("scale-1", monday.AddDate(0, 0, 2))
+	require.NoError(err)
+	_, err = suite.Registry.Assign("scale-1", "2", monday.AddDate(0, 0, 1))
+	assert.EqualError(err, "Device scale-1 was assigned to Patient/1 until 2016-03-09T09:00:00Z, after 2016-03-08T09:00:00Z")
+	_, err = suite.Registry.Assign("scale-1", "2", monday.AddDate(0, 0, 2))
+	assert.NoError(err)
+}
@@ -0,0 +1,244 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrDeviceNotFound is returned when a requested device isn't registered
+var ErrDeviceNotFound = errors.New("Device not found")
+
+// RegisteredDevice is a device in the registry.  ID is the device's identifier (e.g., its serial number), which
+// readings refer to it by; FHIRID is the ID of the Device resource written for it on the FHIR server.
+type RegisteredDevice struct {
+	ID           string `bson:"_id" json:"id"`
+	Type         string `bson:"type,omitempty" json:"type,omitempty"`
+	Manufacturer string `bson:"manufacturer,omitempty" json:"manufacturer,omitempty"`
+	Model        string `bson:"model,omitempty" json:"model,omitempty"`
+	FHIRID       string `bson:"fhirId,omitempty" json:"fhirId,omitempty"`
+}
+
+// Binding is the assignment of a device to a patient from its start until its end (or indefinitely, if it has no
+// end).  Statement is the ID of the DeviceUseStatement written for it on the FHIR server.
+type Binding struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	DeviceID  string        `bson:"device" json:"deviceId"`
+	PatientID string        `bson:"patient" json:"patientId"`
+	Start     time.Time     `bson:"start" json:"start"`
+	End       *time.Time    `bson:"end,omitempty" json:"end,omitempty"`
+	Statement string        `bson:"statement" json:"statement"`
+}
+
+// Covers indicates if the device was assigned to the patient at the given time.  The binding covers its start, but
+// not its end, so a device reassigned at a time is assigned to the new patient at that time.
+func (b *Binding) Covers(t time.Time) bool {
+	return !t.Before(b.Start) && (b.End == nil || t.Before(*b.End))
+}
+
+// RegistryStore provides storage for the registered devices and their bindings to patients
+type RegistryStore interface {
+	// EnsureIndexes creates any indexes needed to efficiently query the store
+	EnsureIndexes() error
+	// GetDevice returns the device with the given ID, or ErrDeviceNotFound if it isn't registered
+	GetDevice(id string) (*RegisteredDevice, error)
+	// ListDevices returns all of the registered devices, sorted by ID
+	ListDevices() ([]RegisteredDevice, error)
+	// SaveDevice inserts or updates the device
+	SaveDevice(device *RegisteredDevice) error
+	// Bindings returns the bindings of the device with the given ID, sorted by their start
+	Bindings(deviceID string) ([]Binding, error)
+	// SaveBinding inserts or updates the binding
+	SaveBinding(binding *Binding) error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// OpenRegistryStore returns the RegistryStore indicated by the backend: "mongo", using the given database, or
+// "memory"
+func OpenRegistryStore(backend, mongoURL, database string) (RegistryStore, error) {
+	switch backend {
+	case "mongo":
+		session, err := mgo.Dial(mongoURL)
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to the database at %s: %s", mongoURL, err.Error())
+		}
+		s := NewMongoRegistryStore(session.DB(database))
+		s.session = session
+		return s, nil
+	case "memory":
+		return NewMemoryRegistryStore(), nil
+	}
+	return nil, fmt.Errorf("Unknown device registry backend: %s", backend)
+}
+
+// MongoRegistryStore is a RegistryStore backed by the "devices" and "deviceBindings" collections of a MongoDB
+// database
+type MongoRegistryStore struct {
+	DevicesC  *mgo.Collection
+	BindingsC *mgo.Collection
+	session   *mgo.Session
+}
+
+// NewMongoRegistryStore returns a RegistryStore backed by the given database.  Closing the store does not close the
+// database's session.
+func NewMongoRegistryStore(db *mgo.Database) *MongoRegistryStore {
+	return &MongoRegistryStore{DevicesC: db.C("devices"), BindingsC: db.C("deviceBindings")}
+}
+
+// EnsureIndexes creates the index for querying bindings by device
+func (s *MongoRegistryStore) EnsureIndexes() error {
+	return s.BindingsC.EnsureIndex(mgo.Index{Key: []string{"device", "start"}})
+}
+
+// GetDevice returns the device with the given ID, or ErrDeviceNotFound if it isn't registered
+func (s *MongoRegistryStore) GetDevice(id string) (*RegisteredDevice, error) {
+	device := new(RegisteredDevice)
+	if err := s.DevicesC.FindId(id).One(device); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrDeviceNotFound
+		}
+		return nil, err
+	}
+	return device, nil
+}
+
+// ListDevices returns all of the registered devices, sorted by ID
+func (s *MongoRegistryStore) ListDevices() ([]RegisteredDevice, error) {
+	var devices []RegisteredDevice
+	if err := s.DevicesC.Find(nil).Sort("_id").All(&devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// SaveDevice inserts or updates the device
+func (s *MongoRegistryStore) SaveDevice(device *RegisteredDevice) error {
+	_, err := s.DevicesC.UpsertId(device.ID, device)
+	return err
+}
+
+// Bindings returns the bindings of the device with the given ID, sorted by their start
+func (s *MongoRegistryStore) Bindings(deviceID string) ([]Binding, error) {
+	var bindings []Binding
+	if err := s.BindingsC.Find(bson.M{"device": deviceID}).Sort("start").All(&bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// SaveBinding inserts or updates the binding
+func (s *MongoRegistryStore) SaveBinding(binding *Binding) error {
+	_, err := s.BindingsC.UpsertId(binding.ID, binding)
+	return err
+}
+
+// Close closes the store's session, if it opened one
+func (s *MongoRegistryStore) Close() error {
+	if s.session != nil {
+		s.session.Close()
+	}
+	return nil
+}
+
+// MemoryRegistryStore is a RegistryStore that keeps devices and bindings in memory.  It is suitable for demos and
+// tests, but the registry is lost when the process exits.
+type MemoryRegistryStore struct {
+	mutex    sync.RWMutex
+	devices  map[string]RegisteredDevice
+	bindings map[bson.ObjectId]Binding
+}
+
+// NewMemoryRegistryStore returns a new, empty, in-memory RegistryStore
+func NewMemoryRegistryStore() *MemoryRegistryStore {
+	return &MemoryRegistryStore{devices: make(map[string]RegisteredDevice), bindings: make(map[bson.ObjectId]Binding)}
+}
+
+// EnsureIndexes does nothing for the in-memory store
+func (s *MemoryRegistryStore) EnsureIndexes() error {
+	return nil
+}
+
+// GetDevice returns the device with the given ID, or ErrDeviceNotFound if it isn't registered
+func (s *MemoryRegistryStore) GetDevice(id string) (*RegisteredDevice, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	return &device, nil
+}
+
+// ListDevices returns all of the registered devices, sorted by ID
+func (s *MemoryRegistryStore) ListDevices() ([]RegisteredDevice, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var devices []RegisteredDevice
+	for _, device := range s.devices {
+		devices = append(devices, device)
+	}
+	sort.Sort(byDeviceID(devices))
+	return devices, nil
+}
+
+// SaveDevice inserts or updates the device
+func (s *MemoryRegistryStore) SaveDevice(device *RegisteredDevice) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices[device.ID] = *device
+	return nil
+}
+
+// Bindings returns the bindings of the device with the given ID, sorted by their start
+func (s *MemoryRegistryStore) Bindings(deviceID string) ([]Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var bindings []Binding
+	for _, binding := range s.bindings {
+		if binding.DeviceID == deviceID {
+			if binding.End != nil {
+				end := *binding.End
+				binding.End = &end
+			}
+			bindings = append(bindings, binding)
+		}
+	}
+	sort.Stable(byStart(bindings))
+	return bindings, nil
+}
+
+// SaveBinding inserts or updates the binding
+func (s *MemoryRegistryStore) SaveBinding(binding *Binding) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	saved := *binding
+	if binding.End != nil {
+		end := *binding.End
+		saved.End = &end
+	}
+	s.bindings[binding.ID] = saved
+	return nil
+}
+
+// Close does nothing for the in-memory store
+func (s *MemoryRegistryStore) Close() error {
+	return nil
+}
+
+type byDeviceID []RegisteredDevice
+
+func (d byDeviceID) Len() int           { return len(d) }
+func (d byDeviceID) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDeviceID) Less(i, j int) bool { return d[i].ID < d[j].ID }
+
+type byStart []Binding
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStart) Less(i, j int) bool { return b[i].Start.Before(b[j].Start) }
@@ -0,0 +1,126 @@
+package devices
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+// In order for 'go test' to run these suites, we need to create
+// normal test functions and pass our suites to suite.Run
+func TestMemoryRegistryStoreSuite(t *testing.T) {
+	suite.Run(t, &RegistryStoreSuite{NewStore: func() RegistryStore {
+		return NewMemoryRegistryStore()
+	}})
+}
+
+func TestMongoRegistryStoreSuite(t *testing.T) {
+	// Skip rather than panic without MongoDB, so the rest of the package's tests still run
+	if _, err := exec.LookPath("mongod"); err != nil {
+		t.Skip("mongod isn't installed")
+	}
+	s := new(MongoRegistryStoreSuite)
+	s.NewStore = func() RegistryStore {
+		s.Session = s.DBServer.Session()
+		return NewMongoRegistryStore(s.Session.DB("riskservice-test"))
+	}
+	suite.Run(t, s)
+}
+
+// RegistryStoreSuite tests the behavior common to all RegistryStore implementations
+type RegistryStoreSuite struct {
+	suite.Suite
+	NewStore func() RegistryStore
+	Store    RegistryStore
+}
+
+func (suite *RegistryStoreSuite) SetupTest() {
+	suite.Store = suite.NewStore()
+	suite.Require().NoError(suite.Store.EnsureIndexes())
+}
+
+func (suite *RegistryStoreSuite) TearDownTest() {
+	suite.Store.Close()
+}
+
+func (suite *RegistryStoreSuite) TestDevices() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	_, err := suite.Store.GetDevice("scale-1")
+	assert.Equal(ErrDeviceNotFound, err)
+	require.NoError(suite.Store.SaveDevice(&RegisteredDevice{ID: "scale-1", Type: "Weight scale"}))
+	require.NoError(suite.Store.SaveDevice(&RegisteredDevice{ID: "cuff-1", Type: "Blood pressure cuff"}))
+	require.NoError(suite.Store.SaveDevice(&RegisteredDevice{ID: "scale-1", Type: "Weight scale", FHIRID: "d1"}))
+
+	device, err := suite.Store.GetDevice("scale-1")
+	require.NoError(err)
+	assert.Equal(RegisteredDevice{ID: "scale-1", Type: "Weight scale", FHIRID: "d1"}, *device)
+	devices, err := suite.Store.ListDevices()
+	require.NoError(err)
+	require.Len(devices, 2)
+	assert.Equal("cuff-1", devices[0].ID)
+	assert.Equal("scale-1", devices[1].ID)
+}
+
+func (suite *RegistryStoreSuite) TestBindings() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	start := time.Date(2016, time.March, 7, 9, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 4)
+	second := &Binding{ID: bson.NewObjectId(), DeviceID: "scale-1", PatientID: "2", Start: end}
+	first := &Binding{ID: bson.NewObjectId(), DeviceID: "scale-1", PatientID: "1", Start: start}
+	other := &Binding{ID: bson.NewObjectId(), DeviceID: "cuff-1", PatientID: "1", Start: start}
+	for _, b := range []*Binding{second, first, other} {
+		require.NoError(suite.Store.SaveBinding(b))
+	}
+	first.End = &end
+	require.NoError(suite.Store.SaveBinding(first))
+
+	bindings, err := suite.Store.Bindings("scale-1")
+	require.NoError(err)
+	require.Len(bindings, 2)
+	assert.Equal(first.ID, bindings[0].ID)
+	assert.True(start.Equal(bindings[0].Start))
+	require.NotNil(bindings[0].End)
+	assert.True(end.Equal(*bindings[0].End))
+	assert.Equal(second.ID, bindings[1].ID)
+	assert.Nil(bindings[1].End)
+
+	bindings, err = suite.Store.Bindings("scale-2")
+	assert.NoError(err)
+	assert.Empty(bindings)
+}
+
+// MongoRegistryStoreSuite runs the common RegistryStore tests against a temporary MongoDB server
+type MongoRegistryStoreSuite struct {
+	RegistryStoreSuite
+	DBServer *dbtest.DBServer
+	Session  *mgo.Session
+}
+
+func (suite *MongoRegistryStoreSuite) SetupSuite() {
+	suite.DBServer = &dbtest.DBServer{}
+	path, err := ioutil.TempDir("", "mongotestdb")
+	if err != nil {
+		panic(err)
+	}
+	suite.DBServer.SetPath(path)
+}
+
+func (suite *MongoRegistryStoreSuite) TearDownTest() {
+	suite.RegistryStoreSuite.TearDownTest()
+	suite.Session.Close()
+	suite.DBServer.Wipe()
+}
+
+func (suite *MongoRegistryStoreSuite) TearDownSuite() {
+	suite.DBServer.Stop()
+}
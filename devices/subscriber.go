@@ -0,0 +1,164 @@
+package devices
+
+import (
+	"log"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/config"
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+)
+
+// DefaultRetryInterval is the default time between attempts to reconnect to the MQTT broker and to flush the readings
+// that couldn't be ingested
+const DefaultRetryInterval = 30 * time.Second
+
+// Subscriber subscribes to device telemetry published to an MQTT broker, mapping each message to a reading that's
+// buffered in the outbox until it's ingested.  Messages are acknowledged once their readings are in the outbox; if
+// the outbox is full, the subscriber disconnects, so that the broker redelivers the unacknowledged messages when the
+// (persistent) session is resumed.
+type Subscriber struct {
+	Options       mqtt.Options
+	Mappings      []Mapping
+	Outbox        *Outbox
+	Ingester      *Ingester
+	RetryInterval time.Duration
+	flush         chan struct{}
+	stall         chan struct{}
+}
+
+// NewSubscriber returns a subscriber connecting to the broker with a persistent session
+func NewSubscriber(options mqtt.Options, mappings []Mapping, outbox *Outbox, ingester *Ingester) *Subscriber {
+	options.CleanSession = false
+	return &Subscriber{
+		Options:       options,
+		Mappings:      mappings,
+		Outbox:        outbox,
+		Ingester:      ingester,
+		RetryInterval: DefaultRetryInterval,
+	}
+}
+
+// Run subscribes to the mapped topics and ingests the readings until the stop channel is closed, reconnecting to the
+// broker whenever the connection is lost
+func (s *Subscriber) Run(stop <-chan struct{}) {
+	s.flush, s.stall = make(chan struct{}, 1), make(chan struct{}, 1)
+	flushed := make(chan struct{})
+	go func() {
+		s.flushLoop(stop)
+		close(flushed)
+	}()
+	defer func() { <-flushed }()
+
+	options := s.Options
+	options.Handler = s.handle
+	for {
+		c, err := mqtt.Dial(options)
+		if err == nil {
+			if _, err = c.Subscribe(s.subscriptions()...); err != nil {
+				c.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Can't subscribe to MQTT broker %s.  Error: %s", options.Broker, err.Error())
+		} else {
+			log.Printf("Subscribed to MQTT broker %s.", options.Broker)
+			select {
+			case <-stop:
+				c.Close()
+				return
+			case <-c.Done():
+				log.Printf("Lost connection to MQTT broker %s.  Error: %s", options.Broker, c.Err().Error())
+			case <-s.stall:
+				log.Printf("Outbox is full; disconnecting from MQTT broker %s until readings are ingested.", options.Broker)
+				c.Close()
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.RetryInterval):
+		}
+	}
+}
+
+// subscriptions returns the subscriptions to the mapped topics, at the highest QoS mapped for each topic
+func (s *Subscriber) subscriptions() []mqtt.Subscription {
+	var subscriptions []mqtt.Subscription
+	index := make(map[string]int)
+	for _, m := range s.Mappings {
+		if i, ok := index[m.Topic]; ok {
+			if *m.QoS > subscriptions[i].QoS {
+				subscriptions[i].QoS = *m.QoS
+			}
+			continue
+		}
+		index[m.Topic] = len(subscriptions)
+		subscriptions = append(subscriptions, mqtt.Subscription{Filter: m.Topic, QoS: *m.QoS})
+	}
+	return subscriptions
+}
+
+// handle maps the message to a reading with the first mapping matching its topic, and adds it to the outbox.  Messages
+// that can't be mapped are logged and dropped, since they'd fail again if they were redelivered.
+func (s *Subscriber) handle(m mqtt.Message) error {
+	var mapping *Mapping
+	for i := range s.Mappings {
+		if mqtt.MatchTopic(s.Mappings[i].Topic, m.Topic) {
+			mapping = &s.Mappings[i]
+			break
+		}
+	}
+	if mapping == nil {
+		log.Printf("Ignoring MQTT message on unmapped topic %s.", m.Topic)
+		return nil
+	}
+	reading, err := mapping.Reading(m.Topic, m.Payload)
+	if err != nil {
+		log.Printf("Ignoring MQTT message on topic %s.  Error: %s", m.Topic, err.Error())
+		return nil
+	}
+	if err := s.Outbox.Add(reading); err != nil {
+		log.Printf("Can't buffer reading from MQTT topic %s.  Error: %s", m.Topic, err.Error())
+		signal(s.stall)
+		return err
+	}
+	signal(s.flush)
+	return nil
+}
+
+// flushLoop flushes the outbox whenever readings are added, and retries the readings that failed periodically
+func (s *Subscriber) flushLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.flush:
+		case <-ticker.C:
+		}
+		results, err := s.Outbox.Flush(s.Ingester)
+		if err != nil {
+			log.Printf("Can't save outbox.  Error: %s", err.Error())
+		}
+		if len(results) == 0 {
+			continue
+		}
+		for _, result := range results {
+			if result.Status == Rejected {
+				log.Printf("Rejected MQTT reading.  Error: %s", result.Error.Error())
+			} else if result.Status == Failed && config.Logging(config.LogDebug) {
+				log.Printf("Failed to ingest MQTT reading; it will be retried.  Error: %s", result.Error.Error())
+			}
+		}
+		LogReadingResultSummary(results)
+	}
+}
+
+// signal sends to a channel with a buffer of 1 without blocking, so that repeated signals are coalesced
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,121 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+	"github.com/intervention-engine/multifactorriskservice/mqtt/mqtttest"
+)
+
+// runSubscriber runs a subscriber to a test broker with the test mappings until the returned function is called
+func (suite *IngesterSuite) runSubscriber(capacity int) (*mqtttest.Broker, *Outbox, func()) {
+	require := suite.Require()
+
+	broker, err := mqtttest.NewBroker()
+	require.NoError(err)
+	mappings, err := ParseMappings([]byte(testMappings), 1)
+	require.NoError(err)
+	outbox, err := NewOutbox("", capacity)
+	require.NoError(err)
+	s := NewSubscriber(mqtt.Options{Broker: broker.Addr, ClientID: "riskservice", Timeout: time.Second}, mappings, outbox, suite.Ingester)
+	s.RetryInterval = 20 * time.Millisecond
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(stopped)
+	}()
+	suite.eventually(func() bool { return broker.Subscribed("riskservice", "home/+/bp") })
+	return broker, outbox, func() {
+		close(stop)
+		<-stopped
+		broker.Close()
+	}
+}
+
+func (suite *IngesterSuite) publishWeight(broker *mqtttest.Broker, timestamp time.Time, lb float64) {
+	payload := fmt.Sprintf(`{"patient": "1", "ts": %q, "reading": {"lb": %g}}`, timestamp.Format(time.RFC3339), lb)
+	broker.Publish(mqtt.Message{Topic: "home/scale-1/weight", Payload: []byte(payload), QoS: 1})
+}
+
+// stored returns the number of observations written to the FHIR server
+func (suite *IngesterSuite) stored() int {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	return len(suite.Stored)
+}
+
+func (suite *IngesterSuite) setFailPosts(fail bool) {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	suite.FailPosts = fail
+}
+
+// eventually waits for the condition to be true
+func (suite *IngesterSuite) eventually(condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			suite.FailNow("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (suite *IngesterSuite) TestSubscriber() {
+	assert := suite.Assert()
+
+	broker, outbox, stop := suite.runSubscriber(10)
+	defer stop()
+
+	suite.publishWeight(broker, now, 132)
+	broker.Publish(mqtt.Message{Topic: "home/cuff-1/bp", Payload: []byte(`{"device-id": "cuff-1", "patient": "2", "time": 1456833600, "values": [120, 80]}`), QoS: 2})
+	// Malformed and unmapped messages are acknowledged and dropped
+	broker.Publish(mqtt.Message{Topic: "home/scale-1/weight", Payload: []byte(`132 lb`), QoS: 1})
+	broker.Publish(mqtt.Message{Topic: "home/scale-1/pulse", Payload: []byte(`72`), QoS: 1})
+	suite.eventually(func() bool { return suite.stored() == 2 })
+	suite.eventually(func() bool { return broker.Inflight("riskservice") == 0 && outbox.Len() == 0 })
+
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	assert.True(suite.Stored[ReadingIdentifierSystem+"|scale-1|body-weight|2016-03-01T12:00:00Z"])
+	assert.True(suite.Stored[ReadingIdentifierSystem+"|cuff-1|blood-pressure|2016-03-01T12:00:00Z"])
+}
+
+func (suite *IngesterSuite) TestSubscriberBuffersReadings() {
+	assert := suite.Assert()
+
+	broker, outbox, stop := suite.runSubscriber(10)
+	defer stop()
+
+	// Readings received while the FHIR server is down are acknowledged and kept in the outbox until they're written
+	suite.setFailPosts(true)
+	suite.publishWeight(broker, now, 132)
+	suite.publishWeight(broker, now.Add(-time.Hour), 133)
+	suite.eventually(func() bool { return outbox.Len() == 2 && broker.Inflight("riskservice") == 0 })
+	assert.Equal(0, suite.stored())
+
+	suite.setFailPosts(false)
+	suite.eventually(func() bool { return outbox.Len() == 0 })
+	assert.Equal(2, suite.stored())
+}
+
+func (suite *IngesterSuite) TestSubscriberOutboxFull() {
+	assert := suite.Assert()
+
+	broker, outbox, stop := suite.runSubscriber(1)
+	defer stop()
+
+	// When the outbox is full, messages aren't acknowledged, so they're redelivered once there's room
+	suite.setFailPosts(true)
+	suite.publishWeight(broker, now, 132)
+	suite.eventually(func() bool { return outbox.Len() == 1 })
+	suite.publishWeight(broker, now.Add(-time.Hour), 133)
+	suite.eventually(func() bool { return !broker.Connected("riskservice") })
+	assert.Equal(1, broker.Inflight("riskservice"))
+
+	suite.setFailPosts(false)
+	suite.eventually(func() bool { return suite.stored() == 2 })
+	suite.eventually(func() bool { return broker.Inflight("riskservice") == 0 && outbox.Len() == 0 })
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/nutrition"
+)
+
+// runExport writes the stored risk pies to a file (or standard output) as JSON or CSV
+func runExport(args []string) int {
+	s := newSettings("export", "", "Exports the stored risk pies as JSON (the stored pies) or CSV (one row per pie, with its overall score).")
+	s.addStore("pies.json")
+	formatFlag := s.loader.String("format", "EXPORT_FORMAT", "json", "Export format: json or csv")
+	outFlag := s.loader.String("out", "EXPORT_FILE", "-", "File to export to, or - for standard output")
+	historyFlag := s.loader.Bool("history", "Flag to include superseded pies in the export")
+	s.addModel()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	model, err := s.model()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	// Pies are scored with the model that produced them: the REDCap model or one of the hosted plugins' models
+	exportModels := []client.ModelConfig{model, client.NewModelConfig(nutrition.NutritionRiskServiceConfig, nil)}
+	var write func(io.Writer, []models.StoredPie, []client.ModelConfig) error
+	switch *formatFlag {
+	case "json":
+		write = writePiesJSON
+	case "csv":
+		write = writePiesCSV
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown export format: %s\n", *formatFlag)
+		return 2
+	}
+
+	pieStore, err := s.openStore("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer pieStore.Close()
+	pies, err := pieStore.List(*historyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't list the stored pies:", err.Error())
+		return 1
+	}
+
+	out := os.Stdout
+	if *outFlag != "-" {
+		if out, err = os.Create(*outFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer out.Close()
+	}
+	if err := write(out, pies, exportModels); err != nil {
+		fmt.Fprintln(os.Stderr, "Can't export the stored pies:", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// writePiesJSON writes the pies as a JSON array
+func writePiesJSON(w io.Writer, pies []models.StoredPie, exportModels []client.ModelConfig) error {
+	if pies == nil {
+		pies = []models.StoredPie{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(pies)
+}
+
+// writePiesCSV writes a CSV row for each pie, with its overall score and the value of each of the models' default pie
+// slices.  Each pie is scored with the aggregation strategy of the model whose method produced it; the score of a pie
+// produced by none of the models is left empty.
+func writePiesCSV(w io.Writer, pies []models.StoredPie, exportModels []client.ModelConfig) error {
+	header := []string{"id", "patient", "method", "asOf", "version", "superseded", "score"}
+	var sliceNames []string
+	for _, model := range exportModels {
+		for _, slice := range model.DefaultPieSlices {
+			if !contains(sliceNames, slice.Name) {
+				sliceNames = append(sliceNames, slice.Name)
+			}
+		}
+	}
+	header = append(header, sliceNames...)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i := range pies {
+		pie := &pies[i]
+		var method string
+		if pie.Method != nil && len(pie.Method.Coding) > 0 {
+			method = pie.Method.Coding[0].System + "|" + pie.Method.Coding[0].Code
+		}
+		var score string
+		if model := pieModel(pie, exportModels); model != nil {
+			result := pie.ToRiskServiceCalculationResult(model.Aggregation)
+			if value := result.GetProbabilityDecimalOrScore(); value != nil {
+				score = strconv.FormatFloat(*value, 'f', -1, 64)
+			}
+		}
+		asOf := pie.AsOf
+		if asOf.IsZero() {
+			asOf = pie.Created
+		}
+		row := []string{pie.Id.Hex(), pie.Patient, method, asOf.Format(time.RFC3339), strconv.Itoa(pie.Version), strconv.FormatBool(pie.Superseded), score}
+		for _, name := range sliceNames {
+			var value string
+			for _, slice := range pie.Slices {
+				if slice.Name == name {
+					value = strconv.Itoa(slice.Value)
+				}
+			}
+			row = append(row, value)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// pieModel returns the model whose method produced the pie, or nil if there is none
+func pieModel(pie *models.StoredPie, exportModels []client.ModelConfig) *client.ModelConfig {
+	if pie.Method == nil {
+		return nil
+	}
+	for i := range exportModels {
+		method := exportModels[i].Method.Coding[0]
+		if pie.Method.MatchesCode(method.System, method.Code) {
+			return &exportModels[i]
+		}
+	}
+	return nil
+}
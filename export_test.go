@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/nutrition"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestExportSuite(t *testing.T) {
+	suite.Run(t, new(ExportSuite))
+}
+
+type ExportSuite struct {
+	suite.Suite
+	Pies []models.StoredPie
+}
+
+func (suite *ExportSuite) SetupTest() {
+	result := plugin.RiskServiceCalculationResult{AsOf: time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	result.Pie = plugin.NewPie("http://fhir/Patient/1")
+	result.Pie.Slices = []plugin.Slice{
+		{Name: "Clinical Risk", Weight: 25, Value: 1, MaxValue: 4},
+		{Name: "Functional and Environmental Risk", Weight: 25, Value: 3, MaxValue: 4},
+		{Name: "Utilization Risk", Weight: 25, Value: 2, MaxValue: 4},
+	}
+	pie := models.NewStoredPie(&result, fhir.CodeableConcept{
+		Coding: []fhir.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "MultiFactor"}},
+	})
+	pie.Version = 2
+	suite.Pies = []models.StoredPie{*pie}
+}
+
+func (suite *ExportSuite) TestWritePiesCSV() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var buf bytes.Buffer
+	require.NoError(writePiesCSV(&buf, suite.Pies, []client.ModelConfig{client.NewREDCapModelConfig(nil)}))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(err)
+	require.Len(rows, 2)
+	assert.Equal([]string{"id", "patient", "method", "asOf", "version", "superseded", "score", "Clinical Risk",
+		"Functional and Environmental Risk", "Psychosocial and Mental Health Risk", "Utilization Risk"}, rows[0])
+	assert.Equal([]string{suite.Pies[0].Id.Hex(), "http://fhir/Patient/1", "http://interventionengine.org/risk-assessments|MultiFactor",
+		"2016-01-01T00:00:00Z", "2", "false", "3", "1", "3", "", "2"}, rows[1])
+}
+
+func (suite *ExportSuite) TestWritePiesCSVScoresPiesByMethod() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	result := plugin.RiskServiceCalculationResult{AsOf: time.Date(2016, time.February, 1, 0, 0, 0, 0, time.UTC)}
+	result.Pie = plugin.NewPie("http://fhir/Patient/1")
+	result.Pie.Slices = []plugin.Slice{
+		{Name: nutrition.BMISlice, Weight: 35, Value: 2, MaxValue: 4},
+		{Name: nutrition.WeightLossSlice, Weight: 35, Value: 4, MaxValue: 4},
+		{Name: nutrition.BiochemicalSlice, Weight: 30, Value: 1, MaxValue: 4},
+	}
+	pies := append(suite.Pies, *models.NewStoredPie(&result, nutrition.NutritionRiskServiceConfig.Method))
+	unknown := models.NewStoredPie(&result, fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://example.org", Code: "Other"}}})
+	pies = append(pies, *unknown)
+
+	// The REDCap pie is scored with the weighted sum, and the nutrition pie with the nutrition model's maximum
+	exportModels := []client.ModelConfig{
+		client.NewREDCapModelConfig(models.WeightedSumAggregation{}),
+		client.NewModelConfig(nutrition.NutritionRiskServiceConfig, nil),
+	}
+	var buf bytes.Buffer
+	require.NoError(writePiesCSV(&buf, pies, exportModels))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(err)
+	require.Len(rows, 4)
+	assert.Equal([]string{"id", "patient", "method", "asOf", "version", "superseded", "score", "Clinical Risk",
+		"Functional and Environmental Risk", "Psychosocial and Mental Health Risk", "Utilization Risk",
+		nutrition.BMISlice, nutrition.WeightLossSlice, nutrition.BiochemicalSlice}, rows[0])
+	assert.Equal("http://interventionengine.org/risk-assessments|MultiFactor", rows[1][2])
+	assert.Equal("38", rows[1][6])
+	assert.Equal([]string{"1", "3", "", "2", "", "", ""}, rows[1][7:])
+	assert.Equal("http://interventionengine.org/risk-assessments|Nutrition", rows[2][2])
+	assert.Equal("4", rows[2][6])
+	assert.Equal([]string{"", "", "", "", "2", "4", "1"}, rows[2][7:])
+	assert.Equal("", rows[3][6])
+}
+
+func (suite *ExportSuite) TestWritePiesJSON() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var buf bytes.Buffer
+	require.NoError(writePiesJSON(&buf, suite.Pies, nil))
+	var pies []models.StoredPie
+	require.NoError(json.Unmarshal(buf.Bytes(), &pies))
+	require.Len(pies, 1)
+	assert.Equal(suite.Pies[0].Id, pies[0].Id)
+	assert.Equal(2, pies[0].Version)
+
+	// An empty store is exported as an empty array
+	buf.Reset()
+	require.NoError(writePiesJSON(&buf, nil, nil))
+	assert.Equal("[]\n", buf.String())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+)
+
+// runImport posts the risk assessments in a REDCap export file (JSON, CSV or XML) to the FHIR server and stores their pies,
+// exiting with a non-zero status if any patient's risk assessments couldn't be imported
+func runImport(args []string) int {
+	s := newSettings("import", " <file>", "Imports the risk assessments in a REDCap export file (JSON, CSV with raw or label headers, or flat XML).")
+	s.addHTTP()
+	s.addStore("pies.json")
+	s.addFHIR()
+	s.addModel()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+	if len(s.args()) != 1 {
+		fmt.Fprintln(os.Stderr, "Exactly one REDCap export file must be passed in.")
+		s.loader.FlagSet.Usage()
+		return 2
+	}
+	path := s.args()[0]
+
+	model, err := s.model()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	records, err := redcap.FileRecordSource{Path: path}.Records()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	pieStore, err := s.openStore("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer pieStore.Close()
+
+	results, err := client.ImportRiskAssessments(*s.FHIR, records, pieStore, s.basisPieURL(), model)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid REDCap records in %s: %s\n", path, err.Error())
+		return 1
+	}
+	return resultsExitStatus(results)
+}
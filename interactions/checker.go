@@ -0,0 +1,256 @@
+package interactions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// DetectedIssueIdentifierSystem is the system of the identifiers given to the DetectedIssues.  The identifier is
+// unique to the patient, interaction and medication, so checking the patient again updates its issues.
+const DetectedIssueIdentifierSystem = "http://interventionengine.org/fhir/drug-nutrient-interactions"
+
+// InteractionTypeSystem is the system of the codes of the interaction types (interaction or depletion)
+const InteractionTypeSystem = "http://interventionengine.org/fhir/drug-nutrient-interaction-types"
+
+// ErrPatientNotFound is returned when checking a patient that isn't on the FHIR server
+var ErrPatientNotFound = errors.New("Patient not found")
+
+// Finding is an interaction of one of a patient's medications.  DetectedIssue is the location of the DetectedIssue
+// written for it, if any.
+type Finding struct {
+	Interaction   *Interaction `json:"interaction"`
+	Medication    string       `json:"medication"`
+	Name          string       `json:"name,omitempty"`
+	DetectedIssue string       `json:"detectedIssue,omitempty"`
+}
+
+// Key returns the finding's DetectedIssue identifier value: its patient, interaction and medication
+func (f *Finding) Key(patientID string) string {
+	return patientID + "|" + f.Interaction.ID + "|" + f.Medication
+}
+
+// ToDetectedIssue returns the finding as a DetectedIssue for the patient, detected at the given time and implicating
+// the medication's statement or order
+func (f *Finding) ToDetectedIssue(patientID string, t time.Time) *fhir.DetectedIssue {
+	detail := f.Interaction.Detail
+	if f.Interaction.Constraint.Detail != "" {
+		detail += " " + f.Interaction.Constraint.Detail
+	}
+	return &fhir.DetectedIssue{
+		Identifier: &fhir.Identifier{System: DetectedIssueIdentifierSystem, Value: f.Key(patientID)},
+		Patient:    &fhir.Reference{Reference: "Patient/" + patientID},
+		Category: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://hl7.org/fhir/v3/ActCode", Code: "FOOD", Display: "Food Interaction Alert"},
+				{System: InteractionTypeSystem, Code: f.Interaction.Type},
+			},
+			Text: f.Interaction.Drug + " and " + f.Interaction.Nutrient,
+		},
+		Severity:   f.Interaction.Severity,
+		Implicated: []fhir.Reference{{Reference: f.Medication, Display: f.Name}},
+		Detail:     detail,
+		Date:       &fhir.FHIRDateTime{Time: t, Precision: fhir.Timestamp},
+	}
+}
+
+// Evaluate returns the interactions of the medications
+func Evaluate(kb *KnowledgeBase, meds []Medication) []Finding {
+	var findings []Finding
+	for i := range meds {
+		for _, interaction := range kb.Match(meds[i].Code) {
+			findings = append(findings, Finding{Interaction: interaction, Medication: meds[i].Resource, Name: meds[i].Name()})
+		}
+	}
+	return findings
+}
+
+// Constraints returns the constraints the findings place on nutrition recommendations, with one constraint for each
+// nutrient and action.  Where more than one finding limits a nutrient, the lowest limit is kept.
+func Constraints(findings []Finding) []Constraint {
+	var constraints []Constraint
+	index := make(map[string]int)
+	for _, f := range findings {
+		c := f.Interaction.Constraint
+		key := c.Nutrient + "|" + c.Action
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(constraints)
+			constraints = append(constraints, c)
+			continue
+		}
+		if c.LimitMg > 0 && (constraints[i].LimitMg == 0 || c.LimitMg < constraints[i].LimitMg) {
+			constraints[i].LimitMg = c.LimitMg
+		}
+	}
+	sort.Sort(byNutrient(constraints))
+	return constraints
+}
+
+// byNutrient sorts constraints by nutrient and action
+type byNutrient []Constraint
+
+func (c byNutrient) Len() int      { return len(c) }
+func (c byNutrient) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byNutrient) Less(i, j int) bool {
+	if c[i].Nutrient != c[j].Nutrient {
+		return c[i].Nutrient < c[j].Nutrient
+	}
+	return c[i].Action < c[j].Action
+}
+
+// Report is the outcome of checking a patient's medications
+type Report struct {
+	PatientID   string       `json:"patientId"`
+	Findings    []Finding    `json:"findings"`
+	Constraints []Constraint `json:"constraints"`
+}
+
+// Checker checks patients' current medications against the knowledge base, writing the interactions to the FHIR
+// server as DetectedIssues
+type Checker struct {
+	KB           *KnowledgeBase
+	FHIREndpoint string
+}
+
+// NewChecker returns a checker of the medications on the FHIR server
+func NewChecker(kb *KnowledgeBase, fhirEndpoint string) *Checker {
+	return &Checker{KB: kb, FHIREndpoint: strings.TrimSuffix(fhirEndpoint, "/")}
+}
+
+// Check checks the medications the patient is currently taking, writing a DetectedIssue for each interaction and
+// removing the DetectedIssues of medications the patient is no longer taking.  It returns ErrPatientNotFound if the
+// patient isn't on the FHIR server.
+func (c *Checker) Check(patientID string) (*Report, error) {
+	res, err := http.Get(c.FHIREndpoint + "/Patient/" + url.QueryEscape(patientID))
+	if err != nil {
+		return nil, fmt.Errorf("Can't get patient %s: %s", patientID, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		return nil, ErrPatientNotFound
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received HTTP %d %s from FHIR server when getting patient %s.", res.StatusCode, res.Status, patientID)
+	}
+
+	meds, err := GetMedications(c.FHIREndpoint, patientID)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get medications for patient %s: %s", patientID, err.Error())
+	}
+	now := models.Now()
+	var current []Medication
+	for _, m := range meds {
+		if m.TakenAt(now) {
+			current = append(current, m)
+		}
+	}
+
+	report := &Report{PatientID: patientID, Findings: Evaluate(c.KB, current)}
+	if err := WriteDetectedIssues(c.FHIREndpoint, patientID, report.Findings, now); err != nil {
+		return nil, err
+	}
+	report.Constraints = Constraints(report.Findings)
+	return report, nil
+}
+
+// WriteDetectedIssues writes the DetectedIssues of the patient's current findings, setting each finding's
+// DetectedIssue location, and deletes the patient's other drug-nutrient interaction DetectedIssues (i.e., those of
+// medications the patient has stopped taking).  Issues that were already detected keep their date, so only new issues
+// are detected at the given time.
+func WriteDetectedIssues(fhirEndpoint, patientID string, findings []Finding, t time.Time) error {
+	existing, err := getDetectedIssues(fhirEndpoint, patientID)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for i := range findings {
+		key := findings[i].Key(patientID)
+		current[key] = true
+		detected := t
+		if issue, ok := existing[key]; ok && issue.Date != nil {
+			detected = issue.Date.Time
+		}
+		location, err := WriteDetectedIssue(fhirEndpoint, patientID, &findings[i], detected)
+		if err != nil {
+			return err
+		}
+		findings[i].DetectedIssue = location
+	}
+	for key, issue := range existing {
+		if !current[key] {
+			if err := deleteDetectedIssue(fhirEndpoint, patientID, issue.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getDetectedIssues queries the FHIR server for the patient's drug-nutrient interaction DetectedIssues, returning
+// them by their identifier value
+func getDetectedIssues(fhirEndpoint, patientID string) (map[string]*fhir.DetectedIssue, error) {
+	issues := make(map[string]*fhir.DetectedIssue)
+	query := strings.TrimSuffix(fhirEndpoint, "/") + "/DetectedIssue?" + url.Values{"patient": []string{patientID}}.Encode()
+	err := client.ForEachBundle(query, func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			if issue, ok := entry.Resource.(*fhir.DetectedIssue); ok && issue.Identifier != nil && issue.Identifier.System == DetectedIssueIdentifierSystem {
+				issues[issue.Identifier.Value] = issue
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't get detected issues for patient %s: %s", patientID, err.Error())
+	}
+	return issues, nil
+}
+
+// deleteDetectedIssue deletes the DetectedIssue with the ID from the FHIR server
+func deleteDetectedIssue(fhirEndpoint, patientID, id string) error {
+	req, err := http.NewRequest("DELETE", strings.TrimSuffix(fhirEndpoint, "/")+"/DetectedIssue/"+url.QueryEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't delete detected issue %s for patient %s: %s", id, patientID, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusGone {
+		return fmt.Errorf("Received HTTP %d %s from FHIR server when deleting detected issue %s for patient %s.", res.StatusCode, res.Status, id, patientID)
+	}
+	return nil
+}
+
+// WriteDetectedIssue writes the finding's DetectedIssue, detected at the given time, with a conditional update on its
+// identifier, so that each is only stored once, returning the DetectedIssue's location
+func WriteDetectedIssue(fhirEndpoint, patientID string, f *Finding, t time.Time) (string, error) {
+	data, err := json.Marshal(f.ToDetectedIssue(patientID, t))
+	if err != nil {
+		return "", err
+	}
+	query := url.QueryEscape(DetectedIssueIdentifierSystem + "|" + f.Key(patientID))
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(fhirEndpoint, "/")+"/DetectedIssue?identifier="+query, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Can't write detected issue for patient %s: %s", patientID, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Received HTTP %d %s from FHIR server when writing detected issue for patient %s.", res.StatusCode, res.Status, patientID)
+	}
+	return res.Header.Get("Location"), nil
+}
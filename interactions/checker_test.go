@@ -0,0 +1,212 @@
+package interactions
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestCheckerSuite(t *testing.T) {
+	suite.Run(t, new(CheckerSuite))
+}
+
+type CheckerSuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Statements []interface{}
+	Orders     []interface{}
+	Issues     []interface{}
+	Written    map[string]*fhir.DetectedIssue
+	Deleted    []string
+}
+
+func (suite *CheckerSuite) SetupTest() {
+	suite.Statements = nil
+	suite.Orders = nil
+	suite.Issues, suite.Deleted = nil, nil
+	suite.Written = make(map[string]*fhir.DetectedIssue)
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/Patient/123":
+			json.NewEncoder(w).Encode(&fhir.Patient{DomainResource: fhir.DomainResource{Resource: fhir.Resource{Id: "123"}}})
+		case r.Method == "GET" && r.URL.Path == "/MedicationStatement" && r.URL.Query().Get("patient") == "123":
+			suite.Equal("MedicationStatement:medication", r.URL.Query().Get("_include"))
+			json.NewEncoder(w).Encode(bundle(suite.Statements))
+		case r.Method == "GET" && r.URL.Path == "/MedicationOrder" && r.URL.Query().Get("patient") == "123":
+			suite.Equal("MedicationOrder:medication", r.URL.Query().Get("_include"))
+			json.NewEncoder(w).Encode(bundle(suite.Orders))
+		case r.Method == "GET" && r.URL.Path == "/DetectedIssue" && r.URL.Query().Get("patient") == "123":
+			json.NewEncoder(w).Encode(bundle(suite.Issues))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/DetectedIssue/"):
+			suite.Deleted = append(suite.Deleted, strings.TrimPrefix(r.URL.Path, "/DetectedIssue/"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT" && r.URL.Path == "/DetectedIssue" && r.URL.Query().Get("identifier") != "":
+			issue := &fhir.DetectedIssue{}
+			json.NewDecoder(r.Body).Decode(issue)
+			suite.Written[r.URL.Query().Get("identifier")] = issue
+			w.Header().Set("Location", "/DetectedIssue/"+issue.Identifier.Value)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (suite *CheckerSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func bundle(resources []interface{}) *fhir.Bundle {
+	b := &fhir.Bundle{Type: "searchset"}
+	for _, r := range resources {
+		b.Entry = append(b.Entry, fhir.BundleEntryComponent{Resource: r})
+	}
+	return b
+}
+
+func statement(id, status string, code *fhir.CodeableConcept) *fhir.MedicationStatement {
+	s := &fhir.MedicationStatement{Status: status, MedicationCodeableConcept: code}
+	s.Id = id
+	s.Patient = &fhir.Reference{Reference: "Patient/123"}
+	return s
+}
+
+func order(id, status string, ref string) *fhir.MedicationOrder {
+	o := &fhir.MedicationOrder{Status: status, MedicationReference: &fhir.Reference{Reference: ref}}
+	o.Id = id
+	o.Patient = &fhir.Reference{Reference: "Patient/123"}
+	return o
+}
+
+func (suite *CheckerSuite) TestCheck() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	notTaken := true
+	skipped := statement("4", "active", rxnorm("6851", "Methotrexate"))
+	skipped.WasNotTaken = &notTaken
+	ended := statement("5", "completed", rxnorm("6038", "Isoniazid"))
+	ended.EffectivePeriod = &fhir.Period{
+		Start: &fhir.FHIRDateTime{Time: time.Now().AddDate(0, -6, 0), Precision: fhir.Date},
+		End:   &fhir.FHIRDateTime{Time: time.Now().AddDate(0, -1, 0), Precision: fhir.Date},
+	}
+	suite.Statements = []interface{}{
+		statement("1", "active", rxnorm("11289", "Warfarin")),
+		statement("2", "active", rxnorm("161", "Acetaminophen")),
+		statement("3", "entered-in-error", rxnorm("8123", "Phenelzine")),
+		skipped,
+		ended,
+	}
+	spironolactone := &fhir.Medication{Code: rxnorm("9997", "Spironolactone")}
+	spironolactone.Id = "m1"
+	lisinopril := &fhir.Medication{Code: rxnorm("29046", "Lisinopril")}
+	lisinopril.Id = "m2"
+	suite.Orders = []interface{}{
+		order("10", "active", "Medication/m1"),
+		order("11", "active", "Medication/m2"),
+		order("12", "stopped", "Medication/m2"),
+		spironolactone,
+		lisinopril,
+	}
+
+	report, err := NewChecker(DefaultKnowledgeBase(), suite.FHIRServer.URL+"/").Check("123")
+	require.NoError(err)
+	assert.Equal("123", report.PatientID)
+	require.Len(report.Findings, 3)
+	assert.Equal("warfarin-vitamin-k", report.Findings[0].Interaction.ID)
+	assert.Equal("MedicationStatement/1", report.Findings[0].Medication)
+	assert.Equal("Warfarin", report.Findings[0].Name)
+	assert.Equal("/DetectedIssue/123|warfarin-vitamin-k|MedicationStatement/1", report.Findings[0].DetectedIssue)
+	assert.Equal("potassium-sparing-diuretic-potassium", report.Findings[1].Interaction.ID)
+	assert.Equal("MedicationOrder/10", report.Findings[1].Medication)
+	assert.Equal("ace-inhibitor-arb-potassium", report.Findings[2].Interaction.ID)
+	assert.Equal("MedicationOrder/11", report.Findings[2].Medication)
+
+	// The potassium limits are consolidated into one constraint
+	require.Len(report.Constraints, 2)
+	assert.Equal(Constraint{Nutrient: "Potassium", Action: Limit, LimitMg: 3000, Detail: "Avoid potassium supplements and salt substitutes."}, report.Constraints[0])
+	assert.Equal("Vitamin K", report.Constraints[1].Nutrient)
+
+	require.Len(suite.Written, 3)
+	issue := suite.Written[DetectedIssueIdentifierSystem+"|123|warfarin-vitamin-k|MedicationStatement/1"]
+	require.NotNil(issue)
+	assert.Equal("Patient/123", issue.Patient.Reference)
+	assert.Equal("high", issue.Severity)
+	require.Len(issue.Implicated, 1)
+	assert.Equal("MedicationStatement/1", issue.Implicated[0].Reference)
+	assert.True(issue.Category.MatchesCode(InteractionTypeSystem, InteractionType))
+	assert.Contains(issue.Detail, "leafy green vegetables")
+	assert.NotNil(issue.Date)
+}
+
+func (suite *CheckerSuite) TestCheckRemovesStoppedMedicationIssues() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	stopped := statement("1", "stopped", rxnorm("11289", "Warfarin"))
+	stopped.EffectivePeriod = &fhir.Period{
+		Start: &fhir.FHIRDateTime{Time: time.Now().AddDate(0, -6, 0), Precision: fhir.Date},
+		End:   &fhir.FHIRDateTime{Time: time.Now().AddDate(0, 0, -7), Precision: fhir.Date},
+	}
+	suite.Statements = []interface{}{stopped, statement("2", "active", rxnorm("6809", "Metformin"))}
+	// Both medications' issues were detected while they were being taken, and another system's issue is left alone
+	detected := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	issue := func(id, system, value string) *fhir.DetectedIssue {
+		i := &fhir.DetectedIssue{
+			Identifier: &fhir.Identifier{System: system, Value: value},
+			Date:       &fhir.FHIRDateTime{Time: detected, Precision: fhir.Timestamp},
+		}
+		i.Id = id
+		return i
+	}
+	suite.Issues = []interface{}{
+		issue("a", DetectedIssueIdentifierSystem, "123|warfarin-vitamin-k|MedicationStatement/1"),
+		issue("b", DetectedIssueIdentifierSystem, "123|metformin-vitamin-b12|MedicationStatement/2"),
+		issue("c", "http://other", "123|warfarin-vitamin-k|MedicationStatement/1"),
+	}
+
+	report, err := NewChecker(DefaultKnowledgeBase(), suite.FHIRServer.URL).Check("123")
+	require.NoError(err)
+	require.Len(report.Findings, 1)
+	assert.Equal("metformin-vitamin-b12", report.Findings[0].Interaction.ID)
+
+	// The stopped warfarin's issue is deleted, and the metformin's keeps the date it was detected
+	assert.Equal([]string{"a"}, suite.Deleted)
+	require.Len(suite.Written, 1)
+	written := suite.Written[DetectedIssueIdentifierSystem+"|123|metformin-vitamin-b12|MedicationStatement/2"]
+	require.NotNil(written)
+	assert.True(written.Date.Time.Equal(detected))
+}
+
+func (suite *CheckerSuite) TestCheckWithoutMedications() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	report, err := NewChecker(DefaultKnowledgeBase(), suite.FHIRServer.URL).Check("123")
+	require.NoError(err)
+	assert.Empty(report.Findings)
+	assert.Empty(report.Constraints)
+	assert.Empty(suite.Written)
+}
+
+func (suite *CheckerSuite) TestCheckPatientNotFound() {
+	_, err := NewChecker(DefaultKnowledgeBase(), suite.FHIRServer.URL).Check("456")
+	suite.Assert().Equal(ErrPatientNotFound, err)
+}
+
+func (suite *CheckerSuite) TestTakenAt() {
+	assert := suite.Assert()
+
+	now := time.Now()
+	assert.True((&Medication{Current: true}).TakenAt(now))
+	assert.False((&Medication{Current: true, Start: now.AddDate(0, 0, 1)}).TakenAt(now))
+	assert.False((&Medication{Current: false}).TakenAt(now))
+	assert.True((&Medication{Current: false, End: now.AddDate(0, 0, 1)}).TakenAt(now))
+	assert.False((&Medication{Current: true, End: now.AddDate(0, 0, -1)}).TakenAt(now))
+}
@@ -0,0 +1,346 @@
+// Package interactions evaluates a patient's medications against a knowledge base of drug-nutrient interactions and
+// nutrient depletions, reporting each as a FHIR DetectedIssue along with the constraints it places on the patient's
+// nutrition recommendations.
+package interactions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	fhir "github.com/intervention-engine/fhir/models"
+)
+
+// RxNormSystem is the code system of the medications in the knowledge base
+const RxNormSystem = "http://www.nlm.nih.gov/research/umls/rxnorm"
+
+// The types of interactions: a drug whose effect is changed by a nutrient (or food), or a drug that depletes a nutrient
+const (
+	InteractionType = "interaction"
+	DepletionType   = "depletion"
+)
+
+// The actions that constraints on nutrition recommendations may require
+const (
+	Avoid      = "avoid"
+	Limit      = "limit"
+	Consistent = "consistent"
+	Increase   = "increase"
+	Supplement = "supplement"
+	Separate   = "separate"
+	Monitor    = "monitor"
+)
+
+var (
+	types      = []string{InteractionType, DepletionType}
+	severities = []string{"high", "moderate", "low"}
+	actions    = []string{Avoid, Limit, Consistent, Increase, Supplement, Separate, Monitor}
+)
+
+// Constraint is a constraint on a patient's nutrition recommendations: an action regarding a nutrient (or food), such
+// as avoiding grapefruit or keeping vitamin K intake consistent.  LimitMg is the daily maximum (in mg) of a nutrient
+// that's limited, or 0 if there's no particular maximum.
+type Constraint struct {
+	Nutrient string  `json:"nutrient"`
+	Action   string  `json:"action"`
+	LimitMg  float64 `json:"limitMg,omitempty"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+// Text returns a sentence describing the constraint, followed by its detail (if any)
+func (c *Constraint) Text() string {
+	nutrient := c.Nutrient
+	var text string
+	switch c.Action {
+	case Avoid:
+		text = "Avoid " + nutrient + "."
+	case Limit:
+		text = "Limit " + nutrient
+		if c.LimitMg > 0 {
+			text += " to " + strconv.FormatFloat(c.LimitMg, 'f', -1, 64) + " mg a day"
+		}
+		text += "."
+	case Consistent:
+		text = "Keep the intake of " + nutrient + " consistent."
+	case Increase:
+		text = "Increase the intake of " + nutrient + "."
+	case Supplement:
+		text = "Supplement " + nutrient + "."
+	case Separate:
+		text = "Take " + nutrient + " apart from the medication."
+	case Monitor:
+		text = "Monitor " + nutrient + "."
+	default:
+		text = c.Action + " " + nutrient + "."
+	}
+	if c.Detail != "" {
+		text += " " + c.Detail
+	}
+	return text
+}
+
+// Interaction is a drug-nutrient interaction or depletion.  The drug is identified by its RxNorm codes (typically the
+// ingredients' RxCUIs, along with any clinical drugs that should also match), or by its names, which are matched
+// case-insensitively against the text of medications that aren't coded in RxNorm.  Severity is a DetectedIssue
+// severity: high, moderate or low.
+type Interaction struct {
+	ID         string     `json:"id"`
+	Drug       string     `json:"drug"`
+	RxNorm     []string   `json:"rxnorm"`
+	Names      []string   `json:"names,omitempty"`
+	Nutrient   string     `json:"nutrient"`
+	Type       string     `json:"type"`
+	Severity   string     `json:"severity"`
+	Detail     string     `json:"detail"`
+	Constraint Constraint `json:"constraint"`
+}
+
+// Matches returns true if the medication code is the interaction's drug
+func (i *Interaction) Matches(code *fhir.CodeableConcept) bool {
+	if code == nil {
+		return false
+	}
+	coded := false
+	for _, coding := range code.Coding {
+		if coding.System != RxNormSystem {
+			continue
+		}
+		coded = true
+		if contains(i.RxNorm, coding.Code) {
+			return true
+		}
+	}
+	if coded {
+		return false
+	}
+	text := []string{strings.ToLower(code.Text)}
+	for _, coding := range code.Coding {
+		text = append(text, strings.ToLower(coding.Display))
+	}
+	for _, name := range i.Names {
+		for _, t := range text {
+			if t != "" && strings.Contains(t, strings.ToLower(name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KnowledgeBase is a collection of drug-nutrient interactions and depletions
+type KnowledgeBase struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Match returns the interactions of the medication code's drug
+func (kb *KnowledgeBase) Match(code *fhir.CodeableConcept) []*Interaction {
+	var matched []*Interaction
+	for i := range kb.Interactions {
+		if kb.Interactions[i].Matches(code) {
+			matched = append(matched, &kb.Interactions[i])
+		}
+	}
+	return matched
+}
+
+// LoadKnowledgeBase loads and validates the JSON knowledge base at the given path
+func LoadKnowledgeBase(path string) (*KnowledgeBase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	kb := new(KnowledgeBase)
+	if err := json.NewDecoder(f).Decode(kb); err != nil {
+		return nil, fmt.Errorf("Invalid interaction knowledge base %s: %s", path, err.Error())
+	}
+	if err := kb.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid interaction knowledge base %s: %s", path, err.Error())
+	}
+	return kb, nil
+}
+
+// validate ensures each interaction has a unique ID, identifies its drug, and has a valid type, severity and
+// constraint
+func (kb *KnowledgeBase) validate() error {
+	if len(kb.Interactions) == 0 {
+		return fmt.Errorf("At least one interaction is required")
+	}
+	ids := make(map[string]bool)
+	for _, i := range kb.Interactions {
+		switch {
+		case i.ID == "":
+			return fmt.Errorf("Interaction of %s with %s has no id", i.Drug, i.Nutrient)
+		case ids[i.ID]:
+			return fmt.Errorf("Interaction %s is defined more than once", i.ID)
+		case len(i.RxNorm) == 0 && len(i.Names) == 0:
+			return fmt.Errorf("Interaction %s needs RxNorm codes or names", i.ID)
+		case i.Nutrient == "" || i.Constraint.Nutrient == "":
+			return fmt.Errorf("Interaction %s needs a nutrient", i.ID)
+		case !contains(types, i.Type):
+			return fmt.Errorf("Interaction %s has invalid type %q: must be one of %s", i.ID, i.Type, strings.Join(types, ", "))
+		case !contains(severities, i.Severity):
+			return fmt.Errorf("Interaction %s has invalid severity %q: must be one of %s", i.ID, i.Severity, strings.Join(severities, ", "))
+		case !contains(actions, i.Constraint.Action):
+			return fmt.Errorf("Interaction %s has invalid action %q: must be one of %s", i.ID, i.Constraint.Action, strings.Join(actions, ", "))
+		case i.Constraint.LimitMg < 0 || (i.Constraint.LimitMg > 0 && i.Constraint.Action != Limit):
+			return fmt.Errorf("Interaction %s can only have a positive limitMg with the limit action", i.ID)
+		}
+		ids[i.ID] = true
+	}
+	return nil
+}
+
+// DefaultKnowledgeBase returns the built-in knowledge base of common drug-nutrient interactions and depletions.  Drugs
+// are identified by their ingredients' RxCUIs.
+func DefaultKnowledgeBase() *KnowledgeBase {
+	kb := &KnowledgeBase{Interactions: []Interaction{
+		{
+			ID:         "warfarin-vitamin-k",
+			Drug:       "Warfarin",
+			RxNorm:     []string{"11289"},
+			Names:      []string{"warfarin", "coumadin", "jantoven"},
+			Nutrient:   "Vitamin K",
+			Type:       InteractionType,
+			Severity:   "high",
+			Detail:     "Changes in vitamin K intake change the anticoagulant effect of warfarin.",
+			Constraint: Constraint{Nutrient: "Vitamin K", Action: Consistent, Detail: "Keep the daily intake of leafy green vegetables consistent."},
+		},
+		{
+			ID:         "metformin-vitamin-b12",
+			Drug:       "Metformin",
+			RxNorm:     []string{"6809"},
+			Names:      []string{"metformin", "glucophage"},
+			Nutrient:   "Vitamin B12",
+			Type:       DepletionType,
+			Severity:   "moderate",
+			Detail:     "Long-term metformin use reduces vitamin B12 absorption.",
+			Constraint: Constraint{Nutrient: "Vitamin B12", Action: Monitor, Detail: "Check vitamin B12 periodically, and supplement if it's low."},
+		},
+		{
+			ID:         "loop-diuretic-potassium",
+			Drug:       "Loop diuretics",
+			RxNorm:     []string{"4603", "1808", "38413"},
+			Names:      []string{"furosemide", "lasix", "bumetanide", "bumex", "torsemide"},
+			Nutrient:   "Potassium",
+			Type:       DepletionType,
+			Severity:   "moderate",
+			Detail:     "Loop diuretics increase the urinary loss of potassium and magnesium.",
+			Constraint: Constraint{Nutrient: "Potassium", Action: Increase, Detail: "Include potassium-rich foods, unless kidney function limits potassium."},
+		},
+		{
+			ID:         "thiazide-potassium",
+			Drug:       "Thiazide diuretics",
+			RxNorm:     []string{"5487", "2409", "6916"},
+			Names:      []string{"hydrochlorothiazide", "chlorthalidone", "metolazone"},
+			Nutrient:   "Potassium",
+			Type:       DepletionType,
+			Severity:   "moderate",
+			Detail:     "Thiazide diuretics increase the urinary loss of potassium.",
+			Constraint: Constraint{Nutrient: "Potassium", Action: Increase, Detail: "Include potassium-rich foods, unless kidney function limits potassium."},
+		},
+		{
+			ID:         "potassium-sparing-diuretic-potassium",
+			Drug:       "Potassium-sparing diuretics",
+			RxNorm:     []string{"9997", "298869", "644", "10763"},
+			Names:      []string{"spironolactone", "aldactone", "eplerenone", "amiloride", "triamterene"},
+			Nutrient:   "Potassium",
+			Type:       InteractionType,
+			Severity:   "high",
+			Detail:     "Potassium-sparing diuretics can cause hyperkalemia with a high potassium intake.",
+			Constraint: Constraint{Nutrient: "Potassium", Action: Limit, LimitMg: 3000, Detail: "Avoid potassium supplements and salt substitutes."},
+		},
+		{
+			ID:         "ace-inhibitor-arb-potassium",
+			Drug:       "ACE inhibitors and ARBs",
+			RxNorm:     []string{"29046", "3827", "35296", "1998", "52175", "69749", "83818"},
+			Names:      []string{"lisinopril", "enalapril", "ramipril", "captopril", "losartan", "valsartan", "irbesartan"},
+			Nutrient:   "Potassium",
+			Type:       InteractionType,
+			Severity:   "moderate",
+			Detail:     "ACE inhibitors and ARBs raise serum potassium.",
+			Constraint: Constraint{Nutrient: "Potassium", Action: Limit, LimitMg: 3000, Detail: "Avoid potassium supplements and salt substitutes."},
+		},
+		{
+			ID:         "ppi-vitamin-b12",
+			Drug:       "Proton pump inhibitors",
+			RxNorm:     []string{"7646", "40790", "283742", "17128"},
+			Names:      []string{"omeprazole", "prilosec", "pantoprazole", "esomeprazole", "nexium", "lansoprazole"},
+			Nutrient:   "Vitamin B12",
+			Type:       DepletionType,
+			Severity:   "low",
+			Detail:     "Long-term acid suppression reduces vitamin B12 (and magnesium) absorption.",
+			Constraint: Constraint{Nutrient: "Vitamin B12", Action: Monitor, Detail: "Check vitamin B12 and magnesium periodically."},
+		},
+		{
+			ID:         "statin-grapefruit",
+			Drug:       "Simvastatin, lovastatin and atorvastatin",
+			RxNorm:     []string{"36567", "6472", "83367"},
+			Names:      []string{"simvastatin", "zocor", "lovastatin", "atorvastatin", "lipitor"},
+			Nutrient:   "Grapefruit",
+			Type:       InteractionType,
+			Severity:   "moderate",
+			Detail:     "Grapefruit inhibits the metabolism of these statins, increasing the risk of myopathy.",
+			Constraint: Constraint{Nutrient: "Grapefruit", Action: Avoid},
+		},
+		{
+			ID:         "levothyroxine-calcium-iron",
+			Drug:       "Levothyroxine",
+			RxNorm:     []string{"10582"},
+			Names:      []string{"levothyroxine", "synthroid"},
+			Nutrient:   "Calcium and iron",
+			Type:       InteractionType,
+			Severity:   "moderate",
+			Detail:     "Calcium and iron bind levothyroxine, reducing its absorption.",
+			Constraint: Constraint{Nutrient: "Calcium and iron", Action: Separate, Detail: "Take calcium and iron supplements at least 4 hours apart from levothyroxine."},
+		},
+		{
+			ID:         "isoniazid-vitamin-b6",
+			Drug:       "Isoniazid",
+			RxNorm:     []string{"6038"},
+			Names:      []string{"isoniazid"},
+			Nutrient:   "Vitamin B6",
+			Type:       DepletionType,
+			Severity:   "moderate",
+			Detail:     "Isoniazid depletes vitamin B6, which can cause peripheral neuropathy.",
+			Constraint: Constraint{Nutrient: "Vitamin B6", Action: Supplement},
+		},
+		{
+			ID:         "methotrexate-folate",
+			Drug:       "Methotrexate",
+			RxNorm:     []string{"6851"},
+			Names:      []string{"methotrexate"},
+			Nutrient:   "Folate",
+			Type:       DepletionType,
+			Severity:   "moderate",
+			Detail:     "Methotrexate is a folate antagonist.",
+			Constraint: Constraint{Nutrient: "Folate", Action: Supplement},
+		},
+		{
+			ID:         "maoi-tyramine",
+			Drug:       "MAO inhibitors",
+			RxNorm:     []string{"8123", "10734", "6011"},
+			Names:      []string{"phenelzine", "tranylcypromine", "isocarboxazid"},
+			Nutrient:   "Tyramine",
+			Type:       InteractionType,
+			Severity:   "high",
+			Detail:     "Tyramine-rich foods can cause a hypertensive crisis with MAO inhibitors.",
+			Constraint: Constraint{Nutrient: "Tyramine", Action: Avoid, Detail: "Avoid aged cheeses, cured meats, and fermented foods."},
+		},
+	}}
+	if err := kb.validate(); err != nil {
+		panic(err)
+	}
+	return kb
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package interactions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestKnowledgeBaseSuite(t *testing.T) {
+	suite.Run(t, new(KnowledgeBaseSuite))
+}
+
+type KnowledgeBaseSuite struct {
+	suite.Suite
+	Dir string
+}
+
+func (suite *KnowledgeBaseSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "interactions")
+	suite.Require().NoError(err)
+	suite.Dir = dir
+}
+
+func (suite *KnowledgeBaseSuite) TearDownTest() {
+	os.RemoveAll(suite.Dir)
+}
+
+func (suite *KnowledgeBaseSuite) write(name, data string) string {
+	path := filepath.Join(suite.Dir, name)
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func rxnorm(code, display string) *fhir.CodeableConcept {
+	return &fhir.CodeableConcept{Coding: []fhir.Coding{{System: RxNormSystem, Code: code, Display: display}}}
+}
+
+func (suite *KnowledgeBaseSuite) TestDefaultKnowledgeBase() {
+	assert := suite.Assert()
+
+	kb := DefaultKnowledgeBase()
+	assert.NoError(kb.validate())
+
+	matched := kb.Match(rxnorm("11289", "Warfarin"))
+	assert.Len(matched, 1)
+	assert.Equal("warfarin-vitamin-k", matched[0].ID)
+	assert.Equal(Consistent, matched[0].Constraint.Action)
+
+	matched = kb.Match(rxnorm("4603", "Furosemide"))
+	assert.Len(matched, 1)
+	assert.Equal("Potassium", matched[0].Nutrient)
+	assert.Equal(DepletionType, matched[0].Type)
+
+	assert.Empty(kb.Match(rxnorm("161", "Acetaminophen")))
+	assert.Empty(kb.Match(nil))
+}
+
+func (suite *KnowledgeBaseSuite) TestMatchByName() {
+	assert := suite.Assert()
+
+	kb := DefaultKnowledgeBase()
+
+	// Medications that aren't coded in RxNorm are matched by name
+	matched := kb.Match(&fhir.CodeableConcept{Text: "Metformin 500 MG Oral Tablet"})
+	assert.Len(matched, 1)
+	assert.Equal("metformin-vitamin-b12", matched[0].ID)
+	matched = kb.Match(&fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://hl7.org/fhir/sid/ndc", Code: "0056-0172", Display: "Coumadin 5 MG"}}})
+	assert.Len(matched, 1)
+	assert.Equal("warfarin-vitamin-k", matched[0].ID)
+
+	// Medications coded in RxNorm are only matched by code
+	assert.Empty(kb.Match(rxnorm("161", "Acetaminophen with a warfarin-free name")))
+}
+
+func (suite *KnowledgeBaseSuite) TestLoadKnowledgeBase() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	path := suite.write("kb.json", `{"interactions": [
+		{
+			"id": "warfarin-vitamin-k",
+			"drug": "Warfarin",
+			"rxnorm": ["11289"],
+			"nutrient": "Vitamin K",
+			"type": "interaction",
+			"severity": "high",
+			"detail": "Vitamin K changes the effect of warfarin.",
+			"constraint": {"nutrient": "Vitamin K", "action": "consistent"}
+		},
+		{
+			"id": "spironolactone-potassium",
+			"drug": "Spironolactone",
+			"names": ["spironolactone"],
+			"nutrient": "Potassium",
+			"type": "interaction",
+			"severity": "high",
+			"detail": "Spironolactone raises serum potassium.",
+			"constraint": {"nutrient": "Potassium", "action": "limit", "limitMg": 2500}
+		}
+	]}`)
+	kb, err := LoadKnowledgeBase(path)
+	require.NoError(err)
+	require.Len(kb.Interactions, 2)
+	assert.Equal(2500.0, kb.Interactions[1].Constraint.LimitMg)
+	assert.Len(kb.Match(&fhir.CodeableConcept{Text: "Spironolactone 25 MG"}), 1)
+}
+
+func (suite *KnowledgeBaseSuite) TestLoadInvalidKnowledgeBase() {
+	assert := suite.Assert()
+
+	valid := `"id": "x", "drug": "X", "rxnorm": ["1"], "nutrient": "Folate", "detail": "X"`
+	for _, data := range []string{
+		`{"interactions": []}`,
+		`{"interactions": [{` + valid + `, "type": "reaction", "severity": "high", "constraint": {"nutrient": "Folate", "action": "supplement"}}]}`,
+		`{"interactions": [{` + valid + `, "type": "depletion", "severity": "severe", "constraint": {"nutrient": "Folate", "action": "supplement"}}]}`,
+		`{"interactions": [{` + valid + `, "type": "depletion", "severity": "high", "constraint": {"nutrient": "Folate", "action": "eat"}}]}`,
+		`{"interactions": [{` + valid + `, "type": "depletion", "severity": "high", "constraint": {"nutrient": "Folate", "action": "supplement", "limitMg": 5}}]}`,
+		`{"interactions": [{"id": "x", "drug": "X", "nutrient": "Folate", "type": "depletion", "severity": "high", "constraint": {"nutrient": "Folate", "action": "supplement"}}]}`,
+		`{"interactions": [
+			{` + valid + `, "type": "depletion", "severity": "high", "constraint": {"nutrient": "Folate", "action": "supplement"}},
+			{` + valid + `, "type": "depletion", "severity": "high", "constraint": {"nutrient": "Folate", "action": "supplement"}}
+		]}`,
+		`{"interactions": `,
+	} {
+		_, err := LoadKnowledgeBase(suite.write("invalid.json", data))
+		assert.Error(err, data)
+	}
+
+	_, err := LoadKnowledgeBase(filepath.Join(suite.Dir, "missing.json"))
+	assert.Error(err)
+}
+
+func (suite *KnowledgeBaseSuite) TestConstraintText() {
+	assert := suite.Assert()
+
+	assert.Equal("Limit Potassium to 3000 mg a day. Avoid potassium supplements and salt substitutes.",
+		(&Constraint{Nutrient: "Potassium", Action: Limit, LimitMg: 3000, Detail: "Avoid potassium supplements and salt substitutes."}).Text())
+	assert.Equal("Limit Sodium.", (&Constraint{Nutrient: "Sodium", Action: Limit}).Text())
+	assert.Equal("Keep the intake of Vitamin K consistent.", (&Constraint{Nutrient: "Vitamin K", Action: Consistent}).Text())
+	assert.Equal("Avoid Grapefruit.", (&Constraint{Nutrient: "Grapefruit", Action: Avoid}).Text())
+}
@@ -0,0 +1,145 @@
+package interactions
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// Medication is a medication taken by (or ordered for) a patient.  Resource is the reference to the
+// MedicationStatement or MedicationOrder, and Current is true if its status is active.  Start and End are zero if
+// they're unknown.
+type Medication struct {
+	Resource string
+	Code     *fhir.CodeableConcept
+	Start    time.Time
+	End      time.Time
+	Current  bool
+}
+
+// Name returns the medication's text, or the display of its first coding with one
+func (m *Medication) Name() string {
+	if m.Code == nil {
+		return ""
+	}
+	if m.Code.Text != "" {
+		return m.Code.Text
+	}
+	for _, coding := range m.Code.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	return ""
+}
+
+// TakenAt returns true if the medication was being taken at the time: it had started, and hadn't ended.  Medications
+// that aren't current are only taken until their end, so they're never taken if their end is unknown.
+func (m *Medication) TakenAt(t time.Time) bool {
+	if m.Start.After(t) {
+		return false
+	}
+	if m.End.IsZero() {
+		return m.Current
+	}
+	return m.End.After(t)
+}
+
+// FromStatement returns the medication of the statement, looking up referenced medications in the given map (by ID).
+// It returns false if the medication wasn't taken, the statement was entered in error, or the medication has no code.
+func FromStatement(s *fhir.MedicationStatement, medications map[string]*fhir.Medication) (Medication, bool) {
+	if s.Status == "entered-in-error" || (s.WasNotTaken != nil && *s.WasNotTaken) {
+		return Medication{}, false
+	}
+	m := Medication{Resource: "MedicationStatement/" + s.Id, Current: s.Status == "active"}
+	m.Code = medicationCode(s.MedicationCodeableConcept, s.MedicationReference, medications)
+	if s.EffectiveDateTime != nil {
+		m.Start = s.EffectiveDateTime.Time
+	} else if s.EffectivePeriod != nil {
+		if s.EffectivePeriod.Start != nil {
+			m.Start = s.EffectivePeriod.Start.Time
+		}
+		if s.EffectivePeriod.End != nil {
+			m.End = s.EffectivePeriod.End.Time
+		}
+	}
+	return m, m.Code != nil
+}
+
+// FromOrder returns the medication of the order, looking up referenced medications in the given map (by ID).  It
+// returns false if the order was entered in error or is a draft, or the medication has no code.
+func FromOrder(o *fhir.MedicationOrder, medications map[string]*fhir.Medication) (Medication, bool) {
+	if o.Status == "entered-in-error" || o.Status == "draft" {
+		return Medication{}, false
+	}
+	m := Medication{Resource: "MedicationOrder/" + o.Id, Current: o.Status == "active"}
+	m.Code = medicationCode(o.MedicationCodeableConcept, o.MedicationReference, medications)
+	if o.DateWritten != nil {
+		m.Start = o.DateWritten.Time
+	}
+	if o.DateEnded != nil {
+		m.End = o.DateEnded.Time
+	}
+	return m, m.Code != nil
+}
+
+// medicationCode returns the code of the medication, which is either given or referenced
+func medicationCode(code *fhir.CodeableConcept, ref *fhir.Reference, medications map[string]*fhir.Medication) *fhir.CodeableConcept {
+	if code != nil {
+		return code
+	}
+	if ref == nil {
+		return nil
+	}
+	id := ref.ReferencedID
+	if id == "" {
+		id = strings.TrimPrefix(ref.Reference, "Medication/")
+	}
+	if medication, ok := medications[id]; ok {
+		return medication.Code
+	}
+	return nil
+}
+
+// GetMedications queries the FHIR server for the patient's MedicationStatements and MedicationOrders, including the
+// Medications they reference
+func GetMedications(fhirEndpoint, patientID string) ([]Medication, error) {
+	var statements []*fhir.MedicationStatement
+	var orders []*fhir.MedicationOrder
+	medications := make(map[string]*fhir.Medication)
+	collect := func(bundle *fhir.Bundle) {
+		for _, entry := range bundle.Entry {
+			switch t := entry.Resource.(type) {
+			case *fhir.MedicationStatement:
+				statements = append(statements, t)
+			case *fhir.MedicationOrder:
+				orders = append(orders, t)
+			case *fhir.Medication:
+				medications[t.Id] = t
+			}
+		}
+	}
+	base := strings.TrimSuffix(fhirEndpoint, "/")
+	for _, resourceType := range []string{"MedicationStatement", "MedicationOrder"} {
+		params := url.Values{"patient": []string{patientID}, "_include": []string{resourceType + ":medication"}}
+		if err := client.ForEachBundle(base+"/"+resourceType+"?"+params.Encode(), collect); err != nil {
+			return nil, err
+		}
+	}
+
+	var meds []Medication
+	for _, s := range statements {
+		if m, ok := FromStatement(s, medications); ok {
+			meds = append(meds, m)
+		}
+	}
+	for _, o := range orders {
+		if m, ok := FromOrder(o, medications); ok {
+			meds = append(meds, m)
+		}
+	}
+	return meds, nil
+}
@@ -1,115 +1,61 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"log"
-	"net"
 	"os"
 	"strings"
-
-	"github.com/gin-gonic/gin"
-	"github.com/robfig/cron"
-
-	"gopkg.in/mgo.v2"
-
-	"github.com/intervention-engine/multifactorriskservice/server"
 )
 
-func main() {
-	httpFlag := flag.String("http", "", "HTTP service address to listen on (env: HTTP_HOST_AND_PORT, default: \":9000\")")
-	mongoFlag := flag.String("mongo", "", "MongoDB address (env: MONGO_URL, default: \"mongodb://localhost:27017\")")
-	fhirFlag := flag.String("fhir", "", "FHIR API address (env: FHIR_URL, default: \"http://localhost:3001\")")
-	redcapFlag := flag.String("redcap", "", "REDCap API address (required, env: REDCAP_URL, example: \"http://redcapsrv:80\")")
-	tokenFlag := flag.String("token", "", "REDCap API token (required, env: REDCAP_TOKEN, example: \"F65EBA22DCB728FEC5ADFAD42378CA40\")")
-	cronFlag := flag.String("cron", "", "Cron expression indicating when risk assessments should be automatically refreshed (env: REDCAP_CRON, default: \"0 0 22 * * *\")")
-	flag.Parse()
-
-	// Prefer http arg, falling back to env, falling back to default
-	httpa := getConfigValue(httpFlag, "HTTP_HOST_AND_PORT", ":9000")
-
-	// Prefer mongo arg, falling back to env, falling back to default
-	mongo := getConfigValue(mongoFlag, "MONGO_URL", "mongodb://localhost:27017")
-	if strings.HasPrefix(mongo, ":") {
-		mongo = "mongodb://localhost" + mongo
-	}
-
-	// Prefer fhir arg, falling back to env, falling back to default
-	fhir := getConfigValue(fhirFlag, "FHIR_URL", "http://localhost:3001")
-	if strings.HasPrefix(fhir, ":") {
-		fhir = "http://localhost" + fhir
-	}
-
-	redcap := getRequiredConfigValue(redcapFlag, "REDCAP_URL", "REDCap URL")
-	token := getRequiredConfigValue(tokenFlag, "REDCAP_TOKEN", "REDCap API Token")
-	cronSpec := getConfigValue(cronFlag, "REDCAP_CRON", "0 0 22 * * *")
-
-	session, err := mgo.Dial(mongo)
-	if err != nil {
-		panic("Can't connect to the database")
-	}
-	defer session.Close()
-	db := session.DB("riskservice")
-	pieCollection := db.C("pies")
-
-	// Get own endpoint address, falling back to discovery if needed
-	endpoint := httpa
-	if strings.HasPrefix(endpoint, ":") {
-		endpoint = discoverSelf() + endpoint
-	}
-	basisPieURL := "http://" + endpoint + "/pies"
-
-	// Setup the cron job and start the scheduler
-	c := cron.New()
-	err = server.ScheduleRefreshRiskAssessmentsCron(c, cronSpec, fhir, redcap, token, pieCollection, basisPieURL)
-	if err != nil {
-		panic("Can't setup cron job for refreshing risk assessments.  Specified spec: " + cronSpec)
-	}
-	c.Start()
-	defer c.Stop()
-
-	// Create the gin engine, register the routes, and run!
-	e := gin.Default()
-	server.RegisterRoutes(e, fhir, redcap, token, pieCollection, basisPieURL)
-	e.Run(httpa)
+// command is a subcommand of the multifactorriskservice executable
+type command struct {
+	Name        string
+	Description string
+	Run         func(args []string) int
 }
 
-func getConfigValue(parsedFlag *string, envVar string, defaultVal string) string {
-	val := *parsedFlag
-	if val == "" {
-		val = os.Getenv(envVar)
-		if val == "" {
-			val = defaultVal
-		}
-	}
-	return val
+var commands = []command{
+	{"serve", "Serve risk pies and refresh risk assessments from REDCap on a schedule (default)", runServe},
+	{"refresh", "Refresh risk assessments from REDCap once, exiting with a non-zero status if any fail", runRefresh},
+	{"validate", "Check the REDCap data dictionary and FHIR server connectivity", runValidate},
+	{"export", "Export the stored risk pies as JSON or CSV", runExport},
+	{"import", "Import risk assessments from a REDCap export file (JSON, CSV or XML)", runImport},
+	{"reconcile", "Report discrepancies between REDCap studies and FHIR patients as JSON or CSV", runReconcile},
+	{"config", "Check the serve command's configuration: config validate [flags]", runConfig},
+	{"mqtt", "Subscribe to device telemetry over MQTT and write it to the FHIR server as Observations", runMQTT},
+	{"mock", "Serve and generate MOCK risk assessments for synthetic patients", runMock},
 }
 
-func getRequiredConfigValue(parsedFlag *string, envVar string, name string) string {
-	val := getConfigValue(parsedFlag, envVar, "")
-	if val == "" {
-		fmt.Fprintf(os.Stderr, "%s must be passed in as an argument or environment variable.\n", name)
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
-	return val
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
 
-func discoverSelf() string {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		log.Println("Unable to determine IP address.  Defaulting to localhost.")
-		return "localhost"
+// run runs the subcommand named by the first argument, returning the exit status.  If the first argument is a flag
+// (or there are no arguments), the serve command is run, so existing invocations of the service keep working.
+func run(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd.Run(args)
 		}
 	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	}
+	printUsage()
+	if name == "help" {
+		return 0
+	}
+	return 2
+}
 
-	log.Println("Unable to determine IP address.  Defaulting to localhost.")
-	return "localhost"
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: multifactorriskservice <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.Name, cmd.Description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'multifactorriskservice <command> -h' for the flags accepted by a command.")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/config"
+	"github.com/intervention-engine/multifactorriskservice/mock"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+)
+
+// runMock serves (and optionally generates) MOCK risk assessments for the synthetic patients on the FHIR server.  It
+// must never be used with real patient data.
+func runMock(args []string) int {
+	s := newSettings("mock", "", "Serves and generates MOCK risk assessments for synthetic patients.  This must NEVER be used with real patient data.")
+	confirmFlag := s.loader.Bool("confirm-mock", "Flag to confirm you want mock data.  This MUST be set (to prevent accidental use of mock).")
+	s.addHTTP()
+	s.addStore("mock-pies.json")
+	s.addFHIR()
+	s.TZ = s.loader.String("tz", "CLINICAL_TZ", "", "IANA timezone in which mock assessment dates are generated, e.g. \"America/New_York\" (default: the host's local timezone)")
+	genFlag := s.loader.Bool("gen", "Flag to indicate that mock risk assessments should be generated immediately")
+	syntheticTag := mock.DefaultSyntheticTag.System + "|" + mock.DefaultSyntheticTag.Code
+	syntheticTagFlag := s.loader.String("synthetic-tag", "MOCK_SYNTHETIC_TAG", syntheticTag, "Meta tag (system|code) marking patients, or the FHIR server's Conformance statement, as synthetic data")
+	syntheticIdentifierFlag := s.loader.String("synthetic-identifier-system", "MOCK_SYNTHETIC_IDENTIFIER_SYSTEM", "", "Identifier system marking patients as synthetic data")
+	syntheticConformanceFlag := s.loader.Bool("synthetic-conformance", "Flag to indicate that all patients are synthetic if the FHIR server's Conformance statement has the synthetic tag")
+	seedFlag := s.loader.String("seed", "MOCK_SEED", "", "Seed for generating mock risk assessments; the same seed always generates the same assessments for a patient (default: the current time)")
+	asOfFlag := s.loader.String("as-of", "MOCK_AS_OF", "", "Date through which mock risk assessments are generated, e.g. \"2016-06-01\" (default: today)")
+	profileFlag := s.loader.String("profile", "MOCK_PROFILE", "", "JSON scenario profile describing the time span, cohorts and score distributions of mock risk assessments (default: a single cohort starting 2014-06-01)")
+	redcapTokenFlag := s.loader.String("redcap-token", "MOCK_REDCAP_TOKEN", "", "Token for the emulated REDCap API served at /redcap; if not set, the REDCap API is not emulated (in dev mode, defaults to \""+mock.DevREDCapToken+"\")")
+	s.loader.Secret("redcap-token")
+	redcapFileFlag := s.loader.String("redcap-file", "MOCK_REDCAP_FILE", "", "JSON, CSV or XML file of REDCap records served by the emulated REDCap API (default: synthetic records for the patients on the FHIR server)")
+	devFlag := s.loader.Bool("dev", "Flag to run an all-in-one development environment: an embedded FHIR server loaded with fixtures, the REDCap emulator, and the real risk service (implies -confirm-mock)")
+	devFHIRFlag := s.loader.String("dev-fhir-http", "DEV_FHIR_HOST_AND_PORT", ":3001", "HTTP address for the embedded FHIR server in dev mode")
+	devFixturesFlag := s.loader.String("dev-fixtures", "DEV_FIXTURES", "fixtures/patients_bundle.json", "FHIR transaction bundle loaded into the embedded FHIR server in dev mode")
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	if !(*confirmFlag || *devFlag) {
+		fmt.Fprintln(os.Stderr, "Mock data can be dangerous if accidentally used in a production environment.  This WILL update the database with fake data.")
+		fmt.Fprintln(os.Stderr, "\nYou MUST confirm that you want to use mock data by passing the '-confirm-mock' flag!")
+		return 1
+	}
+	fmt.Println("!!! WARNING: MOCK risk service is running.  This produces and stores FAKE data. !!!")
+
+	options, err := mock.ParseGeneratorOptions(*seedFlag, *asOfFlag, *profileFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	options.Marker, err = mock.ParseSyntheticMarker(*syntheticTagFlag, *syntheticIdentifierFlag, *syntheticConformanceFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	seedDesc, asOfDesc := "a new seed on each refresh", "the time of each refresh"
+	if options.Seed != 0 {
+		seedDesc = fmt.Sprintf("seed %d", options.Seed)
+	}
+	if !options.AsOf.IsZero() {
+		asOfDesc = options.AsOf.Format("2006-01-02")
+	}
+	log.Printf("Generating mock risk assessments with %s as of %s.", seedDesc, asOfDesc)
+
+	fhir := *s.FHIR
+	if *devFlag {
+		var stop func()
+		fhir, stop, err = mock.StartDevFHIRServer(*s.Mongo, *devFHIRFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't start the embedded FHIR server:", err.Error())
+			return 1
+		}
+		defer stop()
+		if err := mock.LoadFixtures(fhir, *devFixturesFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't load fixtures into the embedded FHIR server:", err.Error())
+			return 1
+		}
+		log.Printf("Embedded FHIR server running at %s with fixtures from %s", fhir, *devFixturesFlag)
+	}
+
+	pieStore, err := s.openStore("mock-riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer pieStore.Close()
+
+	if *devFlag {
+		redcapToken := *redcapTokenFlag
+		if redcapToken == "" {
+			redcapToken = mock.DevREDCapToken
+		}
+		if err := mock.RunDev(*s.HTTP, fhir, redcapToken, pieStore, options, *genFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't run the dev risk service:", err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	endpoint := config.Endpoint(*s.HTTP)
+	basisPieURL := s.basisPieURL()
+
+	// Create the gin engine, register the routes, and run!
+	e := gin.Default()
+	mock.RegisterMockRoutes(e, fhir, pieStore, basisPieURL, options)
+	if *redcapTokenFlag != "" {
+		var source redcap.RecordSource = mock.NewSyntheticRecordSource(fhir, options)
+		if *redcapFileFlag != "" {
+			source = redcap.FileRecordSource{Path: *redcapFileFlag}
+		}
+		redcap.RegisterEmulatorRoutes(e.Group("/redcap"), *redcapTokenFlag, source)
+		log.Println("Emulating the REDCap API at http://" + endpoint + "/redcap")
+	}
+
+	if *genFlag {
+		results, err := mock.RefreshMockRiskAssessments(fhir, pieStore, basisPieURL, options)
+		if err != nil {
+			log.Println("Failed to generate mock risk assessments", err)
+		} else {
+			client.LogResultSummary(results)
+		}
+	}
+	if err := e.Run(*s.HTTP); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
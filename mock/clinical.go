@@ -0,0 +1,388 @@
+package mock
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+)
+
+// Code systems used to identify chronic conditions, severities and observations
+const (
+	icd9System   = "http://hl7.org/fhir/sid/icd-9"
+	icd10System  = "http://hl7.org/fhir/sid/icd-10"
+	snomedSystem = "http://snomed.info/sct"
+	loincSystem  = "http://loinc.org"
+)
+
+// chronicCategory identifies a category of chronic conditions by ICD-9 and ICD-10 code prefixes and SNOMED codes
+type chronicCategory struct {
+	Name          string
+	ICD9Prefixes  []string
+	ICD10Prefixes []string
+	SNOMEDCodes   []string
+}
+
+// chronicCategories are the categories of chronic conditions contributing to clinical risk
+var chronicCategories = []chronicCategory{
+	{"Diabetes", []string{"250"}, []string{"E10", "E11", "E13"}, []string{"44054006", "46635009", "73211009"}},
+	{"Hypertension", []string{"401", "402", "403", "404", "405"}, []string{"I10", "I11", "I12", "I13", "I15"}, []string{"38341003", "59621000"}},
+	{"Heart Failure", []string{"428"}, []string{"I50"}, []string{"42343007", "84114007"}},
+	{"Coronary Artery Disease", []string{"410", "411", "412", "413", "414"}, []string{"I20", "I21", "I22", "I25"}, []string{"53741008", "22298006"}},
+	{"COPD", []string{"491", "492", "496"}, []string{"J43", "J44"}, []string{"13645005", "87433001"}},
+	{"Asthma", []string{"493"}, []string{"J45"}, []string{"195967001"}},
+	{"Chronic Kidney Disease", []string{"585"}, []string{"N18"}, []string{"709044004", "46177005"}},
+	{"Depression", []string{"296.2", "296.3", "311"}, []string{"F32", "F33"}, []string{"35489007", "370143000"}},
+	{"Dementia", []string{"290", "294.1", "331.0"}, []string{"F01", "F03", "G30"}, []string{"52448006", "26929004"}},
+	{"Cancer", []string{"14", "15", "16", "17", "18", "19", "20"}, []string{"C"}, []string{"363346000"}},
+}
+
+// severeCode is the SNOMED code for a severe condition
+const severeCode = "24484000"
+
+// LOINC codes for observations contributing to functional risk
+const (
+	morseFallScaleCode = "59460-6"
+	bmiCode            = "39156-5"
+)
+
+// utilizationWindow is the period of time before an assessment in which encounters contribute to utilization risk
+const utilizationWindow = 365 * 24 * time.Hour
+
+// conditionEvent represents a condition relevant to clinical risk.  A zero Onset indicates the onset is unknown (so
+// the condition is considered active from the start), and a zero Abatement indicates the condition is ongoing.
+type conditionEvent struct {
+	Onset     time.Time
+	Abatement time.Time
+	Category  string
+	Severe    bool
+}
+
+// encounterEvent represents an encounter relevant to utilization risk
+type encounterEvent struct {
+	Start     time.Time
+	Inpatient bool
+	Emergency bool
+}
+
+// observationEvent represents an observation relevant to functional risk
+type observationEvent struct {
+	Date  time.Time
+	Code  string
+	Value float64
+}
+
+// addResource adds the relevant clinical data from the resource to the summary
+func (p *patientSummary) addResource(resource interface{}) {
+	switch t := resource.(type) {
+	case *fhirmodels.Patient:
+		if t.BirthDate != nil {
+			birthDate := t.BirthDate.Time
+			p.BirthDate = &birthDate
+		}
+	case *fhirmodels.Condition:
+		if t.VerificationStatus == "refuted" || t.VerificationStatus == "entered-in-error" {
+			return
+		}
+		var c conditionEvent
+		if t.OnsetDateTime != nil {
+			c.Onset = t.OnsetDateTime.Time
+		} else if t.OnsetPeriod != nil && t.OnsetPeriod.Start != nil {
+			c.Onset = t.OnsetPeriod.Start.Time
+		}
+		if t.AbatementDateTime != nil {
+			c.Abatement = t.AbatementDateTime.Time
+		} else if t.AbatementPeriod != nil && t.AbatementPeriod.End != nil {
+			c.Abatement = t.AbatementPeriod.End.Time
+		}
+		c.Category = chronicCategoryName(t.Code)
+		c.Severe = t.Severity != nil && t.Severity.MatchesCode(snomedSystem, severeCode)
+		p.Conditions = append(p.Conditions, c)
+	case *fhirmodels.MedicationStatement:
+		if t.WasNotTaken != nil && *t.WasNotTaken {
+			return
+		}
+		var start time.Time
+		if t.EffectiveDateTime != nil {
+			start = t.EffectiveDateTime.Time
+		} else if t.EffectivePeriod != nil && t.EffectivePeriod.Start != nil {
+			start = t.EffectivePeriod.Start.Time
+		}
+		p.Medications = append(p.Medications, start)
+	case *fhirmodels.Encounter:
+		if t.Period == nil || t.Period.Start == nil || t.Status == "cancelled" || t.Status == "planned" {
+			return
+		}
+		p.Encounters = append(p.Encounters, encounterEvent{
+			Start:     t.Period.Start.Time,
+			Inpatient: t.Class == "inpatient",
+			Emergency: t.Class == "emergency",
+		})
+	case *fhirmodels.Observation:
+		if t.Code == nil || t.ValueQuantity == nil || t.ValueQuantity.Value == nil || t.EffectiveDateTime == nil {
+			return
+		}
+		for _, code := range []string{morseFallScaleCode, bmiCode} {
+			if t.Code.MatchesCode(loincSystem, code) {
+				p.Observations = append(p.Observations, observationEvent{
+					Date:  t.EffectiveDateTime.Time,
+					Code:  code,
+					Value: *t.ValueQuantity.Value,
+				})
+			}
+		}
+	}
+}
+
+// chronicCategoryName returns the name of the chronic condition category for the code, or "" if it isn't chronic
+func chronicCategoryName(code *fhirmodels.CodeableConcept) string {
+	if code == nil {
+		return ""
+	}
+	for _, category := range chronicCategories {
+		for _, coding := range code.Coding {
+			switch coding.System {
+			case icd9System:
+				if hasAnyPrefix(coding.Code, category.ICD9Prefixes) {
+					return category.Name
+				}
+			case icd10System:
+				if hasAnyPrefix(coding.Code, category.ICD10Prefixes) {
+					return category.Name
+				}
+			case snomedSystem:
+				if contains(category.SNOMEDCodes, coding.Code) {
+					return category.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// clinicalRisk derives the clinical risk score at the given date from the patient's active chronic condition
+// categories, active condition and medication counts, and severe conditions
+func (p *patientSummary) clinicalRisk(d time.Time) int {
+	categories := make(map[string]bool)
+	total, severe := 0, false
+	for _, c := range p.Conditions {
+		if c.Onset.After(d) || (!c.Abatement.IsZero() && !c.Abatement.After(d)) {
+			continue
+		}
+		total++
+		if c.Category != "" {
+			categories[c.Category] = true
+		}
+		severe = severe || c.Severe
+	}
+	for _, start := range p.Medications {
+		if !start.After(d) {
+			total++
+		}
+	}
+
+	score := 1
+	switch {
+	case len(categories) >= 3 || total >= 6:
+		score = 3
+	case len(categories) >= 1 || total >= 3:
+		score = 2
+	}
+	if severe {
+		score++
+	}
+	if score > 4 {
+		score = 4
+	}
+	return score
+}
+
+// hasUtilizationData indicates if utilization risk can be derived from the patient's encounters
+func (p *patientSummary) hasUtilizationData() bool {
+	return len(p.Encounters) > 0
+}
+
+// utilizationRisk derives the utilization risk score at the given date from the patient's encounters, inpatient
+// stays and emergency visits in the preceding year
+func (p *patientSummary) utilizationRisk(d time.Time) int {
+	var total, inpatient, emergency int
+	for _, e := range p.Encounters {
+		if e.Start.After(d) || !e.Start.After(d.Add(-utilizationWindow)) {
+			continue
+		}
+		total++
+		if e.Inpatient {
+			inpatient++
+		}
+		if e.Emergency {
+			emergency++
+		}
+	}
+	switch {
+	case inpatient >= 2:
+		return 4
+	case inpatient == 1 || emergency >= 2:
+		return 3
+	case emergency == 1 || total >= 4:
+		return 2
+	}
+	return 1
+}
+
+// hasFunctionalData indicates if functional risk can be derived from the patient's age
+func (p *patientSummary) hasFunctionalData() bool {
+	return p.BirthDate != nil
+}
+
+// functionalRisk derives the functional risk score at the given date from the patient's age and most recent fall risk
+// and BMI observations
+func (p *patientSummary) functionalRisk(d time.Time) int {
+	score := 1
+	if p.BirthDate != nil {
+		switch age := p.ageAt(d); {
+		case age >= 75:
+			score = 3
+		case age >= 65:
+			score = 2
+		}
+	}
+	if value, ok := p.latestObservation(morseFallScaleCode, d); ok && value >= 45 {
+		score++
+	}
+	if value, ok := p.latestObservation(bmiCode, d); ok && (value < 18.5 || value >= 40) {
+		score++
+	}
+	if score > 4 {
+		score = 4
+	}
+	return score
+}
+
+// ageAt returns the patient's age in years at the given date
+func (p *patientSummary) ageAt(d time.Time) int {
+	age := d.Year() - p.BirthDate.Year()
+	if d.Month() < p.BirthDate.Month() || (d.Month() == p.BirthDate.Month() && d.Day() < p.BirthDate.Day()) {
+		age--
+	}
+	return age
+}
+
+func (p *patientSummary) latestObservation(code string, d time.Time) (float64, bool) {
+	var latest *observationEvent
+	for i := range p.Observations {
+		o := &p.Observations[i]
+		if o.Code == code && !o.Date.After(d) && (latest == nil || o.Date.After(latest.Date)) {
+			latest = o
+		}
+	}
+	if latest == nil {
+		return 0, false
+	}
+	return latest.Value, true
+}
+
+// derivedRisks are the risk scores derived from the patient's clinical data at a given date.  Scores that can't be
+// derived (due to lack of data) are 0.
+type derivedRisks struct {
+	Clinical, Functional, Utilization int
+}
+
+// derivedRisks derives the risk scores at the end of the given date (in its location), so that they reflect every event
+// on that date, whatever its time of day
+func (p *patientSummary) derivedRisks(d time.Time) derivedRisks {
+	d = startOfDay(d, d.Location()).AddDate(0, 0, 1).Add(-time.Nanosecond)
+	risks := derivedRisks{Clinical: p.clinicalRisk(d)}
+	if p.hasFunctionalData() {
+		risks.Functional = p.functionalRisk(d)
+	}
+	if p.hasUtilizationData() {
+		risks.Utilization = p.utilizationRisk(d)
+	}
+	return risks
+}
+
+// eventDates returns the sorted dates at which the patient's derived risks may change: condition onsets and
+// abatements, medication starts, encounters (and when they leave the utilization window), observations, and the
+// birthdays at which the patient's age category changes
+func (p *patientSummary) eventDates() []time.Time {
+	var dates []time.Time
+	for _, c := range p.Conditions {
+		dates = append(dates, c.Onset, c.Abatement)
+	}
+	dates = append(dates, p.Medications...)
+	for _, e := range p.Encounters {
+		dates = append(dates, e.Start, e.Start.Add(utilizationWindow))
+	}
+	for _, o := range p.Observations {
+		dates = append(dates, o.Date)
+	}
+	if p.BirthDate != nil {
+		dates = append(dates, p.BirthDate.AddDate(65, 0, 0), p.BirthDate.AddDate(75, 0, 0))
+	}
+
+	var nonZero []time.Time
+	for _, d := range dates {
+		if !d.IsZero() {
+			nonZero = append(nonZero, d)
+		}
+	}
+	sort.Sort(byTime(nonZero))
+	return nonZero
+}
+
+// nextRiskChange returns the date of the first event after d (and before the given limit) at which the derived risks
+// change, truncated to a date in the location of d.  If there is no such event, the limit is returned.  The risks are
+// compared as of the end of each date, so events later in the day than d are taken into account.
+func (p *patientSummary) nextRiskChange(events []time.Time, d time.Time, limit time.Time) time.Time {
+	current := p.derivedRisks(d)
+	for _, event := range events {
+		event = startOfDay(event, d.Location())
+		if !event.After(d) {
+			continue
+		}
+		if !event.Before(limit) {
+			break
+		}
+		if p.derivedRisks(event) != current {
+			return event
+		}
+	}
+	return limit
+}
+
+// startOfDay returns midnight of the time's date in the given location
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+type byTime []time.Time
+
+func (t byTime) Len() int {
+	return len(t)
+}
+func (t byTime) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+func (t byTime) Less(i, j int) bool {
+	return t[i].Before(t[j])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package mock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func fhirDate(t time.Time) *fhirmodels.FHIRDateTime {
+	return &fhirmodels.FHIRDateTime{Time: t, Precision: fhirmodels.Date}
+}
+
+func patientRef(id string) *fhirmodels.Reference {
+	return &fhirmodels.Reference{Reference: "Patient/" + id, ReferencedID: id, Type: "Patient"}
+}
+
+func condition(patientID, system, code string, onset time.Time, severe bool) *fhirmodels.Condition {
+	c := &fhirmodels.Condition{
+		Patient:       patientRef(patientID),
+		Code:          &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{{System: system, Code: code}}},
+		OnsetDateTime: fhirDate(onset),
+	}
+	if severe {
+		c.Severity = &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{{System: snomedSystem, Code: severeCode}}}
+	}
+	return c
+}
+
+func encounter(patientID, class string, start time.Time) *fhirmodels.Encounter {
+	return &fhirmodels.Encounter{
+		Patient: patientRef(patientID),
+		Status:  "finished",
+		Class:   class,
+		Period:  &fhirmodels.Period{Start: fhirDate(start)},
+	}
+}
+
+func observation(patientID, code string, effective time.Time, value float64) *fhirmodels.Observation {
+	return &fhirmodels.Observation{
+		Subject:           patientRef(patientID),
+		Code:              &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{{System: loincSystem, Code: code}}},
+		EffectiveDateTime: fhirDate(effective),
+		ValueQuantity:     &fhirmodels.Quantity{Value: &value},
+	}
+}
+
+func (suite *MockSuite) TestClinicalRisk() {
+	assert := suite.Assert()
+
+	var p patientSummary
+	p.addResource(condition("1", icd10System, "E11.9", date(2015, time.January, 1), false))
+	p.addResource(condition("1", icd9System, "401.9", date(2015, time.March, 1), false))
+	p.addResource(condition("1", snomedSystem, "42343007", date(2015, time.June, 1), true))
+	p.addResource(condition("1", snomedSystem, "22253000", date(2015, time.July, 1), false))
+	assert.Equal("Diabetes", p.Conditions[0].Category)
+	assert.Equal("Hypertension", p.Conditions[1].Category)
+	assert.Equal("Heart Failure", p.Conditions[2].Category)
+	assert.Equal("", p.Conditions[3].Category)
+
+	assert.Equal(1, p.clinicalRisk(date(2014, time.December, 31)))
+	assert.Equal(2, p.clinicalRisk(date(2015, time.January, 1)))
+	assert.Equal(2, p.clinicalRisk(date(2015, time.March, 1)))
+	// Three chronic categories, one of which is severe
+	assert.Equal(4, p.clinicalRisk(date(2015, time.June, 1)))
+
+	// Abated conditions no longer count
+	p.Conditions[2].Abatement = date(2015, time.August, 1)
+	assert.Equal(2, p.clinicalRisk(date(2015, time.August, 1)))
+}
+
+func (suite *MockSuite) TestUtilizationRisk() {
+	assert := suite.Assert()
+
+	var p patientSummary
+	assert.False(p.hasUtilizationData())
+	p.addResource(encounter("1", "outpatient", date(2015, time.January, 1)))
+	p.addResource(encounter("1", "emergency", date(2015, time.February, 1)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.March, 1)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.April, 1)))
+	assert.True(p.hasUtilizationData())
+
+	assert.Equal(1, p.utilizationRisk(date(2015, time.January, 1)))
+	assert.Equal(2, p.utilizationRisk(date(2015, time.February, 1)))
+	assert.Equal(3, p.utilizationRisk(date(2015, time.March, 1)))
+	assert.Equal(4, p.utilizationRisk(date(2015, time.April, 1)))
+	// Encounters more than a year old no longer count
+	assert.Equal(3, p.utilizationRisk(date(2016, time.March, 15)))
+	assert.Equal(1, p.utilizationRisk(date(2016, time.May, 1)))
+}
+
+func (suite *MockSuite) TestFunctionalRisk() {
+	assert := suite.Assert()
+
+	p := &fhirmodels.Patient{BirthDate: fhirDate(date(1950, time.May, 1))}
+	var sum patientSummary
+	sum.addResource(p)
+	sum.addResource(observation("1", morseFallScaleCode, date(2015, time.June, 1), 50))
+	sum.addResource(observation("1", morseFallScaleCode, date(2015, time.September, 1), 20))
+	sum.addResource(observation("1", bmiCode, date(2016, time.January, 1), 17))
+
+	assert.Equal(1, sum.functionalRisk(date(2015, time.April, 30)))
+	assert.Equal(2, sum.functionalRisk(date(2015, time.May, 1)))
+	assert.Equal(3, sum.functionalRisk(date(2015, time.June, 1)))
+	assert.Equal(2, sum.functionalRisk(date(2015, time.September, 1)))
+	assert.Equal(3, sum.functionalRisk(date(2016, time.January, 1)))
+}
+
+func (suite *MockSuite) TestToStudyGeneratesRecordsAtEventDates() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var p patientSummary
+	p.ID = "1"
+	p.addResource(&fhirmodels.Patient{BirthDate: fhirDate(date(1980, time.January, 1))})
+	p.addResource(encounter("1", "outpatient", date(2014, time.January, 1)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.February, 10)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.March, 10)))
+
+	options, err := ParseGeneratorOptions("42", "2015-12-31", "")
+	require.NoError(err)
+	study := p.ToStudy(options)
+
+	byDate := make(map[string]string)
+	for _, record := range study.Records {
+		byDate[record.RiskFactorDate] = record.UtilizationRisk
+		if record.RiskFactorDate < "2015-02-10" {
+			assert.Contains([]string{"1", "2"}, record.UtilizationRisk, record.RiskFactorDate)
+		}
+	}
+	assert.Equal("3", byDate["2015-02-10"])
+	assert.Equal("4", byDate["2015-03-10"])
+}
+
+func (suite *MockSuite) TestGetPatientSummariesCountsAllResources() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	patient := &fhirmodels.Patient{}
+	patient.Id = "1"
+	patient.Meta = &fhirmodels.Meta{Tag: []fhirmodels.Coding{DefaultSyntheticTag}}
+	bundle := fhirmodels.Bundle{Type: "searchset", Entry: []fhirmodels.BundleEntryComponent{
+		{Resource: patient},
+		{Resource: condition("1", icd10System, "E11.9", date(2015, time.January, 1), false)},
+		{Resource: condition("1", icd10System, "I10", date(2015, time.January, 1), false)},
+		{Resource: &fhirmodels.MedicationStatement{Patient: patientRef("1")}},
+		{Resource: &fhirmodels.MedicationStatement{Patient: patientRef("1")}},
+		{Resource: encounter("1", "inpatient", date(2015, time.January, 1))},
+		{Resource: observation("1", bmiCode, date(2015, time.January, 1), 42)},
+	}}
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(&bundle)
+	}))
+	defer fhirServer.Close()
+
+	pMap, err := getPatientSummariesFromFHIR(fhirServer.URL, SyntheticMarker{Tag: DefaultSyntheticTag})
+	require.NoError(err)
+	require.Len(pMap, 1)
+	sum := pMap["1"]
+	assert.True(sum.Synthetic)
+	assert.Len(sum.Conditions, 2)
+	assert.Len(sum.Medications, 2)
+	assert.Len(sum.Encounters, 1)
+	assert.Len(sum.Observations, 1)
+}
+
+func (suite *MockSuite) TestToStudyGeneratesRecordsAtEventsWithTimes() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var p patientSummary
+	p.ID = "1"
+	p.addResource(&fhirmodels.Patient{BirthDate: fhirDate(date(1980, time.January, 1))})
+	p.addResource(encounter("1", "outpatient", date(2014, time.January, 1)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.February, 10).Add(14*time.Hour+30*time.Minute)))
+	p.addResource(encounter("1", "inpatient", date(2015, time.March, 10).Add(9*time.Hour)))
+	p.addResource(condition("1", icd10System, "E11.9", date(2015, time.May, 5).Add(16*time.Hour), false))
+
+	options, err := ParseGeneratorOptions("42", "2015-12-31", "")
+	require.NoError(err)
+	study := p.ToStudy(options)
+
+	byDate := make(map[string]models.Record)
+	for _, record := range study.Records {
+		byDate[record.RiskFactorDate] = record
+	}
+	require.Contains(byDate, "2015-02-10")
+	assert.Equal("3", byDate["2015-02-10"].UtilizationRisk)
+	require.Contains(byDate, "2015-03-10")
+	assert.Equal("4", byDate["2015-03-10"].UtilizationRisk)
+	require.Contains(byDate, "2015-05-05")
+	assert.Contains([]string{"1", "2", "3"}, byDate["2015-05-05"].ClinicalRisk)
+}
+
+func (suite *MockSuite) TestAgeAtAcrossLeapYears() {
+	assert := suite.Assert()
+
+	birth := date(1950, time.March, 1)
+	p := patientSummary{BirthDate: &birth}
+	// March 1 is day 60 in 1950 but day 61 in 2016, so comparing days of the year would count the birthday a day early
+	assert.Equal(65, p.ageAt(date(2016, time.February, 29)))
+	assert.Equal(66, p.ageAt(date(2016, time.March, 1)))
+	assert.Equal(65, p.ageAt(date(2015, time.December, 31)))
+}
@@ -0,0 +1,97 @@
+package mock
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	fhirserver "github.com/intervention-engine/fhir/server"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+	"github.com/intervention-engine/multifactorriskservice/server"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"gopkg.in/mgo.v2"
+)
+
+// devFHIRDatabase is the MongoDB database used by the embedded FHIR server in dev mode
+const devFHIRDatabase = "dev-fhir"
+
+// DevREDCapToken is the token for the emulated REDCap API in dev mode, if no token is configured
+const DevREDCapToken = "dev-token"
+
+// StartDevFHIRServer starts an in-process FHIR server, backed by the dev-fhir database in MongoDB, listening on the
+// given address.  It returns the FHIR server's base URL and a function to stop it.
+func StartDevFHIRServer(mongoURL, addr string) (string, func(), error) {
+	session, err := mgo.Dial(mongoURL)
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		session.Close()
+		return "", nil, err
+	}
+
+	e := gin.New()
+	e.Use(gin.Recovery())
+	fhirserver.RegisterRoutes(e, nil, fhirserver.NewMongoDataAccessLayer(session.DB(devFHIRDatabase)), fhirserver.Config{})
+	go http.Serve(l, e)
+
+	fhirURL := fmt.Sprintf("http://localhost:%d", l.Addr().(*net.TCPAddr).Port)
+	return fhirURL, func() {
+		l.Close()
+		session.Close()
+	}, nil
+}
+
+// LoadFixtures posts the transaction bundle in the fixtures file to the FHIR server
+func LoadFixtures(fhirEndpoint, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	res, err := http.Post(fhirEndpoint+"/", "application/json", f)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received HTTP %d %s from FHIR server when loading fixtures from %s", res.StatusCode, res.Status, path)
+	}
+	return nil
+}
+
+// RunDev runs the all-in-one development environment.  The real risk service routes are served at the given address,
+// along with the REDCap emulator (at /redcap), backed by synthetic records for the patients on the embedded FHIR
+// server.  If gen is set, the risk service refreshes its risk assessments from the emulated REDCap API at startup.
+func RunDev(httpa, fhirEndpoint, redcapToken string, pieStore store.PieStore, options GeneratorOptions, gen bool) error {
+	l, err := net.Listen("tcp", httpa)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("http://localhost:%d", l.Addr().(*net.TCPAddr).Port)
+	redcapEndpoint := endpoint + "/redcap"
+
+	e := gin.Default()
+	server.RegisterRoutes(e, fhirEndpoint, redcapEndpoint, redcapToken, pieStore, endpoint+"/pies", Model)
+	redcap.RegisterEmulatorRoutes(e.Group("/redcap"), redcapToken, NewSyntheticRecordSource(fhirEndpoint, options))
+	log.Printf("Dev risk service running at %s (FHIR: %s, REDCap: %s)", endpoint, fhirEndpoint, redcapEndpoint)
+
+	if gen {
+		// The listener is already open, so the refresh's requests to the emulated REDCap API will be served once
+		// http.Serve starts below
+		go func() {
+			results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieStore, endpoint+"/pies", Model)
+			if err != nil {
+				log.Println("Failed to generate dev risk assessments", err)
+				return
+			}
+			client.LogResultSummary(results)
+		}()
+	}
+	return http.Serve(l, e)
+}
@@ -0,0 +1,157 @@
+package mock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/dbtest"
+)
+
+func (suite *MockSuite) TestLoadFixtures() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	var posted fhirmodels.Bundle
+	status := http.StatusOK
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		assert.Equal("/", r.URL.Path)
+		require.NoError(json.NewDecoder(r.Body).Decode(&posted))
+		w.WriteHeader(status)
+	}))
+	defer fhirServer.Close()
+
+	require.NoError(LoadFixtures(fhirServer.URL, "../fixtures/patients_bundle.json"))
+	assert.Equal("transaction", posted.Type)
+	assert.Len(posted.Entry, 3)
+
+	status = http.StatusBadRequest
+	assert.Error(LoadFixtures(fhirServer.URL, "../fixtures/patients_bundle.json"))
+	assert.Error(LoadFixtures(fhirServer.URL, "../fixtures/missing.json"))
+}
+
+func (suite *MockSuite) TestRunDev() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&fhirmodels.Bundle{Type: "searchset"})
+	}))
+	defer fhirServer.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	endpoint := "http://" + l.Addr().String()
+	l.Close()
+	go RunDev(l.Addr().String(), fhirServer.URL, DevREDCapToken, store.NewMemoryPieStore(), GeneratorOptions{}, false)
+
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = http.Get(endpoint + "/patients/1/pies"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(err)
+	var pies []models.StoredPie
+	require.NoError(json.NewDecoder(res.Body).Decode(&pies))
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Empty(pies)
+
+	res, err = http.Get(endpoint + "/pies/" + bson.NewObjectId().Hex())
+	require.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+
+	// The REDCap emulator is served alongside the risk service
+	res, err = http.PostForm(endpoint+"/redcap/", url.Values{"token": {DevREDCapToken}, "content": {"version"}})
+	require.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal(redcap.Version, string(body))
+}
+
+func TestDevEnvironment(t *testing.T) {
+	// Skip rather than panic without MongoDB, so the rest of the package's tests still run
+	if _, err := exec.LookPath("mongod"); err != nil {
+		t.Skip("mongod isn't installed")
+	}
+	require := require.New(t)
+
+	dbServer := &dbtest.DBServer{}
+	dir, err := ioutil.TempDir("", "devfhir")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	dbServer.SetPath(dir)
+	defer dbServer.Stop()
+	session := dbServer.Session()
+	mongoURL := session.LiveServers()[0]
+	session.Close()
+
+	// The embedded FHIR server serves the fixtures
+	fhirURL, stop, err := StartDevFHIRServer(mongoURL, "localhost:0")
+	require.NoError(err)
+	defer stop()
+	require.NoError(LoadFixtures(fhirURL, "../fixtures/patients_bundle.json"))
+	var patients fhirmodels.Bundle
+	getJSON(t, fhirURL+"/Patient", &patients)
+	require.Len(patients.Entry, 3)
+	patient, ok := patients.Entry[0].Resource.(*fhirmodels.Patient)
+	require.True(ok)
+
+	// The dev risk service generates assessments for the patients and serves their pies
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(err)
+	addr := l.Addr().String()
+	l.Close()
+	options, err := ParseGeneratorOptions("42", "2016-06-01", "")
+	require.NoError(err)
+	go RunDev(addr, fhirURL, DevREDCapToken, store.NewMemoryPieStore(), options, true)
+
+	var pies []models.StoredPie
+	for i := 0; i < 100 && len(pies) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		getJSON(t, "http://"+addr+"/patients/"+patient.Id+"/pies", &pies)
+	}
+	require.NotEmpty(pies)
+	var pie plugin.Pie
+	getJSON(t, "http://"+addr+"/pies/"+pies[0].Id.Hex(), &pie)
+	require.NotEmpty(pie.Slices)
+
+	var assessments fhirmodels.Bundle
+	getJSON(t, fhirURL+"/RiskAssessment?subject="+patient.Id, &assessments)
+	require.NotEmpty(assessments.Entry)
+}
+
+// getJSON gets the URL, failing the test unless it responds with 200 OK, and decodes the JSON response
+func getJSON(t *testing.T, url string, v interface{}) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Can't get %s: %s", url, err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Received HTTP %d %s when getting %s", res.StatusCode, res.Status, url)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("Can't decode %s: %s", url, err.Error())
+	}
+}
@@ -0,0 +1,398 @@
+// Package mock generates synthetic multi-factor risk assessments for development and testing with synthetic
+// patients.  It must never be used with real patient data.
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+	"github.com/intervention-engine/multifactorriskservice/server"
+	"github.com/intervention-engine/multifactorriskservice/store"
+)
+
+// RegisterMockRoutes sets up the http request handlers for the mock service with Gin
+func RegisterMockRoutes(e *gin.Engine, fhirEndpoint string, pieStore store.PieStore, basisPieURL string, options GeneratorOptions) {
+	server.RegisterPieHandler(e, pieStore)
+	server.RegisterPatientPiesHandler(e, fhirEndpoint, pieStore, Model)
+	server.RegisterTrajectoryHandler(e, fhirEndpoint, pieStore, Model)
+	RegisterMockRefreshHandler(e, fhirEndpoint, pieStore, basisPieURL, options)
+}
+
+// RegisterMockRefreshHandler registers the handler to refresh mock risk assessments
+func RegisterMockRefreshHandler(e *gin.Engine, fhirEndpoint string, pieStore store.PieStore, basisPieURL string, options GeneratorOptions) {
+	e.POST("/refresh", func(c *gin.Context) {
+		results, err := RefreshMockRiskAssessments(fhirEndpoint, pieStore, basisPieURL, options)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		client.LogResultSummary(results)
+		c.JSON(http.StatusOK, results)
+	})
+}
+
+var m sync.Mutex
+
+// Model is the model configuration used for mock risk assessments
+var Model = client.NewREDCapModelConfig(models.MaxValueAggregation{})
+
+// RefreshMockRiskAssessments generates mock risk assessment data and posts it to the FHIR server, replacing older
+// risk assessments and storing pie representations.  The same options always generate the same data for a patient.
+// Patients that aren't marked as synthetic data (according to the options' marker) are skipped and reported as errors
+// in the results.
+func RefreshMockRiskAssessments(fhirEndpoint string, pieStore store.PieStore, basisPieURL string, options GeneratorOptions) ([]client.Result, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	options = options.resolve()
+	pMap, err := getPatientSummariesFromFHIR(fhirEndpoint, options.Marker)
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := removeNonSyntheticPatients(fhirEndpoint, pMap, options.Marker)
+	results := make([]client.Result, 0, len(pMap)+len(skipped))
+	for _, id := range skipped {
+		results = append(results, client.Result{
+			FHIRPatientID: id,
+			Error:         fmt.Errorf("Patient %s is not marked as synthetic data, so mock data was not generated", id),
+		})
+	}
+	for id, sum := range pMap {
+		study := sum.ToStudy(options)
+		result := client.Result{
+			StudyID:       study.ID,
+			FHIRPatientID: id,
+		}
+		calcResults := study.ToResults(fhirEndpoint+"/Patient/"+id, Model.Aggregation)
+		err = client.UpdateRiskAssessmentsAndPies(fhirEndpoint, id, calcResults, pieStore, basisPieURL, Model)
+		if err != nil {
+			result.Error = err
+		} else {
+			result.RiskAssessmentCount = len(calcResults)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// getPatientSummariesFromFHIR queries the FHIR server for the patients, along with the conditions, medication
+// statements, encounters and observations from which their mock risk factors are derived
+func getPatientSummariesFromFHIR(fhirEndpoint string, marker SyntheticMarker) (map[string]patientSummary, error) {
+	pMap := make(map[string]patientSummary)
+	query := fhirEndpoint + "/Patient?_revinclude=Condition:patient&_revinclude=MedicationStatement:patient" +
+		"&_revinclude=Encounter:patient&_revinclude=Observation:patient"
+	// Perform a loop to go through the pages of a bundle response
+	for true {
+		// Query the FHIR server to get the patients
+		r, err := http.NewRequest("GET", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Received HTTP %d %s from FHIR server when querying for patients.", res.StatusCode, res.Status)
+		}
+		var bundle fhirmodels.Bundle
+		decoder := json.NewDecoder(res.Body)
+		if err := decoder.Decode(&bundle); err != nil {
+			return nil, err
+		}
+		for _, entry := range bundle.Entry {
+			var patientID string
+			switch t := entry.Resource.(type) {
+			case *fhirmodels.Patient:
+				patientID = t.Id
+			case *fhirmodels.Condition:
+				patientID = referencedID(t.Patient)
+			case *fhirmodels.MedicationStatement:
+				patientID = referencedID(t.Patient)
+			case *fhirmodels.Encounter:
+				patientID = referencedID(t.Patient)
+			case *fhirmodels.Observation:
+				patientID = referencedID(t.Subject)
+			}
+			if patientID == "" {
+				continue
+			}
+			sum := pMap[patientID]
+			sum.ID = patientID
+			if patient, ok := entry.Resource.(*fhirmodels.Patient); ok {
+				sum.MRN = medicalRecordNumber(patient)
+				sum.Synthetic = marker.IsSyntheticPatient(patient)
+			}
+			sum.addResource(entry.Resource)
+			pMap[patientID] = sum
+		}
+		var more bool
+		for _, link := range bundle.Link {
+			if link.Relation == "next" && link.Url != "" {
+				query = link.Url
+				more = true
+			}
+		}
+		if !more {
+			break
+		}
+	}
+
+	return pMap, nil
+}
+
+func referencedID(ref *fhirmodels.Reference) string {
+	if ref == nil {
+		return ""
+	}
+	return ref.ReferencedID
+}
+
+// patientSummary summarizes the patient's clinical data used to derive mock risk factors
+type patientSummary struct {
+	ID           string
+	MRN          string
+	Synthetic    bool
+	BirthDate    *time.Time
+	Conditions   []conditionEvent
+	Medications  []time.Time
+	Encounters   []encounterEvent
+	Observations []observationEvent
+}
+
+// medicalRecordNumber returns the patient's medical record number, falling back to the first identifier if there is
+// no identifier with the MR type
+func medicalRecordNumber(patient *fhirmodels.Patient) string {
+	for _, identifier := range patient.Identifier {
+		if identifier.Type != nil && identifier.Type.MatchesCode("http://hl7.org/fhir/v2/0203", "MR") {
+			return identifier.Value
+		}
+	}
+	if len(patient.Identifier) > 0 {
+		return patient.Identifier[0].Value
+	}
+	return ""
+}
+
+// NewSyntheticRecordSource returns a REDCap record source that generates records for the patients on the FHIR server,
+// using the patient's medical record number as the study ID (since the risk service looks up patients by identifier).
+// Patients without an identifier, or that aren't marked as synthetic data, are skipped.  The records are the same as those generated for mock risk assessments.
+func NewSyntheticRecordSource(fhirEndpoint string, options GeneratorOptions) redcap.RecordSource {
+	return redcap.RecordSourceFunc(func() ([]models.Record, error) {
+		options := options.resolve()
+		pMap, err := getPatientSummariesFromFHIR(fhirEndpoint, options.Marker)
+		if err != nil {
+			return nil, err
+		}
+		removeNonSyntheticPatients(fhirEndpoint, pMap, options.Marker)
+		var mrns []string
+		byMRN := make(map[string]patientSummary)
+		for _, sum := range pMap {
+			if sum.MRN != "" {
+				mrns = append(mrns, sum.MRN)
+				byMRN[sum.MRN] = sum
+			}
+		}
+		sort.Strings(mrns)
+
+		var records []models.Record
+		for _, mrn := range mrns {
+			sum := byMRN[mrn]
+			study := sum.ToStudy(options)
+			for i, record := range study.Records {
+				record.StudyID = mrn
+				record.EventName = "initial_arm_1"
+				if i > 0 {
+					record.EventName = fmt.Sprintf("visit%d_arm_1", i)
+				}
+				records = append(records, record)
+			}
+		}
+		return records, nil
+	})
+}
+
+// GeneratorOptions control the generation of mock records.  Each patient's records are generated from a seed derived
+// from the Seed and the patient's ID, so the same options always generate the same records for a patient.  A zero Seed
+// or AsOf is resolved to the current time each time records are generated, so a long-running mock keeps generating
+// records up to the present.
+type GeneratorOptions struct {
+	Seed    int64
+	AsOf    time.Time
+	Profile *Profile
+	// Marker identifies the synthetic patients for which mock records may be generated
+	Marker SyntheticMarker
+}
+
+// ParseGeneratorOptions parses the seed, as-of date (in YYYY-MM-DD format) and profile path.  An empty seed or as-of
+// date is left zero, so that it's resolved to the current time whenever records are generated, and an empty profile
+// path results in the default profile.
+func ParseGeneratorOptions(seed, asOf, profilePath string) (GeneratorOptions, error) {
+	options := GeneratorOptions{Marker: SyntheticMarker{Tag: DefaultSyntheticTag}}
+	if profilePath == "" {
+		options.Profile = DefaultProfile()
+	} else {
+		var err error
+		if options.Profile, err = LoadProfile(profilePath); err != nil {
+			return options, err
+		}
+	}
+	if seed != "" {
+		var err error
+		if options.Seed, err = strconv.ParseInt(seed, 10, 64); err != nil || options.Seed == 0 {
+			return options, fmt.Errorf("Invalid mock seed: %s (must be a non-zero integer)", seed)
+		}
+	}
+	if asOf != "" {
+		t, err := time.ParseInLocation("2006-01-02", asOf, models.ClinicalLocation)
+		if err != nil {
+			return options, fmt.Errorf("Invalid mock as-of date: %s", asOf)
+		}
+		options.AsOf = t
+	}
+	return options, nil
+}
+
+// resolve returns the options with a zero Seed resolved to a seed based on the current time, and a zero AsOf resolved
+// to the current time
+func (o GeneratorOptions) resolve() GeneratorOptions {
+	if o.Seed == 0 {
+		o.Seed = time.Now().Unix()
+	}
+	if o.AsOf.IsZero() {
+		o.AsOf = models.Now()
+	}
+	return o
+}
+
+// rand returns a random number generator seeded for the given patient
+func (o GeneratorOptions) rand(patientID string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(patientID))
+	return rand.New(rand.NewSource(o.Seed ^ int64(h.Sum64())))
+}
+
+// ToStudy generates the mock records for the patient, using the options' profile to select the patient's cohort and
+// the span of the records.  Clinical, functional and utilization risk are derived from the patient's clinical data
+// (when available) as of each record's date, varying by no more than one point from the derived score.  When the
+// derived scores change due to a clinical event (e.g., a new condition or an inpatient stay), a record is generated
+// at the date of the event.
+func (p *patientSummary) ToStudy(options GeneratorOptions) models.Study {
+	options = options.resolve()
+	profile := options.Profile
+	if profile == nil {
+		profile = DefaultProfile()
+	}
+	r := options.rand(p.ID)
+	cohort := profile.cohort(r)
+	end := options.AsOf
+	if !profile.end.IsZero() && profile.end.Before(end) {
+		end = profile.end
+	}
+	events := p.eventDates()
+
+	var study models.Study
+	study.ID = p.ID
+	var previousRisks derivedRisks
+	for d := profile.start; !d.After(end); {
+		risks := p.derivedRisks(d)
+		var record models.Record
+		record.StudyID = p.ID
+		record.RiskFactorDate = d.Format("2006-01-02")
+		if len(study.Records) == 0 {
+			populateInitialRecord(r, cohort, &record, risks)
+		} else {
+			populateNextRecord(r, cohort, &record, study.Records[len(study.Records)-1], risks, previousRisks)
+		}
+		study.Records = append(study.Records, record)
+		previousRisks = risks
+		//log.Printf("%s: %s [C: %s, F: %s, P: %s, U: %s]\n", record.RiskFactorDate, record.PerceivedRisk, record.ClinicalRisk, record.FunctionalRisk, record.PsychosocialRisk, record.UtilizationRisk)
+
+		d = p.nextRiskChange(events, d, cohort.nextDate(d, record.PerceivedRisk))
+	}
+	return study
+}
+
+func populateInitialRecord(r *rand.Rand, cohort *Cohort, record *models.Record, risks derivedRisks) {
+	record.ClinicalRisk = strconv.Itoa(risks.Clinical)
+	record.FunctionalRisk = initialDerivedScore(r, cohort, risks.Functional)
+	record.PsychosocialRisk = cohort.initialScore(r)
+	record.UtilizationRisk = initialDerivedScore(r, cohort, risks.Utilization)
+	populatePerceivedRisk(record)
+}
+
+func populateNextRecord(r *rand.Rand, cohort *Cohort, record *models.Record, previous models.Record, risks, previousRisks derivedRisks) {
+	record.ClinicalRisk = nextDerivedScore(r, cohort, previous.ClinicalRisk, risks.Clinical, previousRisks.Clinical)
+	record.FunctionalRisk = nextDerivedScore(r, cohort, previous.FunctionalRisk, risks.Functional, previousRisks.Functional)
+	record.PsychosocialRisk = nextScore(r, cohort, previous.PsychosocialRisk, "1", "4")
+	record.UtilizationRisk = nextDerivedScore(r, cohort, previous.UtilizationRisk, risks.Utilization, previousRisks.Utilization)
+	populatePerceivedRisk(record)
+}
+
+// initialDerivedScore returns the derived score, or a random score from the cohort's initial distribution if the
+// score couldn't be derived (i.e., it is 0)
+func initialDerivedScore(r *rand.Rand, cohort *Cohort, derived int) string {
+	if derived == 0 {
+		return cohort.initialScore(r)
+	}
+	return strconv.Itoa(derived)
+}
+
+// nextDerivedScore returns the next score for a risk factor derived from clinical data.  When the derived score
+// changes, the risk factor changes to the derived score; otherwise it transitions within one point of the derived
+// score.  If the score couldn't be derived (i.e., it is 0), it transitions freely.
+func nextDerivedScore(r *rand.Rand, cohort *Cohort, previous string, derived, previousDerived int) string {
+	if derived == 0 {
+		return nextScore(r, cohort, previous, "1", "4")
+	}
+	if derived != previousDerived {
+		return strconv.Itoa(derived)
+	}
+	low, high := derived, derived
+	if low != 1 {
+		low--
+	}
+	if high != 4 {
+		high++
+	}
+	return nextScore(r, cohort, previous, strconv.Itoa(low), strconv.Itoa(high))
+}
+
+func populatePerceivedRisk(record *models.Record) {
+	for _, risk := range []string{record.ClinicalRisk, record.FunctionalRisk, record.PsychosocialRisk, record.UtilizationRisk} {
+		if risk > record.PerceivedRisk {
+			record.PerceivedRisk = risk
+		}
+	}
+}
+
+// maxTransitionAttempts is the number of times to try transitioning to a score within the allowed range before
+// giving up and keeping the previous score
+const maxTransitionAttempts = 100
+
+func nextScore(r *rand.Rand, cohort *Cohort, previous, low, high string) string {
+	for i := 0; i < maxTransitionAttempts; i++ {
+		next := cohort.transition(r, previous)
+		if next >= low && next <= high {
+			return next
+		}
+		// Try it again
+	}
+	return previous
+}
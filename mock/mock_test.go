@@ -0,0 +1,121 @@
+package mock
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMockSuite(t *testing.T) {
+	suite.Run(t, new(MockSuite))
+}
+
+type MockSuite struct {
+	suite.Suite
+}
+
+func (suite *MockSuite) SetupTest() {
+	models.ClinicalLocation = time.UTC
+}
+
+func (suite *MockSuite) TearDownTest() {
+	models.ClinicalLocation = time.Local
+}
+
+func (suite *MockSuite) TestToStudyIsDeterministic() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	options, err := ParseGeneratorOptions("42", "2016-06-01", "")
+	require.NoError(err)
+	p := patientSummary{
+		ID:          "56fd63cdac1c5d77f6f695a1",
+		Conditions:  make([]conditionEvent, 4),
+		Medications: make([]time.Time, 3),
+	}
+
+	study := p.ToStudy(options)
+	require.NotEmpty(study.Records)
+	assert.Equal("2014-06-01", study.Records[0].RiskFactorDate)
+	assert.True(study.Records[len(study.Records)-1].RiskFactorDate <= "2016-06-01")
+	assert.Equal(study, p.ToStudy(options))
+
+	// Another patient with the same summary gets its own records
+	other := p
+	other.ID = "56fd63cdac1c5d77f6f695a2"
+	assert.NotEqual(study.Records, other.ToStudy(options).Records)
+
+	// A different seed results in different records
+	options.Seed = 43
+	assert.NotEqual(study.Records, p.ToStudy(options).Records)
+}
+
+func (suite *MockSuite) TestParseGeneratorOptions() {
+	assert := suite.Assert()
+
+	// Defaults are left zero, and resolved to the current time whenever records are generated
+	options, err := ParseGeneratorOptions("", "", "")
+	assert.NoError(err)
+	assert.True(options.AsOf.IsZero())
+	assert.Zero(options.Seed)
+	resolved := options.resolve()
+	assert.WithinDuration(time.Now(), resolved.AsOf, time.Minute)
+	assert.NotZero(resolved.Seed)
+
+	options, err = ParseGeneratorOptions("-7", "2016-06-01", "")
+	assert.NoError(err)
+	assert.Equal(int64(-7), options.Seed)
+	assert.Equal(time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC), options.AsOf)
+
+	_, err = ParseGeneratorOptions("abc", "", "")
+	assert.Error(err)
+	_, err = ParseGeneratorOptions("0", "", "")
+	assert.Error(err)
+	_, err = ParseGeneratorOptions("", "06/01/2016", "")
+	assert.Error(err)
+}
+
+func (suite *MockSuite) TestSyntheticRecordSource() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open("../fixtures/patients_bundle.json")
+		require.NoError(err)
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.Copy(w, f)
+	}))
+	defer fhirServer.Close()
+
+	options, err := ParseGeneratorOptions("42", "2016-06-01", "")
+	require.NoError(err)
+	source := NewSyntheticRecordSource(fhirServer.URL, options)
+	records, err := source.Records()
+	require.NoError(err)
+
+	// Records should be keyed by MRN, sorted by MRN, and the same on every request
+	studyIDs := make(map[string]int)
+	for _, record := range records {
+		studyIDs[record.StudyIDString()]++
+	}
+	assert.Len(studyIDs, 3)
+	assert.Contains(studyIDs, "1")
+	assert.Contains(studyIDs, "1-2")
+	assert.Contains(studyIDs, "a")
+	assert.Equal("1", records[0].StudyIDString())
+	assert.Equal("initial_arm_1", records[0].EventName)
+	assert.Equal("visit1_arm_1", records[1].EventName)
+
+	again, err := source.Records()
+	require.NoError(err)
+	assert.Equal(records, again)
+}
@@ -0,0 +1,242 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// riskScores are the possible risk factor scores, from lowest to highest
+var riskScores = []string{"1", "2", "3", "4"}
+
+// Profile describes a scenario for generating mock records: the time span of the records and the mix of cohorts
+// making up the patient population.  Each patient is assigned to one of the cohorts, which determines how the
+// patient's risk scores are distributed and how they change over time.
+type Profile struct {
+	// Start is the date of each patient's initial record (YYYY-MM-DD)
+	Start string `json:"start"`
+	// End is the last date on which records may be generated (YYYY-MM-DD); if empty, records are generated through
+	// the as-of date
+	End     string   `json:"end,omitempty"`
+	Cohorts []Cohort `json:"cohorts"`
+
+	start, end time.Time
+}
+
+// Cohort describes how the risk scores for a group of patients are generated.  Percent is the percent of patients
+// assigned to the cohort; the percents of all of a profile's cohorts must add up to 100.  Any distributions not
+// specified for the cohort use the default cohort's distributions.
+type Cohort struct {
+	Name    string `json:"name"`
+	Percent int    `json:"percent"`
+	// Initial is the percent chance of each score for the initial functional, psychosocial and utilization risk
+	// factors (e.g., {"1": 50, "2": 30, "3": 15, "4": 5}).  The percents must add up to 100.
+	Initial map[string]int `json:"initial,omitempty"`
+	// Transitions is the percent chance of a risk factor changing from one score to another at each reassessment
+	// (e.g., {"1": {"2": 10}}).  The remaining chance is that the score stays the same.
+	Transitions map[string]map[string]int `json:"transitions,omitempty"`
+	// Intervals is the time until the next reassessment, based on the perceived risk of the current assessment
+	Intervals map[string]Interval `json:"intervals,omitempty"`
+}
+
+// Interval represents a period of time in months and days
+type Interval struct {
+	Months int `json:"months,omitempty"`
+	Days   int `json:"days,omitempty"`
+}
+
+// defaultCohort is the original (and default) behavior of the mock generator
+var defaultCohort = Cohort{
+	Name:    "default",
+	Percent: 100,
+	Initial: map[string]int{"1": 50, "2": 30, "3": 15, "4": 5},
+	Transitions: map[string]map[string]int{
+		"1": {"2": 10},
+		"2": {"1": 30, "3": 20},
+		"3": {"2": 50, "4": 15},
+		"4": {"3": 50},
+	},
+	Intervals: map[string]Interval{
+		"1": {Months: 3},
+		"2": {Months: 2},
+		"3": {Days: 21},
+		"4": {Days: 7},
+	},
+}
+
+// DefaultProfile returns the default profile: a single cohort with the original distributions, starting June 1, 2014
+func DefaultProfile() *Profile {
+	p := &Profile{Start: "2014-06-01", Cohorts: []Cohort{defaultCohort}}
+	if err := p.validate(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// LoadProfile loads and validates the JSON profile at the given path.  Dates are interpreted in the ClinicalLocation.
+func LoadProfile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := new(Profile)
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("Invalid mock profile %s: %s", path, err.Error())
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid mock profile %s: %s", path, err.Error())
+	}
+	return p, nil
+}
+
+// validate parses the profile's dates, fills in the cohorts' missing distributions from the default cohort, and
+// ensures the percents are valid
+func (p *Profile) validate() error {
+	var err error
+	if p.Start == "" {
+		p.Start = "2014-06-01"
+	}
+	if p.start, err = time.ParseInLocation("2006-01-02", p.Start, models.ClinicalLocation); err != nil {
+		return fmt.Errorf("Invalid start date: %s", p.Start)
+	}
+	if p.End != "" {
+		if p.end, err = time.ParseInLocation("2006-01-02", p.End, models.ClinicalLocation); err != nil {
+			return fmt.Errorf("Invalid end date: %s", p.End)
+		}
+		if p.end.Before(p.start) {
+			return fmt.Errorf("End date %s is before start date %s", p.End, p.Start)
+		}
+	}
+	if len(p.Cohorts) == 0 {
+		return fmt.Errorf("At least one cohort is required")
+	}
+
+	total := 0
+	for i := range p.Cohorts {
+		c := &p.Cohorts[i]
+		if c.Initial == nil {
+			c.Initial = defaultCohort.Initial
+		}
+		if c.Transitions == nil {
+			c.Transitions = defaultCohort.Transitions
+		}
+		if c.Intervals == nil {
+			c.Intervals = defaultCohort.Intervals
+		}
+		if c.Percent < 0 {
+			return fmt.Errorf("Cohort %s has a negative percent", c.Name)
+		}
+		total += c.Percent
+
+		if sum, err := sumPercents(c.Initial); err != nil {
+			return fmt.Errorf("Cohort %s has an invalid initial distribution: %s", c.Name, err.Error())
+		} else if sum != 100 {
+			return fmt.Errorf("Cohort %s initial distribution adds up to %d, not 100", c.Name, sum)
+		}
+		for from, to := range c.Transitions {
+			if !isRiskScore(from) {
+				return fmt.Errorf("Cohort %s has transitions from invalid score %s", c.Name, from)
+			}
+			if sum, err := sumPercents(to); err != nil {
+				return fmt.Errorf("Cohort %s has invalid transitions from %s: %s", c.Name, from, err.Error())
+			} else if sum > 100 {
+				return fmt.Errorf("Cohort %s transitions from %s add up to %d, more than 100", c.Name, from, sum)
+			}
+		}
+		for _, score := range riskScores {
+			interval, ok := c.Intervals[score]
+			if !ok || interval.Months < 0 || interval.Days < 0 || interval.Months+interval.Days == 0 {
+				return fmt.Errorf("Cohort %s needs a positive interval for perceived risk %s", c.Name, score)
+			}
+		}
+	}
+	if total != 100 {
+		return fmt.Errorf("Cohort percents add up to %d, not 100", total)
+	}
+	return nil
+}
+
+// cohort randomly selects a cohort based on the cohort percents.  When there is only one cohort, no random number is
+// drawn.
+func (p *Profile) cohort(r *rand.Rand) *Cohort {
+	if len(p.Cohorts) == 1 {
+		return &p.Cohorts[0]
+	}
+	i := r.Intn(100)
+	for j := range p.Cohorts {
+		if i < p.Cohorts[j].Percent {
+			return &p.Cohorts[j]
+		}
+		i -= p.Cohorts[j].Percent
+	}
+	return &p.Cohorts[len(p.Cohorts)-1]
+}
+
+// initialScore randomly selects an initial score based on the cohort's initial distribution
+func (c *Cohort) initialScore(r *rand.Rand) string {
+	i := r.Intn(100)
+	// Check from highest to lowest score, so the lowest score gets any remaining chance
+	for j := len(riskScores) - 1; j > 0; j-- {
+		if i < c.Initial[riskScores[j]] {
+			return riskScores[j]
+		}
+		i -= c.Initial[riskScores[j]]
+	}
+	return riskScores[0]
+}
+
+// transition randomly selects the next score based on the cohort's transitions from the previous score
+func (c *Cohort) transition(r *rand.Rand, previous string) string {
+	i := r.Intn(100)
+	// Check from lowest to highest score; the remaining chance is that the score stays the same
+	for _, score := range riskScores {
+		if i < c.Transitions[previous][score] {
+			return score
+		}
+		i -= c.Transitions[previous][score]
+	}
+	return previous
+}
+
+// nextDate returns the date of the next reassessment based on the perceived risk
+func (c *Cohort) nextDate(d time.Time, perceivedRisk string) time.Time {
+	interval, ok := c.Intervals[perceivedRisk]
+	if !ok {
+		interval = c.Intervals[riskScores[0]]
+	}
+	return d.AddDate(0, interval.Months, interval.Days)
+}
+
+func sumPercents(percents map[string]int) (int, error) {
+	scores := make([]string, 0, len(percents))
+	for score := range percents {
+		scores = append(scores, score)
+	}
+	sort.Strings(scores)
+	sum := 0
+	for _, score := range scores {
+		if !isRiskScore(score) {
+			return 0, fmt.Errorf("Invalid score %s", score)
+		}
+		if percents[score] < 0 {
+			return 0, fmt.Errorf("Negative percent for score %s", score)
+		}
+		sum += percents[score]
+	}
+	return sum, nil
+}
+
+func isRiskScore(score string) bool {
+	for _, s := range riskScores {
+		if s == score {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package mock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+func (suite *MockSuite) TestLoadProfile() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	profile, err := LoadProfile("profiles/qa-edge-cases.json")
+	require.NoError(err)
+	assert.Equal(time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC), profile.start)
+	assert.Equal(time.Date(2016, time.December, 31, 0, 0, 0, 0, time.UTC), profile.end)
+	require.Len(profile.Cohorts, 4)
+	// Unspecified distributions come from the default cohort
+	assert.Equal(defaultCohort.Intervals, profile.Cohorts[1].Intervals)
+	assert.Equal(defaultCohort.Initial, profile.Cohorts[2].Initial)
+	assert.Equal(defaultCohort.Transitions, profile.Cohorts[3].Transitions)
+}
+
+func (suite *MockSuite) TestLoadInvalidProfiles() {
+	dir, err := ioutil.TempDir("", "profiles")
+	suite.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	invalid := map[string]string{
+		"percents":   `{"cohorts": [{"name": "a", "percent": 50}]}`,
+		"initial":    `{"cohorts": [{"name": "a", "percent": 100, "initial": {"1": 90}}]}`,
+		"score":      `{"cohorts": [{"name": "a", "percent": 100, "transitions": {"5": {"1": 10}}}]}`,
+		"transition": `{"cohorts": [{"name": "a", "percent": 100, "transitions": {"1": {"2": 60, "3": 60}}}]}`,
+		"interval":   `{"cohorts": [{"name": "a", "percent": 100, "intervals": {"1": {"days": 7}}}]}`,
+		"dates":      `{"start": "2016-01-01", "end": "2015-01-01", "cohorts": [{"name": "a", "percent": 100}]}`,
+		"empty":      `{"start": "2016-01-01"}`,
+	}
+	for name, data := range invalid {
+		path := filepath.Join(dir, name+".json")
+		suite.Require().NoError(ioutil.WriteFile(path, []byte(data), 0644))
+		_, err := LoadProfile(path)
+		suite.Assert().Error(err, name)
+	}
+}
+
+func (suite *MockSuite) TestToStudyWithProfile() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	options, err := ParseGeneratorOptions("42", "2017-06-01", "profiles/qa-edge-cases.json")
+	require.NoError(err)
+	p := patientSummary{Conditions: make([]conditionEvent, 1)}
+
+	cohorts := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		p.ID = time.Date(2016, time.January, 1, 0, 0, i, 0, time.UTC).String()
+		study := p.ToStudy(options)
+		require.NotEmpty(study.Records)
+		assert.Equal("2015-01-01", study.Records[0].RiskFactorDate)
+		assert.True(study.Records[len(study.Records)-1].RiskFactorDate <= "2016-12-31")
+
+		// Stable low-risk patients (with low clinical risk) stay low-risk and are reassessed every 6 months
+		if allLowRisk(study.Records) && len(study.Records) == 4 {
+			cohorts["stable low-risk"]++
+		} else if len(study.Records) > 1 && study.Records[1].RiskFactorDate <= "2015-01-08" {
+			// Only the frequent escalations cohort reassesses low and moderate risk patients within a week
+			cohorts["frequent escalations"]++
+		}
+	}
+	// Roughly half the patients should be stable low-risk and roughly 15% should be frequently reassessed
+	assert.InDelta(100, cohorts["stable low-risk"], 25)
+	assert.InDelta(30, cohorts["frequent escalations"], 20)
+}
+
+func allLowRisk(records []models.Record) bool {
+	for _, record := range records {
+		if record.PerceivedRisk != "1" {
+			return false
+		}
+	}
+	return true
+}
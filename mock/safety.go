@@ -0,0 +1,109 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+)
+
+// DefaultSyntheticTag is the meta tag marking a patient (or FHIR server) as synthetic data by default
+var DefaultSyntheticTag = fhirmodels.Coding{System: "http://interventionengine.org/fhir/tags", Code: "synthetic"}
+
+// SyntheticMarker identifies synthetic data.  A patient is synthetic if its meta has the Tag or if it has an
+// identifier in the IdentifierSystem.  If Conformance is set, all patients are synthetic when the FHIR server's
+// Conformance statement has the Tag in its meta (marking the entire server as synthetic).
+type SyntheticMarker struct {
+	Tag              fhirmodels.Coding
+	IdentifierSystem string
+	Conformance      bool
+}
+
+// ParseSyntheticMarker creates a SyntheticMarker from a tag (in "system|code" format), an identifier system (which
+// may be empty), and whether or not the FHIR server's Conformance statement should be checked
+func ParseSyntheticMarker(tag, identifierSystem string, conformance bool) (SyntheticMarker, error) {
+	marker := SyntheticMarker{IdentifierSystem: identifierSystem, Conformance: conformance}
+	parts := strings.Split(tag, "|")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return marker, fmt.Errorf("Invalid synthetic tag (expected system|code): %s", tag)
+	}
+	marker.Tag = fhirmodels.Coding{System: parts[0], Code: parts[1]}
+	return marker, nil
+}
+
+// IsSyntheticPatient checks if the patient has the marker's tag or an identifier in the marker's identifier system
+func (m SyntheticMarker) IsSyntheticPatient(patient *fhirmodels.Patient) bool {
+	if patient.Meta != nil && m.hasTag(patient.Meta.Tag) {
+		return true
+	}
+	if m.IdentifierSystem != "" {
+		for _, identifier := range patient.Identifier {
+			if identifier.System == m.IdentifierSystem {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSyntheticServer checks if the marker trusts the FHIR server's Conformance statement and the Conformance statement
+// has the marker's tag.  If the Conformance statement can't be retrieved, the server is not considered synthetic.
+func (m SyntheticMarker) IsSyntheticServer(fhirEndpoint string) bool {
+	if !m.Conformance {
+		return false
+	}
+	r, err := http.NewRequest("GET", fhirEndpoint+"/metadata", nil)
+	if err != nil {
+		return false
+	}
+	r.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		log.Println("Couldn't get Conformance statement from FHIR server", err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Received HTTP %d %s from FHIR server when getting Conformance statement.", res.StatusCode, res.Status)
+		return false
+	}
+	var conformance fhirmodels.Conformance
+	if err := json.NewDecoder(res.Body).Decode(&conformance); err != nil {
+		log.Println("Couldn't decode Conformance statement from FHIR server", err)
+		return false
+	}
+	return conformance.Meta != nil && m.hasTag(conformance.Meta.Tag)
+}
+
+func (m SyntheticMarker) hasTag(tags []fhirmodels.Coding) bool {
+	for _, tag := range tags {
+		if tag.System == m.Tag.System && tag.Code == m.Tag.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// removeNonSyntheticPatients removes the patients that aren't marked as synthetic from the map (unless the whole FHIR
+// server is marked as synthetic), returning the sorted IDs of the removed patients
+func removeNonSyntheticPatients(fhirEndpoint string, pMap map[string]patientSummary, marker SyntheticMarker) []string {
+	if marker.IsSyntheticServer(fhirEndpoint) {
+		return nil
+	}
+	var skipped []string
+	for id, sum := range pMap {
+		if !sum.Synthetic {
+			skipped = append(skipped, id)
+			delete(pMap, id)
+		}
+	}
+	sort.Strings(skipped)
+	if len(skipped) > 0 {
+		log.Printf("Skipped %d patients not marked as synthetic data: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+	return skipped
+}
@@ -0,0 +1,92 @@
+package mock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+)
+
+func (suite *MockSuite) TestParseSyntheticMarker() {
+	assert := suite.Assert()
+
+	marker, err := ParseSyntheticMarker("http://example.org/tags|fake", "http://example.org/mrn", true)
+	assert.NoError(err)
+	assert.Equal(SyntheticMarker{
+		Tag:              fhirmodels.Coding{System: "http://example.org/tags", Code: "fake"},
+		IdentifierSystem: "http://example.org/mrn",
+		Conformance:      true,
+	}, marker)
+
+	_, err = ParseSyntheticMarker("synthetic", "", false)
+	assert.Error(err)
+}
+
+func (suite *MockSuite) TestIsSyntheticPatient() {
+	assert := suite.Assert()
+
+	marker := SyntheticMarker{Tag: DefaultSyntheticTag, IdentifierSystem: "http://example.org/synthetic-mrn"}
+	tagged := &fhirmodels.Patient{}
+	tagged.Meta = &fhirmodels.Meta{Tag: []fhirmodels.Coding{DefaultSyntheticTag}}
+	assert.True(marker.IsSyntheticPatient(tagged))
+
+	identified := &fhirmodels.Patient{Identifier: []fhirmodels.Identifier{{System: "http://example.org/synthetic-mrn", Value: "1"}}}
+	assert.True(marker.IsSyntheticPatient(identified))
+
+	otherTag := &fhirmodels.Patient{Identifier: []fhirmodels.Identifier{{System: "http://example.org/mrn", Value: "1"}}}
+	otherTag.Meta = &fhirmodels.Meta{Tag: []fhirmodels.Coding{{System: DefaultSyntheticTag.System, Code: "real"}}}
+	assert.False(marker.IsSyntheticPatient(otherTag))
+	assert.False(marker.IsSyntheticPatient(&fhirmodels.Patient{}))
+}
+
+func (suite *MockSuite) TestSyntheticRecordSourceSkipsUnmarkedPatients() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Remove the synthetic tag from one of the fixture patients
+	data, err := ioutil.ReadFile("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	var bundle fhirmodels.Bundle
+	require.NoError(json.Unmarshal(data, &bundle))
+	bundle.Entry[2].Resource.(*fhirmodels.Patient).Meta = nil
+	var conformance []byte
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.URL.Path == "/metadata" {
+			if conformance == nil {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			w.Write(conformance)
+			return
+		}
+		json.NewEncoder(w).Encode(&bundle)
+	}))
+	defer fhirServer.Close()
+
+	options, err := ParseGeneratorOptions("42", "2016-06-01", "")
+	require.NoError(err)
+	options.Marker.Conformance = true
+	source := NewSyntheticRecordSource(fhirServer.URL, options)
+
+	records, err := source.Records()
+	require.NoError(err)
+	studyIDs := make(map[string]bool)
+	for _, record := range records {
+		studyIDs[record.StudyIDString()] = true
+	}
+	assert.Equal(map[string]bool{"1": true, "a": true}, studyIDs)
+
+	// If the server's Conformance statement is marked as synthetic, all patients are synthetic
+	c := fhirmodels.Conformance{}
+	c.Meta = &fhirmodels.Meta{Tag: []fhirmodels.Coding{DefaultSyntheticTag}}
+	conformance, err = json.Marshal(&c)
+	require.NoError(err)
+	records, err = source.Records()
+	require.NoError(err)
+	for _, record := range records {
+		studyIDs[record.StudyIDString()] = true
+	}
+	assert.Len(studyIDs, 3)
+}
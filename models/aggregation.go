@@ -0,0 +1,185 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// AggregationStrategy combines the slices of a risk pie into the overall score for a risk assessment.  Strategies
+// populate the Score and/or ProbabilityDecimal of the passed in result based on its pie.
+type AggregationStrategy interface {
+	// Name returns the name of the strategy, as recorded on the resulting RiskAssessments
+	Name() string
+	// Aggregate sets the overall score (and/or probability) on the result based on the result's pie slices
+	Aggregate(result *plugin.RiskServiceCalculationResult)
+}
+
+// MaxValueAggregation uses the highest slice value as the overall score.  This is the original multi-factor behavior.
+type MaxValueAggregation struct{}
+
+// Name returns the name of the strategy
+func (a MaxValueAggregation) Name() string {
+	return "max"
+}
+
+// Aggregate sets the score to the maximum slice value
+func (a MaxValueAggregation) Aggregate(result *plugin.RiskServiceCalculationResult) {
+	result.Score, result.ProbabilityDecimal = nil, nil
+	for i := range result.Pie.Slices {
+		if result.Score == nil || *result.Score < result.Pie.Slices[i].Value {
+			value := result.Pie.Slices[i].Value
+			result.Score = &value
+		}
+	}
+}
+
+// WeightedSumAggregation sums each slice's value, normalized by its MaxValue and multiplied by its weight.  With the
+// default multi-factor weights (25 per slice), this results in a score from 0 to 100.
+type WeightedSumAggregation struct{}
+
+// Name returns the name of the strategy
+func (a WeightedSumAggregation) Name() string {
+	return "weighted-sum"
+}
+
+// Aggregate sets the score to the rounded, normalized weighted sum of the slice values
+func (a WeightedSumAggregation) Aggregate(result *plugin.RiskServiceCalculationResult) {
+	result.Score, result.ProbabilityDecimal = nil, nil
+	if len(result.Pie.Slices) == 0 {
+		return
+	}
+	var sum float64
+	for _, slice := range result.Pie.Slices {
+		if slice.MaxValue > 0 {
+			sum += float64(slice.Weight) * float64(slice.Value) / float64(slice.MaxValue)
+		}
+	}
+	score := int(math.Floor(sum + 0.5))
+	result.Score = &score
+}
+
+// WeightedMeanAggregation averages the slice values, weighting each value by its slice weight.  The resulting score
+// is on the same scale as the slice values.
+type WeightedMeanAggregation struct{}
+
+// Name returns the name of the strategy
+func (a WeightedMeanAggregation) Name() string {
+	return "weighted-mean"
+}
+
+// Aggregate sets the score to the rounded weighted mean of the slice values
+func (a WeightedMeanAggregation) Aggregate(result *plugin.RiskServiceCalculationResult) {
+	result.Score, result.ProbabilityDecimal = nil, nil
+	var sum, weights float64
+	for _, slice := range result.Pie.Slices {
+		sum += float64(slice.Weight) * float64(slice.Value)
+		weights += float64(slice.Weight)
+	}
+	if weights == 0 {
+		return
+	}
+	score := int(math.Floor(sum/weights + 0.5))
+	result.Score = &score
+}
+
+// ThresholdCountAggregation counts the slices whose value is at or above the threshold.
+type ThresholdCountAggregation struct {
+	Threshold int
+}
+
+// Name returns the name of the strategy, including its threshold
+func (a ThresholdCountAggregation) Name() string {
+	return fmt.Sprintf("threshold:%d", a.Threshold)
+}
+
+// Aggregate sets the score to the number of slices at or above the threshold
+func (a ThresholdCountAggregation) Aggregate(result *plugin.RiskServiceCalculationResult) {
+	result.Score, result.ProbabilityDecimal = nil, nil
+	count := 0
+	for _, slice := range result.Pie.Slices {
+		if slice.Value >= a.Threshold {
+			count++
+		}
+	}
+	result.Score = &count
+}
+
+// LogisticAggregation applies a logistic formula to the slice values, producing a ProbabilityDecimal (as a
+// percentage from 0 to 100).  Coefficients are applied to slices in order; slices without a coefficient are ignored.
+type LogisticAggregation struct {
+	Intercept    float64
+	Coefficients []float64
+}
+
+// DefaultLogisticAggregation is a logistic strategy with equal coefficients for the four multi-factor slices.  It
+// results in a probability of roughly 5% when all slices are low and 95% when all slices are high.
+var DefaultLogisticAggregation = LogisticAggregation{
+	Intercept:    -4.91,
+	Coefficients: []float64{0.49, 0.49, 0.49, 0.49},
+}
+
+// Name returns the name of the strategy, including its intercept and coefficients
+func (a LogisticAggregation) Name() string {
+	params := make([]string, 0, len(a.Coefficients)+1)
+	params = append(params, strconv.FormatFloat(a.Intercept, 'g', -1, 64))
+	for _, c := range a.Coefficients {
+		params = append(params, strconv.FormatFloat(c, 'g', -1, 64))
+	}
+	return "logistic:" + strings.Join(params, ",")
+}
+
+// Aggregate sets the probability decimal based on the logistic formula.  The score is left empty.
+func (a LogisticAggregation) Aggregate(result *plugin.RiskServiceCalculationResult) {
+	result.Score, result.ProbabilityDecimal = nil, nil
+	z := a.Intercept
+	for i, slice := range result.Pie.Slices {
+		if i < len(a.Coefficients) {
+			z += a.Coefficients[i] * float64(slice.Value)
+		}
+	}
+	probability := 100 / (1 + math.Exp(-z))
+	result.ProbabilityDecimal = &probability
+}
+
+// ParseAggregationStrategy returns the aggregation strategy for the given spec.  Supported specs are "max",
+// "weighted-sum", "weighted-mean", "threshold:<n>" and "logistic[:<intercept>,<coefficient>,...]".  An empty spec
+// results in the default (max) strategy.
+func ParseAggregationStrategy(spec string) (AggregationStrategy, error) {
+	name, params := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, params = spec[:i], spec[i+1:]
+	}
+
+	switch strings.TrimSpace(name) {
+	case "", "max":
+		return MaxValueAggregation{}, nil
+	case "weighted-sum":
+		return WeightedSumAggregation{}, nil
+	case "weighted-mean":
+		return WeightedMeanAggregation{}, nil
+	case "threshold":
+		threshold, err := strconv.Atoi(strings.TrimSpace(params))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid threshold for aggregation strategy: %s", spec)
+		}
+		return ThresholdCountAggregation{Threshold: threshold}, nil
+	case "logistic":
+		if params == "" {
+			return DefaultLogisticAggregation, nil
+		}
+		var values []float64
+		for _, p := range strings.Split(params, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid coefficient for aggregation strategy: %s", spec)
+			}
+			values = append(values, f)
+		}
+		return LogisticAggregation{Intercept: values[0], Coefficients: values[1:]}, nil
+	}
+	return nil, fmt.Errorf("Unknown aggregation strategy: %s", spec)
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestAggregationSuite(t *testing.T) {
+	suite.Run(t, new(AggregationSuite))
+}
+
+type AggregationSuite struct {
+	suite.Suite
+	Result *plugin.RiskServiceCalculationResult
+}
+
+func (suite *AggregationSuite) SetupTest() {
+	suite.Result = &plugin.RiskServiceCalculationResult{
+		Pie: &plugin.Pie{
+			Slices: []plugin.Slice{
+				{Name: "Clinical Risk", Weight: 25, Value: 3, MaxValue: 4},
+				{Name: "Functional and Environmental Risk", Weight: 25, Value: 2, MaxValue: 4},
+				{Name: "Psychosocial and Mental Health Risk", Weight: 25, Value: 1, MaxValue: 4},
+				{Name: "Utilization Risk", Weight: 25, Value: 3, MaxValue: 4},
+			},
+		},
+	}
+}
+
+func (suite *AggregationSuite) TestMaxValueAggregation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	MaxValueAggregation{}.Aggregate(suite.Result)
+	require.NotNil(suite.Result.Score)
+	assert.Equal(3, *suite.Result.Score)
+	assert.Nil(suite.Result.ProbabilityDecimal)
+}
+
+func (suite *AggregationSuite) TestMaxValueAggregationDoesNotAliasSlice() {
+	require := suite.Require()
+
+	MaxValueAggregation{}.Aggregate(suite.Result)
+	require.NotNil(suite.Result.Score)
+	suite.Result.Pie.Slices[0].Value = 1
+	suite.Assert().Equal(3, *suite.Result.Score)
+}
+
+func (suite *AggregationSuite) TestWeightedSumAggregation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// 25*3/4 + 25*2/4 + 25*1/4 + 25*3/4 = 56.25
+	WeightedSumAggregation{}.Aggregate(suite.Result)
+	require.NotNil(suite.Result.Score)
+	assert.Equal(56, *suite.Result.Score)
+	assert.Nil(suite.Result.ProbabilityDecimal)
+}
+
+func (suite *AggregationSuite) TestWeightedMeanAggregation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// (3 + 2 + 1 + 3) / 4 = 2.25
+	WeightedMeanAggregation{}.Aggregate(suite.Result)
+	require.NotNil(suite.Result.Score)
+	assert.Equal(2, *suite.Result.Score)
+
+	suite.Result.Pie.Slices[0].Weight = 75
+	WeightedMeanAggregation{}.Aggregate(suite.Result)
+	assert.Equal(3, *suite.Result.Score)
+}
+
+func (suite *AggregationSuite) TestThresholdCountAggregation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	ThresholdCountAggregation{Threshold: 3}.Aggregate(suite.Result)
+	require.NotNil(suite.Result.Score)
+	assert.Equal(2, *suite.Result.Score)
+
+	ThresholdCountAggregation{Threshold: 4}.Aggregate(suite.Result)
+	assert.Equal(0, *suite.Result.Score)
+}
+
+func (suite *AggregationSuite) TestLogisticAggregation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	LogisticAggregation{Intercept: 0, Coefficients: []float64{0, 0, 0, 0}}.Aggregate(suite.Result)
+	assert.Nil(suite.Result.Score)
+	require.NotNil(suite.Result.ProbabilityDecimal)
+	assert.InDelta(50, *suite.Result.ProbabilityDecimal, 0.0001)
+
+	DefaultLogisticAggregation.Aggregate(suite.Result)
+	require.NotNil(suite.Result.ProbabilityDecimal)
+	assert.True(*suite.Result.ProbabilityDecimal > 0 && *suite.Result.ProbabilityDecimal < 100)
+
+	for i := range suite.Result.Pie.Slices {
+		suite.Result.Pie.Slices[i].Value = 1
+	}
+	DefaultLogisticAggregation.Aggregate(suite.Result)
+	assert.InDelta(5, *suite.Result.ProbabilityDecimal, 1)
+
+	for i := range suite.Result.Pie.Slices {
+		suite.Result.Pie.Slices[i].Value = 4
+	}
+	DefaultLogisticAggregation.Aggregate(suite.Result)
+	assert.InDelta(95, *suite.Result.ProbabilityDecimal, 1)
+}
+
+func (suite *AggregationSuite) TestParseAggregationStrategy() {
+	assert := suite.Assert()
+
+	strategy, err := ParseAggregationStrategy("")
+	assert.NoError(err)
+	assert.Equal(MaxValueAggregation{}, strategy)
+
+	strategy, err = ParseAggregationStrategy("max")
+	assert.NoError(err)
+	assert.Equal(MaxValueAggregation{}, strategy)
+
+	strategy, err = ParseAggregationStrategy("weighted-sum")
+	assert.NoError(err)
+	assert.Equal(WeightedSumAggregation{}, strategy)
+
+	strategy, err = ParseAggregationStrategy("weighted-mean")
+	assert.NoError(err)
+	assert.Equal(WeightedMeanAggregation{}, strategy)
+
+	strategy, err = ParseAggregationStrategy("threshold:3")
+	assert.NoError(err)
+	assert.Equal(ThresholdCountAggregation{Threshold: 3}, strategy)
+	assert.Equal("threshold:3", strategy.Name())
+
+	strategy, err = ParseAggregationStrategy("logistic")
+	assert.NoError(err)
+	assert.Equal(DefaultLogisticAggregation, strategy)
+
+	strategy, err = ParseAggregationStrategy("logistic:-4, 0.5,0.25")
+	assert.NoError(err)
+	assert.Equal(LogisticAggregation{Intercept: -4, Coefficients: []float64{0.5, 0.25}}, strategy)
+	assert.Equal("logistic:-4,0.5,0.25", strategy.Name())
+
+	_, err = ParseAggregationStrategy("threshold")
+	assert.Error(err)
+
+	_, err = ParseAggregationStrategy("logistic:a,b")
+	assert.Error(err)
+
+	_, err = ParseAggregationStrategy("median")
+	assert.Error(err)
+}
+
+func (suite *AggregationSuite) TestRecordUsesStrategy() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	record := Record{
+		StudyID:          "1",
+		RiskFactorDate:   "2015-12-07",
+		ClinicalRisk:     "3",
+		FunctionalRisk:   "2",
+		PsychosocialRisk: "1",
+		UtilizationRisk:  "3",
+		PerceivedRisk:    "3",
+	}
+	result, err := record.ToRiskServiceCalculationResult("http://fhir/Patient/1", ThresholdCountAggregation{Threshold: 2})
+	require.NoError(err)
+	assert.Equal(3, *result.Score)
+
+	result, err = record.ToRiskServiceCalculationResult("http://fhir/Patient/1", nil)
+	require.NoError(err)
+	assert.Equal(3, *result.Score)
+}
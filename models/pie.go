@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// StoredPie represents a pie as it is stored in the database, along with the method and the as-of date of the risk
+// assessment it serves as the basis for.  The contents of a stored pie are never modified; when a patient's risk
+// assessments are refreshed, the new pies are stored as the next version and the previous version is flagged as
+// superseded.
+type StoredPie struct {
+	plugin.Pie   `bson:",inline"`
+	Method       *fhir.CodeableConcept `bson:"method" json:"method,omitempty"`
+	AsOf         time.Time             `bson:"asOf" json:"asOf"`
+	Version      int                   `bson:"version" json:"version"`
+	Superseded   bool                  `bson:"superseded" json:"superseded"`
+	SupersededAt *time.Time            `bson:"supersededAt,omitempty" json:"supersededAt,omitempty"`
+}
+
+// NewStoredPie creates a StoredPie for the result's pie, using the given method
+func NewStoredPie(result *plugin.RiskServiceCalculationResult, method fhir.CodeableConcept) *StoredPie {
+	return &StoredPie{
+		Pie:    *result.Pie,
+		Method: &method,
+		AsOf:   result.AsOf,
+	}
+}
+
+// ToRiskServiceCalculationResult converts the stored pie back into a RiskServiceCalculationResult, using the strategy
+// to compute its overall score (defaulting to MaxValueAggregation if nil).  Pies stored without an as-of date fall
+// back to their created date.
+func (s *StoredPie) ToRiskServiceCalculationResult(strategy AggregationStrategy) plugin.RiskServiceCalculationResult {
+	pie := s.Pie.Clone(false)
+	result := plugin.RiskServiceCalculationResult{
+		AsOf: s.AsOf,
+		Pie:  pie,
+	}
+	if result.AsOf.IsZero() {
+		result.AsOf = s.Created
+	}
+	if strategy == nil {
+		strategy = MaxValueAggregation{}
+	}
+	strategy.Aggregate(&result)
+	return result
+}
@@ -8,6 +8,7 @@ import (
 
 	"gopkg.in/mgo.v2/bson"
 
+	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/riskservice/plugin"
 )
 
@@ -29,9 +30,35 @@ func (r *Record) StudyIDString() string {
 	return fmt.Sprint(r.StudyID)
 }
 
-// RiskFactorDateTime returns the parsed date/time for the risk factor form
+// riskFactorDateLayouts are the REDCap date and datetime formats (as exported by the API) supported for rf_date.  The
+// first is the date format; the others are datetime formats.
+var riskFactorDateLayouts = []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05"}
+
+// RiskFactorDateTime returns the parsed date/time for the risk factor form, interpreted in the ClinicalLocation.  Both
+// REDCap date fields (resulting in midnight) and datetime fields (with or without seconds) are supported.
 func (r *Record) RiskFactorDateTime() (time.Time, error) {
-	return time.ParseInLocation("2006-01-02", r.RiskFactorDate, time.Local)
+	t, _, err := r.parseRiskFactorDate()
+	return t, err
+}
+
+// RiskFactorDatePrecision returns the precision of the risk factor date's REDCap format: date precision for date
+// fields, or timestamp precision for datetime fields (even at midnight)
+func (r *Record) RiskFactorDatePrecision() (fhir.Precision, error) {
+	_, precision, err := r.parseRiskFactorDate()
+	return precision, err
+}
+
+// parseRiskFactorDate parses the risk factor date, along with the precision of the format it was parsed with
+func (r *Record) parseRiskFactorDate() (time.Time, fhir.Precision, error) {
+	for i, layout := range riskFactorDateLayouts {
+		if t, err := time.ParseInLocation(layout, r.RiskFactorDate, ClinicalLocation); err == nil {
+			if i == 0 {
+				return t, fhir.Date, nil
+			}
+			return t, fhir.Timestamp, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("Invalid risk factor date: %s", r.RiskFactorDate)
 }
 
 // IsRiskFactorsComplete checks that the risk factors form was marked as complete, that a valid risk factor date was
@@ -51,7 +78,7 @@ func (r *Record) ToPie(patientURL string) (pie *plugin.Pie, err error) {
 
 	pie = new(plugin.Pie)
 	pie.Id = bson.NewObjectId()
-	pie.Created = time.Now()
+	pie.Created = Now()
 	pie.Patient = patientURL
 
 	crSlice, err := newSlice("Clinical Risk", r.ClinicalRisk)
@@ -80,9 +107,10 @@ func (r *Record) ToPie(patientURL string) (pie *plugin.Pie, err error) {
 }
 
 // ToRiskServiceCalculationResult converts the record to a RiskServiceCalculationResult.  The corresponding patientURL
-// must be passed in so the risk pie can be assiocated to the patient on the FHIR server.  If the record doesn't have
-// complete risk factors, it will result in an error.
-func (r *Record) ToRiskServiceCalculationResult(patientURL string) (result *plugin.RiskServiceCalculationResult, err error) {
+// must be passed in so the risk pie can be assiocated to the patient on the FHIR server.  The strategy determines how
+// the slices are aggregated into the overall score; if it is nil, the MaxValueAggregation is used.  If the record
+// doesn't have complete risk factors, it will result in an error.
+func (r *Record) ToRiskServiceCalculationResult(patientURL string, strategy AggregationStrategy) (result *plugin.RiskServiceCalculationResult, err error) {
 	pie, err := r.ToPie(patientURL)
 	if err != nil {
 		return nil, err
@@ -93,11 +121,10 @@ func (r *Record) ToRiskServiceCalculationResult(patientURL string) (result *plug
 		return nil, err
 	}
 	result.Pie = pie
-	for i := range pie.Slices {
-		if result.Score == nil || *result.Score < pie.Slices[i].Value {
-			result.Score = &pie.Slices[i].Value
-		}
+	if strategy == nil {
+		strategy = MaxValueAggregation{}
 	}
+	strategy.Aggregate(result)
 	return result, nil
 }
 
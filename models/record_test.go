@@ -6,10 +6,14 @@ import (
 	"testing"
 	"time"
 
+	fhir "github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/riskservice/plugin"
 	"github.com/stretchr/testify/suite"
 )
 
+// testLocation is used as the clinical timezone in tests so that results don't depend on the host's timezone
+var testLocation = time.FixedZone("UTC-5", -5*60*60)
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestRecordSuite(t *testing.T) {
@@ -28,6 +32,12 @@ func (suite *RecordSuite) SetupTest() {
 	require.NoError(err)
 	err = json.Unmarshal(data, &suite.Records)
 	require.NoError(err)
+
+	ClinicalLocation = testLocation
+}
+
+func (suite *RecordSuite) TearDownTest() {
+	ClinicalLocation = time.Local
 }
 
 func (suite *RecordSuite) TestLoadRecordsFromJSON() {
@@ -76,15 +86,67 @@ func (suite *RecordSuite) TestRiskFactorDateTime() {
 	assert := suite.Assert()
 	t, e := suite.Records[0].RiskFactorDateTime()
 	assert.NoError(e)
-	assert.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, time.Local), t)
+	assert.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, testLocation), t)
 
 	t, e = suite.Records[1].RiskFactorDateTime()
 	assert.NoError(e)
-	assert.Equal(time.Date(2016, time.April, 1, 0, 0, 0, 0, time.Local), t)
+	assert.Equal(time.Date(2016, time.April, 1, 0, 0, 0, 0, testLocation), t)
 
 	t, e = suite.Records[2].RiskFactorDateTime()
 	assert.NoError(e)
-	assert.Equal(time.Date(2016, time.February, 21, 0, 0, 0, 0, time.Local), t)
+	assert.Equal(time.Date(2016, time.February, 21, 0, 0, 0, 0, testLocation), t)
+}
+
+func (suite *RecordSuite) TestRiskFactorDateTimeWithREDCapDateTime() {
+	assert := suite.Assert()
+	record := suite.Records[0]
+
+	record.RiskFactorDate = "2015-12-07 14:30"
+	t, e := record.RiskFactorDateTime()
+	assert.NoError(e)
+	assert.Equal(time.Date(2015, time.December, 7, 14, 30, 0, 0, testLocation), t)
+
+	record.RiskFactorDate = "2015-12-07 14:30:15"
+	t, e = record.RiskFactorDateTime()
+	assert.NoError(e)
+	assert.Equal(time.Date(2015, time.December, 7, 14, 30, 15, 0, testLocation), t)
+
+	record.RiskFactorDate = "12/07/2015"
+	_, e = record.RiskFactorDateTime()
+	assert.Error(e)
+}
+
+func (suite *RecordSuite) TestRiskFactorDatePrecision() {
+	assert := suite.Assert()
+	record := suite.Records[0]
+
+	record.RiskFactorDate = "2015-12-07"
+	precision, e := record.RiskFactorDatePrecision()
+	assert.NoError(e)
+	assert.Equal(fhir.Precision(fhir.Date), precision)
+
+	// A datetime at midnight keeps its timestamp precision
+	record.RiskFactorDate = "2015-12-07 00:00"
+	precision, e = record.RiskFactorDatePrecision()
+	assert.NoError(e)
+	assert.Equal(fhir.Precision(fhir.Timestamp), precision)
+
+	record.RiskFactorDate = "12/07/2015"
+	_, e = record.RiskFactorDatePrecision()
+	assert.Error(e)
+}
+
+func (suite *RecordSuite) TestRiskFactorDateTimeIsIndependentOfHostTimezone() {
+	assert := suite.Assert()
+
+	// The same REDCap date should result in the same instant, regardless of the host's timezone
+	ClinicalLocation = time.UTC
+	t1, e := suite.Records[0].RiskFactorDateTime()
+	assert.NoError(e)
+	ClinicalLocation = time.FixedZone("UTC+9", 9*60*60)
+	t2, e := suite.Records[0].RiskFactorDateTime()
+	assert.NoError(e)
+	assert.Equal(9*time.Hour, t1.Sub(t2))
 }
 
 func (suite *RecordSuite) TestIsRiskFactorsComplete() {
@@ -133,10 +195,10 @@ func (suite *RecordSuite) TestToRiskServiceCalculationResult() {
 	assert := suite.Assert()
 	require := suite.Require()
 
-	result, err := suite.Records[0].ToRiskServiceCalculationResult("http://fhir/Patient/1")
+	result, err := suite.Records[0].ToRiskServiceCalculationResult("http://fhir/Patient/1", MaxValueAggregation{})
 	require.NoError(err)
 	require.NotNil(result)
-	assert.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, time.Local), result.AsOf)
+	assert.Equal(time.Date(2015, time.December, 7, 0, 0, 0, 0, testLocation), result.AsOf)
 	assert.Equal(3, *result.Score)
 	assert.Nil(result.ProbabilityDecimal)
 	suite.assertPieForRecord0(result.Pie)
@@ -148,6 +210,7 @@ func (suite *RecordSuite) assertPieForRecord0(pie *plugin.Pie) {
 
 	require.NotNil(pie)
 	assert.True(!pie.Created.IsZero(), "Created time should not be zero time")
+	assert.Equal(testLocation, pie.Created.Location())
 	assert.NotEmpty(pie.Id.Hex())
 	assert.Equal(pie.Patient, "http://fhir/Patient/1")
 	require.Len(pie.Slices, 4)
@@ -164,3 +227,22 @@ func (suite *RecordSuite) assertPieForRecord0(pie *plugin.Pie) {
 	assert.Equal("Utilization Risk", pie.Slices[3].Name)
 	assert.Equal(3, pie.Slices[3].Value)
 }
+
+func (suite *RecordSuite) TestCheckDataDictionary() {
+	assert := suite.Assert()
+
+	fields := append([]MetadataField(nil), DataDictionary...)
+	assert.Empty(CheckDataDictionary(fields))
+
+	// REDCap choices may be spaced differently
+	fields[2].SelectChoices = "1,Low|2,Moderate|3,High|4,Very High"
+	assert.Empty(CheckDataDictionary(fields))
+
+	fields[3].FieldType = "dropdown"
+	fields[4].SelectChoices = "1, Low | 2, High"
+	errs := CheckDataDictionary(fields[1:])
+	assert.Len(errs, 3)
+	assert.EqualError(errs[0], "Data dictionary is missing field study_id")
+	assert.EqualError(errs[1], "Data dictionary field rf_func_risk_cat has type dropdown, expected radio")
+	assert.Contains(errs[2].Error(), "rf_sb_risk_cat")
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RecordFields are the names of the REDCap fields in the risk stratification project that make up a Record, in the
+// order they are requested from (and exported by) REDCap
+var RecordFields = []string{"study_id", "redcap_event_name", "rf_date", "rf_cmc_risk_cat", "rf_func_risk_cat", "rf_sb_risk_cat", "rf_util_risk_cat", "rf_risk_predicted"}
+
+// MetadataField represents a field in a REDCap project's data dictionary, as exported by the REDCap metadata API
+type MetadataField struct {
+	FieldName          string `json:"field_name"`
+	FormName           string `json:"form_name"`
+	SectionHeader      string `json:"section_header"`
+	FieldType          string `json:"field_type"`
+	FieldLabel         string `json:"field_label"`
+	SelectChoices      string `json:"select_choices_or_calculations"`
+	FieldNote          string `json:"field_note"`
+	TextValidationType string `json:"text_validation_type_or_show_slider_number"`
+	RequiredField      string `json:"required_field"`
+}
+
+// riskCategoryChoices are the REDCap choices for each of the risk categories
+const riskCategoryChoices = "1, Low | 2, Moderate | 3, High | 4, Very High"
+
+// DataDictionary is the portion of the risk stratification project's data dictionary used by the service.  Note that
+// redcap_event_name is not included, since REDCap does not report it as part of the project metadata.
+var DataDictionary = []MetadataField{
+	{FieldName: "study_id", FormName: "enrollment", FieldType: "text", FieldLabel: "Study ID"},
+	{FieldName: "rf_date", FormName: "risk_factors", FieldType: "text", FieldLabel: "Risk factor assessment date", TextValidationType: "date_ymd", RequiredField: "y"},
+	{FieldName: "rf_cmc_risk_cat", FormName: "risk_factors", FieldType: "radio", FieldLabel: "Clinical risk category", SelectChoices: riskCategoryChoices, RequiredField: "y"},
+	{FieldName: "rf_func_risk_cat", FormName: "risk_factors", FieldType: "radio", FieldLabel: "Functional and environmental risk category", SelectChoices: riskCategoryChoices, RequiredField: "y"},
+	{FieldName: "rf_sb_risk_cat", FormName: "risk_factors", FieldType: "radio", FieldLabel: "Psychosocial and mental health risk category", SelectChoices: riskCategoryChoices, RequiredField: "y"},
+	{FieldName: "rf_util_risk_cat", FormName: "risk_factors", FieldType: "radio", FieldLabel: "Utilization risk category", SelectChoices: riskCategoryChoices, RequiredField: "y"},
+	{FieldName: "rf_risk_predicted", FormName: "risk_factors", FieldType: "radio", FieldLabel: "Perceived overall risk", SelectChoices: riskCategoryChoices, RequiredField: "y"},
+}
+
+// CheckDataDictionary checks that the REDCap project's data dictionary (as exported by the REDCap metadata API) has
+// each of the fields in the DataDictionary, with the same field type and choices.  An error is returned for each field
+// that is missing or doesn't match.
+func CheckDataDictionary(fields []MetadataField) []error {
+	byName := make(map[string]MetadataField)
+	for _, field := range fields {
+		byName[field.FieldName] = field
+	}
+	var errs []error
+	for _, expected := range DataDictionary {
+		field, ok := byName[expected.FieldName]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("Data dictionary is missing field %s", expected.FieldName))
+		case field.FieldType != expected.FieldType:
+			errs = append(errs, fmt.Errorf("Data dictionary field %s has type %s, expected %s", expected.FieldName, field.FieldType, expected.FieldType))
+		case normalizeChoices(field.SelectChoices) != normalizeChoices(expected.SelectChoices):
+			errs = append(errs, fmt.Errorf("Data dictionary field %s has choices \"%s\", expected \"%s\"", expected.FieldName, field.SelectChoices, expected.SelectChoices))
+		}
+	}
+	return errs
+}
+
+// normalizeChoices removes the whitespace from REDCap choices, since REDCap doesn't consistently space them
+func normalizeChoices(choices string) string {
+	return strings.Join(strings.Fields(choices), "")
+}
+
+// FieldValue returns the value of the record's REDCap field with the given name, or nil if it is not a record field
+func (r *Record) FieldValue(name string) interface{} {
+	switch name {
+	case "study_id":
+		return r.StudyID
+	case "redcap_event_name":
+		return r.EventName
+	case "rf_date":
+		return r.RiskFactorDate
+	case "rf_cmc_risk_cat":
+		return r.ClinicalRisk
+	case "rf_func_risk_cat":
+		return r.FunctionalRisk
+	case "rf_sb_risk_cat":
+		return r.PsychosocialRisk
+	case "rf_util_risk_cat":
+		return r.UtilizationRisk
+	case "rf_risk_predicted":
+		return r.PerceivedRisk
+	}
+	return nil
+}
+
+// SetFieldValue sets the value of the record's REDCap field with the given name, returning false if it is not a
+// record field
+func (r *Record) SetFieldValue(name string, value string) bool {
+	switch name {
+	case "study_id":
+		r.StudyID = value
+	case "redcap_event_name":
+		r.EventName = value
+	case "rf_date":
+		r.RiskFactorDate = value
+	case "rf_cmc_risk_cat":
+		r.ClinicalRisk = value
+	case "rf_func_risk_cat":
+		r.FunctionalRisk = value
+	case "rf_sb_risk_cat":
+		r.PsychosocialRisk = value
+	case "rf_util_risk_cat":
+		r.UtilizationRisk = value
+	case "rf_risk_predicted":
+		r.PerceivedRisk = value
+	default:
+		return false
+	}
+	return true
+}
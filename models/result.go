@@ -0,0 +1,64 @@
+package models
+
+import (
+	"sort"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// Result is a risk service calculation result, along with the details of the result that the calculation result
+// itself can't represent.  DatePrecision is the precision of the result's as-of date, or "" if it's a timestamp.  Basis
+// references the resources the result was based on, which are added to the basis of its risk assessment after its pie.
+type Result struct {
+	plugin.RiskServiceCalculationResult
+	DatePrecision fhir.Precision
+	Basis         []fhir.Reference
+}
+
+// NewResults returns the calculation results as Results without any details
+func NewResults(calcResults []plugin.RiskServiceCalculationResult) []Result {
+	results := make([]Result, len(calcResults))
+	for i := range calcResults {
+		results[i].RiskServiceCalculationResult = calcResults[i]
+	}
+	return results
+}
+
+// CalculationResults returns the results' calculation results, without their details
+func CalculationResults(results []Result) []plugin.RiskServiceCalculationResult {
+	calcResults := make([]plugin.RiskServiceCalculationResult, len(results))
+	for i := range results {
+		calcResults[i] = results[i].RiskServiceCalculationResult
+	}
+	return calcResults
+}
+
+// AsOfPrecision returns the precision of the result's as-of date: timestamp precision, unless the result's
+// DatePrecision says otherwise
+func (r *Result) AsOfPrecision() fhir.Precision {
+	if r.DatePrecision != "" {
+		return r.DatePrecision
+	}
+	return fhir.Timestamp
+}
+
+// SortResultsByAsOfDate sorts the results by their as-of dates, preserving the original order of results with the
+// same as-of date
+func SortResultsByAsOfDate(results []Result) {
+	sort.Stable(byAsOfDate(results))
+}
+
+type byAsOfDate []Result
+
+func (d byAsOfDate) Len() int {
+	return len(d)
+}
+
+func (d byAsOfDate) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+func (d byAsOfDate) Less(i, j int) bool {
+	return d[i].AsOf.Before(d[j].AsOf)
+}
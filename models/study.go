@@ -31,11 +31,12 @@ func (s *Study) AddRecord(r Record) error {
 // ToRiskServiceCalculationResults converts the records to RiskServiceCalculationResults and returns them sorted
 // by the AsOf date.  Note that the size of the resulting list may be smaller than the size of the record list since
 // some records may represent incomplete risk factors.  The corresponding patientURL must be passed in so the risk pie
-// can be assiocated to the patient on the FHIR server.
-func (s *Study) ToRiskServiceCalculationResults(patientURL string) []plugin.RiskServiceCalculationResult {
+// can be assiocated to the patient on the FHIR server.  The strategy determines how each pie's slices are aggregated
+// into the overall score (defaulting to MaxValueAggregation if nil).
+func (s *Study) ToRiskServiceCalculationResults(patientURL string, strategy AggregationStrategy) []plugin.RiskServiceCalculationResult {
 	var results []plugin.RiskServiceCalculationResult
 	for i := range s.Records {
-		if result, err := s.Records[i].ToRiskServiceCalculationResult(patientURL); err == nil {
+		if result, err := s.Records[i].ToRiskServiceCalculationResult(patientURL, strategy); err == nil {
 			results = append(results, *result)
 		}
 	}
@@ -44,6 +45,23 @@ func (s *Study) ToRiskServiceCalculationResults(patientURL string) []plugin.Risk
 	return results
 }
 
+// ToResults converts the records to Results as ToRiskServiceCalculationResults does, along with the precision of each
+// record's risk factor date
+func (s *Study) ToResults(patientURL string, strategy AggregationStrategy) []Result {
+	var results []Result
+	for i := range s.Records {
+		result, err := s.Records[i].ToRiskServiceCalculationResult(patientURL, strategy)
+		if err != nil {
+			continue
+		}
+		precision, _ := s.Records[i].RiskFactorDatePrecision()
+		results = append(results, Result{RiskServiceCalculationResult: *result, DatePrecision: precision})
+	}
+	SortResultsByAsOfDate(results)
+
+	return results
+}
+
 // StudyMap is a simple map of studies indexed by the study ID, providing a few convenience functions
 type StudyMap map[string]*Study
 
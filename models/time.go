@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+)
+
+// ClinicalLocation is the timezone in which clinical dates (such as REDCap risk factor dates) are interpreted and
+// emitted.  It defaults to the host's local timezone, but should be configured (see SetClinicalTimezone) so that the
+// same REDCap date always results in the same instant, regardless of the timezone of the host running the service.
+var ClinicalLocation = time.Local
+
+// SetClinicalTimezone sets the ClinicalLocation using an IANA timezone name (e.g., "America/New_York").  An empty name
+// leaves the ClinicalLocation unchanged.
+func SetClinicalTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	ClinicalLocation = loc
+	return nil
+}
+
+// Now returns the current time in the ClinicalLocation
+func Now() time.Time {
+	return time.Now().In(ClinicalLocation)
+}
+
+// ToFHIRDateTime converts the time to a FHIRDateTime with the given precision in the ClinicalLocation, so that dates
+// are emitted as the date in the clinical timezone
+func ToFHIRDateTime(t time.Time, precision fhir.Precision) *fhir.FHIRDateTime {
+	return &fhir.FHIRDateTime{Time: t.In(ClinicalLocation), Precision: precision}
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTimeSuite(t *testing.T) {
+	suite.Run(t, new(TimeSuite))
+}
+
+type TimeSuite struct {
+	suite.Suite
+}
+
+func (suite *TimeSuite) SetupTest() {
+	ClinicalLocation = testLocation
+}
+
+func (suite *TimeSuite) TearDownTest() {
+	ClinicalLocation = time.Local
+}
+
+func (suite *TimeSuite) TestSetClinicalTimezone() {
+	assert := suite.Assert()
+
+	assert.NoError(SetClinicalTimezone(""))
+	assert.Equal(testLocation, ClinicalLocation)
+
+	assert.NoError(SetClinicalTimezone("UTC"))
+	assert.Equal(time.UTC, ClinicalLocation)
+
+	assert.Error(SetClinicalTimezone("Not/AZone"))
+	assert.Equal(time.UTC, ClinicalLocation)
+}
+
+func (suite *TimeSuite) TestNow() {
+	suite.Assert().Equal(testLocation, Now().Location())
+}
+
+func (suite *TimeSuite) TestToFHIRDateTimeWithDate() {
+	assert := suite.Assert()
+
+	dt := ToFHIRDateTime(time.Date(2015, time.December, 7, 0, 0, 0, 0, testLocation), fhir.Date)
+	assert.Equal(fhir.Precision(fhir.Date), dt.Precision)
+	data, err := dt.MarshalJSON()
+	assert.NoError(err)
+	assert.Equal(`"2015-12-07"`, string(data))
+
+	// Even if the time is in another zone, it should be emitted as the date in the clinical timezone
+	dt = ToFHIRDateTime(time.Date(2015, time.December, 7, 5, 0, 0, 0, time.UTC), fhir.Date)
+	assert.Equal(fhir.Precision(fhir.Date), dt.Precision)
+	data, err = dt.MarshalJSON()
+	assert.NoError(err)
+	assert.Equal(`"2015-12-07"`, string(data))
+}
+
+func (suite *TimeSuite) TestToFHIRDateTimeWithTimestamp() {
+	assert := suite.Assert()
+
+	dt := ToFHIRDateTime(time.Date(2015, time.December, 7, 14, 30, 0, 0, testLocation), fhir.Timestamp)
+	assert.Equal(fhir.Precision(fhir.Timestamp), dt.Precision)
+	data, err := dt.MarshalJSON()
+	assert.NoError(err)
+	assert.Equal(`"2015-12-07T14:30:00-05:00"`, string(data))
+
+	// Midnight is a timestamp when the precision says so
+	dt = ToFHIRDateTime(time.Date(2015, time.December, 7, 5, 0, 0, 0, time.UTC), fhir.Timestamp)
+	data, err = dt.MarshalJSON()
+	assert.NoError(err)
+	assert.Equal(`"2015-12-07T00:00:00-05:00"`, string(data))
+}
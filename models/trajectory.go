@@ -0,0 +1,159 @@
+package models
+
+import (
+	"time"
+
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// TrajectoryOptions indicates how trajectory metrics should be computed
+type TrajectoryOptions struct {
+	// SliceHighRiskThreshold is the slice value at or above which a slice is considered high risk
+	SliceHighRiskThreshold float64
+	// OverallHighRiskThreshold is the overall score (or probability) at or above which a patient is considered high risk
+	OverallHighRiskThreshold float64
+	// Window is the period of time (ending at the most recent assessment) used to compute the slope
+	Window time.Duration
+}
+
+// DefaultTrajectoryOptions are the trajectory options suited to the multi-factor model's max value aggregation
+var DefaultTrajectoryOptions = TrajectoryOptions{
+	SliceHighRiskThreshold:   3,
+	OverallHighRiskThreshold: 3,
+	Window:                   180 * 24 * time.Hour,
+}
+
+// Trajectory represents the direction of a patient's risk over a series of risk assessments
+type Trajectory struct {
+	AsOf        time.Time `json:"asOf"`
+	Assessments int       `json:"assessments"`
+	Overall     Trend     `json:"overall"`
+	Slices      []Trend   `json:"slices"`
+}
+
+// Trend represents the trend metrics for the overall risk or for a single slice of the pie.  SlopePerMonth is the
+// least-squares slope (per 30 days) of the values within the trajectory window.  DaysAtHighRisk counts the days
+// between assessments during which the value was at or above the high risk threshold.  Escalations counts the number
+// of times the value rose from below the high risk threshold to at or above it from one assessment to the next.
+type Trend struct {
+	Name                string   `json:"name"`
+	Current             float64  `json:"current"`
+	ChangeSincePrevious *float64 `json:"changeSincePrevious,omitempty"`
+	SlopePerMonth       *float64 `json:"slopePerMonth,omitempty"`
+	DaysAtHighRisk      float64  `json:"daysAtHighRisk"`
+	Escalations         int      `json:"escalations"`
+}
+
+// ComputeTrajectory computes the overall and per-slice trends for the results, which must be sorted by their as-of
+// date.  Slices are matched across results by name, using the slices of the most recent result.  If there are no
+// results, nil is returned.
+func ComputeTrajectory(results []plugin.RiskServiceCalculationResult, options TrajectoryOptions) *Trajectory {
+	if len(results) == 0 {
+		return nil
+	}
+	last := results[len(results)-1]
+	trajectory := &Trajectory{
+		AsOf:        last.AsOf,
+		Assessments: len(results),
+	}
+
+	var overall []point
+	for i := range results {
+		if value := results[i].GetProbabilityDecimalOrScore(); value != nil {
+			overall = append(overall, point{results[i].AsOf, *value})
+		}
+	}
+	trajectory.Overall = computeTrend("Overall", overall, options.OverallHighRiskThreshold, options.Window)
+
+	if last.Pie != nil {
+		for _, slice := range last.Pie.Slices {
+			var points []point
+			for i := range results {
+				if value, ok := sliceValue(results[i].Pie, slice.Name); ok {
+					points = append(points, point{results[i].AsOf, float64(value)})
+				}
+			}
+			trajectory.Slices = append(trajectory.Slices, computeTrend(slice.Name, points, options.SliceHighRiskThreshold, options.Window))
+		}
+	}
+
+	return trajectory
+}
+
+type point struct {
+	Date  time.Time
+	Value float64
+}
+
+func computeTrend(name string, points []point, highRiskThreshold float64, window time.Duration) Trend {
+	trend := Trend{Name: name}
+	if len(points) == 0 {
+		return trend
+	}
+
+	last := points[len(points)-1]
+	trend.Current = last.Value
+	if len(points) > 1 {
+		change := last.Value - points[len(points)-2].Value
+		trend.ChangeSincePrevious = &change
+	}
+
+	for i := 1; i < len(points); i++ {
+		if points[i-1].Value >= highRiskThreshold {
+			trend.DaysAtHighRisk += points[i].Date.Sub(points[i-1].Date).Hours() / 24
+		}
+		if points[i-1].Value < highRiskThreshold && points[i].Value >= highRiskThreshold {
+			trend.Escalations++
+		}
+	}
+
+	windowStart := last.Date.Add(-window)
+	var windowed []point
+	for _, p := range points {
+		if !p.Date.Before(windowStart) {
+			windowed = append(windowed, p)
+		}
+	}
+	trend.SlopePerMonth = slopePerMonth(windowed)
+
+	return trend
+}
+
+// slopePerMonth calculates the least-squares slope of the points, expressed as change in value per 30 days.  If
+// there are fewer than two distinct dates, nil is returned.
+func slopePerMonth(points []point) *float64 {
+	if len(points) < 2 {
+		return nil
+	}
+	origin := points[0].Date
+	var sumX, sumY float64
+	for _, p := range points {
+		sumX += p.Date.Sub(origin).Hours() / (24 * 30)
+		sumY += p.Value
+	}
+	n := float64(len(points))
+	meanX, meanY := sumX/n, sumY/n
+	var num, den float64
+	for _, p := range points {
+		dx := p.Date.Sub(origin).Hours()/(24*30) - meanX
+		num += dx * (p.Value - meanY)
+		den += dx * dx
+	}
+	if den == 0 {
+		return nil
+	}
+	slope := num / den
+	return &slope
+}
+
+func sliceValue(pie *plugin.Pie, name string) (int, bool) {
+	if pie == nil {
+		return 0, false
+	}
+	for _, slice := range pie.Slices {
+		if slice.Name == name {
+			return slice.Value, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTrajectorySuite(t *testing.T) {
+	suite.Run(t, new(TrajectorySuite))
+}
+
+type TrajectorySuite struct {
+	suite.Suite
+	Results []plugin.RiskServiceCalculationResult
+}
+
+func (suite *TrajectorySuite) SetupTest() {
+	require := suite.Require()
+
+	records := []Record{
+		{StudyID: "1", RiskFactorDate: "2016-01-01", ClinicalRisk: "2", FunctionalRisk: "1", PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "2"},
+		{StudyID: "1", RiskFactorDate: "2016-01-31", ClinicalRisk: "3", FunctionalRisk: "1", PsychosocialRisk: "1", UtilizationRisk: "2", PerceivedRisk: "3"},
+		{StudyID: "1", RiskFactorDate: "2016-03-01", ClinicalRisk: "4", FunctionalRisk: "1", PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "4"},
+		{StudyID: "1", RiskFactorDate: "2016-03-31", ClinicalRisk: "2", FunctionalRisk: "1", PsychosocialRisk: "1", UtilizationRisk: "1", PerceivedRisk: "2"},
+	}
+	study := new(Study)
+	for i := range records {
+		require.NoError(study.AddRecord(records[i]))
+	}
+	suite.Results = study.ToRiskServiceCalculationResults("http://fhir/Patient/1", MaxValueAggregation{})
+	require.Len(suite.Results, 4)
+}
+
+func (suite *TrajectorySuite) TestComputeTrajectory() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	trajectory := ComputeTrajectory(suite.Results, DefaultTrajectoryOptions)
+	require.NotNil(trajectory)
+	assert.Equal(4, trajectory.Assessments)
+	assert.Equal(suite.Results[3].AsOf, trajectory.AsOf)
+
+	overall := trajectory.Overall
+	assert.Equal("Overall", overall.Name)
+	assert.Equal(float64(2), overall.Current)
+	require.NotNil(overall.ChangeSincePrevious)
+	assert.Equal(float64(-2), *overall.ChangeSincePrevious)
+	// Only the rise into high risk on 1/31 is an escalation, not the further rise on 3/1
+	assert.Equal(1, overall.Escalations)
+	// High risk from 1/31 through 3/31
+	assert.InDelta(60, overall.DaysAtHighRisk, 0.1)
+	require.NotNil(overall.SlopePerMonth)
+
+	require.Len(trajectory.Slices, 4)
+	clinical := trajectory.Slices[0]
+	assert.Equal("Clinical Risk", clinical.Name)
+	assert.Equal(1, clinical.Escalations)
+	assert.InDelta(60, clinical.DaysAtHighRisk, 0.1)
+
+	utilization := trajectory.Slices[3]
+	assert.Equal("Utilization Risk", utilization.Name)
+	assert.Equal(float64(1), utilization.Current)
+	require.NotNil(utilization.ChangeSincePrevious)
+	assert.Equal(float64(0), *utilization.ChangeSincePrevious)
+	// The utilization risk rose, but never to high risk
+	assert.Equal(0, utilization.Escalations)
+	assert.Equal(float64(0), utilization.DaysAtHighRisk)
+
+	functional := trajectory.Slices[1]
+	assert.Equal(0, functional.Escalations)
+	require.NotNil(functional.SlopePerMonth)
+	assert.InDelta(0, *functional.SlopePerMonth, 0.0001)
+}
+
+func (suite *TrajectorySuite) TestComputeTrajectorySlope() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Only the first three results, which increase by one point each month (roughly)
+	trajectory := ComputeTrajectory(suite.Results[:3], DefaultTrajectoryOptions)
+	require.NotNil(trajectory.Overall.SlopePerMonth)
+	assert.InDelta(1, *trajectory.Overall.SlopePerMonth, 0.05)
+
+	// A small window should exclude the older results, leaving only one point (and therefore no slope)
+	options := DefaultTrajectoryOptions
+	options.Window = 24 * time.Hour
+	trajectory = ComputeTrajectory(suite.Results[:3], options)
+	assert.Nil(trajectory.Overall.SlopePerMonth)
+}
+
+func (suite *TrajectorySuite) TestComputeTrajectorySingleResult() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	trajectory := ComputeTrajectory(suite.Results[:1], DefaultTrajectoryOptions)
+	require.NotNil(trajectory)
+	assert.Equal(1, trajectory.Assessments)
+	assert.Equal(float64(2), trajectory.Overall.Current)
+	assert.Nil(trajectory.Overall.ChangeSincePrevious)
+	assert.Nil(trajectory.Overall.SlopePerMonth)
+	assert.Equal(0, trajectory.Overall.Escalations)
+}
+
+func (suite *TrajectorySuite) TestComputeTrajectoryNoResults() {
+	suite.Assert().Nil(ComputeTrajectory(nil, DefaultTrajectoryOptions))
+}
+
+func (suite *TrajectorySuite) TestStoredPieRoundTrip() {
+	assert := suite.Assert()
+
+	stored := NewStoredPie(&suite.Results[1], fhir.CodeableConcept{Text: "Multi-Factor"})
+	assert.Equal("Multi-Factor", stored.Method.Text)
+	result := stored.ToRiskServiceCalculationResult(MaxValueAggregation{})
+	assert.Equal(suite.Results[1].AsOf, result.AsOf)
+	assert.Equal(3, *result.Score)
+	assert.Equal(suite.Results[1].Pie.Slices, result.Pie.Slices)
+
+	// Pies stored before the as-of date was recorded should fall back to the created date
+	stored.AsOf = time.Time{}
+	result = stored.ToRiskServiceCalculationResult(nil)
+	assert.Equal(stored.Created, result.AsOf)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/devices"
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+)
+
+// runMQTT subscribes to device telemetry published to an MQTT broker, writing the readings to the FHIR server as
+// Observations until it's interrupted
+func runMQTT(args []string) int {
+	s := newSettings("mqtt", "", "Subscribes to device telemetry published to an MQTT broker and writes the readings to the FHIR server as Observations.")
+	s.addFHIR()
+	s.addMQTT()
+	s.addRegistry()
+	s.addLogging()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	data, err := ioutil.ReadFile(*s.Mappings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't read the MQTT mappings:", err.Error())
+		return 1
+	}
+	qos, _ := strconv.Atoi(*s.QoS)
+	mappings, err := devices.ParseMappings(data, byte(qos))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	size, _ := strconv.Atoi(*s.OutboxSize)
+	outbox, err := devices.NewOutbox(*s.Outbox, size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't open the outbox:", err.Error())
+		return 1
+	}
+	if n := outbox.Len(); n > 0 {
+		log.Printf("Loaded %d readings from the outbox.", n)
+	}
+
+	deviceRegistry, err := s.openRegistry("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if deviceRegistry != nil {
+		defer deviceRegistry.Store.Close()
+	}
+
+	subscriber := devices.NewSubscriber(mqtt.Options{
+		Broker:    *s.Broker,
+		ClientID:  *s.ClientID,
+		Username:  *s.Username,
+		Password:  *s.Password,
+		KeepAlive: time.Minute,
+	}, mappings, outbox, s.ingester(deviceRegistry))
+
+	// Stop on SIGINT or SIGTERM, leaving any readings that weren't ingested in the outbox
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	subscriber.Run(stop)
+	if n := outbox.Len(); n > 0 {
+		log.Printf("Stopped with %d readings in the outbox.", n)
+	}
+	return 0
+}
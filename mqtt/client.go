@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long the client waits to connect to the broker and for the broker to acknowledge packets
+const DefaultTimeout = 10 * time.Second
+
+// ErrClosed is returned when using a client whose connection is closed
+var ErrClosed = errors.New("MQTT connection closed")
+
+// Options configure a client's connection to a broker
+type Options struct {
+	// Broker is the broker's address, host:port, optionally prefixed with tcp:// or mqtt://.  The port defaults to
+	// 1883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// CleanSession discards the session when the client disconnects.  With a persistent session, the broker keeps the
+	// client's subscriptions, queues QoS 1 and 2 messages while it's disconnected, and redelivers messages that it
+	// didn't acknowledge.
+	CleanSession bool
+	// KeepAlive is the maximum time between packets sent by the client, or 0 to disable keep-alive pings
+	KeepAlive time.Duration
+	// Timeout is how long to wait to connect and for acknowledgements, or 0 for DefaultTimeout
+	Timeout time.Duration
+	// Handler is called with each message received, one at a time, in the order they're received.  QoS 1 and 2
+	// messages are acknowledged only if the handler returns nil, so that the broker redelivers them when a persistent
+	// session is resumed.
+	Handler func(Message) error
+}
+
+// Client is a connection to an MQTT broker
+type Client struct {
+	opts      Options
+	conn      net.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	lastID    uint16
+	pending   map[uint16]chan Packet
+	received  map[uint16]bool
+	done      chan struct{}
+	err       error
+}
+
+// Dial connects to the broker, returning an error if the connection is refused
+func Dial(opts Options) (*Client, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	address := opts.Broker
+	for _, scheme := range []string{"tcp://", "mqtt://"} {
+		address = strings.TrimPrefix(address, scheme)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "1883")
+	}
+	conn, err := net.DialTimeout("tcp", address, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	connect := ConnectPacket{
+		ClientID:     opts.ClientID,
+		Username:     opts.Username,
+		Password:     opts.Password,
+		CleanSession: opts.CleanSession,
+		KeepAlive:    uint16(opts.KeepAlive / time.Second),
+	}
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	err = WritePacket(conn, connect.Encode())
+	var connack Packet
+	if err == nil {
+		connack, err = ReadPacket(r)
+	}
+	if err == nil && (connack.Type != Connack || len(connack.Body) != 2) {
+		err = fmt.Errorf("Expected MQTT CONNACK, received packet type %d", connack.Type)
+	} else if err == nil && connack.Body[1] != 0 {
+		reason, ok := connackErrors[connack.Body[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", connack.Body[1])
+		}
+		err = fmt.Errorf("MQTT broker %s refused the connection: %s", opts.Broker, reason)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{
+		opts:     opts,
+		conn:     conn,
+		pending:  make(map[uint16]chan Packet),
+		received: make(map[uint16]bool),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop(r)
+	if opts.KeepAlive > 0 {
+		go c.pingLoop()
+	}
+	return c, nil
+}
+
+// Subscribe subscribes to the topic filters, returning the QoS granted for each.  It's an error if the broker refuses
+// any of the subscriptions.
+func (c *Client) Subscribe(subscriptions ...Subscription) ([]byte, error) {
+	for _, s := range subscriptions {
+		if err := ValidateFilter(s.Filter); err != nil {
+			return nil, err
+		}
+	}
+	id, ch := c.expect()
+	ack, err := c.await(id, ch, EncodeSubscribe(id, subscriptions))
+	if err != nil {
+		return nil, err
+	}
+	_, granted, err := DecodeSuback(ack)
+	if err != nil {
+		return nil, err
+	}
+	for i, qos := range granted {
+		if qos == SubscribeFailure && i < len(subscriptions) {
+			return granted, fmt.Errorf("MQTT broker refused the subscription to %s", subscriptions[i].Filter)
+		}
+	}
+	return granted, nil
+}
+
+// Publish publishes the message at QoS 0 or 1, waiting for the broker to acknowledge QoS 1 messages
+func (c *Client) Publish(m Message) error {
+	switch m.QoS {
+	case 0:
+		return c.write(m.Encode())
+	case 1:
+		id, ch := c.expect()
+		m.PacketID = id
+		_, err := c.await(id, ch, m.Encode())
+		return err
+	}
+	return fmt.Errorf("Publishing at MQTT QoS %d isn't supported", m.QoS)
+}
+
+// Done returns a channel that's closed when the connection is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was closed, or nil if it's open
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() error {
+	err := c.write(Packet{Type: Disconnect})
+	c.fail(ErrClosed)
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// expect allocates a packet ID for a packet that the broker acknowledges, returning the channel the acknowledgement
+// is sent to
+func (c *Client) expect() (uint16, chan Packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		c.lastID++
+		if _, ok := c.pending[c.lastID]; c.lastID != 0 && !ok {
+			break
+		}
+	}
+	ch := make(chan Packet, 1)
+	c.pending[c.lastID] = ch
+	return c.lastID, ch
+}
+
+// await sends the packet and waits for its acknowledgement
+func (c *Client) await(id uint16, ch chan Packet, p Packet) (Packet, error) {
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+	if err := c.write(p); err != nil {
+		return Packet{}, err
+	}
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-c.done:
+		return Packet{}, c.Err()
+	case <-time.After(c.opts.Timeout):
+		return Packet{}, fmt.Errorf("Timed out waiting for MQTT broker to acknowledge packet %d", id)
+	}
+}
+
+func (c *Client) write(p Packet) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	if err := WritePacket(c.conn, p); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail closes the connection, recording the first reason
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		if c.opts.KeepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		}
+		p, err := ReadPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch p.Type {
+		case Publish:
+			err = c.receive(p)
+		case Pubrel:
+			var id uint16
+			if id, err = PacketID(p); err == nil {
+				c.lock.Lock()
+				delete(c.received, id)
+				c.lock.Unlock()
+				err = c.write(AckPacket(Pubcomp, id))
+			}
+		case Puback, Suback, Unsuback:
+			var id uint16
+			if id, err = PacketID(p); err == nil {
+				c.lock.Lock()
+				if ch, ok := c.pending[id]; ok {
+					ch <- p
+				}
+				c.lock.Unlock()
+			}
+		case Pingresp:
+		default:
+			err = fmt.Errorf("Unexpected MQTT packet type %d", p.Type)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// receive passes a published message to the handler, acknowledging it if it was handled
+func (c *Client) receive(p Packet) error {
+	m, err := DecodePublish(p)
+	if err != nil {
+		return err
+	}
+	if m.QoS == 2 {
+		// A QoS 2 message that was already handled is resent until it's released, but must only be handled once
+		c.lock.Lock()
+		handled := c.received[m.PacketID]
+		c.lock.Unlock()
+		if handled {
+			return c.write(AckPacket(Pubrec, m.PacketID))
+		}
+	}
+	if c.opts.Handler != nil {
+		if err := c.opts.Handler(m); err != nil {
+			return nil
+		}
+	}
+	switch m.QoS {
+	case 1:
+		return c.write(AckPacket(Puback, m.PacketID))
+	case 2:
+		c.lock.Lock()
+		c.received[m.PacketID] = true
+		c.lock.Unlock()
+		return c.write(AckPacket(Pubrec, m.PacketID))
+	}
+	return nil
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write(Packet{Type: Pingreq})
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package mqtt_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+	"github.com/intervention-engine/multifactorriskservice/mqtt/mqtttest"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestClientSuite(t *testing.T) {
+	suite.Run(t, new(ClientSuite))
+}
+
+type ClientSuite struct {
+	suite.Suite
+	Broker   *mqtttest.Broker
+	Lock     sync.Mutex
+	Received []mqtt.Message
+	Failing  bool
+}
+
+func (suite *ClientSuite) SetupTest() {
+	var err error
+	suite.Broker, err = mqtttest.NewBroker()
+	suite.Require().NoError(err)
+	suite.Received, suite.Failing = nil, false
+}
+
+func (suite *ClientSuite) TearDownTest() {
+	suite.Broker.Close()
+}
+
+func (suite *ClientSuite) dial(clientID string, cleanSession bool) *mqtt.Client {
+	c, err := mqtt.Dial(mqtt.Options{
+		Broker:       "tcp://" + suite.Broker.Addr,
+		ClientID:     clientID,
+		CleanSession: cleanSession,
+		KeepAlive:    time.Minute,
+		Timeout:      time.Second,
+		Handler: func(m mqtt.Message) error {
+			suite.Lock.Lock()
+			defer suite.Lock.Unlock()
+			if suite.Failing {
+				return errors.New("can't handle message")
+			}
+			suite.Received = append(suite.Received, m)
+			return nil
+		},
+	})
+	suite.Require().NoError(err)
+	return c
+}
+
+func (suite *ClientSuite) received() []mqtt.Message {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	return append([]mqtt.Message(nil), suite.Received...)
+}
+
+func (suite *ClientSuite) setFailing(failing bool) {
+	suite.Lock.Lock()
+	defer suite.Lock.Unlock()
+	suite.Failing = failing
+}
+
+// eventually waits for the condition to be true
+func (suite *ClientSuite) eventually(condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			suite.FailNow("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (suite *ClientSuite) TestSubscribeAndReceive() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	c := suite.dial("subscriber", true)
+	defer c.Close()
+	granted, err := c.Subscribe(mqtt.Subscription{Filter: "home/+/weight", QoS: 2}, mqtt.Subscription{Filter: "home/+/pulse", QoS: 0})
+	require.NoError(err)
+	assert.Equal([]byte{2, 0}, granted)
+
+	publisher := suite.dial("publisher", true)
+	defer publisher.Close()
+	require.NoError(publisher.Publish(mqtt.Message{Topic: "home/scale-1/weight", Payload: []byte("60"), QoS: 1}))
+	require.NoError(publisher.Publish(mqtt.Message{Topic: "home/scale-1/pulse", Payload: []byte("72"), QoS: 1}))
+	require.NoError(publisher.Publish(mqtt.Message{Topic: "home/scale-1/other", Payload: []byte("0"), QoS: 0}))
+	suite.Broker.Publish(mqtt.Message{Topic: "home/scale-2/weight", Payload: []byte("70"), QoS: 2})
+
+	suite.eventually(func() bool { return len(suite.received()) == 3 })
+	received := suite.received()
+	assert.Equal("home/scale-1/weight", received[0].Topic)
+	assert.Equal("60", string(received[0].Payload))
+	assert.Equal(byte(1), received[0].QoS)
+	assert.Equal("home/scale-1/pulse", received[1].Topic)
+	assert.Equal(byte(0), received[1].QoS)
+	assert.Equal("home/scale-2/weight", received[2].Topic)
+	assert.Equal(byte(2), received[2].QoS)
+	suite.eventually(func() bool { return suite.Broker.Inflight("subscriber") == 0 })
+}
+
+func (suite *ClientSuite) TestUnhandledMessagesAreRedelivered() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	c := suite.dial("subscriber", false)
+	_, err := c.Subscribe(mqtt.Subscription{Filter: "home/#", QoS: 1})
+	require.NoError(err)
+
+	suite.setFailing(true)
+	suite.Broker.Publish(mqtt.Message{Topic: "home/scale-1/weight", Payload: []byte("60"), QoS: 1})
+	suite.eventually(func() bool { return suite.Broker.Inflight("subscriber") == 1 })
+	require.NoError(c.Close())
+	<-c.Done()
+
+	// Messages published while the client is disconnected are queued in its persistent session
+	suite.Broker.Publish(mqtt.Message{Topic: "home/scale-1/weight", Payload: []byte("61"), QoS: 1})
+	suite.setFailing(false)
+	c = suite.dial("subscriber", false)
+	defer c.Close()
+	suite.eventually(func() bool { return len(suite.received()) == 2 })
+	received := suite.received()
+	assert.Equal("60", string(received[0].Payload))
+	assert.True(received[0].Dup)
+	assert.Equal("61", string(received[1].Payload))
+	suite.eventually(func() bool { return suite.Broker.Inflight("subscriber") == 0 })
+}
+
+func (suite *ClientSuite) TestConnectionLost() {
+	assert := suite.Assert()
+
+	c := suite.dial("subscriber", true)
+	suite.Broker.Disconnect("subscriber")
+	select {
+	case <-c.Done():
+		assert.Error(c.Err())
+	case <-time.After(2 * time.Second):
+		suite.FailNow("Connection wasn't closed")
+	}
+	assert.Equal(mqtt.ErrClosed, c.Publish(mqtt.Message{Topic: "home", QoS: 0}))
+}
+
+func (suite *ClientSuite) TestConnectRefused() {
+	assert := suite.Assert()
+
+	suite.Broker.Username, suite.Broker.Password = "user", "secret"
+	_, err := mqtt.Dial(mqtt.Options{Broker: suite.Broker.Addr, ClientID: "subscriber", Username: "user", Password: "wrong", Timeout: time.Second})
+	assert.EqualError(err, "MQTT broker "+suite.Broker.Addr+" refused the connection: bad user name or password")
+
+	c, err := mqtt.Dial(mqtt.Options{Broker: suite.Broker.Addr, ClientID: "subscriber", Username: "user", Password: "secret", Timeout: time.Second})
+	if assert.NoError(err) {
+		c.Close()
+	}
+}
+
+func (suite *ClientSuite) TestSubscribeInvalidFilter() {
+	c := suite.dial("subscriber", true)
+	defer c.Close()
+	_, err := c.Subscribe(mqtt.Subscription{Filter: "home/#/weight", QoS: 1})
+	suite.Assert().EqualError(err, `Invalid MQTT topic filter "home/#/weight": # must be the last level`)
+}
@@ -0,0 +1,298 @@
+// Package mqtttest provides an embedded MQTT broker for tests.  The broker supports persistent sessions and QoS 0, 1
+// and 2 in both directions, but not retained messages or wills.
+package mqtttest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/intervention-engine/multifactorriskservice/mqtt"
+)
+
+// Broker is an MQTT broker listening on a local port
+type Broker struct {
+	// Addr is the address the broker listens on
+	Addr string
+	// Username and Password are the credentials clients must connect with, if Username isn't empty
+	Username string
+	Password string
+	listener net.Listener
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+// session is the state of a client's session, which persists after the client disconnects unless it requested a
+// clean session
+type session struct {
+	clean         bool
+	conn          *conn
+	subscriptions map[string]byte
+	lastID        uint16
+	// inflight are the QoS 1 and 2 messages sent to the client that it hasn't acknowledged, which are resent when it
+	// reconnects
+	inflight map[uint16]mqtt.Message
+	// incoming are the IDs of QoS 2 messages published by the client that it hasn't released
+	incoming map[uint16]bool
+}
+
+type conn struct {
+	net.Conn
+	writeLock sync.Mutex
+}
+
+func (c *conn) write(p mqtt.Packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return mqtt.WritePacket(c, p)
+}
+
+// NewBroker starts a broker listening on a random local port
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{Addr: listener.Addr().String(), listener: listener, sessions: make(map[string]*session)}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&conn{Conn: c})
+		}
+	}()
+	return b, nil
+}
+
+// Close stops the broker, disconnecting its clients
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, s := range b.sessions {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}
+}
+
+// Publish publishes the message to the subscribed clients, as if it had been published by a client
+func (b *Broker) Publish(m mqtt.Message) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.route(m)
+}
+
+// Disconnect drops the client's connection without a DISCONNECT, as if the network failed
+func (b *Broker) Disconnect(clientID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s, ok := b.sessions[clientID]; ok && s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Connected indicates if the client is connected
+func (b *Broker) Connected(clientID string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.sessions[clientID]
+	return ok && s.conn != nil
+}
+
+// Subscribed indicates if the client has subscribed to the topic filter
+func (b *Broker) Subscribed(clientID, filter string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.sessions[clientID]
+	if !ok {
+		return false
+	}
+	_, ok = s.subscriptions[filter]
+	return ok
+}
+
+// Inflight returns the number of messages sent to the client (or queued while it's disconnected) that it hasn't
+// acknowledged
+func (b *Broker) Inflight(clientID string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s, ok := b.sessions[clientID]; ok {
+		return len(s.inflight)
+	}
+	return 0
+}
+
+func (b *Broker) serve(c *conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	p, err := mqtt.ReadPacket(r)
+	if err != nil || p.Type != mqtt.Connect {
+		return
+	}
+	connect, err := mqtt.DecodeConnect(p)
+	if err != nil {
+		c.write(mqtt.EncodeConnack(false, 1))
+		return
+	}
+	if b.Username != "" && (connect.Username != b.Username || connect.Password != b.Password) {
+		c.write(mqtt.EncodeConnack(false, 4))
+		return
+	}
+	s := b.attach(c, connect)
+	defer b.detach(c, connect.ClientID)
+
+	for {
+		p, err := mqtt.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		b.lock.Lock()
+		err = b.handle(s, c, p)
+		b.lock.Unlock()
+		if err != nil || p.Type == mqtt.Disconnect {
+			return
+		}
+	}
+}
+
+// attach attaches the connection to the client's session, resuming a persistent session by resending the messages
+// the client hasn't acknowledged
+func (b *Broker) attach(c *conn, connect mqtt.ConnectPacket) *session {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, present := b.sessions[connect.ClientID]
+	if present && s.conn != nil {
+		s.conn.Close()
+	}
+	if !present || connect.CleanSession {
+		s = &session{subscriptions: make(map[string]byte), inflight: make(map[uint16]mqtt.Message), incoming: make(map[uint16]bool)}
+		b.sessions[connect.ClientID] = s
+		present = false
+	}
+	s.clean, s.conn = connect.CleanSession, c
+	c.write(mqtt.EncodeConnack(present, 0))
+
+	ids := make([]int, 0, len(s.inflight))
+	for id := range s.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		m := s.inflight[uint16(id)]
+		m.Dup = true
+		c.write(m.Encode())
+	}
+	return s
+}
+
+func (b *Broker) detach(c *conn, clientID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s, ok := b.sessions[clientID]; ok && s.conn == c {
+		s.conn = nil
+		if s.clean {
+			delete(b.sessions, clientID)
+		}
+	}
+}
+
+func (b *Broker) handle(s *session, c *conn, p mqtt.Packet) error {
+	switch p.Type {
+	case mqtt.Publish:
+		m, err := mqtt.DecodePublish(p)
+		if err != nil {
+			return err
+		}
+		switch m.QoS {
+		case 0:
+			b.route(m)
+		case 1:
+			b.route(m)
+			return c.write(mqtt.AckPacket(mqtt.Puback, m.PacketID))
+		case 2:
+			if !s.incoming[m.PacketID] {
+				s.incoming[m.PacketID] = true
+				b.route(m)
+			}
+			return c.write(mqtt.AckPacket(mqtt.Pubrec, m.PacketID))
+		}
+	case mqtt.Pubrel:
+		id, err := mqtt.PacketID(p)
+		if err != nil {
+			return err
+		}
+		delete(s.incoming, id)
+		return c.write(mqtt.AckPacket(mqtt.Pubcomp, id))
+	case mqtt.Subscribe:
+		id, subscriptions, err := mqtt.DecodeSubscribe(p)
+		if err != nil {
+			return err
+		}
+		granted := make([]byte, len(subscriptions))
+		for i, sub := range subscriptions {
+			if sub.QoS > 2 || mqtt.ValidateFilter(sub.Filter) != nil {
+				granted[i] = mqtt.SubscribeFailure
+				continue
+			}
+			s.subscriptions[sub.Filter] = sub.QoS
+			granted[i] = sub.QoS
+		}
+		return c.write(mqtt.EncodeSuback(id, granted))
+	case mqtt.Puback, mqtt.Pubcomp:
+		id, err := mqtt.PacketID(p)
+		if err != nil {
+			return err
+		}
+		delete(s.inflight, id)
+	case mqtt.Pubrec:
+		id, err := mqtt.PacketID(p)
+		if err != nil {
+			return err
+		}
+		delete(s.inflight, id)
+		return c.write(mqtt.AckPacket(mqtt.Pubrel, id))
+	case mqtt.Pingreq:
+		return c.write(mqtt.Packet{Type: mqtt.Pingresp})
+	}
+	return nil
+}
+
+// route delivers the message to each session subscribed to its topic, at the lower of the message's QoS and the
+// highest QoS of the session's matching subscriptions.  QoS 1 and 2 messages are kept until they're acknowledged.
+func (b *Broker) route(m mqtt.Message) {
+	for _, s := range b.sessions {
+		qos, matched := byte(0), false
+		for filter, subQoS := range s.subscriptions {
+			if mqtt.MatchTopic(filter, m.Topic) {
+				matched = true
+				if subQoS > qos {
+					qos = subQoS
+				}
+			}
+		}
+		if !matched {
+			continue
+		}
+		delivered := mqtt.Message{Topic: m.Topic, Payload: m.Payload, QoS: m.QoS}
+		if qos < delivered.QoS {
+			delivered.QoS = qos
+		}
+		if delivered.QoS > 0 {
+			for {
+				s.lastID++
+				if _, ok := s.inflight[s.lastID]; s.lastID != 0 && !ok {
+					break
+				}
+			}
+			delivered.PacketID = s.lastID
+			s.inflight[s.lastID] = delivered
+		}
+		if s.conn != nil {
+			s.conn.write(delivered.Encode())
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, supporting the subset of the protocol needed to subscribe to device
+// telemetry: connecting (with optional credentials and persistent sessions), subscribing, receiving messages at QoS
+// 0, 1 and 2, publishing at QoS 0 and 1, and keep-alive pings.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The MQTT control packet types
+const (
+	Connect     byte = 1
+	Connack     byte = 2
+	Publish     byte = 3
+	Puback      byte = 4
+	Pubrec      byte = 5
+	Pubrel      byte = 6
+	Pubcomp     byte = 7
+	Subscribe   byte = 8
+	Suback      byte = 9
+	Unsubscribe byte = 10
+	Unsuback    byte = 11
+	Pingreq     byte = 12
+	Pingresp    byte = 13
+	Disconnect  byte = 14
+)
+
+// MaxPacketSize is the largest packet that is read, to protect against corrupt or malicious remaining lengths
+const MaxPacketSize = 1 << 20
+
+// SubscribeFailure is the SUBACK return code indicating a subscription was refused
+const SubscribeFailure byte = 0x80
+
+// Packet is an MQTT control packet: its type, the flags in the low nibble of its fixed header, and the rest of the
+// packet after the fixed header
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// ReadPacket reads a packet
+func ReadPacket(r *bufio.Reader) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return Packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return Packet{}, errors.New("Malformed MQTT remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > MaxPacketSize {
+		return Packet{}, fmt.Errorf("MQTT packet of %d bytes exceeds the maximum of %d", length, MaxPacketSize)
+	}
+	p := Packet{Type: header >> 4, Flags: header & 0x0f, Body: make([]byte, length)}
+	_, err = io.ReadFull(r, p.Body)
+	return p, err
+}
+
+// WritePacket writes a packet
+func WritePacket(w io.Writer, p Packet) error {
+	b := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(b, p.Body...))
+	return err
+}
+
+// AckPacket returns a packet that acknowledges the packet ID: a PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK
+func AckPacket(packetType byte, packetID uint16) Packet {
+	var flags byte
+	if packetType == Pubrel {
+		flags = 0x02
+	}
+	return Packet{Type: packetType, Flags: flags, Body: appendUint16(nil, packetID)}
+}
+
+// PacketID returns the packet ID of an acknowledgement
+func PacketID(p Packet) (uint16, error) {
+	d := decoder{body: p.Body}
+	id := d.uint16()
+	return id, d.err
+}
+
+// ConnectPacket is the content of a CONNECT packet
+type ConnectPacket struct {
+	ClientID     string
+	Username     string
+	Password     string
+	CleanSession bool
+	KeepAlive    uint16
+}
+
+// Encode encodes the CONNECT packet for MQTT 3.1.1
+func (c ConnectPacket) Encode() Packet {
+	body := appendString(nil, "MQTT")
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.Username != "" {
+		flags |= 0x80
+	}
+	if c.Password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags)
+	body = appendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.Username != "" {
+		body = appendString(body, c.Username)
+	}
+	if c.Password != "" {
+		body = appendString(body, c.Password)
+	}
+	return Packet{Type: Connect, Body: body}
+}
+
+// DecodeConnect decodes a CONNECT packet.  Wills aren't supported.
+func DecodeConnect(p Packet) (ConnectPacket, error) {
+	d := decoder{body: p.Body}
+	protocol, level, flags := d.string(), d.byte(), d.byte()
+	c := ConnectPacket{CleanSession: flags&0x02 != 0, KeepAlive: d.uint16(), ClientID: d.string()}
+	if flags&0x04 != 0 {
+		return c, errors.New("MQTT wills aren't supported")
+	}
+	if flags&0x80 != 0 {
+		c.Username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = d.string()
+	}
+	if d.err == nil && (protocol != "MQTT" || level != 4) {
+		return c, fmt.Errorf("Unsupported MQTT protocol %s level %d", protocol, level)
+	}
+	return c, d.err
+}
+
+// Message is an application message published to a topic
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+}
+
+// Encode encodes the message as a PUBLISH packet
+func (m Message) Encode() Packet {
+	flags := m.QoS << 1
+	if m.Dup {
+		flags |= 0x08
+	}
+	if m.Retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = appendUint16(body, m.PacketID)
+	}
+	return Packet{Type: Publish, Flags: flags, Body: append(body, m.Payload...)}
+}
+
+// DecodePublish decodes a PUBLISH packet
+func DecodePublish(p Packet) (Message, error) {
+	d := decoder{body: p.Body}
+	m := Message{
+		Topic:  d.string(),
+		QoS:    (p.Flags >> 1) & 0x03,
+		Retain: p.Flags&0x01 != 0,
+		Dup:    p.Flags&0x08 != 0,
+	}
+	if m.QoS > 2 {
+		return m, fmt.Errorf("Invalid MQTT QoS %d", m.QoS)
+	}
+	if m.QoS > 0 {
+		m.PacketID = d.uint16()
+	}
+	m.Payload = d.rest()
+	return m, d.err
+}
+
+// Subscription is a topic filter and the maximum QoS at which messages matching it are delivered
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// EncodeSubscribe encodes a SUBSCRIBE packet
+func EncodeSubscribe(packetID uint16, subscriptions []Subscription) Packet {
+	body := appendUint16(nil, packetID)
+	for _, s := range subscriptions {
+		body = append(appendString(body, s.Filter), s.QoS)
+	}
+	return Packet{Type: Subscribe, Flags: 0x02, Body: body}
+}
+
+// DecodeSubscribe decodes a SUBSCRIBE packet
+func DecodeSubscribe(p Packet) (uint16, []Subscription, error) {
+	d := decoder{body: p.Body}
+	id := d.uint16()
+	var subscriptions []Subscription
+	for d.err == nil && len(d.body) > 0 {
+		subscriptions = append(subscriptions, Subscription{Filter: d.string(), QoS: d.byte()})
+	}
+	if d.err == nil && len(subscriptions) == 0 {
+		d.err = errors.New("MQTT SUBSCRIBE has no topic filters")
+	}
+	return id, subscriptions, d.err
+}
+
+// EncodeSuback encodes a SUBACK packet with the granted QoS (or SubscribeFailure) of each subscription
+func EncodeSuback(packetID uint16, granted []byte) Packet {
+	return Packet{Type: Suback, Body: append(appendUint16(nil, packetID), granted...)}
+}
+
+// DecodeSuback decodes a SUBACK packet
+func DecodeSuback(p Packet) (uint16, []byte, error) {
+	d := decoder{body: p.Body}
+	id := d.uint16()
+	return id, d.rest(), d.err
+}
+
+// The CONNACK return codes
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// EncodeConnack encodes a CONNACK packet
+func EncodeConnack(sessionPresent bool, returnCode byte) Packet {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	return Packet{Type: Connack, Body: []byte{flags, returnCode}}
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+// decoder reads the fields of a packet body, recording the first error
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.body[0]
+	d.body = d.body[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.fail()
+		return 0
+	}
+	n := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return n
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	if d.err != nil || len(d.body) < n {
+		d.fail()
+		return ""
+	}
+	s := string(d.body[:n])
+	d.body = d.body[n:]
+	return s
+}
+
+func (d *decoder) rest() []byte {
+	b := d.body
+	d.body = nil
+	return b
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("Malformed MQTT packet")
+	}
+}
@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatchTopic indicates if the topic name matches the topic filter, which may contain the single-level wildcard "+"
+// and the multi-level wildcard "#"
+func MatchTopic(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	// Topics starting with $ (such as $SYS) are only matched by filters starting with the same level
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(topicLevels):
+			return false
+		case level != "+" && level != topicLevels[i]:
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidateFilter checks that the topic filter is valid: non-empty, with wildcards only occupying entire levels, and
+// "#" only as the last level
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("Invalid MQTT topic filter %q: must not be empty", filter)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return fmt.Errorf("Invalid MQTT topic filter %q: wildcards must occupy an entire level", filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("Invalid MQTT topic filter %q: # must be the last level", filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestTopicSuite(t *testing.T) {
+	suite.Run(t, new(TopicSuite))
+}
+
+type TopicSuite struct {
+	suite.Suite
+}
+
+func (suite *TopicSuite) TestMatchTopic() {
+	assert := suite.Assert()
+
+	assert.True(MatchTopic("home/scale", "home/scale"))
+	assert.False(MatchTopic("home/scale", "home/cuff"))
+	assert.False(MatchTopic("home/scale", "home/scale/weight"))
+	assert.True(MatchTopic("home/+/weight", "home/scale-1/weight"))
+	assert.False(MatchTopic("home/+/weight", "home/scale-1/pulse"))
+	assert.False(MatchTopic("home/+", "home/scale-1/weight"))
+	assert.True(MatchTopic("home/#", "home/scale-1/weight"))
+	assert.True(MatchTopic("home/#", "home"))
+	assert.True(MatchTopic("#", "home/scale-1/weight"))
+	assert.False(MatchTopic("#", "$SYS/uptime"))
+	assert.False(MatchTopic("+/uptime", "$SYS/uptime"))
+	assert.True(MatchTopic("$SYS/#", "$SYS/uptime"))
+}
+
+func (suite *TopicSuite) TestValidateFilter() {
+	assert := suite.Assert()
+
+	for _, filter := range []string{"home/scale", "home/+/weight", "home/#", "#", "+", "+/+"} {
+		assert.NoError(ValidateFilter(filter), filter)
+	}
+	assert.EqualError(ValidateFilter(""), `Invalid MQTT topic filter "": must not be empty`)
+	assert.EqualError(ValidateFilter("home/scale+"), `Invalid MQTT topic filter "home/scale+": wildcards must occupy an entire level`)
+	assert.EqualError(ValidateFilter("home/#/weight"), `Invalid MQTT topic filter "home/#/weight": # must be the last level`)
+}
@@ -0,0 +1,182 @@
+package nutrition
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+)
+
+// AssessmentIdentifierSystem is the system of the identifiers given to the nutrition assessment observations.  The
+// identifier is unique to the patient and the time of the assessment, so assessing the patient again updates its
+// observation.
+const AssessmentIdentifierSystem = "http://interventionengine.org/fhir/nutrition-assessments"
+
+// CodeSystem is the system of the codes of the nutrition assessment observation and its components that aren't in
+// LOINC
+const CodeSystem = "http://interventionengine.org/fhir/nutrition"
+
+// BMICode is the LOINC code for body mass index
+const BMICode = "39156-5"
+
+// assessmentComponent is a component of the nutrition assessment observation.  The value function returns false if
+// the assessment has no value for the component.
+type assessmentComponent struct {
+	code   fhirmodels.Coding
+	unit   string
+	places int
+	value  func(a *Assessment) (float64, bool)
+}
+
+var assessmentComponents = []assessmentComponent{
+	{fhirmodels.Coding{System: loincSystem, Code: BodyWeightCode, Display: "Body weight"}, "kg", 1,
+		func(a *Assessment) (float64, bool) { return a.WeightKg, true }},
+	{fhirmodels.Coding{System: loincSystem, Code: BodyHeightCode, Display: "Body height"}, "cm", 1,
+		func(a *Assessment) (float64, bool) { return a.HeightCm, true }},
+	{fhirmodels.Coding{System: loincSystem, Code: BMICode, Display: "Body mass index"}, "kg/m2", 1,
+		func(a *Assessment) (float64, bool) { return a.BMI, true }},
+	{fhirmodels.Coding{System: CodeSystem, Code: "percent-weight-lost", Display: "Weight lost in the preceding 180 days"}, "%", 1,
+		func(a *Assessment) (float64, bool) { return a.PercentWeightLost, true }},
+	{fhirmodels.Coding{System: CodeSystem, Code: "energy-requirement", Display: "Estimated energy requirement"}, "kcal/d", 0,
+		func(a *Assessment) (float64, bool) { return a.EnergyRequirement, a.EnergyRequirement > 0 }},
+	{fhirmodels.Coding{System: loincSystem, Code: EGFRCode, Display: "eGFR (CKD-EPI 2021)"}, EGFRUnit, 0,
+		func(a *Assessment) (float64, bool) {
+			if a.EGFR == nil {
+				return 0, false
+			}
+			return a.EGFR.Value, true
+		}},
+	{fhirmodels.Coding{System: CodeSystem, Code: "protein-target", Display: "Daily protein target"}, "g/d", 0,
+		func(a *Assessment) (float64, bool) { return a.Targets.ProteinG, true }},
+	{fhirmodels.Coding{System: CodeSystem, Code: "potassium-limit", Display: "Daily potassium limit"}, "mg/d", 0,
+		func(a *Assessment) (float64, bool) { return a.Targets.PotassiumMg, a.Targets.PotassiumMg > 0 }},
+	{fhirmodels.Coding{System: CodeSystem, Code: "phosphorus-limit", Display: "Daily phosphorus limit"}, "mg/d", 0,
+		func(a *Assessment) (float64, bool) { return a.Targets.PhosphorusMg, a.Targets.PhosphorusMg > 0 }},
+}
+
+// Key returns the assessment observation's identifier value: its patient and the time of the assessment
+func (a *Assessment) Key(patientID string) string {
+	return patientID + "|" + a.AsOf.UTC().Format(time.RFC3339)
+}
+
+// ToObservation returns the assessment as an Observation for the patient, derived from the observations of its
+// contributing labs.  Its components are the measurements and estimates the assessment was based on, the CKD stage
+// of its eGFR (if any), and its nutrition targets.  The energy target is the energy requirement, and the potassium
+// and phosphorus limits are left out if they aren't limited.  Each of the targets' drug-nutrient interaction
+// constraints is a component describing the constraint.
+func (a *Assessment) ToObservation(patientID string) *fhirmodels.Observation {
+	code := fhirmodels.Coding{System: CodeSystem, Code: "nutrition-assessment", Display: "Nutrition assessment"}
+	o := &fhirmodels.Observation{
+		Identifier: []fhirmodels.Identifier{{System: AssessmentIdentifierSystem, Value: a.Key(patientID)}},
+		Status:     "final",
+		Category: &fhirmodels.CodeableConcept{
+			Coding: []fhirmodels.Coding{{System: "http://hl7.org/fhir/observation-category", Code: "exam"}},
+		},
+		Code:              &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{code}, Text: code.Display},
+		Subject:           &fhirmodels.Reference{Reference: "Patient/" + patientID},
+		EffectiveDateTime: &fhirmodels.FHIRDateTime{Time: a.AsOf, Precision: fhirmodels.Timestamp},
+	}
+	for _, c := range assessmentComponents {
+		value, ok := c.value(a)
+		if !ok {
+			continue
+		}
+		value = round(value, c.places)
+		o.Component = append(o.Component, fhirmodels.ObservationComponentComponent{
+			Code:          &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{c.code}, Text: c.code.Display},
+			ValueQuantity: &fhirmodels.Quantity{Value: &value, Unit: c.unit, System: ucum.System, Code: c.unit},
+		})
+	}
+	if a.EGFR != nil {
+		code := fhirmodels.Coding{System: CodeSystem, Code: "ckd-stage", Display: "CKD stage"}
+		stage := fhirmodels.Coding{System: CKDStageSystem, Code: a.EGFR.Stage.Code, Display: a.EGFR.Stage.Description}
+		o.Component = append(o.Component, fhirmodels.ObservationComponentComponent{
+			Code:                 &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{code}, Text: code.Display},
+			ValueCodeableConcept: &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{stage}, Text: "CKD stage " + stage.Code},
+		})
+	}
+	for i := range a.Targets.Constraints {
+		code := fhirmodels.Coding{System: CodeSystem, Code: "nutrient-constraint", Display: "Drug-nutrient interaction constraint"}
+		o.Component = append(o.Component, fhirmodels.ObservationComponentComponent{
+			Code:        &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{code}, Text: a.Targets.Constraints[i].Nutrient},
+			ValueString: a.Targets.Constraints[i].Text(),
+		})
+	}
+	for _, ref := range a.ContributingLabReferences() {
+		target := ref
+		o.Related = append(o.Related, fhirmodels.ObservationRelatedComponent{Type: "derived-from", Target: &target})
+	}
+	return o
+}
+
+// ContributingLabReferences returns references to the observations of the contributing labs
+func (a *Assessment) ContributingLabReferences() []fhirmodels.Reference {
+	var refs []fhirmodels.Reference
+	for _, result := range a.ContributingLabs() {
+		if result.Observation != "" {
+			refs = append(refs, fhirmodels.Reference{Reference: "Observation/" + result.Observation})
+		}
+	}
+	return refs
+}
+
+// WriteAssessment writes the assessment observation to the FHIR server, with a conditional update on its identifier
+// so that each is only stored once, returning a reference to the observation.  The reference is empty if the FHIR
+// server doesn't report the observation's location.
+func WriteAssessment(fhirEndpoint, patientID string, a *Assessment) (string, error) {
+	if patientID == "" {
+		return "", errors.New("Can't write nutrition assessment observation without a patient ID")
+	}
+	data, err := json.Marshal(a.ToObservation(patientID))
+	if err != nil {
+		return "", err
+	}
+	query := url.QueryEscape(AssessmentIdentifierSystem + "|" + a.Key(patientID))
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(fhirEndpoint, "/")+"/Observation?identifier="+query, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Can't write nutrition assessment observation for patient %s: %s", patientID, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Received HTTP %d %s from FHIR server when writing nutrition assessment observation for patient %s.", res.StatusCode, res.Status, patientID)
+	}
+	return locationReference(res.Header.Get("Location"), "Observation"), nil
+}
+
+// locationReference returns the relative reference (e.g., "Observation/1") to the resource at the location, or ""
+// if the location isn't the location of a resource of the type
+func locationReference(location, resourceType string) string {
+	i := strings.LastIndex(location, "/"+resourceType+"/")
+	if i < 0 {
+		if !strings.HasPrefix(location, resourceType+"/") {
+			return ""
+		}
+		i = -1
+	}
+	id := location[i+len(resourceType)+2:]
+	if j := strings.Index(id, "/"); j >= 0 {
+		id = id[:j]
+	}
+	if id == "" {
+		return ""
+	}
+	return resourceType + "/" + id
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Floor(value*scale+0.5) / scale
+}
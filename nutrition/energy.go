@@ -0,0 +1,90 @@
+package nutrition
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ActivityFactors are the physical activity level multipliers applied to the resting energy expenditure to estimate
+// the daily energy requirement
+var ActivityFactors = map[string]float64{
+	"sedentary":   1.2,
+	"light":       1.375,
+	"moderate":    1.55,
+	"active":      1.725,
+	"very-active": 1.9,
+}
+
+// DefaultActivityFactor is the activity factor used if none is configured: sedentary, which is the safest assumption
+// for the chronically ill patients the service is used for
+const DefaultActivityFactor = 1.2
+
+// ParseActivityFactor parses an activity level (e.g., "moderate") or a numeric activity factor between 1 and 2.5
+func ParseActivityFactor(s string) (float64, error) {
+	if s == "" {
+		return DefaultActivityFactor, nil
+	}
+	if factor, ok := ActivityFactors[strings.ToLower(s)]; ok {
+		return factor, nil
+	}
+	factor, err := strconv.ParseFloat(s, 64)
+	if err != nil || factor < 1 || factor > 2.5 {
+		levels := make([]string, 0, len(ActivityFactors))
+		for level := range ActivityFactors {
+			levels = append(levels, level)
+		}
+		sort.Strings(levels)
+		return 0, fmt.Errorf("Invalid activity factor %q: must be one of %s, or a number from 1 to 2.5", s, strings.Join(levels, ", "))
+	}
+	return factor, nil
+}
+
+// BMI returns the body mass index for the given weight (in kg) and height (in cm)
+func BMI(weightKg, heightCm float64) float64 {
+	heightM := heightCm / 100
+	return weightKg / (heightM * heightM)
+}
+
+// RestingEnergyExpenditure returns the resting energy expenditure (in kcal/day) estimated by the Mifflin-St Jeor
+// equation for the given weight (in kg), height (in cm), age (in years) and FHIR administrative gender.  Since the
+// equation differs by sex, the mean of the male and female estimates is used if the gender is not male or female.
+func RestingEnergyExpenditure(weightKg, heightCm float64, age int, gender string) float64 {
+	ree := 10*weightKg + 6.25*heightCm - 5*float64(age)
+	switch gender {
+	case "male":
+		return ree + 5
+	case "female":
+		return ree - 161
+	}
+	return ree - 78
+}
+
+// BMIRisk categorizes the BMI from 1 (normal) to 4 (severely underweight or class II obesity and above), following the
+// WHO adult BMI classification
+func BMIRisk(bmi float64) int {
+	switch {
+	case bmi < 16 || bmi >= 35:
+		return 4
+	case bmi < 17 || bmi >= 30:
+		return 3
+	case bmi < 18.5 || bmi >= 25:
+		return 2
+	}
+	return 1
+}
+
+// WeightLossRisk categorizes the percent of body weight lost from 1 (less than 5%) to 4 (15% or more).  Weight gains
+// are categorized as 1, since they are reflected in the BMI risk.
+func WeightLossRisk(percentLost float64) int {
+	switch {
+	case percentLost >= 15:
+		return 4
+	case percentLost >= 10:
+		return 3
+	case percentLost >= 5:
+		return 2
+	}
+	return 1
+}
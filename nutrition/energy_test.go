@@ -0,0 +1,73 @@
+package nutrition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestEnergySuite(t *testing.T) {
+	suite.Run(t, new(EnergySuite))
+}
+
+type EnergySuite struct {
+	suite.Suite
+}
+
+func (suite *EnergySuite) TestBMI() {
+	assert := suite.Assert()
+
+	assert.InDelta(22.86, BMI(70, 175), 0.01)
+	// The README's sample patient: 132 lb, 63 in
+	assert.InDelta(23.38, BMI(132*0.45359237, 63*2.54), 0.01)
+}
+
+func (suite *EnergySuite) TestRestingEnergyExpenditure() {
+	assert := suite.Assert()
+
+	// 10 * 70 + 6.25 * 175 - 5 * 40 = 1593.75
+	assert.InDelta(1598.75, RestingEnergyExpenditure(70, 175, 40, "male"), 0.001)
+	assert.InDelta(1432.75, RestingEnergyExpenditure(70, 175, 40, "female"), 0.001)
+	assert.InDelta(1515.75, RestingEnergyExpenditure(70, 175, 40, "unknown"), 0.001)
+}
+
+func (suite *EnergySuite) TestBMIRisk() {
+	assert := suite.Assert()
+
+	assert.Equal(4, BMIRisk(15.9))
+	assert.Equal(3, BMIRisk(16))
+	assert.Equal(2, BMIRisk(17))
+	assert.Equal(1, BMIRisk(18.5))
+	assert.Equal(1, BMIRisk(24.9))
+	assert.Equal(2, BMIRisk(25))
+	assert.Equal(3, BMIRisk(30))
+	assert.Equal(4, BMIRisk(35))
+}
+
+func (suite *EnergySuite) TestWeightLossRisk() {
+	assert := suite.Assert()
+
+	assert.Equal(1, WeightLossRisk(0))
+	assert.Equal(1, WeightLossRisk(4.9))
+	assert.Equal(2, WeightLossRisk(5))
+	assert.Equal(3, WeightLossRisk(10))
+	assert.Equal(4, WeightLossRisk(15))
+}
+
+func (suite *EnergySuite) TestParseActivityFactor() {
+	assert := suite.Assert()
+
+	factor, err := ParseActivityFactor("")
+	assert.NoError(err)
+	assert.Equal(DefaultActivityFactor, factor)
+	factor, err = ParseActivityFactor("Moderate")
+	assert.NoError(err)
+	assert.Equal(1.55, factor)
+	factor, err = ParseActivityFactor("1.4")
+	assert.NoError(err)
+	assert.Equal(1.4, factor)
+	_, err = ParseActivityFactor("3")
+	assert.EqualError(err, `Invalid activity factor "3": must be one of active, light, moderate, sedentary, very-active, or a number from 1 to 2.5`)
+}
@@ -0,0 +1,355 @@
+package nutrition
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+)
+
+// LOINC codes for the labs used to assess biochemical nutrition risk
+const (
+	AlbuminCode       = "1751-7"
+	PrealbuminCode    = "14338-8"
+	HbA1cCode         = "4548-4"
+	HbA1cIFCCCode     = "59261-8"
+	CholesterolCode   = "2093-3"
+	LDLCode           = "13457-7"
+	LDLDirectCode     = "2089-1"
+	HDLCode           = "2085-9"
+	TriglyceridesCode = "2571-8"
+	HemoglobinCode    = "718-7"
+	FerritinCode      = "2276-4"
+	VitaminDCode      = "1989-3"
+	VitaminB12Code    = "2132-9"
+)
+
+// labWindow is the period of time before an assessment in which a lab result reflects the patient's nutrition status.
+// Older results don't contribute to the biochemical risk.
+const labWindow = 90 * 24 * time.Hour
+
+// ReferenceRange is the normal range of a lab for patients of a sex ("male" or "female", or "" for either) and age
+// (in years, from MinAge until MaxAge, or with no maximum if MaxAge is 0).  Low or High is 0 if the range has no bound
+// on that side.
+type ReferenceRange struct {
+	Sex    string
+	MinAge int
+	MaxAge int
+	Low    float64
+	High   float64
+}
+
+// appliesTo returns true if the range applies to patients of the age and FHIR administrative gender.  Ranges apply to
+// patients of unknown age or gender, so that their widest range can be used.
+func (r ReferenceRange) appliesTo(age int, knownAge bool, gender string) bool {
+	if knownAge && (age < r.MinAge || (r.MaxAge != 0 && age >= r.MaxAge)) {
+		return false
+	}
+	return r.Sex == "" || (gender != "male" && gender != "female") || r.Sex == gender
+}
+
+// Lab is a lab test that reflects nutrition status.  Values outside the reference range are a mild risk (2), unless
+// they're beyond the thresholds on that side: values beyond the first threshold are a moderate risk (3), and beyond the
+// second a severe risk (4).  If a side has no thresholds (i.e., nil), values outside the range on that side don't
+// contribute to nutrition risk.
+type Lab struct {
+	Name  string
+	Codes []string
+	// Unit is the UCUM unit the lab's values are converted to, using the molar mass (in g/mol) of the analyte to convert
+	// substance concentrations
+	Unit      string
+	MolarMass float64
+	Ranges    []ReferenceRange
+	Low       []float64
+	High      []float64
+	// convert converts the lab's values, if they can't be converted with UCUM
+	convert func(q *fhirmodels.Quantity) (float64, error)
+}
+
+// Labs are the labs used to assess biochemical nutrition risk
+var Labs = []Lab{
+	{
+		Name:  "Albumin",
+		Codes: []string{AlbuminCode},
+		Unit:  "g/dL",
+		Ranges: []ReferenceRange{
+			{MaxAge: 60, Low: 3.5, High: 5.0},
+			{MinAge: 60, Low: 3.4, High: 4.8},
+		},
+		Low: []float64{3.0, 2.5},
+	},
+	{
+		Name:  "Prealbumin",
+		Codes: []string{PrealbuminCode},
+		Unit:  "mg/dL",
+		Ranges: []ReferenceRange{
+			{Sex: "male", Low: 20, High: 40},
+			{Sex: "female", Low: 17, High: 34},
+		},
+		Low: []float64{10, 5},
+	},
+	{
+		Name:    "Hemoglobin A1c",
+		Codes:   []string{HbA1cCode, HbA1cIFCCCode},
+		Unit:    "%",
+		Ranges:  []ReferenceRange{{Low: 4.0, High: 5.6}},
+		High:    []float64{6.5, 9.0},
+		convert: hbA1cPercent,
+	},
+	{
+		Name:      "Total cholesterol",
+		Codes:     []string{CholesterolCode},
+		Unit:      "mg/dL",
+		MolarMass: 386.65,
+		Ranges:    []ReferenceRange{{Low: 120, High: 199}},
+		// Low cholesterol is a marker of malnutrition
+		Low:  []float64{100},
+		High: []float64{240},
+	},
+	{
+		Name:      "LDL cholesterol",
+		Codes:     []string{LDLCode, LDLDirectCode},
+		Unit:      "mg/dL",
+		MolarMass: 386.65,
+		Ranges:    []ReferenceRange{{High: 129}},
+		High:      []float64{160, 190},
+	},
+	{
+		Name:      "HDL cholesterol",
+		Codes:     []string{HDLCode},
+		Unit:      "mg/dL",
+		MolarMass: 386.65,
+		Ranges: []ReferenceRange{
+			{Sex: "male", Low: 40},
+			{Sex: "female", Low: 50},
+		},
+		Low: []float64{},
+	},
+	{
+		Name:      "Triglycerides",
+		Codes:     []string{TriglyceridesCode},
+		Unit:      "mg/dL",
+		MolarMass: 885.7,
+		Ranges:    []ReferenceRange{{High: 149}},
+		High:      []float64{200, 500},
+	},
+	{
+		Name:  "Hemoglobin",
+		Codes: []string{HemoglobinCode},
+		Unit:  "g/dL",
+		// The WHO thresholds for anemia
+		Ranges: []ReferenceRange{
+			{Sex: "male", Low: 13.0, High: 17.5},
+			{Sex: "female", Low: 12.0, High: 15.5},
+		},
+		Low: []float64{11.0, 8.0},
+	},
+	{
+		Name:  "Ferritin",
+		Codes: []string{FerritinCode},
+		Unit:  "ng/mL",
+		Ranges: []ReferenceRange{
+			{Sex: "male", Low: 30, High: 400},
+			{Sex: "female", MaxAge: 50, Low: 15, High: 150},
+			{Sex: "female", MinAge: 50, Low: 15, High: 300},
+		},
+		Low: []float64{10},
+	},
+	{
+		Name:      "Vitamin D",
+		Codes:     []string{VitaminDCode},
+		Unit:      "ng/mL",
+		MolarMass: 400.64,
+		Ranges:    []ReferenceRange{{Low: 30, High: 100}},
+		// Under 20 ng/mL is deficient, and over 150 ng/mL is toxic
+		Low:  []float64{20, 12},
+		High: []float64{150},
+	},
+	{
+		Name:      "Vitamin B12",
+		Codes:     []string{VitaminB12Code},
+		Unit:      "pg/mL",
+		MolarMass: 1355.37,
+		Ranges:    []ReferenceRange{{Low: 200, High: 900}},
+		Low:       []float64{150},
+	},
+}
+
+// hbA1cPercent returns the HbA1c in NGSP percent, converting IFCC values (mmol/mol) with the NGSP-IFCC master equation.
+// The units are both dimensionless, so UCUM would convert them as if they were proportional.
+func hbA1cPercent(q *fhirmodels.Quantity) (float64, error) {
+	unit, err := ucum.QuantityUnit(q)
+	if err != nil {
+		return 0, err
+	}
+	if unit == "mmol/mol" {
+		return 0.09148**q.Value + 2.152, nil
+	}
+	if unit != "%" {
+		return 0, fmt.Errorf("Can't convert HbA1c in %s to %%", unit)
+	}
+	return *q.Value, nil
+}
+
+// Matches returns true if the observation is coded as the lab
+func (l *Lab) Matches(o *fhirmodels.Observation) bool {
+	if o.Code == nil {
+		return false
+	}
+	for _, code := range l.Codes {
+		if o.Code.MatchesCode(loincSystem, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns the observation's value in the lab's unit
+func (l *Lab) Value(o *fhirmodels.Observation) (float64, error) {
+	if l.convert != nil {
+		return l.convert(o.ValueQuantity)
+	}
+	return ucum.SubstanceValue(o.ValueQuantity, l.Unit, l.MolarMass)
+}
+
+// Range returns the lab's reference range for patients of the age and FHIR administrative gender.  If more than one
+// range applies (because the patient's age or gender is unknown), the widest is returned.
+func (l *Lab) Range(age int, knownAge bool, gender string) (ReferenceRange, bool) {
+	var found ReferenceRange
+	ok := false
+	for _, r := range l.Ranges {
+		if !r.appliesTo(age, knownAge, gender) {
+			continue
+		}
+		if !ok {
+			found, ok = r, true
+			continue
+		}
+		if found.Sex != r.Sex {
+			found.Sex = ""
+		}
+		if r.MinAge < found.MinAge {
+			found.MinAge = r.MinAge
+		}
+		if found.MaxAge != 0 && (r.MaxAge == 0 || r.MaxAge > found.MaxAge) {
+			found.MaxAge = r.MaxAge
+		}
+		if found.Low == 0 || r.Low == 0 {
+			found.Low = 0
+		} else {
+			found.Low = math.Min(found.Low, r.Low)
+		}
+		if found.High == 0 || r.High == 0 {
+			found.High = 0
+		} else {
+			found.High = math.Max(found.High, r.High)
+		}
+	}
+	return found, ok
+}
+
+// Classify returns the HL7 interpretation code of the value (N, L or H, or LL or HH if the value is a severe risk)
+// according to the reference range, along with its nutrition risk from 1 (low) to 4 (severe)
+func (l *Lab) Classify(value float64, r ReferenceRange) (string, int) {
+	switch {
+	case r.Low != 0 && value < r.Low:
+		risk := grade(l.Low, func(threshold float64) bool { return value < threshold })
+		if risk == 4 {
+			return "LL", risk
+		}
+		return "L", risk
+	case r.High != 0 && value > r.High:
+		risk := grade(l.High, func(threshold float64) bool { return value >= threshold })
+		if risk == 4 {
+			return "HH", risk
+		}
+		return "H", risk
+	}
+	return "N", 1
+}
+
+// grade returns the risk of a value outside the reference range, given whether it's beyond each threshold
+func grade(thresholds []float64, beyond func(threshold float64) bool) int {
+	if thresholds == nil {
+		return 1
+	}
+	risk := 2
+	for _, threshold := range thresholds {
+		if beyond(threshold) {
+			risk++
+		}
+	}
+	return risk
+}
+
+// LabResult is the interpretation of a lab result used in a nutrition assessment
+type LabResult struct {
+	Lab string
+	// Observation is the ID of the lab's observation
+	Observation    string
+	Date           time.Time
+	Value          float64
+	Unit           string
+	Range          ReferenceRange
+	Interpretation string
+	Risk           int
+}
+
+// labValue is a lab's value recorded at a point in time
+type labValue struct {
+	Lab         int
+	Observation string
+	Date        time.Time
+	Value       float64
+}
+
+// labResults returns the interpretation of the latest value of each lab recorded in the lab window before the given
+// date (inclusive), for a patient of the age and FHIR administrative gender
+func labResults(values []labValue, d time.Time, age int, knownAge bool, gender string) []LabResult {
+	latest := make(map[int]labValue)
+	for _, v := range values {
+		if v.Date.After(d) || !v.Date.After(d.Add(-labWindow)) {
+			continue
+		}
+		if found, ok := latest[v.Lab]; !ok || !v.Date.Before(found.Date) {
+			latest[v.Lab] = v
+		}
+	}
+	var results []LabResult
+	for i := range Labs {
+		v, ok := latest[i]
+		if !ok {
+			continue
+		}
+		lab := &Labs[i]
+		r, ok := lab.Range(age, knownAge, gender)
+		if !ok {
+			continue
+		}
+		interpretation, risk := lab.Classify(v.Value, r)
+		results = append(results, LabResult{
+			Lab:            lab.Name,
+			Observation:    v.Observation,
+			Date:           v.Date,
+			Value:          v.Value,
+			Unit:           lab.Unit,
+			Range:          r,
+			Interpretation: interpretation,
+			Risk:           risk,
+		})
+	}
+	return results
+}
+
+// BiochemicalRisk returns the highest risk of the lab results, or 1 (low) if there are none
+func BiochemicalRisk(results []LabResult) int {
+	risk := 1
+	for _, result := range results {
+		if result.Risk > risk {
+			risk = result.Risk
+		}
+	}
+	return risk
+}
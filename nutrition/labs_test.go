@@ -0,0 +1,115 @@
+package nutrition
+
+import (
+	"testing"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestLabsSuite(t *testing.T) {
+	suite.Run(t, new(LabsSuite))
+}
+
+type LabsSuite struct {
+	suite.Suite
+}
+
+func lab(name string) *Lab {
+	for i := range Labs {
+		if Labs[i].Name == name {
+			return &Labs[i]
+		}
+	}
+	return nil
+}
+
+func (suite *LabsSuite) TestRange() {
+	assert := suite.Assert()
+
+	r, ok := lab("Albumin").Range(45, true, "female")
+	assert.True(ok)
+	assert.Equal(ReferenceRange{MaxAge: 60, Low: 3.5, High: 5.0}, r)
+	r, _ = lab("Albumin").Range(72, true, "male")
+	assert.Equal(ReferenceRange{MinAge: 60, Low: 3.4, High: 4.8}, r)
+
+	r, _ = lab("Ferritin").Range(45, true, "female")
+	assert.Equal(150.0, r.High)
+	r, _ = lab("Ferritin").Range(55, true, "female")
+	assert.Equal(300.0, r.High)
+	r, _ = lab("Ferritin").Range(55, true, "male")
+	assert.Equal(ReferenceRange{Sex: "male", Low: 30, High: 400}, r)
+
+	// The widest range is used when the sex or age is unknown
+	r, _ = lab("HDL cholesterol").Range(45, true, "unknown")
+	assert.Equal(ReferenceRange{Low: 40}, r)
+	r, _ = lab("Ferritin").Range(0, false, "female")
+	assert.Equal(ReferenceRange{Sex: "female", Low: 15, High: 300}, r)
+	r, _ = lab("Albumin").Range(0, false, "")
+	assert.Equal(ReferenceRange{Low: 3.4, High: 5.0}, r)
+}
+
+func (suite *LabsSuite) TestClassify() {
+	assert := suite.Assert()
+
+	classify := func(name string, value float64, gender string) (string, int) {
+		l := lab(name)
+		r, _ := l.Range(45, true, gender)
+		return l.Classify(value, r)
+	}
+	tests := []struct {
+		lab            string
+		value          float64
+		gender         string
+		interpretation string
+		risk           int
+	}{
+		{"Albumin", 4.0, "female", "N", 1},
+		{"Albumin", 3.2, "female", "L", 2},
+		{"Albumin", 2.7, "female", "L", 3},
+		{"Albumin", 2.2, "female", "LL", 4},
+		// High albumin doesn't contribute to nutrition risk
+		{"Albumin", 5.5, "female", "H", 1},
+		{"Hemoglobin", 12.5, "female", "N", 1},
+		{"Hemoglobin", 12.5, "male", "L", 2},
+		{"Hemoglobin", 7.9, "male", "LL", 4},
+		{"Hemoglobin A1c", 6.0, "male", "H", 2},
+		{"Hemoglobin A1c", 9.5, "male", "HH", 4},
+		{"HDL cholesterol", 45, "male", "N", 1},
+		{"HDL cholesterol", 45, "female", "L", 2},
+		{"Triglycerides", 250, "female", "H", 3},
+		{"Vitamin D", 25, "female", "L", 2},
+		{"Vitamin D", 10, "female", "LL", 4},
+		{"Vitamin D", 160, "female", "H", 3},
+		{"Vitamin B12", 120, "female", "L", 3},
+	}
+	for _, test := range tests {
+		interpretation, risk := classify(test.lab, test.value, test.gender)
+		assert.Equal(test.interpretation, interpretation, "%s %g (%s)", test.lab, test.value, test.gender)
+		assert.Equal(test.risk, risk, "%s %g (%s)", test.lab, test.value, test.gender)
+	}
+}
+
+func (suite *LabsSuite) TestValue() {
+	assert := suite.Assert()
+
+	observation := func(code string, value float64, unit string) *fhirmodels.Observation {
+		return observationEvent(date(2016, 1, 1), code, value, unit).Value.(*fhirmodels.Observation)
+	}
+	value, err := lab("Vitamin D").Value(observation(VitaminDCode, 75, "nmol/L"))
+	assert.NoError(err)
+	assert.InDelta(30.05, value, 0.01)
+	value, err = lab("Vitamin B12").Value(observation(VitaminB12Code, 300, "pmol/L"))
+	assert.NoError(err)
+	assert.InDelta(406.6, value, 0.1)
+	value, err = lab("Hemoglobin A1c").Value(observation(HbA1cCode, 6.1, "%"))
+	assert.NoError(err)
+	assert.Equal(6.1, value)
+	_, err = lab("Hemoglobin A1c").Value(observation(HbA1cCode, 6.1, "mg/dL"))
+	assert.Error(err)
+	_, err = lab("Albumin").Value(observation(AlbuminCode, 40, "kg"))
+	assert.Error(err)
+
+	assert.True(lab("LDL cholesterol").Matches(observation(LDLDirectCode, 100, "mg/dL")))
+	assert.False(lab("LDL cholesterol").Matches(observation(HDLCode, 100, "mg/dL")))
+}
@@ -0,0 +1,360 @@
+// Package nutrition provides a risk service plugin that assesses a patient's nutrition risk and estimates their
+// nutrition targets from the body weight and height observations and labs in their FHIR data.
+package nutrition
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// LOINC codes for the observations used to assess nutrition risk
+const (
+	loincSystem    = "http://loinc.org"
+	BodyWeightCode = "29463-7"
+	BodyHeightCode = "8302-2"
+)
+
+// Names of the slices in the nutrition pie
+const (
+	BMISlice         = "Body Mass Index"
+	WeightLossSlice  = "Weight Loss"
+	BiochemicalSlice = "Biochemical"
+)
+
+// MinimumAge is the age (in years) at which patients are first assessed, since the BMI categories and energy
+// requirement equation are only valid for adults
+const MinimumAge = 18
+
+// weightLossWindow is the period of time before an assessment in which weight loss contributes to nutrition risk
+const weightLossWindow = 180 * 24 * time.Hour
+
+// NutritionRiskServiceConfig is the configuration of the nutrition risk plugin
+var NutritionRiskServiceConfig = plugin.RiskServicePluginConfig{
+	Name: "Nutrition Risk Service",
+	Method: fhirmodels.CodeableConcept{
+		Coding: []fhirmodels.Coding{{System: "http://interventionengine.org/risk-assessments", Code: "Nutrition"}},
+		Text:   "Nutrition",
+	},
+	PredictedOutcome: fhirmodels.CodeableConcept{Text: "Malnutrition"},
+	DefaultPieSlices: []plugin.Slice{
+		{Name: BMISlice, Weight: 35, MaxValue: 4},
+		{Name: WeightLossSlice, Weight: 35, MaxValue: 4},
+		{Name: BiochemicalSlice, Weight: 30, MaxValue: 4},
+	},
+	RequiredResourceTypes: []string{"Observation", "MedicationStatement", "MedicationOrder"},
+}
+
+// Plugin is a RiskServicePlugin that assesses nutrition risk from a patient's body weight and height observations and
+// labs.  An assessment is made each time the patient's weight, height or one of the labs is recorded.  The patient's
+// MedicationStatements and MedicationOrders constrain the nutrition targets through the drug-nutrient interactions of
+// the medications.  Only medications with a code are considered, since the Medications that orders and statements
+// reference aren't part of the event stream.
+type Plugin struct {
+	// ActivityFactor is the physical activity level multiplier used to estimate energy requirements
+	ActivityFactor float64
+	// Interactions is the knowledge base of drug-nutrient interactions that constrain the nutrition targets, or nil if
+	// the patient's medications aren't considered
+	Interactions *interactions.KnowledgeBase
+}
+
+// NewPlugin returns a nutrition risk plugin using the given activity factor, or DefaultActivityFactor if it is 0
+func NewPlugin(activityFactor float64) *Plugin {
+	if activityFactor == 0 {
+		activityFactor = DefaultActivityFactor
+	}
+	return &Plugin{ActivityFactor: activityFactor}
+}
+
+// Config returns the configuration of the nutrition risk plugin
+func (p *Plugin) Config() plugin.RiskServicePluginConfig {
+	return NutritionRiskServiceConfig
+}
+
+// Assessment represents a patient's nutrition status at a point in time
+type Assessment struct {
+	AsOf     time.Time
+	WeightKg float64
+	HeightCm float64
+	BMI      float64
+	// PercentWeightLost is the percent of body weight lost since the highest weight recorded in the preceding 180 days
+	PercentWeightLost float64
+	// EnergyRequirement is the estimated energy requirement in kcal/day, or 0 if the patient's age is unknown
+	EnergyRequirement float64
+	BMIRisk           int
+	WeightLossRisk    int
+	// Labs are the latest results of the labs recorded in the 90 days preceding the assessment
+	Labs            []LabResult
+	BiochemicalRisk int
+	// EGFR is the latest eGFR estimated in the 90 days preceding the assessment, or nil if there is none
+	EGFR *EGFR
+	// Targets are the daily nutrition targets, limited by the CKD stage of the EGFR and the interactions of the
+	// medications being taken
+	Targets NutritionTargets
+	// Interactions are the interactions of the medications being taken at the time of the assessment
+	Interactions []interactions.Finding
+}
+
+// ContributingLabs returns the lab results outside their reference ranges that contribute to the biochemical risk
+func (a *Assessment) ContributingLabs() []LabResult {
+	var contributing []LabResult
+	for _, result := range a.Labs {
+		if result.Risk > 1 {
+			contributing = append(contributing, result)
+		}
+	}
+	return contributing
+}
+
+// measurement is a body weight (in kg) or height (in cm) recorded at a point in time
+type measurement struct {
+	Date  time.Time
+	Value float64
+}
+
+// Calculate assesses the patient's nutrition risk each time their weight, height or a lab was recorded, as
+// CalculateDetails does, discarding the results' details
+func (p *Plugin) Calculate(es *plugin.EventStream, fhirEndpointURL string) ([]plugin.RiskServiceCalculationResult, error) {
+	results, err := p.CalculateDetails(es, fhirEndpointURL)
+	return models.CalculationResults(results), err
+}
+
+// CalculateDetails assesses the patient's nutrition risk each time their weight, height or a lab was recorded,
+// returning a NotApplicableError if the patient has no weight and height observations as an adult.  The eGFR estimated
+// from each of the patient's serum creatinines is written to the FHIR server as an Observation, even if the patient
+// can't be assessed.  Likewise, if the plugin has a knowledge base, the patient's current medications are checked for
+// interactions, updating the patient's DetectedIssues just as an interactions.Checker does.  Each assessment is also written as an Observation, which is part of
+// the basis of the result's risk assessment along with the observations of the assessment's contributing labs.
+func (p *Plugin) CalculateDetails(es *plugin.EventStream, fhirEndpointURL string) ([]models.Result, error) {
+	if egfrs := EGFRs(es); len(egfrs) > 0 {
+		if err := WriteEGFRs(fhirEndpointURL, es.Patient.Id, egfrs); err != nil {
+			return nil, err
+		}
+	}
+	if p.Interactions != nil && es.Patient != nil {
+		if _, err := interactions.NewChecker(p.Interactions, fhirEndpointURL).Check(es.Patient.Id); err != nil {
+			return nil, err
+		}
+	}
+	assessments, err := p.Assess(es)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]models.Result, len(assessments))
+	for i := range assessments {
+		a := &assessments[i]
+		ref, err := WriteAssessment(fhirEndpointURL, es.Patient.Id, a)
+		if err != nil {
+			return nil, err
+		}
+		if ref != "" {
+			results[i].Basis = append(results[i].Basis, fhirmodels.Reference{Reference: ref})
+		}
+		results[i].Basis = append(results[i].Basis, a.ContributingLabReferences()...)
+
+		pie := plugin.NewPie(strings.TrimSuffix(fhirEndpointURL, "/") + "/Patient/" + es.Patient.Id)
+		pie.Slices = make([]plugin.Slice, len(NutritionRiskServiceConfig.DefaultPieSlices))
+		copy(pie.Slices, NutritionRiskServiceConfig.DefaultPieSlices)
+		pie.UpdateSliceValue(BMISlice, a.BMIRisk)
+		pie.UpdateSliceValue(WeightLossSlice, a.WeightLossRisk)
+		pie.UpdateSliceValue(BiochemicalSlice, a.BiochemicalRisk)
+		results[i].RiskServiceCalculationResult = plugin.RiskServiceCalculationResult{AsOf: a.AsOf, Pie: pie}
+		models.MaxValueAggregation{}.Aggregate(&results[i].RiskServiceCalculationResult)
+	}
+	return results, nil
+}
+
+// Assess returns the patient's nutrition assessments, in chronological order.  Weights and heights are converted from
+// any UCUM unit of mass or length (or a common human-readable unit such as "lb"), and labs to the unit of their
+// reference ranges; observations in other units are ignored.
+func (p *Plugin) Assess(es *plugin.EventStream) ([]Assessment, error) {
+	if es.Patient == nil {
+		return nil, errors.New("Can't assess nutrition risk without a patient")
+	}
+	var weights, heights []measurement
+	var labs []labValue
+	meds := medications(es)
+	for _, event := range es.Events {
+		o, ok := event.Value.(*fhirmodels.Observation)
+		if !ok || event.End || o.Code == nil || o.ValueQuantity == nil || o.ValueQuantity.Value == nil {
+			continue
+		}
+		switch {
+		case o.Code.MatchesCode(loincSystem, BodyWeightCode):
+			if kg, err := ucum.Value(o.ValueQuantity, "kg"); err == nil {
+				weights = append(weights, measurement{event.Date, kg})
+			}
+		case o.Code.MatchesCode(loincSystem, BodyHeightCode):
+			if cm, err := ucum.Value(o.ValueQuantity, "cm"); err == nil {
+				heights = append(heights, measurement{event.Date, cm})
+			}
+		default:
+			for i := range Labs {
+				if !Labs[i].Matches(o) {
+					continue
+				}
+				if value, err := Labs[i].Value(o); err == nil {
+					labs = append(labs, labValue{Lab: i, Observation: o.Id, Date: event.Date, Value: value})
+				}
+				break
+			}
+		}
+	}
+	if len(weights) == 0 || len(heights) == 0 {
+		return nil, plugin.NewNotApplicableError("Nutrition risk requires body weight and height observations")
+	}
+
+	egfrs := EGFRs(es)
+
+	// Assess the patient each time their weight, height or a lab is recorded
+	dates := make([]time.Time, 0, len(weights)+len(heights)+len(labs)+len(egfrs))
+	for _, m := range weights {
+		dates = append(dates, m.Date)
+	}
+	for _, m := range heights {
+		dates = append(dates, m.Date)
+	}
+	for _, v := range labs {
+		dates = append(dates, v.Date)
+	}
+	for _, e := range egfrs {
+		dates = append(dates, e.Date)
+	}
+	sort.Sort(byTime(dates))
+
+	var assessments []Assessment
+	for _, d := range dates {
+		age, knownAge := ageAt(es.Patient, d)
+		if knownAge && age < MinimumAge {
+			continue
+		}
+		weight, ok := latest(weights, d)
+		if !ok {
+			continue
+		}
+		// Adult height is stable, so use the first height if it was recorded after the weight
+		height, ok := latest(heights, d)
+		if !ok {
+			height = heights[0]
+		}
+		a := Assessment{AsOf: d, WeightKg: weight.Value, HeightCm: height.Value}
+		a.BMI = BMI(a.WeightKg, a.HeightCm)
+		a.BMIRisk = BMIRisk(a.BMI)
+		if peak := peakWeight(weights, d); peak > a.WeightKg {
+			a.PercentWeightLost = (peak - a.WeightKg) / peak * 100
+		}
+		a.WeightLossRisk = WeightLossRisk(a.PercentWeightLost)
+		a.Labs = labResults(labs, d, age, knownAge, es.Patient.Gender)
+		a.BiochemicalRisk = BiochemicalRisk(a.Labs)
+		if knownAge {
+			a.EnergyRequirement = p.ActivityFactor * RestingEnergyExpenditure(a.WeightKg, a.HeightCm, age, es.Patient.Gender)
+		}
+		var stage *CKDStage
+		if a.EGFR = latestEGFR(egfrs, d); a.EGFR != nil {
+			stage = a.EGFR.Stage
+		}
+		a.Targets = Targets(a.WeightKg, a.EnergyRequirement, stage)
+		if p.Interactions != nil {
+			a.Interactions = interactions.Evaluate(p.Interactions, takenAt(meds, d))
+			a.Targets.Constrain(interactions.Constraints(a.Interactions))
+		}
+		// Consolidate measurements recorded at the same time into one assessment
+		if n := len(assessments); n > 0 && assessments[n-1].AsOf.Equal(d) {
+			assessments[n-1] = a
+		} else {
+			assessments = append(assessments, a)
+		}
+	}
+	if len(assessments) == 0 {
+		return nil, plugin.NewNotApplicableError("Nutrition risk is only assessed for adults")
+	}
+	return assessments, nil
+}
+
+// medications returns the coded medications of the patient's MedicationStatements and MedicationOrders
+func medications(es *plugin.EventStream) []interactions.Medication {
+	var meds []interactions.Medication
+	for _, event := range es.Events {
+		if event.End {
+			continue
+		}
+		var m interactions.Medication
+		ok := false
+		switch t := event.Value.(type) {
+		case *fhirmodels.MedicationStatement:
+			m, ok = interactions.FromStatement(t, nil)
+		case *fhirmodels.MedicationOrder:
+			m, ok = interactions.FromOrder(t, nil)
+		}
+		if ok {
+			meds = append(meds, m)
+		}
+	}
+	return meds
+}
+
+// latest returns the most recent measurement at or before the given date
+func latest(measurements []measurement, d time.Time) (measurement, bool) {
+	var found measurement
+	ok := false
+	for _, m := range measurements {
+		if !m.Date.After(d) && (!ok || !m.Date.Before(found.Date)) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// peakWeight returns the highest weight recorded in the weight loss window before the given date (inclusive)
+func peakWeight(weights []measurement, d time.Time) float64 {
+	var peak float64
+	for _, m := range weights {
+		if !m.Date.After(d) && m.Date.After(d.Add(-weightLossWindow)) && m.Value > peak {
+			peak = m.Value
+		}
+	}
+	return peak
+}
+
+// ageAt returns the patient's age in years at the given date, and false if the patient's birth date is unknown
+func ageAt(patient *fhirmodels.Patient, d time.Time) (int, bool) {
+	if patient.BirthDate == nil {
+		return 0, false
+	}
+	birth := patient.BirthDate.Time
+	age := d.Year() - birth.Year()
+	if d.Month() < birth.Month() || (d.Month() == birth.Month() && d.Day() < birth.Day()) {
+		age--
+	}
+	return age, true
+}
+
+type byTime []time.Time
+
+func (t byTime) Len() int {
+	return len(t)
+}
+func (t byTime) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+func (t byTime) Less(i, j int) bool {
+	return t[i].Before(t[j])
+}
+
+// takenAt returns the medications being taken at the time
+func takenAt(meds []interactions.Medication, d time.Time) []interactions.Medication {
+	var taken []interactions.Medication
+	for i := range meds {
+		if meds[i].TakenAt(d) {
+			taken = append(taken, meds[i])
+		}
+	}
+	return taken
+}
@@ -0,0 +1,638 @@
+package nutrition
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPluginSuite(t *testing.T) {
+	suite.Run(t, new(PluginSuite))
+}
+
+type PluginSuite struct {
+	suite.Suite
+	Plugin     *Plugin
+	Patient    *fhirmodels.Patient
+	FHIRServer *httptest.Server
+	Written    map[string]*fhirmodels.Observation
+	Issues     map[string]*fhirmodels.DetectedIssue
+	Resources  []interface{}
+	Deleted    []string
+}
+
+func (suite *PluginSuite) SetupTest() {
+	suite.Plugin = NewPlugin(0)
+	suite.Patient = &fhirmodels.Patient{Gender: "female", BirthDate: &fhirmodels.FHIRDateTime{Time: date(1976, 6, 15), Precision: fhirmodels.Date}}
+	suite.Patient.Id = "123"
+	suite.Written = make(map[string]*fhirmodels.Observation)
+	suite.Issues = make(map[string]*fhirmodels.DetectedIssue)
+	suite.Resources, suite.Deleted = nil, nil
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identifier := r.URL.Query().Get("identifier")
+		if r.Method == "GET" {
+			suite.serveSearch(w, r)
+			return
+		}
+		if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/DetectedIssue/") {
+			suite.Deleted = append(suite.Deleted, strings.TrimPrefix(r.URL.Path, "/DetectedIssue/"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method == "PUT" && r.URL.Path == "/DetectedIssue" && identifier != "" {
+			issue := &fhirmodels.DetectedIssue{}
+			json.NewDecoder(r.Body).Decode(issue)
+			suite.Issues[identifier] = issue
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if r.Method != "PUT" || r.URL.Path != "/Observation" || identifier == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o := &fhirmodels.Observation{}
+		json.NewDecoder(r.Body).Decode(o)
+		suite.Written[identifier] = o
+		w.Header().Set("Location", "http://"+r.Host+"/Observation/"+o.Identifier[0].Value+"/_history/1")
+		w.WriteHeader(http.StatusCreated)
+	}))
+}
+
+// serveSearch serves the patient and the searches for their medications and DetectedIssues, which return the suite's
+// resources of the searched type
+func (suite *PluginSuite) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/Patient/"+suite.Patient.Id {
+		json.NewEncoder(w).Encode(suite.Patient)
+		return
+	}
+	bundle := &fhirmodels.Bundle{Type: "searchset"}
+	for _, resource := range suite.Resources {
+		var resourceType string
+		switch resource.(type) {
+		case *fhirmodels.MedicationStatement:
+			resourceType = "MedicationStatement"
+		case *fhirmodels.MedicationOrder:
+			resourceType = "MedicationOrder"
+		case *fhirmodels.DetectedIssue:
+			resourceType = "DetectedIssue"
+		}
+		if r.URL.Path == "/"+resourceType {
+			bundle.Entry = append(bundle.Entry, fhirmodels.BundleEntryComponent{Resource: resource})
+		}
+	}
+	json.NewEncoder(w).Encode(bundle)
+}
+
+func (suite *PluginSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+// written returns the observation written with the identifier, failing the test if there is none
+func (suite *PluginSuite) written(system, value string) *fhirmodels.Observation {
+	o := suite.Written[system+"|"+value]
+	suite.Require().NotNil(o, "No observation written for %s|%s", system, value)
+	return o
+}
+
+// component returns the value of the observation's component with the code, failing the test if there is none
+func (suite *PluginSuite) component(o *fhirmodels.Observation, system, code string) *fhirmodels.ObservationComponentComponent {
+	for i := range o.Component {
+		if o.Component[i].Code.MatchesCode(system, code) {
+			return &o.Component[i]
+		}
+	}
+	suite.Require().Fail("Missing component", "%s|%s", system, code)
+	return nil
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func observationEvent(d time.Time, code string, value float64, unit string) plugin.Event {
+	o := &fhirmodels.Observation{
+		Status: "final",
+		Code:   &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{{System: "http://loinc.org", Code: code}}},
+		ValueQuantity: &fhirmodels.Quantity{
+			Value:  &value,
+			Unit:   unit,
+			System: "http://unitsofmeasure.org",
+			Code:   unit,
+		},
+		EffectiveDateTime: &fhirmodels.FHIRDateTime{Time: d, Precision: fhirmodels.Timestamp},
+	}
+	return plugin.Event{Date: d, Type: "Observation", Value: o}
+}
+
+func (suite *PluginSuite) eventStream(events ...plugin.Event) *plugin.EventStream {
+	es := plugin.NewEventStream(suite.Patient)
+	es.Events = events
+	plugin.SortEventsByDate(es.Events)
+	return es
+}
+
+func (suite *PluginSuite) TestAssess() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 63, "[in_i]"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 132, "[lb_av]"),
+		observationEvent(date(2016, 3, 1), BodyWeightCode, 56, "kg"),
+		observationEvent(date(2016, 5, 1), BodyWeightCode, 52000, "g"),
+		// Weights in unrecognized units are ignored
+		observationEvent(date(2016, 6, 1), BodyWeightCode, 9, "[stone_av]"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 3)
+
+	first := assessments[0]
+	assert.Equal(date(2016, 1, 1), first.AsOf)
+	assert.InDelta(59.87, first.WeightKg, 0.01)
+	assert.InDelta(160.02, first.HeightCm, 0.01)
+	assert.InDelta(23.38, first.BMI, 0.01)
+	assert.Equal(1, first.BMIRisk)
+	assert.Equal(float64(0), first.PercentWeightLost)
+	assert.Equal(1, first.WeightLossRisk)
+	// Age 39: 1.2 * (10 * 59.87 + 6.25 * 160.02 - 5 * 39 - 161)
+	assert.InDelta(1491.44, first.EnergyRequirement, 0.01)
+
+	second := assessments[1]
+	assert.InDelta(6.47, second.PercentWeightLost, 0.01)
+	assert.Equal(2, second.WeightLossRisk)
+	assert.Equal(1, second.BMIRisk)
+
+	third := assessments[2]
+	assert.InDelta(13.15, third.PercentWeightLost, 0.01)
+	assert.Equal(3, third.WeightLossRisk)
+	assert.InDelta(20.31, third.BMI, 0.01)
+}
+
+func (suite *PluginSuite) TestAssessUsesLaterHeight() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Patient.BirthDate = nil
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 110, "kg"),
+		observationEvent(date(2016, 2, 1), BodyHeightCode, 1.75, "m"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 2)
+	assert.Equal(date(2016, 1, 1), assessments[0].AsOf)
+	assert.InDelta(35.92, assessments[0].BMI, 0.01)
+	assert.Equal(4, assessments[0].BMIRisk)
+	// No birth date, so no energy requirement
+	assert.Equal(float64(0), assessments[0].EnergyRequirement)
+	assert.Equal(date(2016, 2, 1), assessments[1].AsOf)
+}
+
+func (suite *PluginSuite) TestNotApplicable() {
+	assert := suite.Assert()
+
+	_, err := suite.Plugin.Assess(suite.eventStream(observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg")))
+	assert.IsType(plugin.NotApplicableError{}, err)
+
+	// Children aren't assessed
+	suite.Patient.BirthDate.Time = date(2005, 1, 1)
+	_, err = suite.Plugin.Assess(suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+	))
+	assert.IsType(plugin.NotApplicableError{}, err)
+}
+
+func (suite *PluginSuite) TestCalculate() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 4, 1), BodyWeightCode, 51, "kg"),
+	)
+	results, err := suite.Plugin.Calculate(es, suite.FHIRServer.URL+"/")
+	require.NoError(err)
+	require.Len(results, 2)
+
+	assert.Equal(date(2016, 1, 1), results[0].AsOf)
+	assert.Equal(suite.FHIRServer.URL+"/Patient/123", results[0].Pie.Patient)
+	assert.Equal([]plugin.Slice{
+		{Name: BMISlice, Weight: 35, Value: 1, MaxValue: 4},
+		{Name: WeightLossSlice, Weight: 35, Value: 1, MaxValue: 4},
+		{Name: BiochemicalSlice, Weight: 30, Value: 1, MaxValue: 4},
+	}, results[0].Pie.Slices)
+	require.NotNil(results[0].Score)
+	assert.Equal(1, *results[0].Score)
+
+	// 15% weight loss, BMI 19.9
+	assert.Equal([]plugin.Slice{
+		{Name: BMISlice, Weight: 35, Value: 1, MaxValue: 4},
+		{Name: WeightLossSlice, Weight: 35, Value: 4, MaxValue: 4},
+		{Name: BiochemicalSlice, Weight: 30, Value: 1, MaxValue: 4},
+	}, results[1].Pie.Slices)
+	assert.Equal(4, *results[1].Score)
+	// The default slices aren't modified
+	assert.Equal(0, NutritionRiskServiceConfig.DefaultPieSlices[1].Value)
+}
+
+func (suite *PluginSuite) TestCalculateWritesAssessments() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 4, 1), BodyWeightCode, 51, "kg"),
+	)
+	results, err := suite.Plugin.CalculateDetails(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	require.Len(results, 2)
+	require.Len(suite.Written, 2)
+
+	o := suite.written(AssessmentIdentifierSystem, "123|2016-04-01T00:00:00Z")
+	assert.Equal("Patient/123", o.Subject.Reference)
+	assert.True(o.EffectiveDateTime.Time.Equal(date(2016, 4, 1)))
+	assert.Equal(51.0, *suite.component(o, loincSystem, BodyWeightCode).ValueQuantity.Value)
+	assert.Equal(160.0, *suite.component(o, loincSystem, BodyHeightCode).ValueQuantity.Value)
+	bmi := suite.component(o, loincSystem, BMICode).ValueQuantity
+	assert.Equal(19.9, *bmi.Value)
+	assert.Equal("kg/m2", bmi.Code)
+	assert.Equal(15.0, *suite.component(o, CodeSystem, "percent-weight-lost").ValueQuantity.Value)
+	// Age 39: 1.2 * (10 * 51 + 6.25 * 160 - 5 * 39 - 161) = 1384.8
+	energy := suite.component(o, CodeSystem, "energy-requirement").ValueQuantity
+	assert.Equal(1385.0, *energy.Value)
+	assert.Equal("kcal/d", energy.Unit)
+
+	// The assessment's observation is part of the basis of its risk assessment
+	assert.Equal([]fhirmodels.Reference{{Reference: "Observation/123|2016-01-01T00:00:00Z"}}, results[0].Basis)
+	assert.Equal([]fhirmodels.Reference{{Reference: "Observation/123|2016-04-01T00:00:00Z"}}, results[1].Basis)
+
+	// Without a birth date, the energy requirement is unknown
+	suite.Patient.BirthDate = nil
+	suite.Written = make(map[string]*fhirmodels.Observation)
+	_, err = suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	o = suite.written(AssessmentIdentifierSystem, "123|2016-01-01T00:00:00Z")
+	for _, c := range o.Component {
+		assert.False(c.Code.MatchesCode(CodeSystem, "energy-requirement"))
+	}
+
+	// Failing to write an assessment fails the calculation
+	suite.FHIRServer.Close()
+	_, err = suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	assert.Error(err)
+}
+
+func (suite *PluginSuite) TestCalculateReferencesContributingLabs() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	hemoglobin := observationEvent(date(2016, 1, 1), HemoglobinCode, 7.5, "g/dL")
+	hemoglobin.Value.(*fhirmodels.Observation).Id = "hgb"
+	albumin := observationEvent(date(2016, 1, 1), AlbuminCode, 4.0, "g/dL")
+	albumin.Value.(*fhirmodels.Observation).Id = "alb"
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		hemoglobin,
+		albumin,
+	)
+	results, err := suite.Plugin.CalculateDetails(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	require.Len(results, 1)
+
+	// Only the abnormal hemoglobin contributes to the biochemical risk
+	assert.Equal([]fhirmodels.Reference{
+		{Reference: "Observation/123|2016-01-01T00:00:00Z"},
+		{Reference: "Observation/hgb"},
+	}, results[0].Basis)
+	o := suite.written(AssessmentIdentifierSystem, "123|2016-01-01T00:00:00Z")
+	require.Len(o.Related, 1)
+	assert.Equal("derived-from", o.Related[0].Type)
+	assert.Equal("Observation/hgb", o.Related[0].Target.Reference)
+}
+
+func (suite *PluginSuite) TestLocationReference() {
+	assert := suite.Assert()
+
+	assert.Equal("Observation/1", locationReference("http://fhir/Observation/1", "Observation"))
+	assert.Equal("Observation/1", locationReference("http://fhir/Observation/1/_history/2", "Observation"))
+	assert.Equal("Observation/1", locationReference("Observation/1", "Observation"))
+	assert.Equal("", locationReference("http://fhir/Patient/1", "Observation"))
+	assert.Equal("", locationReference("", "Observation"))
+}
+
+func (suite *PluginSuite) TestAssessLabs() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	albumin := observationEvent(date(2016, 2, 1), AlbuminCode, 2.8, "g/dL")
+	albumin.Value.(*fhirmodels.Observation).Id = "alb1"
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 1, 1), HemoglobinCode, 12.5, "g/dL"),
+		albumin,
+		observationEvent(date(2016, 3, 1), HbA1cIFCCCode, 53, "mmol/mol"),
+		observationEvent(date(2016, 5, 15), BodyWeightCode, 59, "kg"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 4)
+
+	// The labs recorded with the weight and height are in the first assessment
+	require.Len(assessments[0].Labs, 1)
+	assert.Equal("Hemoglobin", assessments[0].Labs[0].Lab)
+	assert.Equal("N", assessments[0].Labs[0].Interpretation)
+	assert.Equal(1, assessments[0].BiochemicalRisk)
+	assert.Empty(assessments[0].ContributingLabs())
+
+	// Each lab is assessed when it's recorded
+	assert.Equal(date(2016, 2, 1), assessments[1].AsOf)
+	contributing := assessments[1].ContributingLabs()
+	require.Len(contributing, 1)
+	assert.Equal(LabResult{
+		Lab:            "Albumin",
+		Observation:    "alb1",
+		Date:           date(2016, 2, 1),
+		Value:          2.8,
+		Unit:           "g/dL",
+		Range:          ReferenceRange{MaxAge: 60, Low: 3.5, High: 5.0},
+		Interpretation: "L",
+		Risk:           3,
+	}, contributing[0])
+	assert.Equal(3, assessments[1].BiochemicalRisk)
+
+	// 53 mmol/mol is 7.0%
+	require.Len(assessments[2].Labs, 3)
+	assert.Equal("Hemoglobin A1c", assessments[2].Labs[1].Lab)
+	assert.InDelta(7.0, assessments[2].Labs[1].Value, 0.01)
+	assert.Equal(3, assessments[2].Labs[1].Risk)
+
+	// Only the labs from the preceding 90 days are used
+	require.Len(assessments[3].Labs, 1)
+	assert.Equal("Hemoglobin A1c", assessments[3].Labs[0].Lab)
+	assert.Equal(3, assessments[3].BiochemicalRisk)
+}
+
+func (suite *PluginSuite) TestCalculateBiochemicalSlice() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 1, 1), HemoglobinCode, 7.5, "g/dL"),
+	)
+	results, err := suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	require.Len(results, 1)
+	assert.Equal(plugin.Slice{Name: BiochemicalSlice, Weight: 30, Value: 4, MaxValue: 4}, results[0].Pie.Slices[2])
+	assert.Equal(4, *results[0].Score)
+}
+
+func (suite *PluginSuite) TestAssessRenalTargets() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 2, 1), CreatinineCode, 2.0, "mg/dL"),
+		observationEvent(date(2016, 6, 1), BodyWeightCode, 58, "kg"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 3)
+
+	// Without an eGFR, only the default protein target applies
+	assert.Nil(assessments[0].EGFR)
+	assert.Equal(48.0, assessments[0].Targets.ProteinG)
+	assert.Equal(float64(0), assessments[0].Targets.PotassiumMg)
+	assert.Equal(assessments[0].EnergyRequirement, assessments[0].Targets.EnergyKcal)
+
+	// Age 39, creatinine 2.0 mg/dL: eGFR 32 (G3b)
+	require.NotNil(assessments[1].EGFR)
+	assert.InDelta(32.0, assessments[1].EGFR.Value, 0.1)
+	assert.Equal(NutritionTargets{
+		EnergyKcal:   assessments[1].EnergyRequirement,
+		ProteinG:     36,
+		PotassiumMg:  3000,
+		PhosphorusMg: 1000,
+	}, assessments[1].Targets)
+
+	// The eGFR is only used for 90 days
+	assert.Nil(assessments[2].EGFR)
+	assert.InDelta(46.4, assessments[2].Targets.ProteinG, 0.001)
+}
+
+func (suite *PluginSuite) TestCalculateWritesRenalTargets() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 2, 1), CreatinineCode, 2.0, "mg/dL"),
+	)
+	results, err := suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	require.Len(results, 2)
+
+	// Without an eGFR, only the protein target applies
+	o := suite.written(AssessmentIdentifierSystem, "123|2016-01-01T00:00:00Z")
+	assert.Equal(48.0, *suite.component(o, CodeSystem, "protein-target").ValueQuantity.Value)
+	for _, c := range o.Component {
+		assert.False(c.Code.MatchesCode(CodeSystem, "potassium-limit"))
+		assert.False(c.Code.MatchesCode(CodeSystem, "phosphorus-limit"))
+		assert.False(c.Code.MatchesCode(CodeSystem, "ckd-stage"))
+	}
+
+	// eGFR 32 (G3b) limits protein, potassium and phosphorus
+	o = suite.written(AssessmentIdentifierSystem, "123|2016-02-01T00:00:00Z")
+	assert.Equal(32.0, *suite.component(o, loincSystem, EGFRCode).ValueQuantity.Value)
+	stage := suite.component(o, CodeSystem, "ckd-stage").ValueCodeableConcept
+	require.NotNil(stage)
+	assert.True(stage.MatchesCode(CKDStageSystem, "G3b"))
+	protein := suite.component(o, CodeSystem, "protein-target").ValueQuantity
+	assert.Equal(36.0, *protein.Value)
+	assert.Equal("g/d", protein.Code)
+	potassium := suite.component(o, CodeSystem, "potassium-limit").ValueQuantity
+	assert.Equal(3000.0, *potassium.Value)
+	assert.Equal("mg/d", potassium.Code)
+	assert.Equal(1000.0, *suite.component(o, CodeSystem, "phosphorus-limit").ValueQuantity.Value)
+}
+
+func medicationEvent(start, end time.Time, status, rxcui, display string) plugin.Event {
+	s := &fhirmodels.MedicationStatement{
+		Status: status,
+		MedicationCodeableConcept: &fhirmodels.CodeableConcept{
+			Coding: []fhirmodels.Coding{{System: interactions.RxNormSystem, Code: rxcui, Display: display}},
+		},
+		EffectivePeriod: &fhirmodels.Period{Start: &fhirmodels.FHIRDateTime{Time: start, Precision: fhirmodels.Date}},
+	}
+	if !end.IsZero() {
+		s.EffectivePeriod.End = &fhirmodels.FHIRDateTime{Time: end, Precision: fhirmodels.Date}
+	}
+	s.Id = rxcui
+	return plugin.Event{Date: start, Type: "MedicationStatement", Value: s}
+}
+
+func (suite *PluginSuite) TestAssessMedicationConstraints() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Plugin.Interactions = interactions.DefaultKnowledgeBase()
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		medicationEvent(date(2016, 2, 15), date(2016, 5, 1), "completed", "11289", "Warfarin"),
+		medicationEvent(date(2016, 3, 1), time.Time{}, "active", "9997", "Spironolactone"),
+		observationEvent(date(2016, 4, 1), BodyWeightCode, 59, "kg"),
+		observationEvent(date(2016, 6, 1), BodyWeightCode, 58, "kg"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 3)
+
+	// No medications were being taken
+	assert.Empty(assessments[0].Interactions)
+	assert.Empty(assessments[0].Targets.Constraints)
+	assert.Equal(float64(0), assessments[0].Targets.PotassiumMg)
+
+	// Warfarin and spironolactone: vitamin K kept consistent, and potassium limited
+	require.Len(assessments[1].Interactions, 2)
+	assert.Equal("MedicationStatement/11289", assessments[1].Interactions[0].Medication)
+	require.Len(assessments[1].Targets.Constraints, 2)
+	assert.Equal("Potassium", assessments[1].Targets.Constraints[0].Nutrient)
+	assert.Equal("Vitamin K", assessments[1].Targets.Constraints[1].Nutrient)
+	assert.Equal(3000.0, assessments[1].Targets.PotassiumMg)
+
+	// The warfarin ended
+	require.Len(assessments[2].Interactions, 1)
+	assert.Equal("potassium-sparing-diuretic-potassium", assessments[2].Interactions[0].Interaction.ID)
+	assert.Equal(3000.0, assessments[2].Targets.PotassiumMg)
+}
+
+func orderEvent(written time.Time, status, rxcui, display string) plugin.Event {
+	o := &fhirmodels.MedicationOrder{
+		Status: status,
+		MedicationCodeableConcept: &fhirmodels.CodeableConcept{
+			Coding: []fhirmodels.Coding{{System: interactions.RxNormSystem, Code: rxcui, Display: display}},
+		},
+		DateWritten: &fhirmodels.FHIRDateTime{Time: written, Precision: fhirmodels.Date},
+	}
+	o.Id = "order-" + rxcui
+	return plugin.Event{Date: written, Type: "MedicationOrder", Value: o}
+}
+
+func (suite *PluginSuite) TestCalculateWritesMedicationConstraints() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Plugin.Interactions = interactions.DefaultKnowledgeBase()
+	warfarin := medicationEvent(date(2016, 2, 15), date(2016, 5, 1), "completed", "11289", "Warfarin")
+	lisinopril := orderEvent(date(2016, 3, 1), "active", "29046", "Lisinopril")
+	suite.Resources = []interface{}{warfarin.Value, lisinopril.Value}
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		warfarin,
+		lisinopril,
+		observationEvent(date(2016, 4, 1), BodyWeightCode, 59, "kg"),
+	)
+	results, err := suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	require.Len(results, 2)
+
+	// The ordered lisinopril limits potassium, and the warfarin keeps vitamin K consistent
+	o := suite.written(AssessmentIdentifierSystem, "123|2016-04-01T00:00:00Z")
+	assert.Equal(3000.0, *suite.component(o, CodeSystem, "potassium-limit").ValueQuantity.Value)
+	var constraints []string
+	for _, c := range o.Component {
+		if c.Code.MatchesCode(CodeSystem, "nutrient-constraint") {
+			constraints = append(constraints, c.ValueString)
+		}
+	}
+	require.Len(constraints, 2)
+	assert.Contains(constraints[0], "Limit Potassium to 3000 mg a day.")
+	assert.Contains(constraints[1], "Keep the intake of Vitamin K consistent.")
+
+	// Only the medication that's still being taken is written as a DetectedIssue
+	require.Len(suite.Issues, 1)
+	issue := suite.Issues[interactions.DetectedIssueIdentifierSystem+"|123|ace-inhibitor-arb-potassium|MedicationOrder/order-29046"]
+	require.NotNil(issue)
+	assert.Equal("Patient/123", issue.Patient.Reference)
+	assert.Equal("MedicationOrder/order-29046", issue.Implicated[0].Reference)
+
+	// Without a knowledge base, no DetectedIssues are written
+	suite.Plugin.Interactions = nil
+	suite.Issues = make(map[string]*fhirmodels.DetectedIssue)
+	_, err = suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+	assert.Empty(suite.Issues)
+}
+
+func (suite *PluginSuite) TestCalculateRemovesStoppedMedicationIssues() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	suite.Plugin.Interactions = interactions.DefaultKnowledgeBase()
+	warfarin := medicationEvent(date(2016, 2, 15), date(2016, 5, 1), "completed", "11289", "Warfarin")
+	lisinopril := orderEvent(date(2016, 3, 1), "active", "29046", "Lisinopril")
+	// Both medications' issues were detected when they were being taken
+	detected := date(2016, 3, 2)
+	warfarinIssue := &fhirmodels.DetectedIssue{
+		Identifier: &fhirmodels.Identifier{System: interactions.DetectedIssueIdentifierSystem, Value: "123|warfarin-vitamin-k|MedicationStatement/11289"},
+		Date:       &fhirmodels.FHIRDateTime{Time: detected, Precision: fhirmodels.Timestamp},
+	}
+	warfarinIssue.Id = "issue-1"
+	lisinoprilIssue := &fhirmodels.DetectedIssue{
+		Identifier: &fhirmodels.Identifier{System: interactions.DetectedIssueIdentifierSystem, Value: "123|ace-inhibitor-arb-potassium|MedicationOrder/order-29046"},
+		Date:       &fhirmodels.FHIRDateTime{Time: detected, Precision: fhirmodels.Timestamp},
+	}
+	lisinoprilIssue.Id = "issue-2"
+	suite.Resources = []interface{}{warfarin.Value, lisinopril.Value, warfarinIssue, lisinoprilIssue}
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		warfarin,
+		lisinopril,
+	)
+	_, err := suite.Plugin.Calculate(es, suite.FHIRServer.URL)
+	require.NoError(err)
+
+	// The stopped warfarin's issue is removed, and the lisinopril's keeps the date it was detected
+	assert.Equal([]string{"issue-1"}, suite.Deleted)
+	require.Len(suite.Issues, 1)
+	issue := suite.Issues[interactions.DetectedIssueIdentifierSystem+"|"+lisinoprilIssue.Identifier.Value]
+	require.NotNil(issue)
+	assert.True(issue.Date.Time.Equal(detected))
+}
+
+func (suite *PluginSuite) TestAssessIgnoresMedicationsWithoutKnowledgeBase() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		medicationEvent(date(2016, 1, 1), time.Time{}, "active", "9997", "Spironolactone"),
+		observationEvent(date(2016, 4, 1), BodyWeightCode, 59, "kg"),
+	)
+	assessments, err := suite.Plugin.Assess(es)
+	require.NoError(err)
+	require.Len(assessments, 1)
+	assert.Empty(assessments[0].Interactions)
+	assert.Equal(float64(0), assessments[0].Targets.PotassiumMg)
+}
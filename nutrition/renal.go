@@ -0,0 +1,264 @@
+package nutrition
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/multifactorriskservice/ucum"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+// LOINC codes for serum creatinine and the eGFR estimated from it by the CKD-EPI 2021 equation
+const (
+	CreatinineCode = "2160-0"
+	EGFRCode       = "98979-8"
+)
+
+// EGFRUnit is the UCUM unit of eGFR: mL/min per 1.73 m² of body surface area
+const EGFRUnit = "mL/min/{1.73_m2}"
+
+// EGFRIdentifierSystem is the system of the identifiers given to the eGFR observations.  The identifier is unique to
+// the patient and the time the creatinine was recorded, so estimating the eGFR again updates its observation.
+const EGFRIdentifierSystem = "http://interventionengine.org/fhir/egfr"
+
+// CKDStageSystem is the system of the codes of the CKD stages, which are the KDIGO GFR categories
+const CKDStageSystem = "http://interventionengine.org/fhir/ckd-stages"
+
+// creatinineMolarMass is the molar mass of creatinine (g/mol), for converting creatinine reported in umol/L
+const creatinineMolarMass = 113.12
+
+// DefaultProteinPerKg is the daily protein target (g/kg of body weight) for adults without kidney disease: the RDA
+const DefaultProteinPerKg = 0.8
+
+// NutrientLimits are the daily nutrient targets that depend on kidney function.  Potassium and phosphorus are
+// maximums (in mg/day), or 0 if they aren't limited.
+type NutrientLimits struct {
+	ProteinPerKg float64
+	PotassiumMg  float64
+	PhosphorusMg float64
+}
+
+// CKDStage is a stage of chronic kidney disease: a KDIGO GFR category, starting at the eGFR MinEGFR
+type CKDStage struct {
+	Code        string
+	Description string
+	MinEGFR     float64
+	Limits      NutrientLimits
+}
+
+// CKDStages are the CKD stages, from the highest eGFR to the lowest.  The limits for stages G3a to G5 follow the KDOQI
+// guideline for patients who aren't on dialysis: a low protein diet, with potassium and phosphorus restricted as
+// kidney function declines.
+var CKDStages = []CKDStage{
+	{"G1", "Normal or high kidney function", 90, NutrientLimits{ProteinPerKg: DefaultProteinPerKg}},
+	{"G2", "Mildly decreased kidney function", 60, NutrientLimits{ProteinPerKg: DefaultProteinPerKg}},
+	{"G3a", "Mildly to moderately decreased kidney function", 45, NutrientLimits{ProteinPerKg: 0.6, PotassiumMg: 3000, PhosphorusMg: 1000}},
+	{"G3b", "Moderately to severely decreased kidney function", 30, NutrientLimits{ProteinPerKg: 0.6, PotassiumMg: 3000, PhosphorusMg: 1000}},
+	{"G4", "Severely decreased kidney function", 15, NutrientLimits{ProteinPerKg: 0.6, PotassiumMg: 2000, PhosphorusMg: 800}},
+	{"G5", "Kidney failure", 0, NutrientLimits{ProteinPerKg: 0.6, PotassiumMg: 2000, PhosphorusMg: 800}},
+}
+
+// Stage returns the CKD stage of the eGFR
+func Stage(egfr float64) *CKDStage {
+	for i := range CKDStages {
+		if egfr >= CKDStages[i].MinEGFR {
+			return &CKDStages[i]
+		}
+	}
+	return &CKDStages[len(CKDStages)-1]
+}
+
+// CKDEPI returns the eGFR (in mL/min/1.73 m²) estimated by the race-free CKD-EPI 2021 equation for the given serum
+// creatinine (in mg/dL), age (in years) and FHIR administrative gender.  Since the equation differs by sex, it's an
+// error if the gender is not male or female.
+func CKDEPI(creatinineMgDL float64, age int, gender string) (float64, error) {
+	var kappa, alpha, factor float64
+	switch gender {
+	case "male":
+		kappa, alpha, factor = 0.9, -0.302, 1
+	case "female":
+		kappa, alpha, factor = 0.7, -0.241, 1.012
+	default:
+		return 0, fmt.Errorf("Can't estimate eGFR for a patient whose gender is %q", gender)
+	}
+	if creatinineMgDL <= 0 {
+		return 0, fmt.Errorf("Can't estimate eGFR from a creatinine of %g mg/dL", creatinineMgDL)
+	}
+	ratio := creatinineMgDL / kappa
+	return 142 * math.Pow(math.Min(ratio, 1), alpha) * math.Pow(math.Max(ratio, 1), -1.2) * math.Pow(0.9938, float64(age)) * factor, nil
+}
+
+// EGFR is the eGFR estimated from a serum creatinine recorded at a point in time.  Creatinine is the ID of the
+// creatinine's observation.
+type EGFR struct {
+	Creatinine     string
+	Date           time.Time
+	CreatinineMgDL float64
+	Value          float64
+	Stage          *CKDStage
+}
+
+// EGFRs returns the patient's eGFR estimated from each serum creatinine recorded as an adult, in chronological order.
+// The eGFR can't be estimated if the patient's birth date is unknown or their gender isn't male or female.
+func EGFRs(es *plugin.EventStream) []EGFR {
+	if es.Patient == nil {
+		return nil
+	}
+	var egfrs []EGFR
+	for _, event := range es.Events {
+		o, ok := event.Value.(*fhirmodels.Observation)
+		if !ok || event.End || o.Code == nil || o.ValueQuantity == nil || o.ValueQuantity.Value == nil || !o.Code.MatchesCode(loincSystem, CreatinineCode) {
+			continue
+		}
+		age, knownAge := ageAt(es.Patient, event.Date)
+		if !knownAge || age < MinimumAge {
+			continue
+		}
+		creatinine, err := ucum.SubstanceValue(o.ValueQuantity, "mg/dL", creatinineMolarMass)
+		if err != nil {
+			continue
+		}
+		value, err := CKDEPI(creatinine, age, es.Patient.Gender)
+		if err != nil {
+			continue
+		}
+		egfrs = append(egfrs, EGFR{Creatinine: o.Id, Date: event.Date, CreatinineMgDL: creatinine, Value: value, Stage: Stage(value)})
+	}
+	return egfrs
+}
+
+// latestEGFR returns the most recent eGFR estimated in the lab window before the given date (inclusive), or nil if
+// there is none
+func latestEGFR(egfrs []EGFR, d time.Time) *EGFR {
+	var found *EGFR
+	for i := range egfrs {
+		e := &egfrs[i]
+		if !e.Date.After(d) && e.Date.After(d.Add(-labWindow)) && (found == nil || !e.Date.Before(found.Date)) {
+			found = e
+		}
+	}
+	return found
+}
+
+// Key returns the eGFR observation's identifier value: its patient and the time the creatinine was recorded
+func (e *EGFR) Key(patientID string) string {
+	return patientID + "|" + e.Date.UTC().Format(time.RFC3339)
+}
+
+// ToObservation returns the eGFR as an Observation for the patient, interpreted as its CKD stage and derived from the
+// creatinine's observation
+func (e *EGFR) ToObservation(patientID string) *fhirmodels.Observation {
+	value := math.Floor(e.Value + 0.5)
+	stage := fhirmodels.Coding{System: CKDStageSystem, Code: e.Stage.Code, Display: e.Stage.Description}
+	o := &fhirmodels.Observation{
+		Identifier: []fhirmodels.Identifier{{System: EGFRIdentifierSystem, Value: e.Key(patientID)}},
+		Status:     "final",
+		Category: &fhirmodels.CodeableConcept{
+			Coding: []fhirmodels.Coding{{System: "http://hl7.org/fhir/observation-category", Code: "laboratory"}},
+		},
+		Code: &fhirmodels.CodeableConcept{
+			Coding: []fhirmodels.Coding{{System: loincSystem, Code: EGFRCode}},
+			Text:   "eGFR (CKD-EPI 2021)",
+		},
+		Subject:           &fhirmodels.Reference{Reference: "Patient/" + patientID},
+		EffectiveDateTime: &fhirmodels.FHIRDateTime{Time: e.Date, Precision: fhirmodels.Timestamp},
+		ValueQuantity:     &fhirmodels.Quantity{Value: &value, Unit: EGFRUnit, System: ucum.System, Code: EGFRUnit},
+		Interpretation:    &fhirmodels.CodeableConcept{Coding: []fhirmodels.Coding{stage}, Text: "CKD stage " + e.Stage.Code},
+		Method:            &fhirmodels.CodeableConcept{Text: "CKD-EPI 2021 creatinine equation"},
+	}
+	if e.Creatinine != "" {
+		o.Related = []fhirmodels.ObservationRelatedComponent{
+			{Type: "derived-from", Target: &fhirmodels.Reference{Reference: "Observation/" + e.Creatinine}},
+		}
+	}
+	return o
+}
+
+// WriteEGFRs writes the eGFR observations to the FHIR server, with a conditional update on their identifiers so that
+// each is only stored once
+func WriteEGFRs(fhirEndpoint, patientID string, egfrs []EGFR) error {
+	if patientID == "" {
+		return errors.New("Can't write eGFR observations without a patient ID")
+	}
+	for i := range egfrs {
+		data, err := json.Marshal(egfrs[i].ToObservation(patientID))
+		if err != nil {
+			return err
+		}
+		query := url.QueryEscape(EGFRIdentifierSystem + "|" + egfrs[i].Key(patientID))
+		req, err := http.NewRequest("PUT", strings.TrimSuffix(fhirEndpoint, "/")+"/Observation?identifier="+query, bytes.NewBuffer(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("Can't write eGFR observation for patient %s: %s", patientID, err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+			return fmt.Errorf("Received HTTP %d %s from FHIR server when writing eGFR observation for patient %s.", res.StatusCode, res.Status, patientID)
+		}
+	}
+	return nil
+}
+
+// NutritionTargets are a patient's daily nutrition targets: energy (kcal/day, or 0 if the energy requirement is
+// unknown) and protein (g/day), along with the potassium and phosphorus limits (mg/day, or 0 if they aren't limited)
+// and the constraints placed on the patient's diet by drug-nutrient interactions
+type NutritionTargets struct {
+	EnergyKcal   float64
+	ProteinG     float64
+	PotassiumMg  float64
+	PhosphorusMg float64
+	Constraints  []interactions.Constraint
+}
+
+// Targets returns the nutrition targets for a patient of the given weight (in kg) and energy requirement, applying the
+// nutrient limits of the CKD stage (if it's known)
+func Targets(weightKg, energyRequirement float64, stage *CKDStage) NutritionTargets {
+	limits := NutrientLimits{ProteinPerKg: DefaultProteinPerKg}
+	if stage != nil {
+		limits = stage.Limits
+	}
+	return NutritionTargets{
+		EnergyKcal:   energyRequirement,
+		ProteinG:     limits.ProteinPerKg * weightKg,
+		PotassiumMg:  limits.PotassiumMg,
+		PhosphorusMg: limits.PhosphorusMg,
+	}
+}
+
+// Constrain adds the constraints to the targets.  Limits on potassium and phosphorus lower the targets' limits, but
+// never raise them.
+func (t *NutritionTargets) Constrain(constraints []interactions.Constraint) {
+	t.Constraints = append(t.Constraints, constraints...)
+	for _, c := range constraints {
+		if c.Action != interactions.Limit || c.LimitMg == 0 {
+			continue
+		}
+		switch c.Nutrient {
+		case "Potassium":
+			t.PotassiumMg = lowerLimit(t.PotassiumMg, c.LimitMg)
+		case "Phosphorus":
+			t.PhosphorusMg = lowerLimit(t.PhosphorusMg, c.LimitMg)
+		}
+	}
+}
+
+// lowerLimit returns the lower of the limits, where 0 is no limit
+func lowerLimit(limit, other float64) float64 {
+	if limit == 0 || other < limit {
+		return other
+	}
+	return limit
+}
@@ -0,0 +1,189 @@
+package nutrition
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	fhirmodels "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRenalSuite(t *testing.T) {
+	suite.Run(t, new(RenalSuite))
+}
+
+type RenalSuite struct {
+	suite.Suite
+	FHIRServer *httptest.Server
+	Written    map[string]*fhirmodels.Observation
+	Patient    *fhirmodels.Patient
+}
+
+func (suite *RenalSuite) SetupTest() {
+	suite.Written = make(map[string]*fhirmodels.Observation)
+	suite.FHIRServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identifier := r.URL.Query().Get("identifier")
+		if r.Method != "PUT" || r.URL.Path != "/Observation" || identifier == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o := &fhirmodels.Observation{}
+		json.NewDecoder(r.Body).Decode(o)
+		suite.Written[identifier] = o
+		w.WriteHeader(http.StatusCreated)
+	}))
+	suite.Patient = &fhirmodels.Patient{Gender: "female", BirthDate: &fhirmodels.FHIRDateTime{Time: date(1956, 1, 1), Precision: fhirmodels.Date}}
+	suite.Patient.Id = "123"
+}
+
+func (suite *RenalSuite) TearDownTest() {
+	suite.FHIRServer.Close()
+}
+
+func (suite *RenalSuite) eventStream(events ...plugin.Event) *plugin.EventStream {
+	es := plugin.NewEventStream(suite.Patient)
+	es.Events = events
+	plugin.SortEventsByDate(es.Events)
+	return es
+}
+
+func (suite *RenalSuite) TestCKDEPI() {
+	assert := suite.Assert()
+
+	egfr, err := CKDEPI(1.0, 60, "female")
+	assert.NoError(err)
+	assert.InDelta(64.5, egfr, 0.1)
+	egfr, err = CKDEPI(1.0, 60, "male")
+	assert.NoError(err)
+	assert.InDelta(86.2, egfr, 0.1)
+	egfr, _ = CKDEPI(0.6, 40, "female")
+	assert.InDelta(116.3, egfr, 0.1)
+	egfr, _ = CKDEPI(2.5, 70, "male")
+	assert.InDelta(27.0, egfr, 0.1)
+
+	_, err = CKDEPI(1.0, 60, "unknown")
+	assert.Error(err)
+	_, err = CKDEPI(0, 60, "male")
+	assert.Error(err)
+}
+
+func (suite *RenalSuite) TestStage() {
+	assert := suite.Assert()
+
+	assert.Equal("G1", Stage(116).Code)
+	assert.Equal("G2", Stage(89.9).Code)
+	assert.Equal("G3a", Stage(45).Code)
+	assert.Equal("G3b", Stage(44.9).Code)
+	assert.Equal("G4", Stage(15).Code)
+	assert.Equal("G5", Stage(8).Code)
+}
+
+func (suite *RenalSuite) TestTargets() {
+	assert := suite.Assert()
+
+	assert.Equal(NutritionTargets{EnergyKcal: 1800, ProteinG: 56}, Targets(70, 1800, nil))
+	assert.Equal(NutritionTargets{EnergyKcal: 1800, ProteinG: 56}, Targets(70, 1800, Stage(75)))
+	assert.Equal(NutritionTargets{EnergyKcal: 1800, ProteinG: 42, PotassiumMg: 3000, PhosphorusMg: 1000}, Targets(70, 1800, Stage(40)))
+	assert.Equal(NutritionTargets{ProteinG: 42, PotassiumMg: 2000, PhosphorusMg: 800}, Targets(70, 0, Stage(12)))
+}
+
+func (suite *RenalSuite) TestEGFRs() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	creatinine := observationEvent(date(2016, 1, 1), CreatinineCode, 88.4, "umol/L")
+	creatinine.Value.(*fhirmodels.Observation).Id = "cr1"
+	es := suite.eventStream(
+		creatinine,
+		observationEvent(date(2016, 6, 1), CreatinineCode, 2.5, "mg/dL"),
+		// Creatinines in the wrong unit are ignored
+		observationEvent(date(2016, 7, 1), CreatinineCode, 2.5, "g"),
+	)
+	egfrs := EGFRs(es)
+	require.Len(egfrs, 2)
+	assert.Equal("cr1", egfrs[0].Creatinine)
+	assert.InDelta(1.0, egfrs[0].CreatinineMgDL, 0.001)
+	assert.InDelta(64.5, egfrs[0].Value, 0.1)
+	assert.Equal("G2", egfrs[0].Stage.Code)
+	assert.Equal("G4", egfrs[1].Stage.Code)
+
+	// eGFR can't be estimated without the patient's sex
+	suite.Patient.Gender = "unknown"
+	assert.Empty(EGFRs(es))
+}
+
+func (suite *RenalSuite) TestToObservation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	egfr := EGFR{Creatinine: "cr1", Date: date(2016, 1, 1), CreatinineMgDL: 1.0, Value: 64.5, Stage: Stage(64.5)}
+	o := egfr.ToObservation("123")
+	require.Len(o.Identifier, 1)
+	assert.Equal(EGFRIdentifierSystem, o.Identifier[0].System)
+	assert.Equal("123|2016-01-01T00:00:00Z", o.Identifier[0].Value)
+	assert.True(o.Code.MatchesCode("http://loinc.org", EGFRCode))
+	assert.Equal("Patient/123", o.Subject.Reference)
+	assert.Equal(65.0, *o.ValueQuantity.Value)
+	assert.Equal(EGFRUnit, o.ValueQuantity.Code)
+	assert.True(o.Interpretation.MatchesCode(CKDStageSystem, "G2"))
+	require.Len(o.Related, 1)
+	assert.Equal("derived-from", o.Related[0].Type)
+	assert.Equal("Observation/cr1", o.Related[0].Target.Reference)
+
+	egfr.Creatinine = ""
+	assert.Empty(egfr.ToObservation("123").Related)
+}
+
+func (suite *RenalSuite) TestCalculateWritesEGFRs() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	es := suite.eventStream(
+		observationEvent(date(2016, 1, 1), BodyHeightCode, 160, "cm"),
+		observationEvent(date(2016, 1, 1), BodyWeightCode, 60, "kg"),
+		observationEvent(date(2016, 2, 1), CreatinineCode, 2.5, "mg/dL"),
+	)
+	results, err := NewPlugin(0).Calculate(es, suite.FHIRServer.URL+"/")
+	require.NoError(err)
+	assert.Len(results, 2)
+	// The eGFR, along with an observation for each assessment
+	require.Len(suite.Written, 3)
+	o := suite.Written[EGFRIdentifierSystem+"|123|2016-02-01T00:00:00Z"]
+	require.NotNil(o)
+	assert.Equal(21.0, *o.ValueQuantity.Value)
+
+	// The eGFR is written even if the patient can't be assessed
+	suite.Written = make(map[string]*fhirmodels.Observation)
+	_, err = NewPlugin(0).Calculate(suite.eventStream(observationEvent(date(2016, 3, 1), CreatinineCode, 1.0, "mg/dL")), suite.FHIRServer.URL)
+	assert.IsType(plugin.NotApplicableError{}, err)
+	assert.Len(suite.Written, 1)
+
+	// Failing to write the eGFR fails the calculation
+	suite.FHIRServer.Close()
+	_, err = NewPlugin(0).Calculate(es, suite.FHIRServer.URL)
+	assert.Error(err)
+}
+
+func (suite *RenalSuite) TestConstrainTargets() {
+	assert := suite.Assert()
+
+	targets := Targets(60, 1800, Stage(20))
+	targets.Constrain([]interactions.Constraint{
+		{Nutrient: "Potassium", Action: interactions.Limit, LimitMg: 3000},
+		{Nutrient: "Phosphorus", Action: interactions.Limit, LimitMg: 700},
+		{Nutrient: "Grapefruit", Action: interactions.Avoid},
+	})
+	// The CKD stage's potassium limit is lower, but the phosphorus constraint is lower still
+	assert.Equal(2000.0, targets.PotassiumMg)
+	assert.Equal(700.0, targets.PhosphorusMg)
+	assert.Len(targets.Constraints, 3)
+
+	targets = Targets(60, 1800, nil)
+	targets.Constrain([]interactions.Constraint{{Nutrient: "Potassium", Action: interactions.Limit, LimitMg: 3000}})
+	assert.Equal(3000.0, targets.PotassiumMg)
+	assert.Equal(float64(0), targets.PhosphorusMg)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// runReconcile writes a report of the discrepancies between the REDCap studies and the FHIR patients to a file (or
+// standard output) as JSON or CSV
+func runReconcile(args []string) int {
+	s := newSettings("reconcile", "", "Reports discrepancies between the REDCap studies and the FHIR patients: unmatched or ambiguous studies,\n"+
+		"patients without studies, stale risk assessments, and studies with only incomplete records.")
+	s.addFHIR()
+	s.addREDCap()
+	formatFlag := s.loader.String("format", "RECONCILE_FORMAT", "json", "Report format: json or csv")
+	outFlag := s.loader.String("out", "RECONCILE_FILE", "-", "File to write the report to, or - for standard output")
+	s.addModel()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+	if *formatFlag != "json" && *formatFlag != "csv" {
+		fmt.Fprintf(os.Stderr, "Unknown report format: %s\n", *formatFlag)
+		return 2
+	}
+
+	model, err := s.model()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	report, err := client.ReconcileWithREDCap(*s.FHIR, *s.REDCap, *s.Token, model)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't reconcile REDCap studies with FHIR patients:", err.Error())
+		return 1
+	}
+
+	out := os.Stdout
+	if *outFlag != "-" {
+		if out, err = os.Create(*outFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer out.Close()
+	}
+	if *formatFlag == "csv" {
+		err = report.WriteCSV(out)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't write the reconciliation report:", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,223 @@
+package redcap
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// Version is the REDCap version reported by the emulator
+const Version = "6.12.1"
+
+// dateRangeLayout is the format REDCap uses for the dateRangeBegin and dateRangeEnd parameters
+const dateRangeLayout = "2006-01-02 15:04:05"
+
+// RecordSource provides the records served by the emulator
+type RecordSource interface {
+	Records() ([]models.Record, error)
+}
+
+// RecordSourceFunc is an adapter to allow the use of ordinary functions as record sources
+type RecordSourceFunc func() ([]models.Record, error)
+
+// Records calls f()
+func (f RecordSourceFunc) Records() ([]models.Record, error) {
+	return f()
+}
+
+// RegisterEmulatorRoutes registers the handler for an emulated REDCap API on the router (typically a group, such as
+// "/redcap").  The emulator supports the subset of the REDCap API used by the service: exporting records (flat type,
+// filtered by records, fields, dateRangeBegin and dateRangeEnd), metadata and the REDCap version, in JSON or CSV.
+// Requests must use the given token.  Since the records don't carry a modification time, the date range filters are
+// applied to each record's risk factor date.
+func RegisterEmulatorRoutes(r gin.IRoutes, token string, source RecordSource) {
+	r.POST("/", func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			writeError(c, http.StatusBadRequest, "The request could not be parsed")
+			return
+		}
+		form := c.Request.PostForm
+		if form.Get("token") == "" || form.Get("token") != token {
+			writeError(c, http.StatusForbidden, "You do not have permissions to use the API")
+			return
+		}
+		format := form.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("The format %s is not supported by the REDCap emulator", format))
+			return
+		}
+
+		switch form.Get("content") {
+		case "version":
+			c.String(http.StatusOK, Version)
+		case "metadata":
+			exportMetadata(c, form, format)
+		case "record":
+			exportRecords(c, form, format, source)
+		default:
+			writeError(c, http.StatusBadRequest, "The value of the parameter \"content\" is not valid")
+		}
+	})
+}
+
+func exportMetadata(c *gin.Context, form url.Values, format string) {
+	fields := listParam(form, "fields")
+	var metadata []models.MetadataField
+	for _, field := range models.DataDictionary {
+		if len(fields) == 0 || contains(fields, field.FieldName) {
+			metadata = append(metadata, field)
+		}
+	}
+	if metadata == nil {
+		metadata = []models.MetadataField{}
+	}
+	if format == "csv" {
+		rows := [][]string{{"field_name", "form_name", "section_header", "field_type", "field_label", "select_choices_or_calculations", "field_note", "text_validation_type_or_show_slider_number", "required_field"}}
+		for _, f := range metadata {
+			rows = append(rows, []string{f.FieldName, f.FormName, f.SectionHeader, f.FieldType, f.FieldLabel, f.SelectChoices, f.FieldNote, f.TextValidationType, f.RequiredField})
+		}
+		writeCSV(c, rows)
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+func exportRecords(c *gin.Context, form url.Values, format string, source RecordSource) {
+	if t := form.Get("type"); t != "" && t != "flat" {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("The type %s is not supported by the REDCap emulator", t))
+		return
+	}
+	fields := listParam(form, "fields")
+	for _, field := range fields {
+		if !contains(models.RecordFields, field) {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("The following values in the parameter \"fields\" are not valid: '%s'", field))
+			return
+		}
+	}
+	if len(fields) == 0 {
+		fields = models.RecordFields
+	} else {
+		// REDCap exports fields in the order of the data dictionary, regardless of the requested order
+		var ordered []string
+		for _, field := range models.RecordFields {
+			if contains(fields, field) {
+				ordered = append(ordered, field)
+			}
+		}
+		fields = ordered
+	}
+	begin, ok := dateParam(c, form, "dateRangeBegin")
+	if !ok {
+		return
+	}
+	end, ok := dateParam(c, form, "dateRangeEnd")
+	if !ok {
+		return
+	}
+	ids := listParam(form, "records")
+
+	records, err := source.Records()
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	exported := make([]map[string]interface{}, 0, len(records))
+	for i := range records {
+		record := &records[i]
+		if len(ids) > 0 && !contains(ids, record.StudyIDString()) {
+			continue
+		}
+		if !begin.IsZero() || !end.IsZero() {
+			date, err := record.RiskFactorDateTime()
+			if err != nil || (!begin.IsZero() && date.Before(begin)) || (!end.IsZero() && date.After(end)) {
+				continue
+			}
+		}
+		values := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			values[field] = record.FieldValue(field)
+		}
+		exported = append(exported, values)
+	}
+
+	if format == "csv" {
+		rows := [][]string{fields}
+		for _, values := range exported {
+			row := make([]string, len(fields))
+			for i, field := range fields {
+				row[i] = fmt.Sprint(values[field])
+			}
+			rows = append(rows, row)
+		}
+		writeCSV(c, rows)
+		return
+	}
+	c.JSON(http.StatusOK, exported)
+}
+
+// dateParam parses the REDCap date/time parameter in the ClinicalLocation, writing an error response if it is invalid
+func dateParam(c *gin.Context, form url.Values, name string) (time.Time, bool) {
+	value := form.Get(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+	t, err := time.ParseInLocation(dateRangeLayout, value, models.ClinicalLocation)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("The value of the parameter \"%s\" is not a valid date/time (YYYY-MM-DD HH:MM:SS)", name))
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// listParam returns the values for a REDCap list parameter, which may be passed as an array (e.g., records[0]=1) or
+// as a comma-separated string (e.g., records=1,2)
+func listParam(form url.Values, name string) []string {
+	var values []string
+	for key, vals := range form {
+		if key != name && !strings.HasPrefix(key, name+"[") {
+			continue
+		}
+		for _, val := range vals {
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+	return values
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCSV(c *gin.Context, rows [][]string) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.WriteAll(rows)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// writeError writes the error in the same format REDCap uses for JSON responses
+func writeError(c *gin.Context, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	c.Data(status, "application/json; charset=utf-8", body)
+}
@@ -0,0 +1,202 @@
+package redcap
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestEmulatorSuite(t *testing.T) {
+	suite.Run(t, new(EmulatorSuite))
+}
+
+type EmulatorSuite struct {
+	suite.Suite
+	Server *httptest.Server
+}
+
+func (suite *EmulatorSuite) SetupSuite() {
+	gin.SetMode(gin.ReleaseMode)
+}
+
+func (suite *EmulatorSuite) SetupTest() {
+	models.ClinicalLocation = time.UTC
+	e := gin.New()
+	RegisterEmulatorRoutes(e.Group("/redcap"), "123456789", FileRecordSource{Path: "../fixtures/example_records.json"})
+	suite.Server = httptest.NewServer(e)
+}
+
+func (suite *EmulatorSuite) TearDownTest() {
+	suite.Server.Close()
+	models.ClinicalLocation = time.Local
+}
+
+func (suite *EmulatorSuite) post(form url.Values) *http.Response {
+	if form.Get("token") == "" {
+		form.Set("token", "123456789")
+	}
+	res, err := http.PostForm(suite.Server.URL+"/redcap/", form)
+	suite.Require().NoError(err)
+	return res
+}
+
+func (suite *EmulatorSuite) decodeRecords(res *http.Response) []map[string]interface{} {
+	defer res.Body.Close()
+	suite.Require().Equal(http.StatusOK, res.StatusCode)
+	var records []map[string]interface{}
+	suite.Require().NoError(json.NewDecoder(res.Body).Decode(&records))
+	return records
+}
+
+func (suite *EmulatorSuite) decodeError(res *http.Response) string {
+	defer res.Body.Close()
+	var body map[string]string
+	suite.Require().NoError(json.NewDecoder(res.Body).Decode(&body))
+	return body["error"]
+}
+
+func (suite *EmulatorSuite) TestGetREDCapDataFromEmulator() {
+	require := suite.Require()
+
+	m, err := client.GetREDCapData(suite.Server.URL+"/redcap", "123456789")
+	require.NoError(err)
+	require.Len(m, 2)
+	require.Len(m["1"].Records, 2)
+	require.Len(m["a"].Records, 1)
+	suite.Assert().Equal("2016-04-01", m["1"].Records[1].RiskFactorDate)
+}
+
+func (suite *EmulatorSuite) TestInvalidToken() {
+	res := suite.post(url.Values{"token": {"bad"}, "content": {"record"}})
+	suite.Assert().Equal(http.StatusForbidden, res.StatusCode)
+	suite.Assert().Equal("You do not have permissions to use the API", suite.decodeError(res))
+
+	_, err := client.GetREDCapData(suite.Server.URL+"/redcap", "bad")
+	suite.Assert().EqualError(err, "Received HTTP 403 Forbidden from REDCap: You do not have permissions to use the API")
+}
+
+func (suite *EmulatorSuite) TestInvalidContent() {
+	res := suite.post(url.Values{"content": {"project"}})
+	suite.Assert().Equal(http.StatusBadRequest, res.StatusCode)
+	suite.Assert().Equal("The value of the parameter \"content\" is not valid", suite.decodeError(res))
+}
+
+func (suite *EmulatorSuite) TestVersion() {
+	res := suite.post(url.Values{"content": {"version"}})
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(Version, string(body))
+}
+
+func (suite *EmulatorSuite) TestMetadata() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res := suite.post(url.Values{"content": {"metadata"}, "format": {"json"}, "fields[0]": {"rf_date"}})
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	var metadata []models.MetadataField
+	require.NoError(json.NewDecoder(res.Body).Decode(&metadata))
+	require.Len(metadata, 1)
+	assert.Equal("rf_date", metadata[0].FieldName)
+	assert.Equal("date_ymd", metadata[0].TextValidationType)
+}
+
+func (suite *EmulatorSuite) TestGetREDCapMetadataFromEmulator() {
+	require := suite.Require()
+
+	metadata, err := client.GetREDCapMetadata(suite.Server.URL+"/redcap", "123456789")
+	require.NoError(err)
+	suite.Assert().Empty(models.CheckDataDictionary(metadata))
+}
+
+func (suite *EmulatorSuite) TestRecordsFilteredByRecordsAndFields() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	records := suite.decodeRecords(suite.post(url.Values{"content": {"record"}, "records": {"a"}, "fields": {"rf_date, study_id"}}))
+	require.Len(records, 1)
+	assert.Equal(map[string]interface{}{"study_id": "a", "rf_date": "2016-02-21"}, records[0])
+
+	records = suite.decodeRecords(suite.post(url.Values{"content": {"record"}, "records[0]": {"1"}, "records[1]": {"a"}}))
+	assert.Len(records, 3)
+
+	res := suite.post(url.Values{"content": {"record"}, "fields": {"foo"}})
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+	assert.Equal("The following values in the parameter \"fields\" are not valid: 'foo'", suite.decodeError(res))
+}
+
+func (suite *EmulatorSuite) TestRecordsFilteredByDateRange() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	records := suite.decodeRecords(suite.post(url.Values{"content": {"record"}, "dateRangeBegin": {"2016-02-01 00:00:00"}}))
+	require.Len(records, 2)
+	assert.Equal("2016-04-01", records[0]["rf_date"])
+	assert.Equal("2016-02-21", records[1]["rf_date"])
+
+	records = suite.decodeRecords(suite.post(url.Values{"content": {"record"}, "dateRangeBegin": {"2016-02-01 00:00:00"}, "dateRangeEnd": {"2016-03-01 00:00:00"}}))
+	require.Len(records, 1)
+	assert.Equal("a", records[0]["study_id"])
+
+	res := suite.post(url.Values{"content": {"record"}, "dateRangeBegin": {"2016-02-01"}})
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *EmulatorSuite) TestRecordsAsCSV() {
+	require := suite.Require()
+
+	res := suite.post(url.Values{"content": {"record"}, "format": {"csv"}, "fields": {"study_id,rf_date"}})
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	rows, err := csv.NewReader(res.Body).ReadAll()
+	require.NoError(err)
+	suite.Assert().Equal([][]string{{"study_id", "rf_date"}, {"1", "2015-12-07"}, {"1", "2016-04-01"}, {"a", "2016-02-21"}}, rows)
+}
+
+func TestFileRecordSourceCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "records.csv")
+	data := "study_id,redcap_event_name,rf_date,rf_cmc_risk_cat,rf_func_risk_cat,rf_sb_risk_cat,rf_util_risk_cat,rf_risk_predicted,comments\n" +
+		"1,initial_arm_1,2015-12-07,3,2,1,3,3,ignored\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := FileRecordSource{Path: path}.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := models.Record{
+		StudyID:          "1",
+		EventName:        "initial_arm_1",
+		RiskFactorDate:   "2015-12-07",
+		ClinicalRisk:     "3",
+		FunctionalRisk:   "2",
+		PsychosocialRisk: "1",
+		UtilizationRisk:  "3",
+		PerceivedRisk:    "3",
+	}
+	if len(records) != 1 || records[0] != expected {
+		t.Errorf("Unexpected records from CSV: %+v", records)
+	}
+}
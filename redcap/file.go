@@ -0,0 +1,29 @@
+package redcap
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// FileRecordSource is a RecordSource that serves the records in a JSON, CSV or XML file, as exported from REDCap.  The
+// file is read on each request, so it can be edited while the emulator is running.
+type FileRecordSource struct {
+	Path string
+}
+
+// Records reads the records from the file, detecting its format (see ReadRecords)
+func (s FileRecordSource) Records() ([]models.Record, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := ReadRecords(f)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid REDCap records in %s: %s", s.Path, err.Error())
+	}
+	return records, nil
+}
@@ -0,0 +1,147 @@
+package redcap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// eventNameLabel is the header REDCap uses for the redcap_event_name column when exporting labels
+const eventNameLabel = "Event Name"
+
+// byteOrderMark is the Unicode byte order mark, which Excel adds to the start of CSV files
+const byteOrderMark = '\uFEFF'
+
+// ReadRecords reads records from a REDCap export, detecting its format from its first non-whitespace character: a
+// JSON array ('['), XML ('<'), or otherwise CSV.
+func ReadRecords(r io.Reader) ([]models.Record, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// Skip whitespace and the byte order mark that Excel adds when saving CSV files
+		if unicode.IsSpace(c) || c == byteOrderMark {
+			continue
+		}
+		br.UnreadRune()
+		switch c {
+		case '[':
+			return ReadJSONRecords(br)
+		case '<':
+			return ReadXMLRecords(br)
+		default:
+			return ReadCSVRecords(br)
+		}
+	}
+}
+
+// ReadJSONRecords reads records from a REDCap JSON export (an array of flat records)
+func ReadJSONRecords(r io.Reader) ([]models.Record, error) {
+	var records []models.Record
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ReadCSVRecords reads records from a REDCap CSV export, with a header row of either REDCap field names (raw) or field
+// labels (labels).  Choice values may likewise be either raw codes or labels.  Columns that aren't record fields are
+// ignored.
+func ReadCSVRecords(r io.Reader) ([]models.Record, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := make([]string, len(rows[0]))
+	for i, column := range rows[0] {
+		header[i] = fieldName(strings.TrimSpace(strings.TrimPrefix(column, string(byteOrderMark))))
+	}
+	records := make([]models.Record, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		var record models.Record
+		for i, value := range row {
+			if i < len(header) {
+				setFieldValue(&record, header[i], value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ReadXMLRecords reads records from a REDCap XML export of flat records, in which each record is an item element with
+// a child element for each field:
+//
+//	<records><item><study_id><![CDATA[1]]></study_id>...</item></records>
+func ReadXMLRecords(r io.Reader) ([]models.Record, error) {
+	var export struct {
+		Items []struct {
+			Fields []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"item"`
+	}
+	if err := xml.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+	records := make([]models.Record, 0, len(export.Items))
+	for _, item := range export.Items {
+		var record models.Record
+		for _, field := range item.Fields {
+			setFieldValue(&record, field.XMLName.Local, field.Value)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// fieldName returns the REDCap field name for a column header, which may be the field's name or its label
+func fieldName(header string) string {
+	if strings.EqualFold(header, eventNameLabel) {
+		return "redcap_event_name"
+	}
+	for _, field := range models.DataDictionary {
+		if strings.EqualFold(header, field.FieldLabel) {
+			return field.FieldName
+		}
+	}
+	return header
+}
+
+// setFieldValue sets the record's field to the value, converting choice labels (e.g., "High") to their codes
+func setFieldValue(record *models.Record, name, value string) {
+	value = strings.TrimSpace(value)
+	for _, field := range models.DataDictionary {
+		if field.FieldName == name && field.SelectChoices != "" {
+			if code, ok := choiceCode(field.SelectChoices, value); ok {
+				value = code
+			}
+		}
+	}
+	record.SetFieldValue(name, value)
+}
+
+// choiceCode returns the code of the choice with the given label, given REDCap choices in "code, label | ..." format
+func choiceCode(choices, label string) (string, bool) {
+	for _, choice := range strings.Split(choices, "|") {
+		parts := strings.SplitN(choice, ",", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[1]), label) {
+			return strings.TrimSpace(parts[0]), true
+		}
+	}
+	return "", false
+}
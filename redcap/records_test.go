@@ -0,0 +1,109 @@
+package redcap
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestRecordsSuite(t *testing.T) {
+	suite.Run(t, new(RecordsSuite))
+}
+
+type RecordsSuite struct {
+	suite.Suite
+}
+
+// expectedRecord is the first record in fixtures/example_records.json, as read from any of the export formats
+var expectedRecord = models.Record{
+	StudyID:          "1",
+	EventName:        "initial_arm_1",
+	RiskFactorDate:   "2015-12-07",
+	ClinicalRisk:     "3",
+	FunctionalRisk:   "2",
+	PsychosocialRisk: "1",
+	UtilizationRisk:  "3",
+	PerceivedRisk:    "3",
+}
+
+func (suite *RecordsSuite) TestReadJSONRecords() {
+	require := suite.Require()
+
+	f, err := os.Open("../fixtures/example_records.json")
+	require.NoError(err)
+	defer f.Close()
+	records, err := ReadRecords(f)
+	require.NoError(err)
+	require.Len(records, 3)
+	// JSON study IDs are numbers, so compare the string representation
+	suite.Assert().Equal("1", records[0].StudyIDString())
+	suite.Assert().Equal(expectedRecord.PerceivedRisk, records[0].PerceivedRisk)
+}
+
+func (suite *RecordsSuite) TestReadRawCSVRecords() {
+	require := suite.Require()
+
+	data := "\uFEFFstudy_id,redcap_event_name,rf_date,rf_cmc_risk_cat,rf_func_risk_cat,rf_sb_risk_cat,rf_util_risk_cat,rf_risk_predicted\n" +
+		"1,initial_arm_1,2015-12-07,3,2,1,3,3\n"
+	records, err := ReadRecords(strings.NewReader(data))
+	require.NoError(err)
+	require.Len(records, 1)
+	suite.Assert().Equal(expectedRecord, records[0])
+}
+
+func (suite *RecordsSuite) TestReadLabelCSVRecords() {
+	require := suite.Require()
+
+	data := "Study ID,Event Name,Risk factor assessment date,Clinical risk category,Functional and environmental risk category," +
+		"Psychosocial and mental health risk category,Utilization risk category,Perceived overall risk,Comments\n" +
+		"1,initial_arm_1,2015-12-07,High,Moderate,Low,High,high,\"Not a field, so ignored\"\n"
+	records, err := ReadRecords(strings.NewReader(data))
+	require.NoError(err)
+	require.Len(records, 1)
+	suite.Assert().Equal(expectedRecord, records[0])
+}
+
+func (suite *RecordsSuite) TestReadXMLRecords() {
+	require := suite.Require()
+
+	data := `<?xml version="1.0" encoding="UTF-8" ?>
+<records>
+	<item>
+		<study_id><![CDATA[1]]></study_id>
+		<redcap_event_name><![CDATA[initial_arm_1]]></redcap_event_name>
+		<rf_date><![CDATA[2015-12-07]]></rf_date>
+		<rf_cmc_risk_cat><![CDATA[3]]></rf_cmc_risk_cat>
+		<rf_func_risk_cat><![CDATA[2]]></rf_func_risk_cat>
+		<rf_sb_risk_cat><![CDATA[1]]></rf_sb_risk_cat>
+		<rf_util_risk_cat><![CDATA[3]]></rf_util_risk_cat>
+		<rf_risk_predicted><![CDATA[3]]></rf_risk_predicted>
+		<comments><![CDATA[ignored]]></comments>
+	</item>
+	<item>
+		<study_id>a</study_id>
+	</item>
+</records>`
+	records, err := ReadRecords(strings.NewReader(data))
+	require.NoError(err)
+	require.Len(records, 2)
+	suite.Assert().Equal(expectedRecord, records[0])
+	suite.Assert().Equal("a", records[1].StudyIDString())
+}
+
+func (suite *RecordsSuite) TestReadInvalidRecords() {
+	assert := suite.Assert()
+
+	_, err := ReadRecords(strings.NewReader("[{"))
+	assert.Error(err)
+	_, err = ReadRecords(strings.NewReader("<records><item>"))
+	assert.Error(err)
+
+	records, err := ReadRecords(strings.NewReader("  \n"))
+	assert.NoError(err)
+	assert.Empty(records)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+)
+
+// runRefresh refreshes the risk assessments from REDCap once, exiting with a non-zero status if the refresh fails or
+// any patient's risk assessments couldn't be refreshed
+func runRefresh(args []string) int {
+	s := newSettings("refresh", "", "Refreshes the risk assessments from REDCap once, exiting with a non-zero status if any fail.")
+	s.addHTTP()
+	s.addStore("pies.json")
+	s.addFHIR()
+	s.addREDCap()
+	s.addModel()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	model, err := s.model()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	pieStore, err := s.openStore("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer pieStore.Close()
+
+	results, err := client.RefreshRiskAssessments(*s.FHIR, *s.REDCap, *s.Token, pieStore, s.basisPieURL(), model)
+	if err != nil {
+		log.Println("Failed to refresh risk assessments", err)
+		return 1
+	}
+	return resultsExitStatus(results)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron"
+
+	"github.com/intervention-engine/multifactorriskservice/cgm"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/multifactorriskservice/server"
+)
+
+// runServe serves the risk pies and refreshes the risk assessments from REDCap on a schedule.  On SIGHUP, the
+// configuration is reloaded, applying changes to the refresh and calculation schedules and log level.
+func runServe(args []string) int {
+	s := newServeSettings("Serves risk pies and refreshes risk assessments from REDCap on a schedule.  Send SIGHUP to reload the refresh and calculation schedules and log level from the environment and configuration file.")
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	model, err := s.model()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	registry, err := s.registry(model)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	kb, err := s.knowledgeBase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	pieStore, err := s.openStore("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer pieStore.Close()
+
+	deviceRegistry, err := s.openRegistry("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if deviceRegistry != nil {
+		defer deviceRegistry.Store.Close()
+	}
+
+	sampleStore, err := s.openSampleStore("riskservice")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	var receiver *cgm.Receiver
+	var summarizer *cgm.Summarizer
+	if sampleStore != nil {
+		defer sampleStore.Close()
+		receiver = cgm.NewReceiver(sampleStore)
+		if deviceRegistry != nil {
+			receiver.Resolver = deviceRegistry
+		}
+		trace, _ := strconv.ParseBool(*s.CGMTrace)
+		summarizer = cgm.NewSummarizer(sampleStore, *s.FHIR, trace)
+	}
+
+	basisPieURL := s.basisPieURL()
+
+	// Setup the cron jobs and start the scheduler
+	schedule := func() (*cron.Cron, error) {
+		c := cron.New()
+		// The hosted REDCap plugin already recalculates the REDCap risk assessments with the other plugins, so
+		// refreshing them on a separate schedule would only post and store them twice
+		if !registry.Has("redcap") {
+			err := server.ScheduleRefreshRiskAssessmentsCron(c, *s.Cron, *s.FHIR, *s.REDCap, *s.Token, pieStore, basisPieURL, model)
+			if err != nil {
+				return nil, errors.New("Can't setup cron job for refreshing risk assessments.  Specified spec: " + *s.Cron)
+			}
+		}
+		if len(registry.Plugins()) > 0 {
+			err := server.ScheduleCalculateRiskAssessmentsCron(c, *s.Calculate, *s.FHIR, registry, pieStore, basisPieURL)
+			if err != nil {
+				return nil, errors.New("Can't setup cron job for calculating risk assessments.  Specified spec: " + *s.Calculate)
+			}
+		}
+		if retentionDays := s.retentionDays(); retentionDays > 0 {
+			if err := server.SchedulePruneSupersededPiesCron(c, "@daily", pieStore, retentionDays); err != nil {
+				return nil, errors.New("Can't setup cron job for pruning superseded pies.")
+			}
+		}
+		if summarizer != nil {
+			if err := server.ScheduleSummarizeCGMCron(c, *s.CGMCron, summarizer, s.cgmRetentionDays()); err != nil {
+				return nil, errors.New("Can't setup cron job for summarizing CGM samples.  Specified spec: " + *s.CGMCron)
+			}
+		}
+		return c, nil
+	}
+	c, err := schedule()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	var cronLock sync.Mutex
+	c.Start()
+	defer func() {
+		cronLock.Lock()
+		defer cronLock.Unlock()
+		c.Stop()
+	}()
+
+	// Reload the configuration on SIGHUP, replacing the cron jobs if the refresh schedule changed
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if !s.reload() {
+				continue
+			}
+			rescheduled, err := schedule()
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			cronLock.Lock()
+			c.Stop()
+			c = rescheduled
+			c.Start()
+			cronLock.Unlock()
+			log.Printf("Rescheduled the refresh of risk assessments (%s), calculation by the hosted plugins (%s), and CGM summaries (%s).", *s.Cron, *s.Calculate, *s.CGMCron)
+		}
+	}()
+
+	// Create the gin engine, register the routes, and run!
+	e := gin.New()
+	e.Use(server.Logger(), gin.Recovery())
+	server.RegisterRoutes(e, *s.FHIR, *s.REDCap, *s.Token, pieStore, basisPieURL, model)
+	server.RegisterCalculateHandler(e, *s.FHIR, registry, pieStore, basisPieURL)
+	server.RegisterInteractionsHandler(e, interactions.NewChecker(kb, *s.FHIR))
+	server.RegisterReadingsHandler(e, s.ingester(deviceRegistry))
+	if deviceRegistry != nil {
+		server.RegisterDeviceRegistryHandlers(e, deviceRegistry)
+	}
+	if receiver != nil {
+		server.RegisterCGMHandlers(e, receiver, summarizer)
+	}
+	if err := e.Run(*s.HTTP); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// newServeSettings creates the settings of the serve command, which are also checked by the config validate command
+func newServeSettings(description string) *settings {
+	s := newSettings("serve", "", description)
+	s.addHTTP()
+	s.addStore("pies.json")
+	s.addFHIR()
+	s.addREDCap()
+	s.addSchedule()
+	s.addModel()
+	s.addPlugins()
+	s.addRegistry()
+	s.addCGM()
+	s.addLogging()
+	return s
+}
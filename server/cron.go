@@ -2,20 +2,94 @@ package server
 
 import (
 	"log"
+	"time"
 
+	"github.com/intervention-engine/multifactorriskservice/cgm"
 	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/config"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
 	"github.com/robfig/cron"
-	"gopkg.in/mgo.v2"
 )
 
 // ScheduleRefreshRiskAssessmentsCron schedules a cron job for refreshing the risk assessments
-func ScheduleRefreshRiskAssessmentsCron(c *cron.Cron, spec string, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) error {
+func ScheduleRefreshRiskAssessmentsCron(c *cron.Cron, spec string, fhirEndpoint, redcapEndpoint, redcapToken string, pieStore store.PieStore, basisPieURL string, model client.ModelConfig) error {
 	return c.AddFunc(spec, func() {
-		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
+		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieStore, basisPieURL, model)
 		if err != nil {
 			log.Println("Error refreshing risk assessments", err)
-		} else {
+			return
+		}
+		for _, result := range results {
+			if result.Error != nil {
+				log.Printf("Error refreshing risk assessments for study %s: %s", result.StudyID, result.Error.Error())
+			} else if config.Logging(config.LogDebug) {
+				log.Printf("Refreshed %d risk assessments for study %s (patient %s).", result.RiskAssessmentCount, result.StudyID, result.FHIRPatientID)
+			}
+		}
+		if config.Logging(config.LogInfo) {
 			client.LogResultSummary(results)
 		}
 	})
 }
+
+// ScheduleCalculateRiskAssessmentsCron schedules a cron job for calculating the risk assessments of every patient
+// with the hosted plugins
+func ScheduleCalculateRiskAssessmentsCron(c *cron.Cron, spec string, fhirEndpoint string, registry *client.PluginRegistry, pieStore store.PieStore, basisPieURL string) error {
+	return c.AddFunc(spec, func() {
+		results, err := registry.CalculateAllRiskAssessments(fhirEndpoint, pieStore, basisPieURL)
+		if err != nil {
+			log.Println("Error calculating risk assessments", err)
+			return
+		}
+		for _, result := range results {
+			if result.Error != nil {
+				log.Println(result.Error.Error())
+			}
+		}
+		if config.Logging(config.LogInfo) {
+			client.LogPluginResultSummary(results)
+		}
+	})
+}
+
+// SchedulePruneSupersededPiesCron schedules a cron job for removing pies that were superseded more than the given
+// number of days ago
+func SchedulePruneSupersededPiesCron(c *cron.Cron, spec string, pieStore store.PieStore, retentionDays int) error {
+	return c.AddFunc(spec, func() {
+		removed, err := pieStore.Prune(time.Now().AddDate(0, 0, -retentionDays))
+		if err != nil {
+			log.Println("Error pruning superseded pies", err)
+		} else {
+			log.Printf("Pruned %d pies superseded more than %d days ago.", removed, retentionDays)
+		}
+	})
+}
+
+// ScheduleSummarizeCGMCron schedules a cron job for summarizing the previous day's CGM samples, and removing the
+// samples from more than the given number of days ago (unless it's 0)
+func ScheduleSummarizeCGMCron(c *cron.Cron, spec string, summarizer *cgm.Summarizer, retentionDays int) error {
+	return c.AddFunc(spec, func() {
+		results, err := summarizer.SummarizeDay(time.Now().In(models.ClinicalLocation).AddDate(0, 0, -1))
+		if err != nil {
+			log.Println("Error summarizing CGM samples", err)
+		} else {
+			for _, result := range results {
+				if result.Error != nil {
+					log.Println(result.Error.Error())
+				}
+			}
+			if config.Logging(config.LogInfo) {
+				cgm.LogSummaryResultSummary(results)
+			}
+		}
+		if retentionDays > 0 {
+			start, _ := cgm.Day(time.Now().AddDate(0, 0, -retentionDays))
+			if removed, err := summarizer.Store.Prune(start); err != nil {
+				log.Println("Error pruning CGM samples", err)
+			} else {
+				log.Printf("Pruned %d CGM samples from more than %d days ago.", removed, retentionDays)
+			}
+		}
+	})
+}
@@ -10,7 +10,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/intervention-engine/multifactorriskservice/client"
 	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -106,7 +108,7 @@ func (suite *CronSuite) TestCron() {
 
 	// Schedule the cron
 	c := cron.New()
-	err := ScheduleRefreshRiskAssessmentsCron(c, "@every 1s", suite.FHIRServer.URL, suite.REDCapServer.URL, "12345", suite.Database.C("pies"), "http://example.org/pies/")
+	err := ScheduleRefreshRiskAssessmentsCron(c, "@every 1s", suite.FHIRServer.URL, suite.REDCapServer.URL, "12345", store.NewMongoPieStore(suite.Database.C("pies")), "http://example.org/pies/", client.NewREDCapModelConfig(nil))
 	c.Start()
 	defer c.Stop()
 
@@ -1,32 +1,58 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/multifactorriskservice/cgm"
 	"github.com/intervention-engine/multifactorriskservice/client"
-	"github.com/intervention-engine/riskservice/plugin"
-	"gopkg.in/mgo.v2"
+	"github.com/intervention-engine/multifactorriskservice/config"
+	"github.com/intervention-engine/multifactorriskservice/devices"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/redcap"
+	"github.com/intervention-engine/multifactorriskservice/store"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // RegisterRoutes sets up the http request handlers with Gin
-func RegisterRoutes(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) {
-	RegisterPieHandler(e, pieCollection)
-	RegisterRefreshHandler(e, fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
+func RegisterRoutes(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieStore store.PieStore, basisPieURL string, model client.ModelConfig) {
+	RegisterPieHandler(e, pieStore)
+	RegisterPatientPiesHandler(e, fhirEndpoint, pieStore, model)
+	RegisterTrajectoryHandler(e, fhirEndpoint, pieStore, model)
+	RegisterRefreshHandler(e, fhirEndpoint, redcapEndpoint, redcapToken, pieStore, basisPieURL, model)
+	RegisterImportHandler(e, fhirEndpoint, pieStore, basisPieURL, model)
+	RegisterReconciliationHandler(e, fhirEndpoint, redcapEndpoint, redcapToken, model)
 }
 
-// RegisterPieHandler registers the handler to return pies from the database
-func RegisterPieHandler(e *gin.Engine, pieCollection *mgo.Collection) {
+// Logger returns middleware that logs each request, unless the log level is above info.  The log level is checked on
+// every request, so it may be changed while the service is running.
+func Logger() gin.HandlerFunc {
+	logger := gin.Logger()
+	return func(c *gin.Context) {
+		if config.Logging(config.LogInfo) {
+			logger(c)
+		} else {
+			c.Next()
+		}
+	}
+}
+
+// RegisterPieHandler registers the handler to return pies from the pie store
+func RegisterPieHandler(e *gin.Engine, pieStore store.PieStore) {
 	e.GET("/pies/:id", func(c *gin.Context) {
-		pie := &plugin.Pie{}
 		id := c.Param("id")
 		if bson.IsObjectIdHex(id) {
-			query := pieCollection.FindId(bson.ObjectIdHex(id))
-			if err := query.One(pie); err == nil {
-				c.JSON(http.StatusOK, pie)
-			} else {
+			if pie, err := pieStore.Get(bson.ObjectIdHex(id)); err == nil {
+				pie.Created = pie.Created.In(models.ClinicalLocation)
+				c.JSON(http.StatusOK, &pie.Pie)
+			} else if err == store.ErrNotFound {
 				c.Status(http.StatusNotFound)
+			} else {
+				c.AbortWithError(http.StatusInternalServerError, err)
 			}
 		} else {
 			c.String(http.StatusBadRequest, "Bad ID format for requested Pie. Should be a BSON Id")
@@ -35,10 +61,54 @@ func RegisterPieHandler(e *gin.Engine, pieCollection *mgo.Collection) {
 	})
 }
 
+// RegisterPatientPiesHandler registers the handler to return a patient's current pies for the model.  If the history
+// query parameter is true, superseded versions of the pies are also returned.
+func RegisterPatientPiesHandler(e *gin.Engine, fhirEndpoint string, pieStore store.PieStore, model client.ModelConfig) {
+	e.GET("/patients/:id/pies", func(c *gin.Context) {
+		patientURL := fhirEndpoint + "/Patient/" + c.Param("id")
+		var pies []models.StoredPie
+		var err error
+		if c.Query("history") == "true" {
+			pies, err = pieStore.History(patientURL, model.Method.Coding[0])
+		} else {
+			pies, err = pieStore.Find(patientURL, model.Method.Coding[0])
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if pies == nil {
+			pies = []models.StoredPie{}
+		}
+		for i := range pies {
+			pies[i].Created = pies[i].Created.In(models.ClinicalLocation)
+		}
+		c.JSON(http.StatusOK, pies)
+	})
+}
+
+// RegisterTrajectoryHandler registers the handler to return the risk trajectory for a patient, computed from the
+// patient's stored pies
+func RegisterTrajectoryHandler(e *gin.Engine, fhirEndpoint string, pieStore store.PieStore, model client.ModelConfig) {
+	e.GET("/patients/:id/trajectory", func(c *gin.Context) {
+		results, err := client.GetRiskServiceCalculationResults(fhirEndpoint, c.Param("id"), pieStore, model)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		trajectory := models.ComputeTrajectory(results, model.Trajectory)
+		if trajectory == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, trajectory)
+	})
+}
+
 // RegisterRefreshHandler registers the handler to refresh risk assessments from REDCap
-func RegisterRefreshHandler(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieCollection *mgo.Collection, basisPieURL string) {
+func RegisterRefreshHandler(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, pieStore store.PieStore, basisPieURL string, model client.ModelConfig) {
 	e.POST("/refresh", func(c *gin.Context) {
-		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieCollection, basisPieURL)
+		results, err := client.RefreshRiskAssessments(fhirEndpoint, redcapEndpoint, redcapToken, pieStore, basisPieURL, model)
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
@@ -47,3 +117,299 @@ func RegisterRefreshHandler(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapT
 		c.JSON(http.StatusOK, results)
 	})
 }
+
+// RegisterCalculateHandler registers the handler to calculate a patient's risk assessments with the hosted plugins
+func RegisterCalculateHandler(e *gin.Engine, fhirEndpoint string, registry *client.PluginRegistry, pieStore store.PieStore, basisPieURL string) {
+	e.POST("/calculate/:patientID", func(c *gin.Context) {
+		results, err := registry.CalculateRiskAssessments(fhirEndpoint, c.Param("patientID"), pieStore, basisPieURL)
+		if err == client.ErrPatientNotFound {
+			c.String(http.StatusNotFound, "Patient %s not found", c.Param("patientID"))
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	})
+}
+
+// RegisterInteractionsHandler registers the route for checking a patient's current medications for drug-nutrient
+// interactions, writing them to the FHIR server as DetectedIssues
+func RegisterInteractionsHandler(e *gin.Engine, checker *interactions.Checker) {
+	e.POST("/interactions/:patientID", func(c *gin.Context) {
+		report, err := checker.Check(c.Param("patientID"))
+		if err == interactions.ErrPatientNotFound {
+			c.String(http.StatusNotFound, "Patient %s not found", c.Param("patientID"))
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
+
+// RegisterReadingsHandler registers the handler to ingest device readings, which are posted as a JSON array of
+// readings (or a single reading).  The response has the result of ingesting each reading.
+func RegisterReadingsHandler(e *gin.Engine, ingester *devices.Ingester) {
+	e.POST("/devices/readings", func(c *gin.Context) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(c.Request.Body).Decode(&raw); err != nil {
+			c.String(http.StatusBadRequest, "Readings must be posted as JSON: %s", err.Error())
+			return
+		}
+		var readings []devices.Reading
+		var err error
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(raw, &readings)
+		} else {
+			readings = make([]devices.Reading, 1)
+			err = json.Unmarshal(raw, &readings[0])
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, "Readings must be posted as JSON: %s", err.Error())
+			return
+		}
+		results := ingester.Ingest(readings)
+		devices.LogReadingResultSummary(results)
+		c.JSON(http.StatusOK, results)
+	})
+}
+
+// RegisterDeviceRegistryHandlers registers the handlers to register devices, assign them to (and unassign them from)
+// patients, and resolve the patient a device was assigned to at a time.  Assignments start (or end) now unless the
+// request gives the time.
+func RegisterDeviceRegistryHandlers(e *gin.Engine, registry *devices.Registry) {
+	e.GET("/registry/devices", func(c *gin.Context) {
+		registered, err := registry.Store.ListDevices()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if registered == nil {
+			registered = []devices.RegisteredDevice{}
+		}
+		c.JSON(http.StatusOK, registered)
+	})
+
+	e.PUT("/registry/devices/:id", func(c *gin.Context) {
+		var device devices.RegisteredDevice
+		if err := json.NewDecoder(c.Request.Body).Decode(&device); err != nil {
+			c.String(http.StatusBadRequest, "Device must be put as JSON: %s", err.Error())
+			return
+		}
+		device.ID = c.Param("id")
+		registered, err := registry.Register(device)
+		if err != nil {
+			registryError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, registered)
+	})
+
+	e.GET("/registry/devices/:id", func(c *gin.Context) {
+		device, bindings, err := registry.Device(c.Param("id"))
+		if err != nil {
+			registryError(c, err)
+			return
+		}
+		if bindings == nil {
+			bindings = []devices.Binding{}
+		}
+		c.JSON(http.StatusOK, gin.H{"device": device, "bindings": bindings})
+	})
+
+	e.POST("/registry/devices/:id/assign", func(c *gin.Context) {
+		var assignment struct {
+			PatientID string    `json:"patientId"`
+			Start     time.Time `json:"start"`
+		}
+		if err := json.NewDecoder(c.Request.Body).Decode(&assignment); err != nil {
+			c.String(http.StatusBadRequest, "Assignment must be posted as JSON: %s", err.Error())
+			return
+		}
+		if assignment.Start.IsZero() {
+			assignment.Start = time.Now()
+		}
+		binding, err := registry.Assign(c.Param("id"), assignment.PatientID, assignment.Start)
+		if err != nil {
+			registryError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, binding)
+	})
+
+	e.POST("/registry/devices/:id/unassign", func(c *gin.Context) {
+		var unassignment struct {
+			End time.Time `json:"end"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := json.NewDecoder(c.Request.Body).Decode(&unassignment); err != nil {
+				c.String(http.StatusBadRequest, "Unassignment must be posted as JSON: %s", err.Error())
+				return
+			}
+		}
+		if unassignment.End.IsZero() {
+			unassignment.End = time.Now()
+		}
+		binding, err := registry.Unassign(c.Param("id"), unassignment.End)
+		if err != nil {
+			registryError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, binding)
+	})
+
+	e.GET("/registry/devices/:id/patient", func(c *gin.Context) {
+		at := time.Now()
+		if param := c.Query("at"); param != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339Nano, param); err != nil {
+				c.String(http.StatusBadRequest, "Invalid time: %s", param)
+				return
+			}
+		}
+		patientID, err := registry.Resolve(c.Param("id"), at)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		} else if patientID == "" {
+			c.String(http.StatusNotFound, "Device %s wasn't assigned to a patient at %s", c.Param("id"), at.UTC().Format(time.RFC3339))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deviceId": c.Param("id"), "patientId": patientID, "at": at})
+	})
+}
+
+// registryError responds with the status for the device registry error: 404 if the device isn't registered, 400 if
+// the request is invalid, or 500 otherwise
+func registryError(c *gin.Context, err error) {
+	if err == devices.ErrDeviceNotFound {
+		c.String(http.StatusNotFound, "Device %s isn't registered", c.Param("id"))
+	} else if _, ok := err.(*devices.AssignmentError); ok {
+		c.String(http.StatusBadRequest, "%s", err.Error())
+	} else {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// RegisterCGMHandlers registers the handlers to receive CGM samples, which are posted as a JSON array of samples (or a
+// single sample), and to summarize a day's samples on demand.  The day is given by the date parameter (YYYY-MM-DD),
+// and is yesterday by default.
+func RegisterCGMHandlers(e *gin.Engine, receiver *cgm.Receiver, summarizer *cgm.Summarizer) {
+	e.POST("/cgm/samples", func(c *gin.Context) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(c.Request.Body).Decode(&raw); err != nil {
+			c.String(http.StatusBadRequest, "Samples must be posted as JSON: %s", err.Error())
+			return
+		}
+		var samples []cgm.Sample
+		var err error
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(raw, &samples)
+		} else {
+			samples = make([]cgm.Sample, 1)
+			err = json.Unmarshal(raw, &samples[0])
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, "Samples must be posted as JSON: %s", err.Error())
+			return
+		}
+		result, err := receiver.Receive(samples)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	e.POST("/cgm/summarize", func(c *gin.Context) {
+		day := time.Now().In(models.ClinicalLocation).AddDate(0, 0, -1)
+		if date := c.Query("date"); date != "" {
+			var err error
+			if day, err = time.ParseInLocation("2006-01-02", date, models.ClinicalLocation); err != nil {
+				c.String(http.StatusBadRequest, "Invalid date: %s", date)
+				return
+			}
+		}
+		results, err := summarizer.SummarizeDay(day)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if results == nil {
+			results = []cgm.SummaryResult{}
+		}
+		cgm.LogSummaryResultSummary(results)
+		c.JSON(http.StatusOK, results)
+	})
+}
+
+// maxImportMemory is the maximum number of bytes of an uploaded import that are held in memory (the rest are stored
+// in temporary files)
+const maxImportMemory = 32 << 20
+
+// RegisterImportHandler registers the handler to import risk assessments from REDCap export files (JSON, CSV or XML)
+// uploaded as multipart form data in one or more "file" fields
+func RegisterImportHandler(e *gin.Engine, fhirEndpoint string, pieStore store.PieStore, basisPieURL string, model client.ModelConfig) {
+	e.POST("/import", func(c *gin.Context) {
+		if err := c.Request.ParseMultipartForm(maxImportMemory); err != nil {
+			c.String(http.StatusBadRequest, "Import must be uploaded as multipart form data: %s", err.Error())
+			return
+		}
+		defer c.Request.MultipartForm.RemoveAll()
+		files := c.Request.MultipartForm.File["file"]
+		if len(files) == 0 {
+			c.String(http.StatusBadRequest, "No REDCap export files were uploaded in the \"file\" field")
+			return
+		}
+
+		var records []models.Record
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			fileRecords, err := redcap.ReadRecords(f)
+			f.Close()
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid REDCap records in %s: %s", fh.Filename, err.Error())
+				return
+			}
+			records = append(records, fileRecords...)
+		}
+
+		results, err := client.ImportRiskAssessments(fhirEndpoint, records, pieStore, basisPieURL, model)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid REDCap records: %s", err.Error())
+			return
+		}
+		client.LogResultSummary(results)
+		c.JSON(http.StatusOK, results)
+	})
+}
+
+// RegisterReconciliationHandler registers the handler to report the discrepancies between the REDCap studies and the
+// FHIR patients.  The report is returned as JSON, or as CSV if the format query parameter is csv.
+func RegisterReconciliationHandler(e *gin.Engine, fhirEndpoint, redcapEndpoint, redcapToken string, model client.ModelConfig) {
+	e.GET("/reconciliation", func(c *gin.Context) {
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "csv" {
+			c.String(http.StatusBadRequest, "Unknown reconciliation report format: %s", format)
+			return
+		}
+		report, err := client.ReconcileWithREDCap(fhirEndpoint, redcapEndpoint, redcapToken, model)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if format == "csv" {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Status(http.StatusOK)
+			report.WriteCSV(c.Writer)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/intervention-engine/multifactorriskservice/client"
 	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/store"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -75,7 +78,7 @@ func (suite *RoutesSuite) SetupTest() {
 
 	e := gin.New()
 	suite.Server = httptest.NewServer(e)
-	RegisterRoutes(e, suite.FHIRServer.URL, suite.REDCapServer.URL, "123abc", suite.Database.C("pies"), suite.Server.URL+"/pies/")
+	RegisterRoutes(e, suite.FHIRServer.URL, suite.REDCapServer.URL, "123abc", store.NewMongoPieStore(suite.Database.C("pies")), suite.Server.URL+"/pies/", client.NewREDCapModelConfig(nil))
 }
 
 func (suite *RoutesSuite) TearDownTest() {
@@ -145,6 +148,95 @@ func (suite *RoutesSuite) TestRefresh() {
 	assert.Equal(count, 3)
 }
 
+func (suite *RoutesSuite) TestImport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// Upload the REDCap export
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", "example_records.json")
+	require.NoError(err)
+	records, err := ioutil.ReadFile("../fixtures/example_records.json")
+	require.NoError(err)
+	part.Write(records)
+	require.NoError(w.Close())
+	res, err = http.Post(suite.Server.URL+"/import", w.FormDataContentType(), &body)
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var results []client.Result
+	require.NoError(json.NewDecoder(res.Body).Decode(&results))
+
+	// Check the results
+	assert.Len(results, 2)
+	assert.Contains(results, client.Result{
+		StudyID:             "1",
+		FHIRPatientID:       "56fd63cdac1c5d77f6f695a1",
+		RiskAssessmentCount: 2,
+	})
+	assert.Contains(results, client.Result{
+		StudyID:             "a",
+		FHIRPatientID:       "56fd63cdac1c5d77f6f695a2",
+		RiskAssessmentCount: 1,
+	})
+	count, err := suite.Database.C("pies").Count()
+	require.NoError(err)
+	assert.Equal(3, count)
+
+	// An upload without a file is rejected
+	body.Reset()
+	w = multipart.NewWriter(&body)
+	require.NoError(w.Close())
+	res, err = http.Post(suite.Server.URL+"/import", w.FormDataContentType(), &body)
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestReconciliation() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// Before a refresh, the matched patients' risk assessments are stale
+	res, err = http.Get(suite.Server.URL + "/reconciliation")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var report client.Report
+	require.NoError(json.NewDecoder(res.Body).Decode(&report))
+	assert.Equal(map[client.IssueType]int{client.PatientWithoutStudy: 1, client.StaleRiskAssessments: 2}, report.Counts)
+
+	// After a refresh, only the patient without a study is reported
+	res, err = http.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	res, err = http.Get(suite.Server.URL + "/reconciliation?format=csv")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	assert.Equal("type,studyID,fhirPatientIDs,redcapDate,riskAssessmentDate,detail\n"+
+		"patient-without-study,,56fd63cdac1c5d77f6f695a3,,,None of patient 56fd63cdac1c5d77f6f695a3's identifiers match a Study ID\n", string(body))
+}
+
 func (suite *RoutesSuite) TestGetPie() {
 	require := suite.Require()
 	assert := suite.Assert()
@@ -194,3 +286,99 @@ func (suite *RoutesSuite) TestGetInvalidPie() {
 	defer res.Body.Close()
 	assert.Equal(http.StatusNotFound, res.StatusCode)
 }
+
+func (suite *RoutesSuite) TestGetTrajectory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// Trigger the refresh to populate the pies
+	res, err = http.DefaultClient.Post(suite.Server.URL+"/refresh", "application/json", nil)
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	// Get the trajectory
+	res, err = http.DefaultClient.Get(suite.Server.URL + "/patients/56fd63cdac1c5d77f6f695a1/trajectory")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var trajectory models.Trajectory
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(&trajectory)
+	require.NoError(err)
+
+	assert.Equal(2, trajectory.Assessments)
+	assert.Equal(float64(4), trajectory.Overall.Current)
+	require.NotNil(trajectory.Overall.ChangeSincePrevious)
+	assert.Equal(float64(1), *trajectory.Overall.ChangeSincePrevious)
+	// The patient was already at high risk, so the rise from 3 to 4 isn't an escalation
+	assert.Equal(0, trajectory.Overall.Escalations)
+	require.Len(trajectory.Slices, 4)
+	assert.Equal("Utilization Risk", trajectory.Slices[3].Name)
+	assert.Equal(float64(4), trajectory.Slices[3].Current)
+}
+
+func (suite *RoutesSuite) TestGetTrajectoryForUnknownPatient() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	res, err := http.DefaultClient.Get(suite.Server.URL + "/patients/56fd63cdac1c5d77f6f695ff/trajectory")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (suite *RoutesSuite) TestGetPatientPiesWithHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Add the patients to the database
+	data, err := os.Open("../fixtures/patients_bundle.json")
+	require.NoError(err)
+	defer data.Close()
+	res, err := http.Post(suite.FHIRServer.URL+"/", "application/json", data)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// Trigger the refresh twice so the first set of pies is superseded
+	for i := 0; i < 2; i++ {
+		res, err = http.DefaultClient.Post(suite.Server.URL+"/refresh", "application/json", nil)
+		require.NoError(err)
+		defer res.Body.Close()
+		require.Equal(http.StatusOK, res.StatusCode)
+	}
+
+	// Get the current pies
+	res, err = http.DefaultClient.Get(suite.Server.URL + "/patients/56fd63cdac1c5d77f6f695a1/pies")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var pies []models.StoredPie
+	require.NoError(json.NewDecoder(res.Body).Decode(&pies))
+	require.Len(pies, 2)
+	for _, pie := range pies {
+		assert.Equal(2, pie.Version)
+		assert.False(pie.Superseded)
+	}
+
+	// Get the pies with their history
+	res, err = http.DefaultClient.Get(suite.Server.URL + "/patients/56fd63cdac1c5d77f6f695a1/pies?history=true")
+	require.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	pies = nil
+	require.NoError(json.NewDecoder(res.Body).Decode(&pies))
+	require.Len(pies, 4)
+	assert.Equal(1, pies[0].Version)
+	assert.True(pies[0].Superseded)
+	assert.Equal(2, pies[3].Version)
+	assert.False(pies[3].Superseded)
+}
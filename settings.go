@@ -0,0 +1,494 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/multifactorriskservice/cgm"
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/config"
+	"github.com/intervention-engine/multifactorriskservice/devices"
+	"github.com/intervention-engine/multifactorriskservice/interactions"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/multifactorriskservice/nutrition"
+	"github.com/intervention-engine/multifactorriskservice/store"
+	"github.com/robfig/cron"
+)
+
+// settings holds the configuration values shared by the commands.  Each command adds the settings it needs before
+// parsing its arguments; settings that weren't added are nil.
+type settings struct {
+	loader      *config.Loader
+	HTTP        *string
+	Mongo       *string
+	Store       *string
+	StoreFile   *string
+	FHIR        *string
+	REDCap      *string
+	Token       *string
+	TZ          *string
+	Aggregation *string
+	Cron        *string
+	Retention   *string
+	LogLevel    *string
+	Plugins     *string
+	Calculate   *string
+	Activity    *string
+	KB          *string
+	Broker      *string
+	ClientID    *string
+	Username    *string
+	Password    *string
+	Mappings    *string
+	QoS         *string
+	Outbox      *string
+	OutboxSize  *string
+	Registry    *string
+	CGMStore    *string
+	CGMCron     *string
+	CGMTrace    *string
+	CGMRetain   *string
+}
+
+// availablePlugins are the names of the risk service plugins that can be hosted by the service
+var availablePlugins = []string{"redcap", "nutrition"}
+
+// reloadableSettings are the settings that the serve command applies when it reloads its configuration.  All other
+// settings can only be changed by restarting.
+var reloadableSettings = []string{"cron", "calculate-cron", "cgm-cron", "log-level"}
+
+// newSettings creates the settings for the named command.  The arguments (if any) and description are printed in the
+// command's usage.
+func newSettings(command, arguments, description string) *settings {
+	s := &settings{loader: config.NewLoader(command, os.Stderr)}
+	fs := s.loader.FlagSet
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: multifactorriskservice %s [flags]%s\n\n%s\n\nFlags:\n", command, arguments, description)
+		fs.PrintDefaults()
+	}
+	return s
+}
+
+// addHTTP adds the address the service listens on, which is also used to build the URLs of the risk pies
+func (s *settings) addHTTP() {
+	s.HTTP = s.loader.String("http", "HTTP_HOST_AND_PORT", ":9000", "HTTP service address to listen on")
+}
+
+// addStore adds the pie storage settings, using the given file by default for the file backend
+func (s *settings) addStore(defaultFile string) {
+	s.Mongo = s.loader.String("mongo", "MONGO_URL", "mongodb://localhost:27017", "MongoDB address")
+	s.Store = s.loader.String("store", "PIE_STORE", "mongo", "Pie storage backend: mongo, memory, or file")
+	s.StoreFile = s.loader.String("store-file", "PIE_STORE_FILE", defaultFile, "File used by the file pie storage backend")
+	s.loader.Check("store", func(backend string) error {
+		switch strings.ToLower(backend) {
+		case "mongo", "memory", "file":
+			return nil
+		}
+		return fmt.Errorf("Unknown pie store backend: %s", backend)
+	})
+}
+
+// addFHIR adds the FHIR server address
+func (s *settings) addFHIR() {
+	s.FHIR = s.loader.String("fhir", "FHIR_URL", "http://localhost:3001", "FHIR API address")
+}
+
+// addREDCap adds the REDCap API address and token
+func (s *settings) addREDCap() {
+	s.REDCap = s.loader.Required("redcap", "REDCAP_URL", "REDCap API address, e.g. \"http://redcapsrv:80\"")
+	s.Token = s.loader.Required("token", "REDCAP_TOKEN", "REDCap API token, e.g. \"F65EBA22DCB728FEC5ADFAD42378CA40\"")
+	s.loader.Secret("token")
+}
+
+// addModel adds the settings for interpreting and scoring risk assessments: the clinical timezone and aggregation
+// strategy
+func (s *settings) addModel() {
+	s.TZ = s.loader.String("tz", "CLINICAL_TZ", "", "IANA timezone in which REDCap dates are interpreted, e.g. \"America/New_York\" (default: the host's local timezone)")
+	s.Aggregation = s.loader.String("aggregation", "REDCAP_AGGREGATION", "max", "Strategy for aggregating risk factors into an overall score: max, weighted-sum, weighted-mean, threshold:<n>, or logistic[:<intercept>,<coefficients>...]")
+	s.loader.Check("tz", func(name string) error {
+		if name == "" {
+			return nil
+		}
+		_, err := time.LoadLocation(name)
+		return err
+	})
+	s.loader.Check("aggregation", func(name string) error {
+		_, err := models.ParseAggregationStrategy(name)
+		return err
+	})
+}
+
+// addSchedule adds the schedule for refreshing the risk assessments and the number of days to keep superseded pies
+func (s *settings) addSchedule() {
+	s.Cron = s.loader.String("cron", "REDCAP_CRON", "0 0 22 * * *", "Cron expression indicating when risk assessments should be automatically refreshed")
+	s.Retention = s.loader.String("pie-retention-days", "PIE_RETENTION_DAYS", "0", "Number of days to keep superseded pies before pruning them, or 0 to keep them forever")
+	s.loader.Check("cron", func(spec string) error {
+		_, err := cron.Parse(spec)
+		return err
+	})
+	s.loader.Check("pie-retention-days", func(days string) error {
+		if n, err := strconv.Atoi(days); err != nil || n < 0 {
+			return fmt.Errorf("must be a non-negative integer")
+		}
+		return nil
+	})
+}
+
+// addPlugins adds the settings for the hosted risk service plugins: which are enabled, when they recalculate every
+// patient's risk assessments, and the activity factor and drug-nutrient interaction knowledge base used by the
+// nutrition plugin
+func (s *settings) addPlugins() {
+	s.Plugins = s.loader.String("plugins", "RISK_PLUGINS", "none", "Comma-separated risk service plugins to host: "+strings.Join(availablePlugins, ", ")+", or none")
+	s.Calculate = s.loader.String("calculate-cron", "CALCULATE_CRON", "0 0 23 * * *", "Cron expression indicating when every patient's risk assessments should be recalculated by the hosted plugins")
+	s.Activity = s.loader.String("activity-factor", "NUTRITION_ACTIVITY_FACTOR", "sedentary", "Activity level (sedentary, light, moderate, active or very-active) or factor used by the nutrition plugin to estimate energy requirements")
+	s.loader.Check("plugins", func(names string) error {
+		_, err := parsePluginNames(names)
+		return err
+	})
+	s.loader.Check("calculate-cron", func(spec string) error {
+		_, err := cron.Parse(spec)
+		return err
+	})
+	s.KB = s.loader.String("interactions", "INTERACTIONS_KB", "", "JSON knowledge base of drug-nutrient interactions, or empty to use the built-in knowledge base")
+	s.loader.Check("activity-factor", func(factor string) error {
+		_, err := nutrition.ParseActivityFactor(factor)
+		return err
+	})
+	s.loader.Check("interactions", func(path string) error {
+		if path == "" {
+			return nil
+		}
+		_, err := interactions.LoadKnowledgeBase(path)
+		return err
+	})
+}
+
+// knowledgeBase returns the drug-nutrient interaction knowledge base: the configured file, or the built-in one
+func (s *settings) knowledgeBase() (*interactions.KnowledgeBase, error) {
+	if *s.KB == "" {
+		return interactions.DefaultKnowledgeBase(), nil
+	}
+	return interactions.LoadKnowledgeBase(*s.KB)
+}
+
+// parsePluginNames parses a comma-separated list of plugin names, or "none"
+func parsePluginNames(names string) ([]string, error) {
+	if strings.TrimSpace(names) == "none" {
+		return nil, nil
+	}
+	var parsed []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !contains(availablePlugins, name) {
+			return nil, fmt.Errorf("Unknown plugin %q: must be one of %s, or none", name, strings.Join(availablePlugins, ", "))
+		}
+		if !contains(parsed, name) {
+			parsed = append(parsed, name)
+		}
+	}
+	return parsed, nil
+}
+
+// registry returns the registry of enabled plugins.  The REDCap plugin uses the given REDCap model configuration.
+func (s *settings) registry(model client.ModelConfig) (*client.PluginRegistry, error) {
+	names, err := parsePluginNames(*s.Plugins)
+	if err != nil {
+		return nil, err
+	}
+	registry := client.NewPluginRegistry()
+	for _, name := range names {
+		switch name {
+		case "redcap":
+			err = registry.Register(name, client.NewREDCapPlugin(*s.REDCap, *s.Token, model), model)
+		case "nutrition":
+			factor, _ := nutrition.ParseActivityFactor(*s.Activity)
+			p := nutrition.NewPlugin(factor)
+			if p.Interactions, err = s.knowledgeBase(); err != nil {
+				return nil, err
+			}
+			err = registry.Register(name, p, client.NewModelConfig(nutrition.NutritionRiskServiceConfig, nil))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addMQTT adds the settings for subscribing to device telemetry: the MQTT broker and credentials, the mappings of
+// topics to readings, and the outbox buffering readings until they're written to the FHIR server
+func (s *settings) addMQTT() {
+	s.Broker = s.loader.Required("mqtt-broker", "MQTT_BROKER", "MQTT broker address, e.g. \"tcp://mosquitto:1883\"")
+	s.ClientID = s.loader.String("mqtt-client-id", "MQTT_CLIENT_ID", "multifactorriskservice", "MQTT client ID, which identifies the persistent session holding unacknowledged messages")
+	s.Username = s.loader.String("mqtt-username", "MQTT_USERNAME", "", "MQTT user name")
+	s.Password = s.loader.String("mqtt-password", "MQTT_PASSWORD", "", "MQTT password")
+	s.Mappings = s.loader.Required("mqtt-mappings", "MQTT_MAPPINGS", "JSON file mapping MQTT topics to device readings")
+	s.QoS = s.loader.String("mqtt-qos", "MQTT_QOS", "1", "QoS (0, 1 or 2) of the subscriptions whose mappings don't specify one")
+	s.Outbox = s.loader.String("outbox", "OUTBOX_FILE", "mqtt-outbox.json", "File buffering readings until they're written to the FHIR server, or empty to only buffer them in memory")
+	s.OutboxSize = s.loader.String("outbox-size", "OUTBOX_SIZE", "10000", "Maximum number of readings buffered in the outbox")
+	s.loader.Secret("mqtt-password")
+	s.loader.Check("mqtt-qos", func(qos string) error {
+		if n, err := strconv.Atoi(qos); err != nil || n < 0 || n > 2 {
+			return fmt.Errorf("must be 0, 1 or 2")
+		}
+		return nil
+	})
+	s.loader.Check("outbox-size", func(size string) error {
+		if n, err := strconv.Atoi(size); err != nil || n < 1 {
+			return fmt.Errorf("must be a positive integer")
+		}
+		return nil
+	})
+}
+
+// addRegistry adds the device registry backend, along with the MongoDB address if the command doesn't already have it
+func (s *settings) addRegistry() {
+	if s.Mongo == nil {
+		s.Mongo = s.loader.String("mongo", "MONGO_URL", "mongodb://localhost:27017", "MongoDB address")
+	}
+	s.Registry = s.loader.String("device-registry", "DEVICE_REGISTRY", "", "Device registry backend: mongo, memory, or none to attribute readings to the patient they're sent for (defaults to the -store backend if it's mongo or memory, otherwise none)")
+	s.loader.Check("device-registry", func(backend string) error {
+		switch backend {
+		case "", "mongo", "memory", "none":
+			return nil
+		}
+		return fmt.Errorf("Unknown device registry backend: %s", backend)
+	})
+}
+
+// addCGM adds the CGM sample store backend, summary schedule, and sample retention, along with the MongoDB address if
+// the command doesn't already have it
+func (s *settings) addCGM() {
+	if s.Mongo == nil {
+		s.Mongo = s.loader.String("mongo", "MONGO_URL", "mongodb://localhost:27017", "MongoDB address")
+	}
+	s.CGMStore = s.loader.String("cgm-store", "CGM_STORE", "", "CGM sample storage backend: mongo, memory, or none to disable CGM samples (defaults to the -store backend if it's mongo or memory, otherwise none)")
+	s.CGMCron = s.loader.String("cgm-cron", "CGM_CRON", "0 30 0 * * *", "Cron expression indicating when the previous day's CGM samples should be summarized")
+	s.CGMTrace = s.loader.String("cgm-trace", "CGM_TRACE", "false", "Include each day's CGM samples in its summary as SampledData")
+	s.CGMRetain = s.loader.String("cgm-retention-days", "CGM_RETENTION_DAYS", "90", "Days to keep CGM samples after they're summarized (0 keeps them forever)")
+	s.loader.Check("cgm-store", func(backend string) error {
+		switch backend {
+		case "", "mongo", "memory", "none":
+			return nil
+		}
+		return fmt.Errorf("Unknown CGM sample store backend: %s", backend)
+	})
+	s.loader.Check("cgm-cron", func(spec string) error {
+		_, err := cron.Parse(spec)
+		return err
+	})
+	s.loader.Check("cgm-trace", func(value string) error {
+		_, err := strconv.ParseBool(value)
+		return err
+	})
+	s.loader.Check("cgm-retention-days", func(value string) error {
+		days, err := strconv.Atoi(value)
+		if err == nil && days < 0 {
+			err = fmt.Errorf("Can't keep CGM samples for %d days", days)
+		}
+		return err
+	})
+}
+
+// addLogging adds the log level
+func (s *settings) addLogging() {
+	s.LogLevel = s.loader.String("log-level", "LOG_LEVEL", "info", "Log level: debug, info (logs requests and refresh summaries), or error")
+	s.loader.Check("log-level", func(name string) error {
+		_, err := config.ParseLogLevel(name)
+		return err
+	})
+}
+
+// parse parses the command's arguments and applies the settings that affect the whole process (i.e., the clinical
+// timezone and log level).  If the arguments are invalid, the error is reported and the exit status is returned; otherwise 0 is
+// returned.
+func (s *settings) parse(args []string) int {
+	if err := s.loader.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		s.loader.FlagSet.Usage()
+		return 2
+	}
+	if s.Mongo != nil {
+		*s.Mongo = config.LocalURL("mongodb", *s.Mongo)
+	}
+	if s.FHIR != nil {
+		*s.FHIR = config.LocalURL("http", *s.FHIR)
+	}
+	if s.TZ != nil {
+		if err := models.SetClinicalTimezone(*s.TZ); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid clinical timezone:", err.Error())
+			return 1
+		}
+	}
+	s.applyLogLevel()
+	return 0
+}
+
+// storeBackend returns the backend, or if it isn't set, the backend matching the pie store's: mongo or memory, or none
+// for the file pie store.  Commands without a pie store use mongo.
+func (s *settings) storeBackend(backend string) string {
+	if backend != "" {
+		return backend
+	}
+	if s.Store == nil {
+		return "mongo"
+	}
+	switch strings.ToLower(*s.Store) {
+	case "mongo", "memory":
+		return strings.ToLower(*s.Store)
+	}
+	return "none"
+}
+
+// applyLogLevel sets the log level, if the command has one
+func (s *settings) applyLogLevel() {
+	if s.LogLevel != nil {
+		level, _ := config.ParseLogLevel(*s.LogLevel)
+		config.SetLogLevel(level)
+	}
+}
+
+// reload reloads the configuration, applying the reloadable settings and logging the changes to other settings, which
+// require a restart.  It returns true if the refresh or calculation schedule changed.
+func (s *settings) reload() bool {
+	updated, ignored, err := s.loader.Reload(reloadableSettings...)
+	if err != nil {
+		log.Println("Can't reload the configuration:", err.Error())
+		return false
+	}
+	for _, name := range ignored {
+		log.Printf("Ignoring the change to -%s; restart the service to apply it.", name)
+	}
+	scheduleChanged := false
+	for _, name := range updated {
+		log.Printf("Reloaded -%s.", name)
+		scheduleChanged = scheduleChanged || name == "cron" || name == "calculate-cron" || name == "cgm-cron"
+	}
+	s.applyLogLevel()
+	return scheduleChanged
+}
+
+// retentionDays returns the number of days to keep superseded pies
+func (s *settings) retentionDays() int {
+	days, _ := strconv.Atoi(*s.Retention)
+	return days
+}
+
+// args returns the arguments remaining after the flags
+func (s *settings) args() []string {
+	return s.loader.FlagSet.Args()
+}
+
+// openStore opens the pie store, using the given database for the mongo backend, and ensures its indexes exist
+func (s *settings) openStore(database string) (store.PieStore, error) {
+	pieStore, err := store.Open(store.Config{
+		Backend:  *s.Store,
+		MongoURL: *s.Mongo,
+		Database: database,
+		File:     *s.StoreFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the pie store: %s", err.Error())
+	}
+	if err := pieStore.EnsureIndexes(); err != nil {
+		pieStore.Close()
+		return nil, fmt.Errorf("Can't create indexes on the pie store: %s", err.Error())
+	}
+	return pieStore, nil
+}
+
+// openRegistry opens the device registry, using the given database for the mongo backend, and ensures its indexes
+// exist.  It returns nil if the registry is disabled.
+func (s *settings) openRegistry(database string) (*devices.Registry, error) {
+	backend := s.storeBackend(*s.Registry)
+	if backend == "none" {
+		return nil, nil
+	}
+	registryStore, err := devices.OpenRegistryStore(backend, *s.Mongo, database)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the device registry: %s", err.Error())
+	}
+	if err := registryStore.EnsureIndexes(); err != nil {
+		registryStore.Close()
+		return nil, fmt.Errorf("Can't create indexes on the device registry: %s", err.Error())
+	}
+	return devices.NewRegistry(registryStore, *s.FHIR), nil
+}
+
+// openSampleStore opens the CGM sample store, using the given database for the mongo backend, and ensures its indexes
+// exist.  It returns nil if CGM samples are disabled.
+func (s *settings) openSampleStore(database string) (cgm.SampleStore, error) {
+	backend := s.storeBackend(*s.CGMStore)
+	if backend == "none" {
+		return nil, nil
+	}
+	sampleStore, err := cgm.OpenSampleStore(backend, *s.Mongo, database)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the CGM sample store: %s", err.Error())
+	}
+	if err := sampleStore.EnsureIndexes(); err != nil {
+		sampleStore.Close()
+		return nil, fmt.Errorf("Can't create indexes on the CGM sample store: %s", err.Error())
+	}
+	return sampleStore, nil
+}
+
+// cgmRetentionDays returns the number of days to keep CGM samples
+func (s *settings) cgmRetentionDays() int {
+	days, _ := strconv.Atoi(*s.CGMRetain)
+	return days
+}
+
+// ingester returns the device reading ingester, which resolves the readings' patients with the registry (if any)
+func (s *settings) ingester(registry *devices.Registry) *devices.Ingester {
+	ingester := devices.NewIngester(*s.FHIR)
+	if registry != nil {
+		ingester.Resolver = registry
+	}
+	return ingester
+}
+
+// model returns the REDCap model configuration using the configured aggregation strategy
+func (s *settings) model() (client.ModelConfig, error) {
+	aggregation, err := models.ParseAggregationStrategy(*s.Aggregation)
+	if err != nil {
+		return client.ModelConfig{}, err
+	}
+	return client.NewREDCapModelConfig(aggregation), nil
+}
+
+// basisPieURL returns the base URL of the risk pies served by the service, discovering the host's IP address if the
+// HTTP address is only a port
+func (s *settings) basisPieURL() string {
+	return "http://" + config.Endpoint(*s.HTTP) + "/pies"
+}
+
+// resultsExitStatus logs the summary of the results, along with each error, returning 1 if there were any errors
+func resultsExitStatus(results []client.Result) int {
+	client.LogResultSummary(results)
+	status := 0
+	for _, result := range results {
+		if result.Error != nil {
+			log.Println(result.Error.Error())
+			status = 1
+		}
+	}
+	return status
+}
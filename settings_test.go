@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestSettingsSuite(t *testing.T) {
+	suite.Run(t, new(SettingsSuite))
+}
+
+type SettingsSuite struct {
+	suite.Suite
+}
+
+func (suite *SettingsSuite) serveSettings(args ...string) *settings {
+	s := newSettings("serve", "", "")
+	s.addStore("pies.json")
+	s.addRegistry()
+	s.addCGM()
+	suite.Equal(0, s.parse(args))
+	return s
+}
+
+func (suite *SettingsSuite) TestRegistryDefaultsToStoreBackend() {
+	s := suite.serveSettings()
+	suite.Equal("mongo", s.storeBackend(*s.Registry))
+
+	s = suite.serveSettings("-store", "memory")
+	suite.Equal("memory", s.storeBackend(*s.Registry))
+
+	s = suite.serveSettings("-store", "file")
+	suite.Equal("none", s.storeBackend(*s.Registry))
+}
+
+func (suite *SettingsSuite) TestRegistryOverridesStoreBackend() {
+	s := suite.serveSettings("-store", "file", "-device-registry", "memory")
+	suite.Equal("memory", s.storeBackend(*s.Registry))
+
+	s = suite.serveSettings("-store", "mongo", "-device-registry", "none")
+	suite.Equal("none", s.storeBackend(*s.Registry))
+}
+
+func (suite *SettingsSuite) TestRegistryWithoutStoreUsesMongo() {
+	s := newSettings("mqtt", "", "")
+	s.addRegistry()
+	suite.Equal(0, s.parse(nil))
+	suite.Equal("mongo", s.storeBackend(*s.Registry))
+}
+
+func (suite *SettingsSuite) TestCGMStoreDefaultsToStoreBackend() {
+	s := suite.serveSettings()
+	suite.Equal("mongo", s.storeBackend(*s.CGMStore))
+
+	s = suite.serveSettings("-store", "memory")
+	suite.Equal("memory", s.storeBackend(*s.CGMStore))
+
+	s = suite.serveSettings("-store", "file")
+	suite.Equal("none", s.storeBackend(*s.CGMStore))
+
+	s = suite.serveSettings("-store", "file", "-cgm-store", "memory")
+	suite.Equal("memory", s.storeBackend(*s.CGMStore))
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// FilePieStore is a PieStore embedded in a single file on disk.  Pies are held in memory and the whole store is
+// written to the file (atomically, via a temporary file and rename) after every change, so it is best suited to
+// laptop demos and small deployments that don't warrant a MongoDB server.  Since each process would overwrite the
+// others' changes, the store holds an exclusive lock on a sibling ".lock" file until it's closed.
+type FilePieStore struct {
+	MemoryPieStore
+	path string
+	lock *os.File
+}
+
+// NewFilePieStore opens the pie store in the given file, creating it if it doesn't yet exist.  An error is returned
+// if another process has the store open.
+func NewFilePieStore(path string) (*FilePieStore, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("The pie store %s is in use by another process: %s", path, err.Error())
+	}
+	s := &FilePieStore{path: path, lock: lock}
+	s.pies = make(map[bson.ObjectId]models.StoredPie)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	var pies []models.StoredPie
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &pies); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for i := range pies {
+		s.pies[pies[i].Id] = pies[i]
+	}
+	return s, nil
+}
+
+// Replace flags the current pies for the given patient URL and method as superseded, adds the new pies as the next
+// version, and saves the store to disk.  If the store can't be saved, the pies are left unchanged.
+func (s *FilePieStore) Replace(patientURL string, method fhir.Coding, pies []models.StoredPie) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.snapshot()
+	s.replace(patientURL, method, pies)
+	if err := s.save(); err != nil {
+		s.pies = previous
+		return err
+	}
+	return nil
+}
+
+// Prune removes the pies that were superseded before the given time, saving the store to disk if any were removed.
+// If the store can't be saved, no pies are removed.
+func (s *FilePieStore) Prune(supersededBefore time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.snapshot()
+	removed := s.prune(supersededBefore)
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		s.pies = previous
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Close releases the store's lock, so that other processes can open it
+func (s *FilePieStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+// snapshot returns a copy of the pies, so they can be restored if a change can't be saved; the caller must hold the
+// lock.  Changes replace pies rather than modifying them, so the pies themselves don't need to be copied.
+func (s *FilePieStore) snapshot() map[bson.ObjectId]models.StoredPie {
+	pies := make(map[bson.ObjectId]models.StoredPie, len(s.pies))
+	for id, pie := range s.pies {
+		pies[id] = pie
+	}
+	return pies
+}
+
+// save writes all of the pies to the file; the caller must hold the lock
+func (s *FilePieStore) save() error {
+	pies := make([]models.StoredPie, 0, len(s.pies))
+	for _, pie := range s.pies {
+		pies = append(pies, pie)
+	}
+	data, err := json.Marshal(pies)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
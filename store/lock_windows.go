@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package store
+
+import "os"
+
+// lockFile does nothing on Windows, where advisory locks aren't supported, so processes sharing a file pie store
+// aren't protected from each other
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// MemoryPieStore is a PieStore that keeps pies in memory.  It is suitable for demos and tests, but all pies are lost
+// when the process exits.
+type MemoryPieStore struct {
+	mutex sync.RWMutex
+	pies  map[bson.ObjectId]models.StoredPie
+}
+
+// NewMemoryPieStore returns a new, empty, in-memory PieStore
+func NewMemoryPieStore() *MemoryPieStore {
+	return &MemoryPieStore{pies: make(map[bson.ObjectId]models.StoredPie)}
+}
+
+// Get returns the pie with the given ID, or ErrNotFound if it doesn't exist
+func (s *MemoryPieStore) Get(id bson.ObjectId) (*models.StoredPie, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pie, ok := s.pies[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clonePie(&pie), nil
+}
+
+// EnsureIndexes does nothing for the in-memory store
+func (s *MemoryPieStore) EnsureIndexes() error {
+	return nil
+}
+
+// Find returns the current pies for the given patient URL and method, sorted by their as-of date
+func (s *MemoryPieStore) Find(patientURL string, method fhir.Coding) ([]models.StoredPie, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var pies []models.StoredPie
+	for _, pie := range s.pies {
+		if !pie.Superseded && pie.Patient == patientURL && matchesMethod(&pie, method) {
+			pies = append(pies, *clonePie(&pie))
+		}
+	}
+	sort.Stable(byVersionAndAsOf(pies))
+	return pies, nil
+}
+
+// History returns all of the pies for the given patient URL and method, sorted by version and as-of date
+func (s *MemoryPieStore) History(patientURL string, method fhir.Coding) ([]models.StoredPie, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var pies []models.StoredPie
+	for _, pie := range s.pies {
+		if pie.Patient == patientURL && matchesMethod(&pie, method) {
+			pies = append(pies, *clonePie(&pie))
+		}
+	}
+	sort.Stable(byVersionAndAsOf(pies))
+	return pies, nil
+}
+
+// List returns all of the pies, sorted by patient URL, version and as-of date, including superseded pies only if
+// history is set
+func (s *MemoryPieStore) List(history bool) ([]models.StoredPie, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var pies []models.StoredPie
+	for _, pie := range s.pies {
+		if history || !pie.Superseded {
+			pies = append(pies, *clonePie(&pie))
+		}
+	}
+	sort.Stable(byVersionAndAsOf(pies))
+	sort.Stable(byPatient(pies))
+	return pies, nil
+}
+
+// Replace flags the current pies for the given patient URL and method as superseded and adds the new pies as the
+// next version
+func (s *MemoryPieStore) Replace(patientURL string, method fhir.Coding, pies []models.StoredPie) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.replace(patientURL, method, pies)
+	return nil
+}
+
+// Prune removes the pies that were superseded before the given time
+func (s *MemoryPieStore) Prune(supersededBefore time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.prune(supersededBefore), nil
+}
+
+// Close does nothing for the in-memory store
+func (s *MemoryPieStore) Close() error {
+	return nil
+}
+
+// replace does the work of Replace; the caller must hold the write lock
+func (s *MemoryPieStore) replace(patientURL string, method fhir.Coding, pies []models.StoredPie) {
+	now := time.Now()
+	version := 1
+	for id, pie := range s.pies {
+		if pie.Patient == patientURL && matchesMethod(&pie, method) {
+			if pie.Version >= version {
+				version = pie.Version + 1
+			}
+			if !pie.Superseded {
+				pie.Superseded, pie.SupersededAt = true, &now
+				s.pies[id] = pie
+			}
+		}
+	}
+	for i := range pies {
+		pie := clonePie(&pies[i])
+		pie.Version, pie.Superseded, pie.SupersededAt = version, false, nil
+		s.pies[pie.Id] = *pie
+	}
+}
+
+// prune does the work of Prune; the caller must hold the write lock
+func (s *MemoryPieStore) prune(supersededBefore time.Time) int {
+	removed := 0
+	for id, pie := range s.pies {
+		if pie.Superseded && pie.SupersededAt != nil && pie.SupersededAt.Before(supersededBefore) {
+			delete(s.pies, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// clonePie copies the pie so callers can't modify the stored slices or method
+func clonePie(pie *models.StoredPie) *models.StoredPie {
+	cloned := *pie
+	cloned.Pie = *pie.Pie.Clone(false)
+	if pie.Method != nil {
+		method := *pie.Method
+		method.Coding = append([]fhir.Coding(nil), pie.Method.Coding...)
+		cloned.Method = &method
+	}
+	return &cloned
+}
+
+type byVersionAndAsOf []models.StoredPie
+
+func (p byVersionAndAsOf) Len() int {
+	return len(p)
+}
+func (p byVersionAndAsOf) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+func (p byVersionAndAsOf) Less(i, j int) bool {
+	if p[i].Version != p[j].Version {
+		return p[i].Version < p[j].Version
+	}
+	return p[i].AsOf.Before(p[j].AsOf)
+}
+
+type byPatient []models.StoredPie
+
+func (p byPatient) Len() int {
+	return len(p)
+}
+func (p byPatient) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+func (p byPatient) Less(i, j int) bool {
+	return p[i].Patient < p[j].Patient
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// MongoPieStore is a PieStore backed by a MongoDB collection
+type MongoPieStore struct {
+	C       *mgo.Collection
+	session *mgo.Session
+}
+
+// NewMongoPieStore returns a PieStore backed by the given collection.  Closing the store does not close the
+// collection's session.
+func NewMongoPieStore(c *mgo.Collection) *MongoPieStore {
+	return &MongoPieStore{C: c}
+}
+
+// EnsureIndexes creates the indexes for querying pies by patient and method, by created date, and by the date they
+// were superseded (for pruning)
+func (s *MongoPieStore) EnsureIndexes() error {
+	indexes := []mgo.Index{
+		{Key: []string{"patient", "method.coding.system", "method.coding.code", "superseded", "asOf"}},
+		{Key: []string{"created"}},
+		{Key: []string{"supersededAt"}, Sparse: true},
+	}
+	for _, index := range indexes {
+		if err := s.C.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the pie with the given ID, or ErrNotFound if it doesn't exist
+func (s *MongoPieStore) Get(id bson.ObjectId) (*models.StoredPie, error) {
+	pie := new(models.StoredPie)
+	if err := s.C.FindId(id).One(pie); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return pie, nil
+}
+
+// Find returns the current pies for the given patient URL and method, sorted by their as-of date
+func (s *MongoPieStore) Find(patientURL string, method fhir.Coding) ([]models.StoredPie, error) {
+	query := patientAndMethodQuery(patientURL, method)
+	query["superseded"] = bson.M{"$ne": true}
+	var pies []models.StoredPie
+	if err := s.C.Find(query).Sort("asOf").All(&pies); err != nil {
+		return nil, err
+	}
+	return pies, nil
+}
+
+// History returns all of the pies for the given patient URL and method, sorted by version and as-of date
+func (s *MongoPieStore) History(patientURL string, method fhir.Coding) ([]models.StoredPie, error) {
+	var pies []models.StoredPie
+	if err := s.C.Find(patientAndMethodQuery(patientURL, method)).Sort("version", "asOf").All(&pies); err != nil {
+		return nil, err
+	}
+	return pies, nil
+}
+
+// List returns all of the pies, sorted by patient URL, version and as-of date, including superseded pies only if
+// history is set
+func (s *MongoPieStore) List(history bool) ([]models.StoredPie, error) {
+	query := bson.M{}
+	if !history {
+		query["superseded"] = bson.M{"$ne": true}
+	}
+	var pies []models.StoredPie
+	if err := s.C.Find(query).Sort("patient", "version", "asOf").All(&pies); err != nil {
+		return nil, err
+	}
+	return pies, nil
+}
+
+// Replace inserts the new pies as the next version for the given patient URL and method, and then flags the previously
+// current pies as superseded.  The new pies are inserted first so that the patient always has current pies: if they
+// can't be inserted, any that were are removed and the previous pies remain current.
+func (s *MongoPieStore) Replace(patientURL string, method fhir.Coding, pies []models.StoredPie) error {
+	query := patientAndMethodQuery(patientURL, method)
+	var latest models.StoredPie
+	version := 1
+	if err := s.C.Find(query).Sort("-version").One(&latest); err == nil {
+		version = latest.Version + 1
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	ids := make([]bson.ObjectId, len(pies))
+	for i := range pies {
+		pie := pies[i]
+		pie.Version, pie.Superseded, pie.SupersededAt = version, false, nil
+		if err := s.C.Insert(&pie); err != nil {
+			s.C.RemoveAll(bson.M{"_id": bson.M{"$in": ids[:i]}})
+			return err
+		}
+		ids[i] = pie.Id
+	}
+
+	query["superseded"] = bson.M{"$ne": true}
+	query["_id"] = bson.M{"$nin": ids}
+	_, err := s.C.UpdateAll(query, bson.M{"$set": bson.M{"superseded": true, "supersededAt": time.Now()}})
+	return err
+}
+
+// Prune removes the pies that were superseded before the given time
+func (s *MongoPieStore) Prune(supersededBefore time.Time) (int, error) {
+	info, err := s.C.RemoveAll(bson.M{"superseded": true, "supersededAt": bson.M{"$lt": supersededBefore}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// Close closes the underlying session if the store opened it
+func (s *MongoPieStore) Close() error {
+	if s.session != nil {
+		s.session.Close()
+	}
+	return nil
+}
+
+func patientAndMethodQuery(patientURL string, method fhir.Coding) bson.M {
+	return bson.M{
+		"patient":       patientURL,
+		"method.coding": bson.M{"$elemMatch": bson.M{"system": method.System, "code": method.Code}},
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/dbtest"
+
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestMongoPieStoreSuite(t *testing.T) {
+	s := new(MongoPieStoreSuite)
+	s.NewStore = func() (PieStore, error) {
+		s.Session = s.DBServer.Session()
+		return NewMongoPieStore(s.Session.DB("riskservice-test").C("pies")), nil
+	}
+	suite.Run(t, s)
+}
+
+// MongoPieStoreSuite runs the common PieStore tests against a temporary MongoDB server
+type MongoPieStoreSuite struct {
+	PieStoreSuite
+	DBServer     *dbtest.DBServer
+	DBServerPath string
+	Session      *mgo.Session
+}
+
+func (suite *MongoPieStoreSuite) SetupSuite() {
+	suite.DBServer = &dbtest.DBServer{}
+	var err error
+	suite.DBServerPath, err = ioutil.TempDir("", "mongotestdb")
+	if err != nil {
+		panic(err)
+	}
+	suite.DBServer.SetPath(suite.DBServerPath)
+}
+
+func (suite *MongoPieStoreSuite) TearDownTest() {
+	suite.PieStoreSuite.TearDownTest()
+	suite.Session.Close()
+	suite.DBServer.Wipe()
+}
+
+func (suite *MongoPieStoreSuite) TearDownSuite() {
+	suite.DBServer.Stop()
+}
+
+func (suite *MongoPieStoreSuite) TestReplaceKeepsCurrentPiesWhenInsertFails() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	v1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v1}))
+
+	// The second pie reuses the first version's ID, so it can't be inserted
+	v2 := newTestPie("http://fhir/Patient/1", multiFactor, asOf.AddDate(0, 1, 0), 2)
+	assert.Error(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v2, v1}))
+
+	pies, err := suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(v1.Id, pies[0].Id)
+	_, err = suite.Store.Get(v2.Id)
+	assert.Equal(ErrNotFound, err)
+}
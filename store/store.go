@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// ErrNotFound is returned when a requested pie does not exist in the store
+var ErrNotFound = errors.New("Pie not found")
+
+// PieStore provides storage for risk pies.  Pies are identified by their ID, and grouped by the patient they belong
+// to and the method (risk model) that produced them.  Each set of pies stored for a patient and method is a new
+// version; older versions are kept as superseded history until they are pruned.
+type PieStore interface {
+	// EnsureIndexes creates any indexes needed to efficiently query the store
+	EnsureIndexes() error
+	// Get returns the pie with the given ID (whether current or superseded), or ErrNotFound if it doesn't exist
+	Get(id bson.ObjectId) (*models.StoredPie, error)
+	// Find returns the current (non-superseded) pies for the given patient URL and method, sorted by their as-of date
+	Find(patientURL string, method fhir.Coding) ([]models.StoredPie, error)
+	// History returns all of the pies, current and superseded, for the given patient URL and method, sorted by version
+	// and then by as-of date
+	History(patientURL string, method fhir.Coding) ([]models.StoredPie, error)
+	// List returns all of the pies in the store, sorted by patient URL, version and as-of date.  Superseded pies are only
+	// included if history is set.
+	List(history bool) ([]models.StoredPie, error)
+	// Replace stores the pies as the next version for the given patient URL and method, flagging the current pies as
+	// superseded
+	Replace(patientURL string, method fhir.Coding, pies []models.StoredPie) error
+	// Prune removes superseded pies that were superseded before the given time, returning the number removed
+	Prune(supersededBefore time.Time) (int, error)
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// Config indicates which PieStore backend to use and how to connect to it.  The Backend may be "mongo" (the default),
+// "memory", or "file".  MongoURL and Database are used by the mongo backend; File is used by the file backend.
+type Config struct {
+	Backend  string
+	MongoURL string
+	Database string
+	File     string
+}
+
+// Open returns the PieStore indicated by the configuration
+func Open(config Config) (PieStore, error) {
+	switch strings.ToLower(config.Backend) {
+	case "", "mongo":
+		session, err := mgo.Dial(config.MongoURL)
+		if err != nil {
+			return nil, fmt.Errorf("Can't connect to the database at %s: %s", config.MongoURL, err.Error())
+		}
+		return &MongoPieStore{C: session.DB(config.Database).C("pies"), session: session}, nil
+	case "memory":
+		return NewMemoryPieStore(), nil
+	case "file":
+		if config.File == "" {
+			return nil, errors.New("A file must be specified for the file pie store")
+		}
+		return NewFilePieStore(config.File)
+	}
+	return nil, fmt.Errorf("Unknown pie store backend: %s", config.Backend)
+}
+
+// matchesMethod checks if the pie was produced by the given method
+func matchesMethod(pie *models.StoredPie, method fhir.Coding) bool {
+	return pie.Method != nil && pie.Method.MatchesCode(method.System, method.Code)
+}
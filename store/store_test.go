@@ -0,0 +1,390 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/multifactorriskservice/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run these suites, we need to create
+// normal test functions and pass our suites to suite.Run
+func TestMemoryPieStoreSuite(t *testing.T) {
+	suite.Run(t, &PieStoreSuite{NewStore: func() (PieStore, error) {
+		return NewMemoryPieStore(), nil
+	}})
+}
+
+func TestFilePieStoreSuite(t *testing.T) {
+	s := new(PieStoreSuite)
+	s.NewStore = func() (PieStore, error) {
+		return NewFilePieStore(filepath.Join(s.Dir, "pies.json"))
+	}
+	suite.Run(t, s)
+}
+
+// PieStoreSuite tests the behavior common to all PieStore implementations
+type PieStoreSuite struct {
+	suite.Suite
+	NewStore func() (PieStore, error)
+	Dir      string
+	Store    PieStore
+}
+
+var multiFactor = fhir.Coding{System: "http://interventionengine.org/risk-assessments", Code: "MultiFactor"}
+var otherMethod = fhir.Coding{System: "http://interventionengine.org/risk-assessments", Code: "Other"}
+
+func (suite *PieStoreSuite) SetupTest() {
+	var err error
+	suite.Dir, err = ioutil.TempDir("", "piestore")
+	suite.Require().NoError(err)
+	suite.Store, err = suite.NewStore()
+	suite.Require().NoError(err)
+}
+
+func (suite *PieStoreSuite) TearDownTest() {
+	suite.Store.Close()
+	if err := os.RemoveAll(suite.Dir); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Error cleaning up temp directory: %s", err.Error())
+	}
+}
+
+func newTestPie(patientURL string, method fhir.Coding, asOf time.Time, values ...int) models.StoredPie {
+	pie := plugin.NewPie(patientURL)
+	pie.Created = pie.Created.Truncate(time.Millisecond)
+	for i, value := range values {
+		pie.Slices = append(pie.Slices, plugin.Slice{Name: fmt.Sprintf("Slice %d", i), Weight: 25, Value: value, MaxValue: 4})
+	}
+	return *models.NewStoredPie(&plugin.RiskServiceCalculationResult{AsOf: asOf, Pie: pie}, fhir.CodeableConcept{Coding: []fhir.Coding{method}})
+}
+
+func (suite *PieStoreSuite) TestReplaceAndGet() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	pie := newTestPie("http://fhir/Patient/1", multiFactor, time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), 1, 2, 3, 4)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{pie}))
+
+	found, err := suite.Store.Get(pie.Id)
+	require.NoError(err)
+	assert.Equal(pie.Id, found.Id)
+	assert.Equal(pie.Patient, found.Patient)
+	assert.Equal(pie.Slices, found.Slices)
+	assert.True(pie.AsOf.Equal(found.AsOf))
+	assert.True(pie.Created.Equal(found.Created))
+	assert.True(found.Method.MatchesCode(multiFactor.System, multiFactor.Code))
+
+	// Modifying the returned pie should not modify the stored pie
+	found.Slices[0].Value = 4
+	found, err = suite.Store.Get(pie.Id)
+	require.NoError(err)
+	assert.Equal(1, found.Slices[0].Value)
+}
+
+func (suite *PieStoreSuite) TestGetNotFound() {
+	_, err := suite.Store.Get(bson.NewObjectId())
+	suite.Assert().Equal(ErrNotFound, err)
+}
+
+func (suite *PieStoreSuite) TestFindSortsByAsOf() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	later := newTestPie("http://fhir/Patient/1", multiFactor, time.Date(2016, time.April, 1, 0, 0, 0, 0, time.UTC), 3)
+	earlier := newTestPie("http://fhir/Patient/1", multiFactor, time.Date(2015, time.December, 7, 0, 0, 0, 0, time.UTC), 2)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{later, earlier}))
+
+	pies, err := suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 2)
+	assert.Equal(earlier.Id, pies[0].Id)
+	assert.Equal(later.Id, pies[1].Id)
+}
+
+func (suite *PieStoreSuite) TestReplaceOnlyAffectsPatientAndMethod() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	p1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	p2 := newTestPie("http://fhir/Patient/2", multiFactor, asOf, 2)
+	p1Other := newTestPie("http://fhir/Patient/1", otherMethod, asOf, 3)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{p1}))
+	require.NoError(suite.Store.Replace("http://fhir/Patient/2", multiFactor, []models.StoredPie{p2}))
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", otherMethod, []models.StoredPie{p1Other}))
+
+	// Replace patient 1's multi-factor pie
+	p1New := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 4)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{p1New}))
+
+	superseded, err := suite.Store.Get(p1.Id)
+	require.NoError(err)
+	assert.True(superseded.Superseded)
+	pies, err := suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(p1New.Id, pies[0].Id)
+
+	pies, err = suite.Store.Find("http://fhir/Patient/2", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(p2.Id, pies[0].Id)
+
+	pies, err = suite.Store.Find("http://fhir/Patient/1", otherMethod)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(p1Other.Id, pies[0].Id)
+}
+
+func (suite *PieStoreSuite) TestFindNone() {
+	pies, err := suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	suite.Assert().NoError(err)
+	suite.Assert().Empty(pies)
+}
+
+func (suite *PieStoreSuite) TestReplaceKeepsHistory() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	v1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v1}))
+	v2 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 2)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v2}))
+
+	pies, err := suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(v2.Id, pies[0].Id)
+	assert.Equal(2, pies[0].Version)
+	assert.False(pies[0].Superseded)
+	assert.Nil(pies[0].SupersededAt)
+
+	pies, err = suite.Store.History("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 2)
+	assert.Equal(v1.Id, pies[0].Id)
+	assert.Equal(1, pies[0].Version)
+	assert.True(pies[0].Superseded)
+	require.NotNil(pies[0].SupersededAt)
+	// The contents of the superseded pie are unchanged
+	assert.Equal(1, pies[0].Slices[0].Value)
+	assert.Equal(v2.Id, pies[1].Id)
+	assert.Equal(2, pies[1].Version)
+}
+
+func (suite *PieStoreSuite) TestList() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	p2 := newTestPie("http://fhir/Patient/2", multiFactor, asOf, 1)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/2", multiFactor, []models.StoredPie{p2}))
+	v1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v1}))
+	v2a := newTestPie("http://fhir/Patient/1", multiFactor, asOf.AddDate(0, 1, 0), 2)
+	v2b := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 3)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v2a, v2b}))
+
+	pies, err := suite.Store.List(false)
+	require.NoError(err)
+	require.Len(pies, 3)
+	assert.Equal(v2b.Id, pies[0].Id)
+	assert.Equal(v2a.Id, pies[1].Id)
+	assert.Equal(p2.Id, pies[2].Id)
+
+	pies, err = suite.Store.List(true)
+	require.NoError(err)
+	require.Len(pies, 4)
+	assert.Equal(v1.Id, pies[0].Id)
+	assert.True(pies[0].Superseded)
+	assert.Equal(v2b.Id, pies[1].Id)
+	assert.Equal(v2a.Id, pies[2].Id)
+	assert.Equal(p2.Id, pies[3].Id)
+}
+
+func (suite *PieStoreSuite) TestPrune() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	v1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v1}))
+	v2 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 2)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v2}))
+
+	// Nothing was superseded before an hour ago
+	removed, err := suite.Store.Prune(time.Now().Add(-time.Hour))
+	require.NoError(err)
+	assert.Equal(0, removed)
+
+	// Only the superseded pie should be removed, not the current one
+	removed, err = suite.Store.Prune(time.Now().Add(time.Hour))
+	require.NoError(err)
+	assert.Equal(1, removed)
+	_, err = suite.Store.Get(v1.Id)
+	assert.Equal(ErrNotFound, err)
+	pies, err := suite.Store.History("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(v2.Id, pies[0].Id)
+
+	// Versions continue from the latest remaining version
+	v3 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 3)
+	require.NoError(suite.Store.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v3}))
+	pies, err = suite.Store.Find("http://fhir/Patient/1", multiFactor)
+	require.NoError(err)
+	require.Len(pies, 1)
+	assert.Equal(3, pies[0].Version)
+}
+
+func TestFilePieStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pies.json")
+
+	s, err := NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pie := newTestPie("http://fhir/Patient/1", multiFactor, time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), 1, 2)
+	if err := s.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{pie}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopen the store and make sure the pie is still there
+	s, err = NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	found, err := s.Get(pie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Patient != pie.Patient || len(found.Slices) != 2 || !found.AsOf.Equal(pie.AsOf) {
+		t.Errorf("Reopened pie does not match stored pie: %+v", found)
+	}
+}
+
+func TestFilePieStoreKeepsPiesWhenSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pies.json")
+
+	s, err := NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	asOf := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	v1 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 1)
+	if err := s.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v1}); err != nil {
+		t.Fatal(err)
+	}
+	v2 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 2)
+	if err := s.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving fails once the directory is gone, so neither change should take effect
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	v3 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 3)
+	if err := s.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v3}); err == nil {
+		t.Fatal("Expected an error replacing pies when the store can't be saved")
+	}
+	if removed, err := s.Prune(time.Now().Add(time.Hour)); err == nil || removed != 0 {
+		t.Fatalf("Expected an error and no pies removed when the store can't be saved, got %d removed", removed)
+	}
+	pies, err := s.History("http://fhir/Patient/1", multiFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pies) != 2 || pies[0].Id != v1.Id || pies[1].Id != v2.Id || pies[1].Superseded {
+		t.Fatalf("Expected the pies from before the failed changes, got %+v", pies)
+	}
+
+	// The next successful save doesn't include the failed replacement
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	v4 := newTestPie("http://fhir/Patient/1", multiFactor, asOf, 4)
+	if err := s.Replace("http://fhir/Patient/1", multiFactor, []models.StoredPie{v4}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	reopened, err := NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.Get(v3.Id); err != ErrNotFound {
+		t.Errorf("Expected the pie from the failed replacement not to be saved, got %v", err)
+	}
+	if pies, _ := reopened.History("http://fhir/Patient/1", multiFactor); len(pies) != 3 {
+		t.Errorf("Expected 3 saved pies, got %d", len(pies))
+	}
+}
+
+func TestFilePieStoreIsLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pies.json")
+
+	s, err := NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFilePieStore(path); err == nil {
+		t.Fatal("Expected an error opening a file pie store that's already open")
+	}
+
+	// Once it's closed, the store can be opened again
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFilePieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open(Config{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*MemoryPieStore); !ok {
+		t.Errorf("Expected memory backend, got %T", s)
+	}
+
+	if _, err := Open(Config{Backend: "file"}); err == nil {
+		t.Error("Expected error when no file is configured for the file backend")
+	}
+
+	if _, err := Open(Config{Backend: "bolt"}); err == nil {
+		t.Error("Expected error for unknown backend")
+	}
+}
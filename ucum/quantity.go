@@ -0,0 +1,165 @@
+package ucum
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+)
+
+const loincSystem = "http://loinc.org"
+
+// aliases maps the human-readable units that sources often record instead of UCUM codes to their UCUM codes.  Keys
+// are lower case, since human-readable units are matched case-insensitively.
+var aliases = map[string]string{
+	"lb":      "[lb_av]",
+	"lbs":     "[lb_av]",
+	"pound":   "[lb_av]",
+	"pounds":  "[lb_av]",
+	"oz":      "[oz_av]",
+	"in":      "[in_i]",
+	"inch":    "[in_i]",
+	"inches":  "[in_i]",
+	"ft":      "[ft_i]",
+	"kgs":     "kg",
+	"kcal":    "kcal",
+	"mg/dl":   "mg/dL",
+	"g/dl":    "g/dL",
+	"ug/dl":   "ug/dL",
+	"mmol/l":  "mmol/L",
+	"umol/l":  "umol/L",
+	"nmol/l":  "nmol/L",
+	"pmol/l":  "pmol/L",
+	"ng/ml":   "ng/mL",
+	"pg/ml":   "pg/mL",
+	"iu/l":    "[IU]/L",
+	"kg/m^2":  "kg/m2",
+	"kg/m²":   "kg/m2",
+	"percent": "%",
+}
+
+// QuantityUnit returns the UCUM code for the quantity's unit: its code, if it's coded in UCUM (or the system isn't
+// given), otherwise its human-readable unit, translating common units such as "lb" and "mg/dl" to UCUM
+func QuantityUnit(q *fhir.Quantity) (string, error) {
+	if q.Code != "" && (q.System == "" || q.System == System) {
+		return q.Code, nil
+	}
+	unit := strings.Replace(strings.TrimSpace(q.Unit), "µ", "u", -1)
+	if unit == "" {
+		if q.Code != "" {
+			return "", fmt.Errorf("Unit %s isn't coded in UCUM (%s)", q.Code, q.System)
+		}
+		return "", errors.New("Quantity has no unit")
+	}
+	if code, ok := aliases[strings.ToLower(unit)]; ok {
+		return code, nil
+	}
+	return unit, nil
+}
+
+// Value returns the quantity's value converted to the given unit
+func Value(q *fhir.Quantity, to string) (float64, error) {
+	return SubstanceValue(q, to, 0)
+}
+
+// SubstanceValue returns the quantity's value converted to the given unit, using the substance's molar mass (in g/mol)
+// to convert between mass and amount of substance
+func SubstanceValue(q *fhir.Quantity, to string, molarMass float64) (float64, error) {
+	if q.Value == nil {
+		return 0, errors.New("Quantity has no value")
+	}
+	from, err := QuantityUnit(q)
+	if err != nil {
+		return 0, err
+	}
+	return ConvertSubstance(*q.Value, from, to, molarMass)
+}
+
+// Target is the unit that a kind of observation is normalized to, along with the molar mass (in g/mol) of the analyte
+// for converting between mass and substance concentrations, or 0 if they can't be converted
+type Target struct {
+	Unit      string
+	MolarMass float64
+}
+
+// Normalizer normalizes the quantities of observations, converting them to the target unit for their LOINC code
+type Normalizer map[string]Target
+
+// DefaultNormalizer normalizes the observations used in risk calculations to the units that the plugins expect.  HbA1c
+// isn't normalized, since its units (% and mmol/mol) are both dimensionless but aren't proportional.
+var DefaultNormalizer = Normalizer{
+	"29463-7": {Unit: "kg"},                        // Body weight
+	"3141-9":  {Unit: "kg"},                        // Body weight (measured)
+	"8302-2":  {Unit: "cm"},                        // Body height
+	"39156-5": {Unit: "kg/m2"},                     // Body mass index
+	"2345-7":  {Unit: "mg/dL", MolarMass: 180.16},  // Glucose in serum or plasma
+	"2093-3":  {Unit: "mg/dL", MolarMass: 386.65},  // Cholesterol
+	"2085-9":  {Unit: "mg/dL", MolarMass: 386.65},  // HDL cholesterol
+	"13457-7": {Unit: "mg/dL", MolarMass: 386.65},  // LDL cholesterol (calculated)
+	"2089-1":  {Unit: "mg/dL", MolarMass: 386.65},  // LDL cholesterol (direct)
+	"2571-8":  {Unit: "mg/dL", MolarMass: 885.7},   // Triglycerides
+	"2160-0":  {Unit: "mg/dL", MolarMass: 113.12},  // Creatinine
+	"1751-7":  {Unit: "g/dL"},                      // Albumin
+	"14338-8": {Unit: "mg/dL"},                     // Prealbumin
+	"718-7":   {Unit: "g/dL"},                      // Hemoglobin
+	"2276-4":  {Unit: "ng/mL"},                     // Ferritin
+	"1989-3":  {Unit: "ng/mL", MolarMass: 400.64},  // 25-hydroxyvitamin D
+	"2132-9":  {Unit: "pg/mL", MolarMass: 1355.37}, // Vitamin B12
+}
+
+// NormalizeQuantity returns a copy of the quantity converted to the target unit and coded in UCUM
+func NormalizeQuantity(q *fhir.Quantity, target Target) (*fhir.Quantity, error) {
+	value, err := SubstanceValue(q, target.Unit, target.MolarMass)
+	if err != nil {
+		return nil, err
+	}
+	normalized := *q
+	normalized.Value = &value
+	normalized.Unit = target.Unit
+	normalized.System = System
+	normalized.Code = target.Unit
+	return &normalized, nil
+}
+
+// NormalizeObservation returns a copy of the observation with its value quantity converted to the target unit for
+// its LOINC code.  Observations without a value quantity, or with a code that has no target, are returned as is.
+func (n Normalizer) NormalizeObservation(o *fhir.Observation) (*fhir.Observation, error) {
+	if o.Code == nil || o.ValueQuantity == nil || o.ValueQuantity.Value == nil {
+		return o, nil
+	}
+	for code, target := range n {
+		if !o.Code.MatchesCode(loincSystem, code) {
+			continue
+		}
+		q, err := NormalizeQuantity(o.ValueQuantity, target)
+		if err != nil {
+			return nil, fmt.Errorf("Can't normalize observation %s (LOINC %s): %s", o.Id, code, err.Error())
+		}
+		normalized := *o
+		normalized.ValueQuantity = q
+		return &normalized, nil
+	}
+	return o, nil
+}
+
+// NormalizeEventStream normalizes the observations in the event stream, removing the events for observations that
+// can't be normalized (so they aren't used with the wrong units), and returning their errors
+func (n Normalizer) NormalizeEventStream(es *plugin.EventStream) []error {
+	var errs []error
+	events := es.Events[:0]
+	for _, event := range es.Events {
+		if o, ok := event.Value.(*fhir.Observation); ok {
+			normalized, err := n.NormalizeObservation(o)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			event.Value = normalized
+		}
+		events = append(events, event)
+	}
+	es.Events = events
+	return errs
+}
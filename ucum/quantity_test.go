@@ -0,0 +1,130 @@
+package ucum
+
+import (
+	"testing"
+	"time"
+
+	fhir "github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/riskservice/plugin"
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestQuantitySuite(t *testing.T) {
+	suite.Run(t, new(QuantitySuite))
+}
+
+type QuantitySuite struct {
+	suite.Suite
+}
+
+func quantity(value float64, unit, system, code string) *fhir.Quantity {
+	return &fhir.Quantity{Value: &value, Unit: unit, System: system, Code: code}
+}
+
+func observation(id, loincCode string, q *fhir.Quantity) *fhir.Observation {
+	return &fhir.Observation{
+		Id:            id,
+		Status:        "final",
+		Code:          &fhir.CodeableConcept{Coding: []fhir.Coding{{System: "http://loinc.org", Code: loincCode}}},
+		ValueQuantity: q,
+	}
+}
+
+func (suite *QuantitySuite) TestQuantityUnit() {
+	assert := suite.Assert()
+
+	unit, err := QuantityUnit(quantity(132, "lb", System, "[lb_av]"))
+	assert.NoError(err)
+	assert.Equal("[lb_av]", unit)
+
+	unit, err = QuantityUnit(quantity(132, "", "", "[lb_av]"))
+	assert.NoError(err)
+	assert.Equal("[lb_av]", unit)
+
+	// Human-readable units are used when the unit isn't coded in UCUM
+	unit, err = QuantityUnit(quantity(132, "lbs", "", ""))
+	assert.NoError(err)
+	assert.Equal("[lb_av]", unit)
+	unit, err = QuantityUnit(quantity(5.5, "mmol/l", "http://snomed.info/sct", "258813002"))
+	assert.NoError(err)
+	assert.Equal("mmol/L", unit)
+	unit, err = QuantityUnit(quantity(20, "µmol/L", "", ""))
+	assert.NoError(err)
+	assert.Equal("umol/L", unit)
+
+	_, err = QuantityUnit(quantity(5.5, "", "http://snomed.info/sct", "258813002"))
+	assert.EqualError(err, "Unit 258813002 isn't coded in UCUM (http://snomed.info/sct)")
+	_, err = QuantityUnit(quantity(5.5, "", "", ""))
+	assert.EqualError(err, "Quantity has no unit")
+}
+
+func (suite *QuantitySuite) TestValue() {
+	assert := suite.Assert()
+
+	kg, err := Value(quantity(132, "lb", "", ""), "kg")
+	assert.NoError(err)
+	assert.InDelta(59.874, kg, 0.001)
+
+	mmolL, err := SubstanceValue(quantity(100, "mg/dL", System, "mg/dL"), "mmol/L", 180.16)
+	assert.NoError(err)
+	assert.InDelta(5.551, mmolL, 0.001)
+
+	_, err = Value(&fhir.Quantity{Code: "kg"}, "kg")
+	assert.EqualError(err, "Quantity has no value")
+	_, err = Value(quantity(63, "in", "", ""), "kg")
+	assert.EqualError(err, "Can't convert [in_i] to kg: the units are incompatible")
+}
+
+func (suite *QuantitySuite) TestNormalizeObservation() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	o := observation("1", "29463-7", quantity(132, "lb", System, "[lb_av]"))
+	normalized, err := DefaultNormalizer.NormalizeObservation(o)
+	require.NoError(err)
+	assert.InDelta(59.874, *normalized.ValueQuantity.Value, 0.001)
+	assert.Equal("kg", normalized.ValueQuantity.Unit)
+	assert.Equal(System, normalized.ValueQuantity.System)
+	assert.Equal("kg", normalized.ValueQuantity.Code)
+	assert.Equal("1", normalized.Id)
+	// The original observation is unchanged
+	assert.Equal(132.0, *o.ValueQuantity.Value)
+	assert.Equal("[lb_av]", o.ValueQuantity.Code)
+
+	normalized, err = DefaultNormalizer.NormalizeObservation(observation("2", "2345-7", quantity(5.551, "mmol/L", System, "mmol/L")))
+	require.NoError(err)
+	assert.InDelta(100, *normalized.ValueQuantity.Value, 0.01)
+	assert.Equal("mg/dL", normalized.ValueQuantity.Code)
+
+	// Observations without a target unit are returned as is
+	o = observation("3", "59460-6", quantity(45, "{score}", System, "{score}"))
+	normalized, err = DefaultNormalizer.NormalizeObservation(o)
+	assert.NoError(err)
+	assert.True(o == normalized)
+
+	_, err = DefaultNormalizer.NormalizeObservation(observation("4", "29463-7", quantity(63, "in", System, "[in_i]")))
+	assert.EqualError(err, "Can't normalize observation 4 (LOINC 29463-7): Can't convert [in_i] to kg: the units are incompatible")
+}
+
+func (suite *QuantitySuite) TestNormalizeEventStream() {
+	assert := suite.Assert()
+
+	d := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	es := plugin.NewEventStream(&fhir.Patient{})
+	es.Events = []plugin.Event{
+		{Date: d, Type: "Observation", Value: observation("1", "29463-7", quantity(132, "lb", "", ""))},
+		{Date: d, Type: "Observation", Value: observation("2", "8302-2", quantity(63, "lb", "", ""))},
+		{Date: d, Type: "Condition", Value: &fhir.Condition{}},
+		{Date: d, Type: "Observation", Value: observation("3", "8302-2", quantity(63, "in", "", ""))},
+	}
+
+	errs := Normalizer{"29463-7": {Unit: "kg"}, "8302-2": {Unit: "cm"}}.NormalizeEventStream(es)
+	assert.Len(errs, 1)
+	assert.EqualError(errs[0], "Can't normalize observation 2 (LOINC 8302-2): Can't convert [lb_av] to cm: the units are incompatible")
+	assert.Len(es.Events, 3)
+	assert.InDelta(59.874, *es.Events[0].Value.(*fhir.Observation).ValueQuantity.Value, 0.001)
+	assert.IsType(&fhir.Condition{}, es.Events[1].Value)
+	assert.InDelta(160.02, *es.Events[2].Value.(*fhir.Observation).ValueQuantity.Value, 0.001)
+}
@@ -0,0 +1,307 @@
+// Package ucum converts quantities between units of measure identified by their UCUM (Unified Code for Units of
+// Measure) codes, so that observations recorded in different units (e.g., lb and kg, or mg/dL and mmol/L) can be
+// normalized before they are used in risk calculations.
+package ucum
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// System is the FHIR coding system for UCUM units
+const System = "http://unitsofmeasure.org"
+
+// The base quantities that units are measured in
+const (
+	mass = iota
+	length
+	duration
+	amount
+	// arbitrary is for international units, which are defined per substance, so they can only be converted to other
+	// international units
+	arbitrary
+	baseQuantities
+)
+
+// dimension is the exponent of each base quantity in a unit, e.g., mg/dL has a mass of 1 and a length of -3
+type dimension [baseQuantities]int
+
+// Unit is a parsed UCUM unit, which is a multiple of the base units: g, m, s, mol and [IU]
+type Unit struct {
+	Code   string
+	factor float64
+	dim    dimension
+}
+
+// atom is a UCUM unit atom, such as "g" or "[lb_av]".  Only metric atoms may be prefixed (e.g., "kg").
+type atom struct {
+	factor float64
+	dim    dimension
+	metric bool
+}
+
+var atoms = map[string]atom{
+	"g":       {1, dimension{mass: 1}, true},
+	"m":       {1, dimension{length: 1}, true},
+	"s":       {1, dimension{duration: 1}, true},
+	"mol":     {1, dimension{amount: 1}, true},
+	"L":       {1e-3, dimension{length: 3}, true},
+	"l":       {1e-3, dimension{length: 3}, true},
+	"[IU]":    {1, dimension{arbitrary: 1}, true},
+	"[iU]":    {1, dimension{arbitrary: 1}, true},
+	"U":       {1e-6 / 60, dimension{amount: 1, duration: -1}, true},
+	"cal":     {4184, dimension{mass: 1, length: 2, duration: -2}, true},
+	"J":       {1000, dimension{mass: 1, length: 2, duration: -2}, true},
+	"[Cal]":   {4184000, dimension{mass: 1, length: 2, duration: -2}, false},
+	"Pa":      {1000, dimension{mass: 1, length: -1, duration: -2}, true},
+	"m[Hg]":   {133322387.415, dimension{mass: 1, length: -1, duration: -2}, true},
+	"min":     {60, dimension{duration: 1}, false},
+	"h":       {3600, dimension{duration: 1}, false},
+	"d":       {86400, dimension{duration: 1}, false},
+	"wk":      {604800, dimension{duration: 1}, false},
+	"mo":      {2629800, dimension{duration: 1}, false},
+	"a":       {31557600, dimension{duration: 1}, false},
+	"[lb_av]": {453.59237, dimension{mass: 1}, false},
+	"[oz_av]": {28.349523125, dimension{mass: 1}, false},
+	"[in_i]":  {0.0254, dimension{length: 1}, false},
+	"[ft_i]":  {0.3048, dimension{length: 1}, false},
+	"%":       {0.01, dimension{}, false},
+}
+
+var prefixes = map[string]float64{
+	"G":  1e9,
+	"M":  1e6,
+	"k":  1e3,
+	"h":  1e2,
+	"da": 1e1,
+	"d":  1e-1,
+	"c":  1e-2,
+	"m":  1e-3,
+	"u":  1e-6,
+	"n":  1e-9,
+	"p":  1e-12,
+	"f":  1e-15,
+}
+
+// IncompatibleUnitsError is returned when converting between units that measure different kinds of quantities, such
+// as a mass and a length
+type IncompatibleUnitsError struct {
+	From string
+	To   string
+}
+
+func (e IncompatibleUnitsError) Error() string {
+	return fmt.Sprintf("Can't convert %s to %s: the units are incompatible", e.From, e.To)
+}
+
+// Parse parses a UCUM unit code, e.g., "mg/dL", "kg/m2", "10*3/uL" or "mL/min/{1.73_m2}".  Annotations (in braces)
+// are ignored, as UCUM specifies.
+func Parse(code string) (Unit, error) {
+	p := parser{code: code}
+	u, err := p.term()
+	if err == nil && p.pos < len(code) {
+		err = fmt.Errorf("unexpected %q", code[p.pos:])
+	}
+	if err != nil {
+		return Unit{}, fmt.Errorf("Invalid UCUM unit %q: %s", code, err.Error())
+	}
+	u.Code = code
+	return u, nil
+}
+
+// Compatible indicates if quantities can be converted between the units
+func (u Unit) Compatible(other Unit) bool {
+	return u.dim == other.dim
+}
+
+// Convert converts a value from one unit to another, returning an IncompatibleUnitsError if they measure different
+// kinds of quantities
+func Convert(value float64, from, to string) (float64, error) {
+	return ConvertSubstance(value, from, to, 0)
+}
+
+// ConvertSubstance converts a value from one unit to another, using the substance's molar mass (in g/mol) to convert
+// between mass and amount of substance, e.g., a glucose concentration from mg/dL to mmol/L.  If the molar mass is 0,
+// only units that measure the same kind of quantity can be converted.
+func ConvertSubstance(value float64, from, to string, molarMass float64) (float64, error) {
+	fromUnit, err := Parse(from)
+	if err != nil {
+		return 0, err
+	}
+	toUnit, err := Parse(to)
+	if err != nil {
+		return 0, err
+	}
+	canonical := value * fromUnit.factor
+	if !fromUnit.Compatible(toUnit) {
+		// Moles are converted to grams by multiplying by the molar mass, so a unit with n more moles than the target
+		// (and n fewer grams) is multiplied by the molar mass n times
+		n := fromUnit.dim[amount] - toUnit.dim[amount]
+		converted := fromUnit.dim
+		converted[amount] -= n
+		converted[mass] += n
+		if molarMass <= 0 || n == 0 || converted != toUnit.dim {
+			return 0, IncompatibleUnitsError{From: from, To: to}
+		}
+		canonical *= math.Pow(molarMass, float64(n))
+	}
+	return canonical / toUnit.factor, nil
+}
+
+func (u Unit) mul(other Unit, power int) Unit {
+	u.factor *= math.Pow(other.factor, float64(power))
+	for i := range u.dim {
+		u.dim[i] += other.dim[i] * power
+	}
+	return u
+}
+
+// parser is a recursive descent parser for UCUM's grammar: a term is components separated by "." (multiplication) or
+// "/" (division); a component is an annotation, a number (including powers of 10 such as "10*3"), a parenthesized term,
+// or a unit symbol with an optional exponent and annotation
+type parser struct {
+	code string
+	pos  int
+}
+
+func (p *parser) term() (Unit, error) {
+	u := Unit{factor: 1}
+	power := 1
+	if p.next('/') {
+		power = -1
+	}
+	for {
+		c, err := p.component()
+		if err != nil {
+			return Unit{}, err
+		}
+		u = u.mul(c, power)
+		switch {
+		case p.next('.'):
+			power = 1
+		case p.next('/'):
+			power = -1
+		default:
+			return u, nil
+		}
+	}
+}
+
+func (p *parser) component() (Unit, error) {
+	if p.pos >= len(p.code) {
+		return Unit{}, fmt.Errorf("missing unit")
+	}
+	switch c := p.code[p.pos]; {
+	case c == '{':
+		return Unit{factor: 1}, p.annotation()
+	case c == '(':
+		p.pos++
+		u, err := p.term()
+		if err != nil {
+			return Unit{}, err
+		}
+		if !p.next(')') {
+			return Unit{}, fmt.Errorf("missing )")
+		}
+		return u, nil
+	case c >= '0' && c <= '9':
+		n := p.digits()
+		factor, _ := strconv.ParseFloat(n, 64)
+		if p.next('*') || p.next('^') {
+			if n != "10" {
+				return Unit{}, fmt.Errorf("only powers of 10 are supported, not %s", n)
+			}
+			exp, ok := p.exponent()
+			if !ok {
+				return Unit{}, fmt.Errorf("missing exponent of 10")
+			}
+			factor = math.Pow(10, float64(exp))
+		}
+		return Unit{factor: factor}, nil
+	}
+	u, err := p.symbol()
+	if err != nil {
+		return Unit{}, err
+	}
+	if exp, ok := p.exponent(); ok {
+		u = Unit{factor: 1}.mul(u, exp)
+	}
+	if p.pos < len(p.code) && p.code[p.pos] == '{' {
+		return u, p.annotation()
+	}
+	return u, nil
+}
+
+// symbol parses a unit atom, with an optional prefix
+func (p *parser) symbol() (Unit, error) {
+	start := p.pos
+	for p.pos < len(p.code) {
+		c := p.code[p.pos]
+		if c == '[' {
+			end := strings.IndexByte(p.code[p.pos:], ']')
+			if end < 0 {
+				return Unit{}, fmt.Errorf("missing ]")
+			}
+			p.pos += end + 1
+			continue
+		}
+		if strings.IndexByte("./(){}+-0123456789", c) >= 0 {
+			break
+		}
+		p.pos++
+	}
+	symbol := p.code[start:p.pos]
+	if symbol == "" {
+		return Unit{}, fmt.Errorf("unexpected %q", p.code[start:])
+	}
+	if a, ok := atoms[symbol]; ok {
+		return Unit{factor: a.factor, dim: a.dim}, nil
+	}
+	for prefix, factor := range prefixes {
+		if a, ok := atoms[strings.TrimPrefix(symbol, prefix)]; ok && a.metric && strings.HasPrefix(symbol, prefix) {
+			return Unit{factor: factor * a.factor, dim: a.dim}, nil
+		}
+	}
+	return Unit{}, fmt.Errorf("unknown unit %q", symbol)
+}
+
+// exponent parses an optional signed integer exponent
+func (p *parser) exponent() (int, bool) {
+	start := p.pos
+	if p.pos < len(p.code) && (p.code[p.pos] == '+' || p.code[p.pos] == '-') {
+		p.pos++
+	}
+	if p.digits() == "" {
+		p.pos = start
+		return 0, false
+	}
+	exp, err := strconv.Atoi(strings.TrimPrefix(p.code[start:p.pos], "+"))
+	return exp, err == nil
+}
+
+func (p *parser) digits() string {
+	start := p.pos
+	for p.pos < len(p.code) && p.code[p.pos] >= '0' && p.code[p.pos] <= '9' {
+		p.pos++
+	}
+	return p.code[start:p.pos]
+}
+
+func (p *parser) annotation() error {
+	end := strings.IndexByte(p.code[p.pos:], '}')
+	if end < 0 {
+		return fmt.Errorf("missing }")
+	}
+	p.pos += end + 1
+	return nil
+}
+
+func (p *parser) next(c byte) bool {
+	if p.pos < len(p.code) && p.code[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package ucum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run
+func TestUnitSuite(t *testing.T) {
+	suite.Run(t, new(UnitSuite))
+}
+
+type UnitSuite struct {
+	suite.Suite
+}
+
+func (suite *UnitSuite) TestParse() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	u, err := Parse("mg/dL")
+	require.NoError(err)
+	assert.Equal("mg/dL", u.Code)
+	assert.InDelta(1e-3/1e-4, u.factor, 1e-9)
+	assert.Equal(dimension{mass: 1, length: -3}, u.dim)
+
+	u, err = Parse("kg/m2")
+	require.NoError(err)
+	assert.InDelta(1000, u.factor, 1e-9)
+	assert.Equal(dimension{mass: 1, length: -2}, u.dim)
+
+	u, err = Parse("10*3/uL")
+	require.NoError(err)
+	assert.InDelta(1e12, u.factor, 1)
+	assert.Equal(dimension{length: -3}, u.dim)
+
+	u, err = Parse("mL/min/{1.73_m2}")
+	require.NoError(err)
+	assert.Equal(dimension{length: 3, duration: -1}, u.dim)
+
+	u, err = Parse("{beats}/min")
+	require.NoError(err)
+	assert.Equal(dimension{duration: -1}, u.dim)
+
+	u, err = Parse("kg.m/s2")
+	require.NoError(err)
+	assert.Equal(dimension{mass: 1, length: 1, duration: -2}, u.dim)
+
+	u, err = Parse("g/(kg.d)")
+	require.NoError(err)
+	assert.InDelta(1e-3/86400, u.factor, 1e-15)
+	assert.Equal(dimension{duration: -1}, u.dim)
+
+	u, err = Parse("/[IU]")
+	require.NoError(err)
+	assert.Equal(dimension{arbitrary: -1}, u.dim)
+}
+
+func (suite *UnitSuite) TestParseErrors() {
+	assert := suite.Assert()
+
+	for _, code := range []string{"", "furlong", "kg/", "mg/dL)", "(mg", "{beats", "[lb_av", "k[lb_av]", "2*3", "m g"} {
+		_, err := Parse(code)
+		assert.Error(err, code)
+	}
+	_, err := Parse("furlong")
+	assert.EqualError(err, `Invalid UCUM unit "furlong": unknown unit "furlong"`)
+}
+
+func (suite *UnitSuite) TestConvert() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// The README's sample patient: 132 lb, 63 in
+	kg, err := Convert(132, "[lb_av]", "kg")
+	require.NoError(err)
+	assert.InDelta(59.874, kg, 0.001)
+	cm, err := Convert(63, "[in_i]", "cm")
+	require.NoError(err)
+	assert.InDelta(160.02, cm, 0.001)
+
+	mgdL, err := Convert(3.5, "g/L", "g/dL")
+	require.NoError(err)
+	assert.InDelta(0.35, mgdL, 1e-9)
+
+	kcal, err := Convert(2000, "[Cal]", "kcal")
+	require.NoError(err)
+	assert.InDelta(2000, kcal, 1e-9)
+
+	kPa, err := Convert(120, "mm[Hg]", "kPa")
+	require.NoError(err)
+	assert.InDelta(15.999, kPa, 0.001)
+
+	pct, err := Convert(0.065, "1", "%")
+	require.NoError(err)
+	assert.InDelta(6.5, pct, 1e-9)
+}
+
+func (suite *UnitSuite) TestConvertIncompatible() {
+	assert := suite.Assert()
+
+	_, err := Convert(132, "[lb_av]", "cm")
+	assert.Equal(IncompatibleUnitsError{From: "[lb_av]", To: "cm"}, err)
+	assert.EqualError(err, "Can't convert [lb_av] to cm: the units are incompatible")
+
+	// Mass and substance concentrations can't be converted without a molar mass
+	_, err = Convert(100, "mg/dL", "mmol/L")
+	assert.Equal(IncompatibleUnitsError{From: "mg/dL", To: "mmol/L"}, err)
+
+	_, err = Convert(100, "[IU]/L", "mg/L")
+	assert.Error(err)
+
+	_, err = Convert(100, "furlong", "m")
+	assert.EqualError(err, `Invalid UCUM unit "furlong": unknown unit "furlong"`)
+}
+
+func (suite *UnitSuite) TestConvertSubstance() {
+	assert := suite.Assert()
+	require := suite.Require()
+
+	// Glucose: 100 mg/dL is 5.55 mmol/L
+	mmolL, err := ConvertSubstance(100, "mg/dL", "mmol/L", 180.16)
+	require.NoError(err)
+	assert.InDelta(5.551, mmolL, 0.001)
+	mgdL, err := ConvertSubstance(5.551, "mmol/L", "mg/dL", 180.16)
+	require.NoError(err)
+	assert.InDelta(100, mgdL, 0.01)
+
+	// Creatinine: 1 mg/dL is 88.4 umol/L
+	umolL, err := ConvertSubstance(1, "mg/dL", "umol/L", 113.12)
+	require.NoError(err)
+	assert.InDelta(88.4, umolL, 0.01)
+
+	// Units of the same kind ignore the molar mass
+	gL, err := ConvertSubstance(100, "mg/dL", "g/L", 180.16)
+	require.NoError(err)
+	assert.InDelta(1, gL, 1e-9)
+
+	_, err = ConvertSubstance(100, "mg/dL", "mmol", 180.16)
+	assert.Equal(IncompatibleUnitsError{From: "mg/dL", To: "mmol"}, err)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/intervention-engine/multifactorriskservice/client"
+	"github.com/intervention-engine/multifactorriskservice/models"
+)
+
+// runValidate checks the configuration, the REDCap project's data dictionary, and connectivity to the FHIR server,
+// exiting with a non-zero status if any check fails
+func runValidate(args []string) int {
+	s := newSettings("validate", "", "Checks the configuration, the REDCap data dictionary, and FHIR server connectivity.")
+	s.addFHIR()
+	s.addREDCap()
+	s.addModel()
+	if status := s.parse(args); status != 0 {
+		return status
+	}
+
+	status := 0
+	check := func(name string, errs ...error) {
+		var failed bool
+		for _, err := range errs {
+			if err != nil {
+				if !failed {
+					fmt.Printf("FAIL %s\n", name)
+					failed = true
+				}
+				fmt.Printf("     %s\n", err.Error())
+			}
+		}
+		if failed {
+			status = 1
+		} else {
+			fmt.Printf("OK   %s\n", name)
+		}
+	}
+
+	_, err := s.model()
+	check("Aggregation strategy "+*s.Aggregation, err)
+
+	metadata, err := client.GetREDCapMetadata(*s.REDCap, *s.Token)
+	if err != nil {
+		check("REDCap data dictionary at "+*s.REDCap, err)
+	} else {
+		check("REDCap data dictionary at "+*s.REDCap, models.CheckDataDictionary(metadata)...)
+	}
+
+	check("FHIR server at "+*s.FHIR, client.CheckFHIRServer(*s.FHIR))
+
+	if status != 0 {
+		fmt.Fprintln(os.Stderr, "Validation failed.")
+	}
+	return status
+}